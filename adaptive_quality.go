@@ -0,0 +1,166 @@
+package vnc
+
+import "time"
+
+// The defaults of the ClientConfig.AdaptiveQuality settings, and of the
+// levels it moves back towards if none were sent with SetEncodings.
+const (
+	defaultAdaptiveLowBandwidth  = 128 * 1024
+	defaultAdaptiveHighBandwidth = 1024 * 1024
+	defaultAdaptiveInterval      = 2 * time.Second
+	defaultJPEGQuality           = 8
+	defaultCompressionLevel      = 2
+)
+
+// The fewest bytes of updates ClientConfig.AdaptiveQuality measures the
+// throughput over, since small updates say little about the network.
+const adaptiveQualityMinBytes = 64 * 1024
+
+// The highest JPEG quality and compression levels.
+const maxEncodingLevel = 9
+
+// qualityController is the state of ClientConfig.AdaptiveQuality, which
+// is only used by the main loop.
+type qualityController struct {
+	started bool
+
+	// The levels last sent, and the best ones to move back to, which are
+	// those last sent with SetEncodings by the user.
+	quality, compression       int
+	maxQuality, minCompression int
+
+	// The updates received since the start of the interval, and the
+	// time spent reading them.
+	intervalStart time.Time
+	bytes         uint64
+	elapsed       time.Duration
+
+	// The total BytesReceived of the statistics, as of the last update.
+	totalBytes uint64
+}
+
+// encodingLevels returns the JPEG quality and compression levels in encs,
+// or the defaults for those that aren't.
+func encodingLevels(encs []Encoding) (quality, compression int) {
+	quality, compression = defaultJPEGQuality, defaultCompressionLevel
+	for _, enc := range encs {
+		switch t := enc.Type(); {
+		case t >= -32 && t <= -23:
+			quality = int(t + 32)
+		case t >= -256 && t <= -247:
+			compression = int(t + 256)
+		}
+	}
+
+	return quality, compression
+}
+
+// withEncodingLevels returns encs with their JPEG quality and compression
+// levels replaced by the given ones.
+func withEncodingLevels(encs []Encoding, quality, compression int) []Encoding {
+	result := make([]Encoding, 0, len(encs)+2)
+	for _, enc := range encs {
+		t := enc.Type()
+		if (t >= -32 && t <= -23) || (t >= -256 && t <= -247) {
+			continue
+		}
+
+		result = append(result, enc)
+	}
+
+	return append(result,
+		&JPEGQualityPseudoEncoding{Level: uint8(quality)},
+		&CompressionLevelPseudoEncoding{Level: uint8(compression)})
+}
+
+// observe adds an update of the given size, read in elapsed, and reports
+// whether the levels have changed, once an interval is over.
+func (q *qualityController) observe(cfg *ClientConfig, received uint64, elapsed time.Duration, now time.Time) bool {
+	q.bytes += received
+	q.elapsed += elapsed
+
+	interval := cfg.AdaptiveQualityInterval
+	if interval <= 0 {
+		interval = defaultAdaptiveInterval
+	}
+	if now.Sub(q.intervalStart) < interval || q.bytes < adaptiveQualityMinBytes || q.elapsed <= 0 {
+		return false
+	}
+
+	throughput := float64(q.bytes) / q.elapsed.Seconds()
+	q.intervalStart, q.bytes, q.elapsed = now, 0, 0
+
+	low, high := cfg.AdaptiveQualityLowBandwidth, cfg.AdaptiveQualityHighBandwidth
+	if low <= 0 {
+		low = defaultAdaptiveLowBandwidth
+	}
+	if high <= 0 {
+		high = defaultAdaptiveHighBandwidth
+	}
+
+	switch {
+	case throughput < float64(low) && (q.quality > 0 || q.compression < maxEncodingLevel):
+		q.quality = maxInt(0, q.quality-1)
+		q.compression = minInt(maxEncodingLevel, q.compression+1)
+	case throughput > float64(high) && (q.quality < q.maxQuality || q.compression > q.minCompression):
+		q.quality = minInt(q.maxQuality, q.quality+1)
+		q.compression = maxInt(q.minCompression, q.compression-1)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// adaptQuality is called by the main loop for each FramebufferUpdate,
+// with the time spent reading it, and resends SetEncodings when
+// ClientConfig.AdaptiveQuality changes the levels.
+func (c *ClientConn) adaptQuality(elapsed time.Duration, now time.Time) error {
+	if !c.config.AdaptiveQuality {
+		return nil
+	}
+
+	q := &c.qualityControl
+	total := c.totalBytesReceived()
+	received := total
+	if total >= q.totalBytes {
+		received = total - q.totalBytes
+	}
+	q.totalBytes = total
+
+	// The levels are taken up again if SetEncodings has been called with
+	// other ones since they were last sent.
+	quality, compression := encodingLevels(c.Encs)
+	if !q.started || quality != q.quality || compression != q.compression {
+		*q = qualityController{
+			started:        true,
+			quality:        quality,
+			compression:    compression,
+			maxQuality:     quality,
+			minCompression: compression,
+			intervalStart:  now,
+			totalBytes:     total,
+		}
+		return nil
+	}
+
+	if !q.observe(c.config, received, elapsed, now) {
+		return nil
+	}
+
+	c.logf("adapting to the bandwidth with JPEG quality %d and compression level %d", q.quality, q.compression)
+	return c.SetEncodings(withEncodingLevels(c.Encs, q.quality, q.compression))
+}
+
+// totalBytesReceived returns the BytesReceived of all of the encodings.
+func (c *ClientConn) totalBytesReceived() uint64 {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	var total uint64
+	for _, s := range c.encodingStats {
+		total += s.BytesReceived
+	}
+
+	return total
+}
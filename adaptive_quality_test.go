@@ -0,0 +1,106 @@
+package vnc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientConn_AdaptiveQuality(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{
+		AdaptiveQuality:         true,
+		AdaptiveQualityInterval: time.Second,
+	})
+	defer server.Close()
+	conn.Encs = []Encoding{
+		new(TightEncoding),
+		new(RawEncoding),
+		&UnsupportedEncoding{EncodingType: -23},  // JPEG quality 9
+		&UnsupportedEncoding{EncodingType: -255}, // Compression level 1
+	}
+
+	msgCh := make(chan *SetEncodingsMessage, 1)
+	go func() {
+		for {
+			msg, err := ReadClientMessage(server, nil)
+			if err != nil {
+				return
+			}
+			msgCh <- msg.(*SetEncodingsMessage)
+		}
+	}()
+
+	now := time.Unix(0, 0)
+	if err := conn.adaptQuality(0, now); err != nil {
+		t.Fatalf("error adapting quality: %s", err)
+	}
+
+	// update receives bytes over elapsed, one interval after the last.
+	update := func(bytes uint64, elapsed time.Duration) {
+		t.Helper()
+
+		conn.statsLock.Lock()
+		conn.addDecode(7, 0, bytes, 0)
+		conn.statsLock.Unlock()
+
+		now = now.Add(time.Second)
+		if err := conn.adaptQuality(elapsed, now); err != nil {
+			t.Fatalf("error adapting quality: %s", err)
+		}
+	}
+	expectLevels := func(quality, compression int) {
+		t.Helper()
+
+		select {
+		case msg := <-msgCh:
+			actualQuality, actualCompression := encodingLevels(msg.Encodings)
+			if actualQuality != quality || actualCompression != compression {
+				t.Fatalf("sent quality %d and compression %d, want %d and %d",
+					actualQuality, actualCompression, quality, compression)
+			}
+			if msg.Encodings[0].Type() != 7 {
+				t.Fatalf("sent %s first, want Tight", EncodingName(msg.Encodings[0].Type()))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("SetEncodings not sent")
+		}
+	}
+	expectNothing := func() {
+		t.Helper()
+
+		select {
+		case msg := <-msgCh:
+			t.Fatalf("sent encodings %v", msg.Encodings)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// A slow link lowers the quality a level at a time.
+	update(100*1024, time.Second)
+	expectLevels(8, 2)
+	update(100*1024, time.Second)
+	expectLevels(7, 3)
+
+	// Moderate throughput keeps the levels, as do intervals with too
+	// little data to tell.
+	update(512*1024, time.Second)
+	expectNothing()
+	update(1024, time.Millisecond)
+	expectNothing()
+
+	// Once the bandwidth recovers, the levels move back up to those sent
+	// by the user, and no further.
+	update(4*1024*1024, time.Second)
+	expectLevels(8, 2)
+	update(4*1024*1024, time.Second)
+	expectLevels(9, 1)
+	update(4*1024*1024, time.Second)
+	expectNothing()
+
+	// New levels sent with SetEncodings are taken up as the best ones.
+	conn.Encs = withEncodingLevels(conn.Encs, 5, 5)
+	update(4*1024*1024, time.Second)
+	update(4*1024*1024, time.Second)
+	expectNothing()
+	update(100*1024, time.Second)
+	expectLevels(4, 6)
+}
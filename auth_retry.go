@@ -0,0 +1,61 @@
+package vnc
+
+import "fmt"
+
+// AuthRetryError is returned by Client when ClientConfig.AuthRetry is set
+// and the server has rejected the authentication but kept the connection
+// open. Conn is the connection to pass to RetryAuth or close, and Err is
+// the ErrAuthFailed or ErrAuthTooManyAttempts error.
+type AuthRetryError struct {
+	Conn *ClientConn
+	Err  error
+}
+
+func (e *AuthRetryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AuthRetryError) Unwrap() error {
+	return e.Err
+}
+
+// RetryAuth authenticates again using auth, on the connection of an
+// AuthRetryError returned by Client, such as after asking the user for
+// the password again. If it succeeds, the handshake is completed and
+// the connection is used as if Client had returned it without an error.
+//
+// The RFB protocol has no way to retry the authentication: servers close
+// the connection after sending a failed SecurityResult. Some version 3.8
+// servers that want to allow further attempts instead keep it open and
+// start the security handshake over, by sending their security types
+// again after the reason for the failure. RetryAuth only works with such
+// servers, and returns a HandshakeClosedError for any other server, which
+// closes the connection. It is never possible with versions 3.3 and 3.7, which
+// don't send a reason, so Client always closes those connections.
+//
+// If the server rejects this attempt as well, the connection is kept
+// open so that RetryAuth can be called again. On any other error, the
+// connection is closed.
+func (c *ClientConn) RetryAuth(auth ClientAuth) error {
+	if !c.authFailed {
+		return fmt.Errorf("RetryAuth requires a connection whose authentication was rejected, with ClientConfig.AuthRetry set")
+	}
+
+	c.authFailed = false
+	err := handshakeClosed(HandshakeSecurity, c.securityHandshake([]ClientAuth{auth}, 8))
+	if err == nil {
+		err = handshakeClosed(HandshakeInit, c.initialize())
+	}
+
+	if err != nil {
+		if !c.authFailed {
+			c.Close()
+		}
+
+		return err
+	}
+
+	c.start()
+
+	return nil
+}
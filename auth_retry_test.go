@@ -0,0 +1,153 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// serveTestPasswordAttempt performs the server side of one attempt at VNC
+// authentication, sending the security types and a challenge, and
+// reports whether the response was for the given password.
+func serveTestPasswordAttempt(server net.Conn, password string) (bool, error) {
+	server.Write([]byte{1, 2})
+
+	var securityType [1]byte
+	if _, err := io.ReadFull(server, securityType[:]); err != nil {
+		return false, err
+	}
+
+	challenge := []byte("0123456789abcdef")
+	if _, err := server.Write(challenge); err != nil {
+		return false, err
+	}
+
+	response := make([]byte, 16)
+	if _, err := io.ReadFull(server, response); err != nil {
+		return false, err
+	}
+
+	expected, err := (&PasswordAuth{}).encrypt(password, challenge)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(response, expected), nil
+}
+
+func TestClientConn_RetryAuth(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// The server rejects the first attempt, then starts the security
+	// handshake over.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- func() error {
+			server.Write([]byte("RFB 003.008\n"))
+
+			var version [12]byte
+			if _, err := io.ReadFull(server, version[:]); err != nil {
+				return err
+			}
+
+			for {
+				ok, err := serveTestPasswordAttempt(server, "secret")
+				if err != nil {
+					return err
+				}
+				if ok {
+					break
+				}
+
+				reason := "wrong password"
+				var failure bytes.Buffer
+				binary.Write(&failure, binary.BigEndian, []uint32{1, uint32(len(reason))})
+				failure.WriteString(reason)
+				server.Write(failure.Bytes())
+			}
+
+			server.Write([]byte{0, 0, 0, 0})
+
+			var sharedFlag [1]byte
+			if _, err := io.ReadFull(server, sharedFlag[:]); err != nil {
+				return err
+			}
+
+			return writeTestServerInit(server, 4, "test")
+		}()
+	}()
+
+	conn, err := Client(client, &ClientConfig{
+		Auth:      []ClientAuth{&PasswordAuth{Password: "wrong"}},
+		AuthRetry: true,
+	})
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("err = %v, want %v", err, ErrAuthFailed)
+	}
+	if conn != nil {
+		t.Fatal("Client returned a connection along with an error")
+	}
+
+	var retryErr *AuthRetryError
+	if !errors.As(err, &retryErr) || retryErr.Conn == nil {
+		t.Fatalf("err = %#v, want an AuthRetryError with the connection", err)
+	}
+	conn = retryErr.Conn
+	defer conn.Close()
+
+	if err := conn.RetryAuth(&PasswordAuth{Password: "wrong"}); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("second attempt: err = %v, want %v", err, ErrAuthFailed)
+	}
+
+	if err := conn.RetryAuth(&PasswordAuth{Password: "secret"}); err != nil {
+		t.Fatalf("error retrying: %s", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("error in mock server: %s", err)
+	}
+
+	if conn.SecurityType != 2 || conn.DesktopName != "test" {
+		t.Fatalf("security type %d, desktop name %q", conn.SecurityType, conn.DesktopName)
+	}
+
+	if err := conn.RetryAuth(&PasswordAuth{Password: "secret"}); err == nil {
+		t.Fatal("expected error retrying an authenticated connection")
+	}
+}
+
+func TestClient_AuthRetryVersion33(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		server.Write([]byte("RFB 003.003\n"))
+
+		var version [12]byte
+		io.ReadFull(server, version[:])
+
+		server.Write([]byte{0, 0, 0, 2})
+		server.Write([]byte("0123456789abcdef"))
+
+		response := make([]byte, 16)
+		io.ReadFull(server, response)
+		server.Write([]byte{0, 0, 0, 1})
+	}()
+
+	// A version 3.3 server closes the connection after a failure, so it
+	// is never returned for retrying.
+	conn, err := Client(client, &ClientConfig{
+		Auth:      []ClientAuth{&PasswordAuth{Password: "wrong"}},
+		AuthRetry: true,
+	})
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("err = %v, want %v", err, ErrAuthFailed)
+	}
+	var retryErr *AuthRetryError
+	if conn != nil || errors.As(err, &retryErr) {
+		t.Fatal("Client returned a version 3.3 connection for retrying")
+	}
+}
@@ -0,0 +1,80 @@
+package vnc
+
+import (
+	"context"
+	"net"
+)
+
+// WaitForBell waits for the server to send the next Bell message, or for
+// ctx to be done. Bells read before it is called don't count. Messages
+// are handled as usual while waiting, and the Bell is still sent on
+// ServerMessageCh. It returns net.ErrClosed if the connection ends first.
+func (c *ClientConn) WaitForBell(ctx context.Context) error {
+	ch := c.addBellWaiter()
+	defer c.removeBellWaiter(ch)
+
+	select {
+	case _, ok := <-ch:
+		if !ok {
+			return net.ErrClosed
+		}
+
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// addBellWaiter registers a waiter for the next Bell to be read.
+func (c *ClientConn) addBellWaiter() chan struct{} {
+	c.bellLock.Lock()
+	defer c.bellLock.Unlock()
+
+	ch := make(chan struct{}, 1)
+	if c.bellsClosed {
+		close(ch)
+		return ch
+	}
+
+	c.bellWaiters = append(c.bellWaiters, ch)
+	return ch
+}
+
+func (c *ClientConn) removeBellWaiter(ch chan struct{}) {
+	c.bellLock.Lock()
+	defer c.bellLock.Unlock()
+
+	for i, other := range c.bellWaiters {
+		if other == ch {
+			c.bellWaiters = append(c.bellWaiters[:i], c.bellWaiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// bellReceived is called by the main loop for each Bell, and wakes up
+// all of the waiters.
+func (c *ClientConn) bellReceived() {
+	c.bellLock.Lock()
+	defer c.bellLock.Unlock()
+
+	for _, ch := range c.bellWaiters {
+		ch <- struct{}{}
+	}
+
+	c.bellWaiters = nil
+}
+
+// closeBellWaiters fails the waiting WaitForBell calls, once no more
+// messages will be read.
+func (c *ClientConn) closeBellWaiters() {
+	c.bellLock.Lock()
+	defer c.bellLock.Unlock()
+
+	for _, ch := range c.bellWaiters {
+		close(ch)
+	}
+
+	c.bellWaiters = nil
+	c.bellsClosed = true
+}
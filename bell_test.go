@@ -0,0 +1,76 @@
+package vnc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientConn_WaitForBell(t *testing.T) {
+	msgCh := make(chan ServerMessage, 4)
+	conn, server := newTestClientConn(&ClientConfig{ServerMessageCh: msgCh})
+	defer server.Close()
+
+	go conn.mainLoop()
+
+	// Bells read before WaitForBell is called don't count.
+	server.Write([]byte{2})
+	<-msgCh
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.WaitForBell(context.Background())
+	}()
+
+	for waiting := 0; waiting == 0; {
+		conn.bellLock.Lock()
+		waiting = len(conn.bellWaiters)
+		conn.bellLock.Unlock()
+	}
+
+	// Other messages are handled while waiting.
+	server.Write([]byte{0, 0, 0, 0})
+	if msg := <-msgCh; msg.Type() != 0 {
+		t.Fatalf("received %T, want *FramebufferUpdateMessage", msg)
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("returned %v before the bell", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	server.Write([]byte{2})
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("error waiting for bell: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("bell not awaited")
+	}
+	if _, ok := (<-msgCh).(*BellMessage); !ok {
+		t.Fatal("bell not sent on ServerMessageCh")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := conn.WaitForBell(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The waiters fail once the connection ends.
+	go func() {
+		errCh <- conn.WaitForBell(context.Background())
+	}()
+	server.Close()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("err = %v after close, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("still waiting after close")
+	}
+}
@@ -5,40 +5,272 @@
 package vnc
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
 	"io"
 	"net"
-	"unicode"
+	"strings"
+	"sync"
+	"time"
 )
 
 type ClientConn struct {
 	c      net.Conn
 	config *ClientConfig
 
+	// writeLock serializes writes of client messages to c.
+	writeLock sync.Mutex
+
+	// writeBuf buffers the messages written when
+	// ClientConfig.WriteCoalesceDelay is set, and flushTimer writes it
+	// out once the delay has passed. Both are guarded by writeLock.
+	writeBuf   *bufio.Writer
+	flushTimer *time.Timer
+
 	// If the pixel format uses a color map, then this is the color
 	// map that is used. This should not be modified directly, since
-	// the data comes from the server.
+	// the data comes from the server. Until the server has set any
+	// colors, it holds DefaultColorMap256.
+	//
+	// Every pixel format sent with SetPixelFormat starts with a fresh
+	// color map: DefaultColorMap256 for a color-mapped format, and all
+	// zero colors for a true color one. Colors set by the server for an
+	// earlier format are never used to decode pixels of a later one.
 	ColorMap [256]Color
 
 	// Encodings supported by the client. This should not be modified
 	// directly. Instead, SetEncodings should be used.
 	Encs []Encoding
 
-	// Width of the frame buffer in pixels, sent from the server.
-	FrameBufferWidth uint16
-
-	// Height of the frame buffer in pixels, sent from the server.
+	// Width and height of the frame buffer in pixels, sent from the
+	// server.
+	//
+	// Both change as the server resizes the desktop, from the goroutine
+	// reading from the server, so they must only be read directly from
+	// handlers called by that goroutine, such as OnResize. Use Dimensions
+	// anywhere else.
+	FrameBufferWidth  uint16
 	FrameBufferHeight uint16
 
 	// Name associated with the desktop, sent from the server.
 	DesktopName string
 
+	// The security type negotiated with the server during the
+	// handshake. Security contains further details about it for
+	// security types that tunnel another authentication method.
+	SecurityType uint8
+	Security     SecurityInfo
+
+	// The format of the audio samples sent by QEMU servers, as set by
+	// SetAudioFormat.
+	AudioFormat AudioFormat
+
+	// The position of the cursor last reported by the server, if the
+	// CursorPosPseudoEncoding has been sent using SetEncodings.
+	CursorPosition image.Point
+
 	// The pixel format associated with the connection. This shouldn't
 	// be modified. If you wish to set a new pixel format, use the
 	// SetPixelFormat method.
 	PixelFormat PixelFormat
+
+	// fbLock guards the framebuffer and the state of the automatic
+	// update loop, which are used from both the main loop and the user
+	// of the connection. The main loop also holds it while changing
+	// FrameBufferWidth and FrameBufferHeight.
+	fbLock   sync.Mutex
+	fb       *Framebuffer
+	tiledFB  *TiledFramebuffer
+	viewport Rectangle
+	paused   bool
+
+	// The cursor last sent by the server, which is also guarded by fbLock.
+	// See CompositeCursor.
+	cursor *CursorPseudoEncoding
+
+	// pixelFormatCheck tracks whether the server has been seen to honor
+	// the last SetPixelFormat request. It is also guarded by fbLock.
+	pixelFormatCheck int
+
+	// continuousSupported is set once the server has announced support
+	// for continuous updates, and continuousActive while they are
+	// enabled. They are also guarded by fbLock.
+	continuousSupported bool
+	continuousActive    bool
+
+	// The frames handled since the last fence of LowLatencyMode, and
+	// whether that fence is still unanswered, also guarded by fbLock.
+	framesSinceFence  int
+	frameFencePending bool
+
+	// refreshPending is set when a full update should be requested once
+	// the current update has been handled, such as after a rectangle
+	// that couldn't be decoded. It is also guarded by fbLock.
+	refreshPending bool
+
+	// frameSent is when a frame was last sent on FramebufferCh, and
+	// framePending is set while a coalesced frame is waiting to be sent
+	// by frameTimer.
+	frameSent    time.Time
+	framePending bool
+	frameTimer   *time.Timer
+
+	// The color map waiting to be passed to OnColorMapChanged, and the
+	// timer that passes it once the server stops changing it, both
+	// guarded by colorMapLock.
+	colorMapLock    sync.Mutex
+	colorMapPending [256]Color
+	colorMapTimer   *time.Timer
+
+	// pixelBytes is reused to read the pixel data of each rectangle.
+	pixelBytes []byte
+
+	// hextileTiles is reused to hold the tiles of each Hextile rectangle.
+	hextileTiles []hextileTile
+
+	// The Tight encoding uses four zlib streams, which are selected and
+	// reset by each rectangle. They persist for the whole connection.
+	tightStreams [4]zlibStream
+
+	// The screen layout last reported by the server, and whether the
+	// server supports the ExtendedDesktopSize pseudo-encoding.
+	screens             []Screen
+	extendedDesktopSize bool
+	resolutionRequested bool
+
+	statsLock     sync.Mutex
+	encodingStats map[int32]*EncodingStats
+
+	// The features the server has shown it supports with its messages,
+	// also guarded by statsLock. See SupportsFeature.
+	features map[Feature]bool
+
+	// The time the oldest unanswered FramebufferUpdateRequest was sent,
+	// and the last response times of the server, also guarded by
+	// statsLock. See ServerResponseTime.
+	requestSent   time.Time
+	responseTimes [responseTimeWindow]time.Duration
+	responses     int
+
+	// When connecting started, and how long after it the first update
+	// was decoded, also guarded by statsLock. See TimeToFirstFrame.
+	connectStarted time.Time
+	firstFrame     time.Duration
+
+	// The rectangles of each real encoding received in the updates
+	// checked by checkEncodingFallback since SetEncodings was last sent,
+	// also guarded by statsLock.
+	fallbackCounts  map[int32]int
+	fallbackUpdates int
+	fallbackChecked bool
+
+	// The channels returned by Observe.
+	observersLock   sync.Mutex
+	observers       []chan ServerMessage
+	observersClosed bool
+
+	// Pings waiting for the server to respond to their fence, by the
+	// sequence number in the fence payload.
+	pingLock sync.Mutex
+	pingSeq  uint32
+	pings    map[uint32]chan struct{}
+
+	// The keys sent as pressed and not yet released, in the order they
+	// were pressed.
+	keysLock    sync.Mutex
+	pressedKeys []uint32
+
+	// The pixel format to restore once the preview enabled with
+	// SetPreviewMode is disabled, or nil while it isn't enabled.
+	previewLock    sync.Mutex
+	previewRestore *PixelFormat
+
+	// The buttons last sent as pressed, and the scroll deltas that
+	// haven't added up to a wheel notch yet. See ScrollDelta.
+	pointerLock      sync.Mutex
+	pointerMask      ButtonMask
+	scrollX, scrollY int
+
+	// The RequestUpdate calls waiting for an update, and the number of
+	// updates the main loop has started reading.
+	updateLock    sync.Mutex
+	updateWaiters []*updateWaiter
+	updatesRead   uint64
+	updatesClosed bool
+
+	// The context set with SetDecodeContext, also guarded by updateLock.
+	decodeCtx context.Context
+
+	// The clipboard text last sent or received, used by SetClipboard, and
+	// the capabilities returned by ClipboardCaps.
+	clipboardLock  sync.Mutex
+	clipboardText  string
+	clipboardKnown bool
+	clipboardCaps  *ClipboardCaps
+
+	// The WaitForBell calls waiting for the next Bell.
+	bellLock    sync.Mutex
+	bellWaiters []chan struct{}
+	bellsClosed bool
+
+	// The state of ClientConfig.AdaptiveQuality, only used by the main
+	// loop.
+	qualityControl qualityController
+
+	// The file transfer in progress, guarded by fileLock. transferLock is
+	// held for the whole of a transfer, so that they run one at a time.
+	transferLock sync.Mutex
+	fileLock     sync.Mutex
+	fileTransfer *fileTransfer
+	filesClosed  bool
+
+	// The messages queued by TrySendKeyEvent and TrySendPointerEvent.
+	queue sendQueue
+
+	// The protocol version negotiated during the handshake.
+	protocolVersion string
+
+	// authFailed is set when the server has rejected the authentication
+	// of a version 3.8 connection, which RetryAuth may try again.
+	authFailed bool
+
+	// closed is set once Close has been called, so that the main loop
+	// can tell a clean close from a failed connection.
+	closeLock sync.Mutex
+	closed    bool
+
+	// stalled is set, also guarded by closeLock, when the connection is
+	// closed because of ClientConfig.CloseOnStall.
+	stalled bool
+
+	// err is the error that ended the main loop, also guarded by
+	// closeLock. See Err.
+	err error
+
+	// stallTimer runs from the first FramebufferUpdateRequest that hasn't
+	// been answered by an update, and stallID tells it apart from timers
+	// that were stopped too late. See ClientConfig.UpdateStallTimeout.
+	stallLock  sync.Mutex
+	stallTimer *time.Timer
+	stallID    uint64
+}
+
+// ServerInfo describes the server, as announced during the handshake.
+type ServerInfo struct {
+	// ProtocolVersion is the version of the protocol negotiated with
+	// the server, such as "RFB 003.008".
+	ProtocolVersion string
+
+	FrameBufferWidth  uint16
+	FrameBufferHeight uint16
+	PixelFormat       PixelFormat
+	DesktopName       string
 }
 
 // A ClientConfig structure is used to configure a ClientConn. After
@@ -48,9 +280,20 @@ type ClientConfig struct {
 	// suitable by the server will be used to authenticate.
 	Auth []ClientAuth
 
+	// RequiredSecurityTypes, if set, are the only security types the
+	// client accepts, whatever the server offers and Auth supports. RFB
+	// doesn't protect the list of security types the server offers, so a
+	// man in the middle can remove the strong ones from it, leaving the
+	// client to fall back to None or VNC authentication. Requiring only
+	// 19, VeNCrypt, which always uses TLS, makes Client fail with
+	// ErrSecurityTypeNotAllowed instead.
+	RequiredSecurityTypes []uint8
+
 	// Exclusive determines whether the connection is shared with other
 	// clients. If true, then all other clients connected will be
 	// disconnected when a connection is established to the VNC server.
+	// It is sent as the shared flag of the ClientInit message, which is
+	// 1 by default and 0 when Exclusive is set.
 	Exclusive bool
 
 	// The channel that all messages received from the server will be
@@ -64,129 +307,877 @@ type ClientConfig struct {
 	// This only needs to contain NEW server messages, and doesn't
 	// need to explicitly contain the RFC-required messages.
 	ServerMessages []ServerMessage
+
+	// UltraVNC servers may send file transfer and text chat messages
+	// that are not part of the RFC. These are always parsed, so that
+	// the connection stays in sync, but are otherwise skipped. If this
+	// is set, it is called with each of these messages instead.
+	UltraVNCMessageHandler func(ServerMessage)
+
+	// If KeepFramebuffer is true, the connection maintains a local copy
+	// of the remote frame buffer, which is updated with every
+	// FramebufferUpdate received. See ClientConn.Framebuffer.
+	KeepFramebuffer bool
+
+	// If FramebufferTileSize is set together with KeepFramebuffer, the
+	// local copy of the frame buffer is a TiledFramebuffer with tiles of
+	// this size, which only takes memory for the parts of the frame
+	// buffer that have been updated. Use ClientConn.FramebufferImage to
+	// read it. Framebuffer returns nil, and FramebufferCh isn't used,
+	// since those hold a copy of the whole frame buffer. PalettedImage
+	// still works, but allocates an image of the whole frame buffer.
+	FramebufferTileSize uint16
+
+	// If KeepFramebuffer is set, a copy of the framebuffer is sent on
+	// FramebufferCh after each FramebufferUpdate has been applied. As
+	// with ServerMessageCh, it is up to the user of the library to
+	// ensure that this channel is properly read.
+	FramebufferCh chan<- *Framebuffer
+
+	// Servers answer an incremental update request with a
+	// FramebufferUpdate without any rectangles when nothing changed. If
+	// SkipEmptyUpdates is set, such updates aren't sent on
+	// ServerMessageCh, and no frame is sent on FramebufferCh for them.
+	// The automatic update loop and RequestUpdate still see them.
+	SkipEmptyUpdates bool
+
+	// If KeepFramebuffer is set, OnResize is called when the framebuffer
+	// has been resized by a FramebufferUpdate, before the resulting frame
+	// is sent on FramebufferCh. The contents of the area common to the
+	// old and new sizes are kept, and the rest of the framebuffer is
+	// black. CopyRect rectangles with a source outside of the resized
+	// framebuffer are skipped.
+	OnResize func(oldWidth, oldHeight, newWidth, newHeight uint16)
+
+	// OnEncodingFallback, if set, is called if the server doesn't use the
+	// preferred encoding sent with SetEncodings, the first real encoding
+	// other than CopyRect, in any of the first few updates with pixel
+	// data. actual is the encoding it used the most instead, often Raw
+	// when the server doesn't support the encodings asked for, which
+	// explains unexpected bandwidth use. It is called at most once after
+	// each SetEncodings, from the goroutine reading messages.
+	OnEncodingFallback func(preferred, actual int32)
+
+	// OnAuthenticated, OnConnected and OnDisconnected, if set, are called
+	// as the connection goes through the phases of its life.
+	// OnAuthenticated is called once the server has accepted the security
+	// handshake, and OnConnected once the handshake is complete, before
+	// any messages from the server are read. OnDisconnected is called
+	// exactly once after OnConnected, when the connection has been
+	// closed, with the error that ended it, or nil if it was ended by
+	// Close.
+	OnAuthenticated func(SecurityInfo)
+	OnConnected     func(ServerInfo)
+	OnDisconnected  func(error)
+
+	// UpdateStallTimeout, if set, is how long the client waits for a
+	// FramebufferUpdate after requesting one before it considers the
+	// server stalled. This catches servers that keep the connection alive
+	// but stop sending updates, which TCP keepalives can't detect. OnStall
+	// is then called, and if CloseOnStall is set, the connection is closed
+	// and ErrUpdateStalled is passed to OnDisconnected, so that the
+	// caller can reconnect.
+	UpdateStallTimeout time.Duration
+	OnStall            func()
+	CloseOnStall       bool
+
+	// WriteCoalesceDelay, if set, holds back the messages sent to the
+	// server for up to this long, so that messages sent in quick
+	// succession, such as the key events of typing, are written together
+	// in fewer system calls and TCP segments. A few milliseconds are
+	// enough for typing. FramebufferUpdateRequests and Fences, which the
+	// server is expected to answer, are written immediately, along with
+	// anything held back before them, and Flush writes everything at
+	// once. Messages that are still held back when the connection is
+	// closed are lost, so call Flush before Close.
+	WriteCoalesceDelay time.Duration
+
+	// OnRectangle, if set, is called with each rectangle of a
+	// FramebufferUpdate as soon as it has been decoded, before the rest
+	// of the update has been read. This lets a large update be rendered
+	// as it arrives. The update as a whole is only sent on
+	// ServerMessageCh, and applied to the framebuffer, once all of its
+	// rectangles have been read.
+	OnRectangle func(Rectangle)
+
+	// If KeepFramebuffer is set, OnFrame is called once for each
+	// FramebufferUpdate, with the framebuffer after all of the
+	// rectangles of the update have been applied to it, and after
+	// OnResize, so that the whole frame can be rendered at once. The
+	// rectangles that changed are those passed to OnRectangle since the
+	// last frame. It is called from the goroutine reading messages, and
+	// is passed the framebuffer itself rather than a copy, which must
+	// only be read during the call. As with FramebufferCh, it isn't
+	// called with FramebufferTileSize, nor for empty updates with
+	// SkipEmptyUpdates.
+	OnFrame func(*Framebuffer)
+
+	// CutTextAsTitle, if set, is called with the text of each
+	// ServerCutText message, for servers that send the title of the
+	// desktop as cut text in a format of their own, rather than using
+	// the DesktopName pseudo-encoding. If it returns true, the title
+	// replaces ClientConn.DesktopName, and the message isn't passed on
+	// as cut text.
+	CutTextAsTitle func(text string) (title string, ok bool)
+
+	// OnCursorPos, if set, is called when the server reports a new
+	// position of the cursor using the CursorPos pseudo-encoding.
+	OnCursorPos func(image.Point)
+
+	// OnColorMapChanged, if set, is called with a copy of the color map
+	// once the server has changed it with SetColorMapEntries. Servers
+	// animating the palette send many small SetColorMapEntries in a
+	// burst, so the callback is only called once no further change has
+	// arrived for ColorMapChangeDelay, with the color map as the whole
+	// burst left it. ClientConn.ColorMap itself is updated by each
+	// message. The callback is called from a goroutine of its own.
+	OnColorMapChanged func(colorMap [256]Color)
+
+	// ColorMapChangeDelay is how long the color map must stay unchanged
+	// before OnColorMapChanged is called. If this is zero, a delay of
+	// 10 milliseconds is used.
+	ColorMapChangeDelay time.Duration
+
+	// MaxDecodeFPS limits the number of frames per second sent on
+	// FramebufferCh. Updates that arrive faster than that are still
+	// applied to the framebuffer, but are coalesced so that only the
+	// latest frame is sent once the interval has passed. If this is
+	// zero, every frame is sent.
+	MaxDecodeFPS int
+
+	// If AutoUpdate is true, framebuffer updates are requested
+	// automatically: a full update when the connection is established,
+	// and an incremental update after each update is received. The
+	// region requested can be limited using ClientConn.SetViewport.
+	AutoUpdate bool
+
+	// UpdateStrategy is how the automatic update loop requests updates.
+	// Different servers work best with different patterns of requests.
+	// The default, UpdateStrategyViewport, requests the viewport.
+	UpdateStrategy UpdateStrategy
+
+	// If PreferredResolution is set, and the server announces support
+	// for the ExtendedDesktopSizePseudoEncoding, the client requests the
+	// frame buffer to be resized to it. The server may reject the
+	// request, in which case the frame buffer keeps its size.
+	PreferredResolution image.Point
+
+	// If set, the audio data of QEMUAudioMessages is sent on this
+	// channel instead of ServerMessageCh. See ClientConn.EnableAudio.
+	AudioCh chan<- []byte
+
+	// DisableCopyRect, DisableHextile, DisableRRE, DisableTight and
+	// DisableZlib leave the encodings out of those passed to SetEncodings
+	// and returned by EnabledEncodings, so that the server doesn't use
+	// them. DisableRRE also disables CoRRE, and DisableTight also disables
+	// TightPNG. The Raw encoding can't be disabled.
+	DisableCopyRect bool
+	DisableHextile  bool
+	DisableRRE      bool
+	DisableTight    bool
+	DisableZlib     bool
+
+	// ContinuousUpdates includes the ContinuousUpdatesPseudoEncoding in
+	// the encodings passed to SetEncodings and returned by
+	// EnabledEncodings. It is left out by default, since continuous
+	// updates change how updates are requested. See
+	// ClientConn.EnableContinuousUpdates.
+	ContinuousUpdates bool
+
+	// LowLatencyMode sets up continuous updates paced with fences, the
+	// low latency mode of TigerVNC and TightVNC servers. The
+	// ContinuousUpdatesPseudoEncoding is passed to SetEncodings, as with
+	// ContinuousUpdates, and continuous updates of the viewport are
+	// enabled as soon as the server announces its support. A Fence
+	// request is then sent after every LowLatencyFenceInterval frames
+	// have been handled, unless the previous one is still unanswered,
+	// so that the server can tell how far behind the client is. As
+	// always, fence requests from the server are answered automatically.
+	LowLatencyMode bool
+
+	// LowLatencyFenceInterval is the number of frames after which a
+	// Fence is sent in LowLatencyMode. If this is zero, one is sent
+	// after every frame.
+	LowLatencyFenceInterval int
+
+	// LowCPU limits the encodings passed to SetEncodings and returned by
+	// EnabledEncodings to those that are cheap to decode, Raw, CopyRect
+	// and Hextile, along with the pseudo-encodings other than the JPEG
+	// quality levels. This suits devices that can't keep up with
+	// decompressing Zlib, Tight and JPEG data; Stats reports the time
+	// spent decoding each encoding.
+	LowCPU bool
+
+	// AdaptiveQuality measures the throughput of the framebuffer updates
+	// over each AdaptiveQualityInterval, and resends SetEncodings to
+	// adjust the JPEG quality and compression levels to it. Below
+	// AdaptiveQualityLowBandwidth, the quality is lowered by a level and
+	// the compression raised by one. Above AdaptiveQualityHighBandwidth,
+	// they move back by a level towards those last sent with SetEncodings,
+	// or quality 8 and compression 2 if none were sent.
+	AdaptiveQuality bool
+
+	// The throughputs, in bytes per second, at which AdaptiveQuality
+	// lowers and raises the quality. They default to 128KB/s and 1MB/s.
+	AdaptiveQualityLowBandwidth  int
+	AdaptiveQualityHighBandwidth int
+
+	// AdaptiveQualityInterval is the shortest time over which the
+	// throughput is measured by AdaptiveQuality, which defaults to two
+	// seconds. Intervals with less than 64KB of updates are extended
+	// until that much has been received.
+	AdaptiveQualityInterval time.Duration
+
+	// InputOnly is for clients that only send input, such as bots
+	// driving a remote UI, and never look at the screen. The pixel
+	// format is set to NewPixelFormatBGR233 once connected, the real
+	// encodings passed to SetEncodings and returned by EnabledEncodings
+	// are limited to Raw, leaving out the cursor pseudo-encodings too,
+	// and the pixel data of Raw rectangles is read and discarded without
+	// being decoded, so that RawEncoding.Colors is nil. Updates are still
+	// read, and must be requested, for the server to carry on, but the
+	// framebuffer kept with KeepFramebuffer stays black.
+	InputOnly bool
+
+	// KeepEncodingOrder sends the encodings passed to SetEncodings in the
+	// order given. By default, the real encodings are sent first, in the
+	// order given, followed by the pseudo-encodings in the order expected
+	// by servers such as TigerVNC. See SetEncodings.
+	KeepEncodingOrder bool
+
+	// MaxAdvertisedEncodings, if set, limits SetEncodings to sending this
+	// many encodings, for servers that fail when sent more than they
+	// expect. The encodings of highest priority are kept, after ordering
+	// them, and Raw is kept in any case.
+	MaxAdvertisedEncodings int
+
+	// MaxProtocolVersion, if set, caps the protocol version the client
+	// responds with during the handshake, such as "RFB 003.003" for a
+	// server that rejects clients asking for a version newer than its
+	// own, even one it announced. Versions 3.3, 3.7 and 3.8 are
+	// supported. If this is empty, the newest version that both the
+	// client and the server support is used.
+	MaxProtocolVersion string
+
+	// MaxDesktopNameLength is the longest desktop name accepted in the
+	// ServerInit message, which protects against a server claiming a
+	// huge name to force a large allocation. Longer names fail the
+	// handshake. If this is zero, a maximum of 4096 bytes is used.
+	MaxDesktopNameLength uint32
+
+	// MaxFramebufferPixels is the largest framebuffer, in pixels, accepted
+	// in the ServerInit message or when the server resizes the desktop,
+	// which protects against a server claiming a huge framebuffer to
+	// force large allocations. If this is zero, a maximum of 1<<26
+	// pixels, such as 8192x8192, is used.
+	MaxFramebufferPixels int
+
+	// MaxDecompressedBytesPerRect is the most data that is decompressed
+	// from the chunk of compressed data of a single rectangle of the Zlib
+	// and Tight encodings. A chunk may hold more data than its rectangle
+	// uses, which is then decompressed and discarded, so this protects
+	// against a small chunk expanding to a huge amount. Up to 32KB of
+	// extra data decompressed along with the pixels isn't counted, since
+	// the decompressor has already taken it from the chunk. Rectangles
+	// whose chunk decompresses to more fail to decode, closing the
+	// connection, as do rectangles whose own pixels are larger than the
+	// limit. If this is zero, the limit is twice the size of the pixels
+	// of the rectangle.
+	MaxDecompressedBytesPerRect int64
+
+	// MaxRectanglesPerUpdate, if set, is the largest number of rectangles
+	// accepted in a FramebufferUpdate, which protects against a server
+	// wasting the CPU of the client with a huge number of tiny ones.
+	// Updates declaring more fail to decode, closing the connection.
+	// Updates ended by a LastRect rectangle declare the maximum count
+	// instead, and fail once they have more rectangles than this.
+	MaxRectanglesPerUpdate int
+
+	// StrictMode turns server behavior that is tolerated by default into
+	// errors wrapping ErrSpecViolation, which close the connection, so
+	// that the client can be used to check servers against the RFB
+	// protocol. This rejects messages of extensions the client hasn't
+	// announced support for with SetEncodings, including UltraVNC
+	// messages, which are otherwise skipped; CopyRect sources outside of
+	// the framebuffer, which are otherwise skipped; extended clipboard
+	// messages without ExtendedClipboardPseudoEncoding; and SetColorMap
+	// entries in a true color pixel format, or beyond the end of the
+	// color map. Rectangles in encodings that weren't sent with
+	// SetEncodings, other than Raw, and real rectangles outside of the
+	// framebuffer are always rejected.
+	StrictMode bool
+
+	// ZlibBufferSize, if set, is the capacity of the buffer that holds
+	// the compressed data of each zlib stream, which is kept for the
+	// lifetime of the connection. Rectangles with more compressed data
+	// than this grow the buffer while they are decoded, after which it
+	// is shrunk back, trading the cost of reallocating for memory. By
+	// default, buffers keep the capacity of the largest rectangle seen.
+	// The decompressors always use the 32KB window of the stream.
+	ZlibBufferSize int
+
+	// HextileWorkers is the number of goroutines that decode the tiles of
+	// a large Hextile rectangle concurrently, once its data has been
+	// read. If this is zero, GOMAXPROCS goroutines are used. Set it to 1
+	// to decode all tiles in the goroutine reading from the server.
+	HextileWorkers int
+
+	// SparseRRE returns RRE and CoRRE rectangles as their background
+	// color and subrectangles, in RREEncoding.Background and
+	// RREEncoding.Subrects, rather than decoding them into Colors. This
+	// saves filling in every pixel of rectangles that are mostly
+	// background, for consumers that paint the subrectangles themselves.
+	SparseRRE bool
+
+	// If CaptureDecodeErrors is set, a rectangle that fails to decode is
+	// reported as an *EncodingError, holding the first 64 bytes of its
+	// data, to help with reporting bugs in decoders. It is off by
+	// default, since the data may hold the contents of the screen.
+	CaptureDecodeErrors bool
+
+	// ReadTrace, if set, receives a verbatim copy of everything read from
+	// the server after the handshake, for attaching to a bug report. It
+	// can be decoded again with Replay, given the RecordingMetadata of
+	// the connection. The trace holds everything the server sent,
+	// including the contents of the screen, cut text and any typed
+	// passwords echoed on screen, so it must be handled as carefully as
+	// the session itself. Errors writing to it are ignored.
+	ReadTrace io.Writer
+
+	// ForceByteOrder overrides the byte order of the pixel format when
+	// decoding pixel data. This is a workaround for servers that set the
+	// big endian flag of their pixel format incorrectly, and is not
+	// compliant with the RFC, which requires the server to send pixels in
+	// the byte order of the pixel format. The default, ByteOrderAuto,
+	// uses the byte order of the pixel format.
+	ForceByteOrder ByteOrder
+
+	// RawChannelValues keeps the red, green and blue values of true color
+	// pixels as sent by the server, ranging from zero to the max of each
+	// channel in the pixel format. By default, they are scaled to the
+	// full 16 bits of a Color, so that colors are the same regardless of
+	// the pixel format, and the same as those of a color map.
+	RawChannelValues bool
+
+	// TightYCbCr returns the JPEG rectangles of the Tight encodings as
+	// the YCbCr image decoded from the JPEG data, in TightEncoding.Image,
+	// instead of converting them into colors. This saves a colorspace
+	// conversion for users that encode the image as JPEG again, such as
+	// transcoding proxies. Framebuffer.Apply converts such images itself.
+	TightYCbCr bool
+
+	// TightRawJPEG returns the JPEG rectangles of the Tight encodings as
+	// the JPEG data sent by the server, in TightEncoding.JPEG, without
+	// decoding it, for users that pass the images on as they are, such
+	// as bridges to MJPEG streams. This takes precedence over TightYCbCr.
+	// Framebuffer.Apply decodes such images itself, so the framebuffer
+	// kept with KeepFramebuffer still costs a decode.
+	TightRawJPEG bool
+
+	// If ColorPool is set, the colors of decoded rectangles are taken
+	// from it. The receiver of a FramebufferUpdateMessage on
+	// ServerMessageCh should return them using ColorPool.Release once
+	// done with the message. If ServerMessageCh isn't set, and there are
+	// no observers, the connection does so itself after each update.
+	ColorPool *ColorPool
+
+	// BeforeSend, if set, is called with every message before it is sent
+	// to the server, including the messages sent automatically by the
+	// connection. It returns the message to send in its place, which can
+	// be the original message, a modified copy of it or a different
+	// message altogether, or false to drop the message.
+	BeforeSend func(ClientMessage) (ClientMessage, bool)
+
+	// Logf, if set, is called to report problems with the connection
+	// that are not otherwise surfaced as errors, such as a server that
+	// appears to have ignored a SetPixelFormat request. It is also
+	// called once for the first rectangle received in each encoding.
+	Logf func(format string, v ...interface{})
+
+	// SendQueueSize is the number of messages queued by
+	// TrySendKeyEvent and TrySendPointerEvent waiting to be written to
+	// the server, before they return ErrWouldBlock. If this is zero, a
+	// size of 64 is used.
+	SendQueueSize int
+
+	// ClientName is a friendly name for the connection, which is never
+	// sent to the server. It labels the messages passed to Logf, so that
+	// the connections can be told apart when many are multiplexed.
+	ClientName string
+
+	// If AuthRetry is set, Client doesn't close the connection when a
+	// version 3.8 server rejects the authentication, and returns it in
+	// an AuthRetryError, so that RetryAuth can try again without
+	// reconnecting. The connection must then be retried or closed. Only
+	// some servers allow this; see RetryAuth.
+	AuthRetry bool
 }
 
 func Client(c net.Conn, cfg *ClientConfig) (*ClientConn, error) {
 	conn := &ClientConn{
-		c:      c,
-		config: cfg,
+		c:              c,
+		config:         cfg,
+		connectStarted: time.Now(),
 	}
 
 	if err := conn.handshake(); err != nil {
+		if cfg.AuthRetry && conn.authFailed {
+			return nil, &AuthRetryError{Conn: conn, Err: err}
+		}
+
 		conn.Close()
 		return nil, err
 	}
 
-	go conn.mainLoop()
+	conn.start()
 
 	return conn, nil
 }
 
+// start begins using the connection after the handshake has completed.
+func (c *ClientConn) start() {
+	if c.config.ReadTrace != nil {
+		c.c = &tracingConn{Conn: c.c, trace: c.config.ReadTrace}
+	}
+
+	if c.config.KeepFramebuffer && c.config.FramebufferTileSize > 0 {
+		c.tiledFB = NewTiledFramebuffer(c.FrameBufferWidth, c.FrameBufferHeight, c.config.FramebufferTileSize)
+	} else if c.config.KeepFramebuffer {
+		c.fb = NewFramebuffer(c.FrameBufferWidth, c.FrameBufferHeight)
+	}
+
+	if c.config.OnConnected != nil {
+		c.config.OnConnected(ServerInfo{
+			ProtocolVersion:   c.protocolVersion,
+			FrameBufferWidth:  c.FrameBufferWidth,
+			FrameBufferHeight: c.FrameBufferHeight,
+			PixelFormat:       c.PixelFormat,
+			DesktopName:       c.DesktopName,
+		})
+	}
+
+	go c.mainLoop()
+}
+
 func (c *ClientConn) Close() error {
+	c.closeLock.Lock()
+	c.closed = true
+	c.closeLock.Unlock()
+
+	c.closeQueue()
+
 	return c.c.Close()
 }
 
+// Err returns the error that ended the connection, or nil while it is
+// still usable. This is the error passed to ClientConfig.OnDisconnected,
+// such as io.EOF when the server closed the connection, except that a
+// connection closed with Close reports net.ErrClosed. Once Err returns
+// an error, messages can no longer be sent or received.
+func (c *ClientConn) Err() error {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+
+	if c.err == nil && c.closed {
+		return net.ErrClosed
+	}
+
+	return c.err
+}
+
+// disconnected closes the connection once the main loop has ended, and
+// reports err, the reason it ended, to OnDisconnected. If Close has been
+// called, the error is a result of that, and nil is reported instead.
+func (c *ClientConn) disconnected(err error) {
+	c.closeLock.Lock()
+	if c.stalled {
+		err = ErrUpdateStalled
+	} else if c.closed {
+		err = nil
+	}
+	c.closed = true
+	c.err = err
+	c.closeLock.Unlock()
+
+	c.updateReceived()
+	c.closeQueue()
+	c.stopFrameTimer()
+	c.c.Close()
+
+	if c.config.OnDisconnected != nil {
+		c.config.OnDisconnected(err)
+	}
+}
+
 // CutText tells the server that the client has new text in its cut buffer.
 // The text string MUST only contain Latin-1 characters. This encoding
 // is compatible with Go's native string format, but can only use up to
 // unicode.MaxLatin values.
 //
+// If the server has announced extended clipboard capabilities, text
+// larger than the maximum size it accepts is rejected. See SetClipboard
+// for sending only text that changed.
+//
 // See RFC 6143 Section 7.5.6
 func (c *ClientConn) CutText(text string) error {
-	var buf bytes.Buffer
+	if caps := c.ClipboardCaps(); caps != nil && caps.Supports(ClipboardText) {
+		if max := caps.MaxUnsolicitedSize[ClipboardText]; uint32(len(text)) > max {
+			return fmt.Errorf("cut text of %d bytes exceeds the server's maximum of %d", len(text), max)
+		}
+	}
 
-	// This is the fixed size data we'll send
-	fixedData := []interface{}{
-		uint8(6),
-		uint8(0),
-		uint8(0),
-		uint8(0),
-		uint32(len(text)),
+	return c.Send(&ClientCutTextMessage{Text: text})
+}
+
+// Requests a framebuffer update from the server. There may be an indefinite
+// time between the request and the actual framebuffer update being
+// received.
+//
+// See RFC 6143 Section 7.5.3
+func (c *ClientConn) FramebufferUpdateRequest(incremental bool, x, y, width, height uint16) error {
+	return c.Send(&FramebufferUpdateRequestMessage{
+		Incremental: incremental,
+		X:           x,
+		Y:           y,
+		Width:       width,
+		Height:      height,
+	})
+}
+
+// Refresh requests a full, non-incremental update of the entire frame
+// buffer, at its current size, such as to redraw everything after the
+// viewer has been minimized. Unlike the automatic update loop, it
+// ignores the viewport set with SetViewport.
+func (c *ClientConn) Refresh() error {
+	width, height := c.Dimensions()
+	return c.FramebufferUpdateRequest(false, 0, 0, width, height)
+}
+
+// Dimensions returns the current width and height of the frame buffer.
+// Unlike reading FrameBufferWidth and FrameBufferHeight, this is safe
+// while the server may be resizing the desktop.
+func (c *ClientConn) Dimensions() (width, height uint16) {
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	return c.FrameBufferWidth, c.FrameBufferHeight
+}
+
+// setDimensions changes the size of the frame buffer, as announced by
+// the server.
+func (c *ClientConn) setDimensions(width, height uint16) {
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	c.FrameBufferWidth = width
+	c.FrameBufferHeight = height
+}
+
+// requestRefresh arranges for Refresh to be called once the update being
+// read has been handled.
+func (c *ClientConn) requestRefresh() {
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	c.refreshPending = true
+}
+
+// Framebuffer returns a copy of the local frame buffer maintained by the
+// connection, or nil if ClientConfig.KeepFramebuffer is not set.
+func (c *ClientConn) Framebuffer() *Framebuffer {
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	if c.fb == nil {
+		return nil
 	}
 
-	for _, val := range fixedData {
-		if err := binary.Write(&buf, binary.BigEndian, val); err != nil {
-			return err
-		}
+	fb := *c.fb
+	fb.Colors = make([]Color, len(c.fb.Colors))
+	copy(fb.Colors, c.fb.Colors)
+	return &fb
+}
+
+// FramebufferImage returns a copy of the region r of the local frame
+// buffer, clipped to the frame buffer, or nil if ClientConfig.KeepFramebuffer
+// is not set. Unlike Framebuffer, this also works with
+// ClientConfig.FramebufferTileSize, and only copies the region.
+func (c *ClientConn) FramebufferImage(r Rectangle) image.Image {
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	switch {
+	case c.fb != nil:
+		return c.fb.SubImage(r)
+	case c.tiledFB != nil:
+		return c.tiledFB.SubImage(r)
 	}
 
-	for _, char := range text {
-		if char > unicode.MaxLatin1 {
-			return fmt.Errorf("Character '%s' is not valid Latin-1", char)
-		}
+	return nil
+}
 
-		if err := binary.Write(&buf, binary.BigEndian, uint8(char)); err != nil {
-			return err
-		}
+// ImageInto copies the local frame buffer into dst, which must have the
+// bounds of the entire frame buffer, so that a single image can be
+// reused for every frame. It returns an error if the bounds don't match,
+// in which case the caller should allocate an image of the new size, as
+// after OnResize, or if ClientConfig.KeepFramebuffer is not set. Colors
+// are reduced to 8 bits per channel.
+func (c *ClientConn) ImageInto(dst *image.RGBA) error {
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	var width, height uint16
+	var at func(x, y int) Color
+	switch {
+	case c.fb != nil:
+		width, height = c.fb.Width, c.fb.Height
+		at = func(x, y int) Color { return c.fb.Colors[y*int(width)+x] }
+	case c.tiledFB != nil:
+		width, height = c.tiledFB.Width, c.tiledFB.Height
+		at = func(x, y int) Color { return c.tiledFB.At(uint16(x), uint16(y)) }
+	default:
+		return fmt.Errorf("images require ClientConfig.KeepFramebuffer")
 	}
 
-	dataLength := 8 + len(text)
-	if _, err := c.c.Write(buf.Bytes()[0:dataLength]); err != nil {
-		return err
+	if bounds := image.Rect(0, 0, int(width), int(height)); dst.Bounds() != bounds {
+		return fmt.Errorf("image bounds %v don't match the %dx%d framebuffer", dst.Bounds(), width, height)
+	}
+
+	for y := 0; y < int(height); y++ {
+		row := dst.Pix[y*dst.Stride:]
+		for x := 0; x < int(width); x++ {
+			col := at(x, y)
+			pix := row[x*4 : x*4+4]
+			pix[0] = uint8(col.R >> 8)
+			pix[1] = uint8(col.G >> 8)
+			pix[2] = uint8(col.B >> 8)
+			pix[3] = 0xff
+		}
 	}
 
 	return nil
 }
 
-// Requests a framebuffer update from the server. There may be an indefinite
-// time between the request and the actual framebuffer update being
-// received.
+// PalettedImage returns a copy of the local frame buffer as a paletted
+// image, with the color map of the connection as its palette, which
+// takes a quarter of the memory of an RGBA image. It requires a color
+// map pixel format, and ClientConfig.KeepFramebuffer to be set.
 //
-// See RFC 6143 Section 7.5.3
-func (c *ClientConn) FramebufferUpdateRequest(incremental bool, x, y, width, height uint16) error {
-	var buf bytes.Buffer
-	var incrementalByte uint8 = 0
+// The index of each pixel is that of its color in the color map. Pixels
+// painted before the server changed the color map are given the index of
+// the closest color in the new one. As with the ColorMap field, this must
+// not be called while the server may be changing the color map.
+func (c *ClientConn) PalettedImage() (*image.Paletted, error) {
+	if c.PixelFormat.TrueColor {
+		return nil, fmt.Errorf("paletted images require a color map pixel format")
+	}
 
-	if incremental {
-		incrementalByte = 1
+	colorMap := c.ColorMap
+	palette := make(color.Palette, len(colorMap))
+	indexes := make(map[Color]uint8, len(colorMap))
+	for i := len(colorMap) - 1; i >= 0; i-- {
+		palette[i] = colorMap[i]
+		indexes[colorMap[i]] = uint8(i)
 	}
 
-	data := []interface{}{
-		uint8(3),
-		incrementalByte,
-		x, y, width, height,
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	var width, height uint16
+	var colors []Color
+	switch {
+	case c.fb != nil:
+		width, height, colors = c.fb.Width, c.fb.Height, c.fb.Colors
+	case c.tiledFB != nil:
+		width, height = c.tiledFB.Width, c.tiledFB.Height
+		colors = c.tiledFB.colors(Rectangle{Width: width, Height: height})
+	default:
+		return nil, fmt.Errorf("paletted images require ClientConfig.KeepFramebuffer")
 	}
 
-	for _, val := range data {
-		if err := binary.Write(&buf, binary.BigEndian, val); err != nil {
-			return err
+	img := image.NewPaletted(image.Rect(0, 0, int(width), int(height)), palette)
+	for i, col := range colors {
+		index, ok := indexes[col]
+		if !ok {
+			index = closestColor(&colorMap, col)
+			indexes[col] = index
 		}
+		img.Pix[i] = index
 	}
 
-	if _, err := c.c.Write(buf.Bytes()[0:10]); err != nil {
-		return err
+	return img, nil
+}
+
+// SetViewport limits the framebuffer updates requested by the automatic
+// update loop to the given region, and immediately requests a full
+// update of it. A width or height of zero requests the entire frame
+// buffer. When used together with ClientConfig.KeepFramebuffer, the
+// contents of the framebuffer outside of the viewport are kept as they
+// were last received.
+func (c *ClientConn) SetViewport(x, y, width, height uint16) error {
+	c.fbLock.Lock()
+	c.viewport = Rectangle{X: x, Y: y, Width: width, Height: height}
+	c.fbLock.Unlock()
+
+	return c.requestViewportUpdate(false)
+}
+
+// Pause stops the automatic update loop from requesting further
+// framebuffer updates, for example while a viewer is minimized. Messages
+// sent by the server, such as bells and cut text, are still received
+// while paused.
+func (c *ClientConn) Pause() {
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	c.paused = true
+}
+
+// Resume restarts an automatic update loop stopped by Pause. Since the
+// local framebuffer is likely to be out of date, a full update of the
+// viewport is requested.
+func (c *ClientConn) Resume() error {
+	c.fbLock.Lock()
+	wasPaused := c.paused
+	c.paused = false
+	c.fbLock.Unlock()
+
+	if !wasPaused || !c.config.AutoUpdate {
+		return nil
 	}
 
-	return nil
+	return c.requestViewportUpdate(false)
 }
 
-// KeyEvent indiciates a key press or release and sends it to the server.
-// The key is indicated using the X Window System "keysym" value. Use
-// Google to find a reference of these values. To simulate a key press,
-// you must send a key with both a down event, and a non-down event.
-//
-// See 7.5.4.
-func (c *ClientConn) KeyEvent(keysym uint32, down bool) error {
-	var downFlag uint8 = 0
-	if down {
-		downFlag = 1
+// autoUpdating reports whether the automatic update loop should request
+// updates.
+func (c *ClientConn) autoUpdating() bool {
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	return c.config.AutoUpdate && !c.paused
+}
+
+// requestViewportUpdate requests an update of the current viewport,
+// clipped to the frame buffer.
+func (c *ClientConn) requestViewportUpdate(incremental bool) error {
+	region, ok := c.viewportRegion()
+	if !ok {
+		return nil
 	}
 
-	data := []interface{}{
-		uint8(4),
-		downFlag,
-		uint8(0),
-		uint8(0),
-		keysym,
+	return c.FramebufferUpdateRequest(incremental, region.X, region.Y, region.Width, region.Height)
+}
+
+// viewportRegion returns the region requested by the automatic update
+// loop, which is the viewport clipped to the frame buffer, or the whole
+// frame buffer. It reports false if the viewport lies entirely outside of
+// the frame buffer.
+func (c *ClientConn) viewportRegion() (Rectangle, bool) {
+	c.fbLock.Lock()
+	region := c.viewport
+	width, height := c.FrameBufferWidth, c.FrameBufferHeight
+	c.fbLock.Unlock()
+
+	if region.Width == 0 || region.Height == 0 || c.config.UpdateStrategy == UpdateStrategyFullScreen {
+		region = Rectangle{Width: width, Height: height}
 	}
 
-	for _, val := range data {
-		if err := binary.Write(c.c, binary.BigEndian, val); err != nil {
-			return err
+	if region.X >= width || region.Y >= height {
+		return Rectangle{}, false
+	}
+	if int(region.X)+int(region.Width) > int(width) {
+		region.Width = width - region.X
+	}
+	if int(region.Y)+int(region.Height) > int(height) {
+		region.Height = height - region.Y
+	}
+
+	return region, true
+}
+
+// UpdateStrategy is how the automatic update loop of
+// ClientConfig.AutoUpdate requests updates.
+type UpdateStrategy int
+
+const (
+	// UpdateStrategyViewport requests the viewport set with SetViewport,
+	// or the whole frame buffer if there is none, after each update.
+	UpdateStrategyViewport UpdateStrategy = iota
+
+	// UpdateStrategyFullScreen always requests the whole frame buffer,
+	// as one large request, ignoring the viewport.
+	UpdateStrategyFullScreen
+
+	// UpdateStrategyDirtyFollowUp requests each region changed by an
+	// update on its own, before requesting the viewport as
+	// UpdateStrategyViewport does. Servers that answer requests one at a
+	// time then send the regions that are changing, such as a playing
+	// video, first. An update of more than 8 regions is followed up with
+	// a single request of their bounds.
+	UpdateStrategyDirtyFollowUp
+)
+
+// The most regions of an update requested on their own by
+// UpdateStrategyDirtyFollowUp.
+const maxDirtyFollowUps = 8
+
+// requestFollowUp requests the next update once an update has been
+// handled, using the UpdateStrategy of the configuration.
+func (c *ClientConn) requestFollowUp(update *FramebufferUpdateMessage) error {
+	region, ok := c.viewportRegion()
+	if !ok {
+		return nil
+	}
+
+	var requests []ClientMessage
+	if c.config.UpdateStrategy == UpdateStrategyDirtyFollowUp {
+		var dirty []Rectangle
+		for _, rect := range update.Rectangles {
+			if rect.Enc != nil && isPseudoEncoding(rect.Enc.Type()) {
+				continue
+			}
+
+			if rect, ok := rect.Intersect(region); ok {
+				dirty = append(dirty, rect)
+			}
+		}
+
+		if len(dirty) > maxDirtyFollowUps {
+			bounds, _ := update.Bounds().Intersect(region)
+			dirty = []Rectangle{bounds}
+		}
+
+		for _, rect := range dirty {
+			requests = append(requests, &FramebufferUpdateRequestMessage{
+				Incremental: true,
+				X:           rect.X,
+				Y:           rect.Y,
+				Width:       rect.Width,
+				Height:      rect.Height,
+			})
 		}
 	}
 
-	return nil
+	requests = append(requests, &FramebufferUpdateRequestMessage{
+		Incremental: true,
+		X:           region.X,
+		Y:           region.Y,
+		Width:       region.Width,
+		Height:      region.Height,
+	})
+
+	return c.send(requests...)
+}
+
+// KeyEvent indiciates a key press or release and sends it to the server.
+// The key is indicated using the X Window System "keysym" value. Use
+// Google to find a reference of these values. To simulate a key press,
+// you must send a key with both a down event, and a non-down event.
+//
+// See 7.5.4.
+func (c *ClientConn) KeyEvent(keysym uint32, down bool) error {
+	return c.Send(&KeyEventMessage{Down: down, Keysym: keysym})
 }
 
 // PointerEvent indicates that pointer movement or a pointer button
@@ -197,90 +1188,397 @@ func (c *ClientConn) KeyEvent(keysym uint32, down bool) error {
 //
 // See RFC 6143 Section 7.5.5
 func (c *ClientConn) PointerEvent(mask ButtonMask, x, y uint16) error {
-	var buf bytes.Buffer
+	return c.Send(&PointerEventMessage{Mask: mask, X: x, Y: y})
+}
 
-	data := []interface{}{
-		uint8(5),
-		uint8(mask),
-		x,
-		y,
+// SetEncodings sets the encoding types in which the pixel data can
+// be sent from the server. After calling this method, the encs slice
+// given should not be modified.
+//
+// Encodings disabled in the ClientConfig, such as by DisableZlib, are
+// left out even if they are in encs, so the flags take precedence over
+// the slice. See EnabledEncodings for the encodings enabled by default.
+//
+// The real encodings are sent in the order given, which is the order of
+// preference, followed by the pseudo-encodings: the JPEG quality and
+// compression levels, then those for the cursor, the desktop size and
+// the rest, regardless of where they are in encs. Set
+// ClientConfig.KeepEncodingOrder to send them in the order given, and
+// ClientConfig.MaxAdvertisedEncodings to send no more than a given
+// number of them.
+//
+// See RFC 6143 Section 7.5.2
+func (c *ClientConn) SetEncodings(encs []Encoding) error {
+	enabled := make([]Encoding, 0, len(encs))
+	for _, enc := range encs {
+		if !c.encodingDisabled(enc.Type()) {
+			enabled = append(enabled, enc)
+		}
 	}
 
-	for _, val := range data {
-		if err := binary.Write(&buf, binary.BigEndian, val); err != nil {
-			return err
+	if !c.config.KeepEncodingOrder {
+		orderEncodings(enabled)
+	}
+	enabled = limitEncodings(enabled, c.config.MaxAdvertisedEncodings)
+
+	return c.Send(&SetEncodingsMessage{Encodings: enabled})
+}
+
+// EnabledEncodings returns the built-in encodings that aren't disabled in
+// the ClientConfig, in order of preference, for use with SetEncodings.
+// Raw is always supported, whether it is in the list or not.
+func (c *ClientConn) EnabledEncodings() []Encoding {
+	var encs []Encoding
+	for _, enc := range BuiltinEncodings() {
+		if !c.encodingDisabled(enc.Type()) {
+			encs = append(encs, enc)
 		}
 	}
 
-	if _, err := c.c.Write(buf.Bytes()[0:6]); err != nil {
+	return encs
+}
+
+// ForceEncoding sends SetEncodings with only the given encoding type and
+// Raw, which servers must always support, and then requests a full
+// update, so that everything is sent again in that encoding. This is
+// meant for narrowing down problems with a server, together with
+// EncodingsSeen, and overrides the flags in the ClientConfig that
+// disable encodings.
+//
+// The encoding used is the one of that type last sent with SetEncodings,
+// if any, so that its options are kept, or else the built-in one.
+func (c *ClientConn) ForceEncoding(encType int32) error {
+	forced := c.findEncoding(encType)
+	if forced == nil {
+		return fmt.Errorf("unsupported encoding type %d", encType)
+	}
+
+	encs := []Encoding{forced}
+	if rawType := new(RawEncoding).Type(); encType != rawType {
+		encs = append(encs, c.findEncoding(rawType))
+	}
+
+	if err := c.Send(&SetEncodingsMessage{Encodings: encs}); err != nil {
 		return err
 	}
 
+	return c.Refresh()
+}
+
+// findEncoding returns the encoding of the given type last sent with
+// SetEncodings, or else the built-in one, or nil if there is none.
+func (c *ClientConn) findEncoding(encType int32) Encoding {
+	for _, encs := range [][]Encoding{c.Encs, BuiltinEncodings()} {
+		for _, enc := range encs {
+			if enc.Type() == encType {
+				return enc
+			}
+		}
+	}
+
 	return nil
 }
 
-// SetEncodings sets the encoding types in which the pixel data can
-// be sent from the server. After calling this method, the encs slice
-// given should not be modified.
+// encodingDisabled reports whether an encoding type is disabled in the
+// ClientConfig.
+func (c *ClientConn) encodingDisabled(encType int32) bool {
+	if c.config.LowCPU && !lowCPUEncoding(encType) {
+		return true
+	}
+	if c.config.InputOnly && !inputOnlyEncoding(encType) {
+		return true
+	}
+
+	switch encType {
+	case new(CopyRectEncoding).Type():
+		return c.config.DisableCopyRect
+	case new(HextileEncoding).Type():
+		return c.config.DisableHextile
+	case new(RREEncoding).Type(), new(CoRREEncoding).Type():
+		return c.config.DisableRRE
+	case new(ZlibEncoding).Type():
+		return c.config.DisableZlib
+	case new(TightEncoding).Type(), new(TightPNGEncoding).Type():
+		return c.config.DisableTight
+	case new(ContinuousUpdatesPseudoEncoding).Type():
+		return !c.config.ContinuousUpdates && !c.config.LowLatencyMode
+	}
+
+	return false
+}
+
+// lowCPUEncoding reports whether an encoding type is enabled by
+// ClientConfig.LowCPU.
+func lowCPUEncoding(encType int32) bool {
+	switch {
+	case encType >= -32 && encType <= -23:
+		// JPEG quality levels.
+		return false
+	case isPseudoEncoding(encType):
+		return true
+	}
+
+	switch encType {
+	case 0, 1, 5: // Raw, CopyRect, Hextile
+		return true
+	}
+
+	return false
+}
+
+// inputOnlyEncoding reports whether an encoding type is enabled by
+// ClientConfig.InputOnly: Raw, and the pseudo-encodings that don't carry
+// pixel data.
+func inputOnlyEncoding(encType int32) bool {
+	switch encType {
+	case 0:
+		return true
+	case -239, -240, -314: // Cursor, XCursor, CursorWithAlpha
+		return false
+	}
+
+	return isPseudoEncoding(encType)
+}
+
+// SetPixelFormat sets the format in which pixel values should be sent
+// in FramebufferUpdate messages from the server. This resets ColorMap,
+// as the server's color map doesn't carry over to the new format.
 //
-// See RFC 6143 Section 7.5.2
-func (c *ClientConn) SetEncodings(encs []Encoding) error {
-	data := make([]interface{}, 3+len(encs))
-	data[0] = uint8(2)
-	data[1] = uint8(0)
-	data[2] = uint16(len(encs))
+// See RFC 6143 Section 7.5.1
+func (c *ClientConn) SetPixelFormat(format *PixelFormat) error {
+	return c.Send(&SetPixelFormatMessage{PixelFormat: *format})
+}
+
+// Send sends a message to the server. If ClientConfig.BeforeSend is set,
+// it is called first, and may replace or drop the message. Messages are
+// serialized in full before being written, so that concurrent calls never
+// interleave their data, and an invalid message never leaves a partial
+// message on the wire.
+//
+// The state of the connection that is affected by a message, such as
+// the pixel format and the encodings, is updated from the message that
+// was actually sent. Dropped messages leave it unchanged.
+func (c *ClientConn) Send(msg ClientMessage) error {
+	return c.send(msg)
+}
+
+// SendChord sends a key chord, such as Ctrl+Alt+F2: a key down event for
+// each of the keysyms in order, followed by key up events in the reverse
+// order. The events are written at once, so that messages sent from
+// other goroutines can't be interleaved with them.
+func (c *ClientConn) SendChord(keysyms ...uint32) error {
+	msgs := make([]ClientMessage, 0, 2*len(keysyms))
+	for _, keysym := range keysyms {
+		msgs = append(msgs, &KeyEventMessage{Down: true, Keysym: keysym})
+	}
 
-	for i, enc := range encs {
-		data[3+i] = int32(enc.Type())
+	for i := len(keysyms) - 1; i >= 0; i-- {
+		msgs = append(msgs, &KeyEventMessage{Down: false, Keysym: keysyms[i]})
 	}
 
+	return c.send(msgs...)
+}
+
+// send sends messages to the server as described by Send, in a single
+// write.
+func (c *ClientConn) send(msgs ...ClientMessage) error {
 	var buf bytes.Buffer
-	for _, val := range data {
-		if err := binary.Write(&buf, binary.BigEndian, val); err != nil {
+	sent := make([]ClientMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		if c.config.BeforeSend != nil {
+			var ok bool
+			if msg, ok = c.config.BeforeSend(msg); !ok {
+				continue
+			}
+		}
+
+		if err := msg.Serialize(&buf); err != nil {
 			return err
 		}
+
+		sent = append(sent, msg)
+	}
+
+	if len(sent) == 0 {
+		return nil
 	}
 
-	dataLength := 4 + (4 * len(encs))
-	if _, err := c.c.Write(buf.Bytes()[0:dataLength]); err != nil {
+	// The server may answer a request before the write returns.
+	c.recordRequest(sent)
+
+	c.writeLock.Lock()
+	err := c.write(buf.Bytes(), urgentMessages(sent))
+	c.writeLock.Unlock()
+	if err != nil {
 		return err
 	}
 
-	c.Encs = encs
+	for _, msg := range sent {
+		c.messageSent(msg)
+	}
 
 	return nil
 }
 
-// SetPixelFormat sets the format in which pixel values should be sent
-// in FramebufferUpdate messages from the server.
+// Flush waits until all of the messages sent so far have been written to
+// the connection, including a write in progress in another goroutine, the
+// messages queued by the TrySend methods and those held back by
+// ClientConfig.WriteCoalesceDelay. If the connection passed to
+// Client buffers its writes, and has a Flush method, such as a net.Conn
+// wrapping a bufio.Writer, it is flushed too.
 //
-// See RFC 6143 Section 7.5.1
-func (c *ClientConn) SetPixelFormat(format *PixelFormat) error {
-	var keyEvent [20]byte
-	keyEvent[0] = 0
-
-	pfBytes, err := writePixelFormat(format)
-	if err != nil {
+// This is useful before closing the connection, for example after
+// releasing all of the keys that are held down.
+func (c *ClientConn) Flush() error {
+	if err := c.waitQueue(); err != nil {
 		return err
 	}
 
-	// Copy the pixel format bytes into the proper slice location
-	copy(keyEvent[4:], pfBytes)
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
 
-	// Send the data down the connection
-	if _, err := c.c.Write(keyEvent[:]); err != nil {
+	if err := c.flushWrites(); err != nil {
 		return err
 	}
 
-	// Reset the color map as according to RFC.
-	var newColorMap [256]Color
-	c.ColorMap = newColorMap
+	if f, ok := c.c.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
 
 	return nil
 }
 
+// messageSent updates the state of the connection after a message has
+// been sent to the server.
+func (c *ClientConn) messageSent(msg ClientMessage) {
+	switch msg := msg.(type) {
+	case *SetEncodingsMessage:
+		c.Encs = msg.Encodings
+
+		c.statsLock.Lock()
+		c.fallbackCounts = nil
+		c.fallbackUpdates = 0
+		c.fallbackChecked = false
+		c.statsLock.Unlock()
+	case *SetPixelFormatMessage:
+		// Reset the color map as according to RFC, to the default
+		// colors until the server sends its own.
+		var newColorMap [256]Color
+		if !msg.PixelFormat.TrueColor {
+			newColorMap = DefaultColorMap256()
+		}
+		c.ColorMap = newColorMap
+
+		c.PixelFormat = msg.PixelFormat
+
+		c.fbLock.Lock()
+		c.pixelFormatCheck = pixelFormatRequested
+		c.fbLock.Unlock()
+	case *ClientCutTextMessage:
+		c.clipboardChanged(msg.Text)
+	case *KeyEventMessage:
+		c.keySent(msg)
+	case *PointerEventMessage:
+		c.pointerLock.Lock()
+		c.pointerMask = msg.Mask
+		c.pointerLock.Unlock()
+	case *FramebufferUpdateRequestMessage:
+		c.updateRequested()
+	case *EnableContinuousUpdatesMessage:
+		if msg.Enable {
+			c.fbLock.Lock()
+			c.continuousActive = true
+			c.fbLock.Unlock()
+		}
+	case *QEMUAudioClientMessage:
+		if msg.Operation == AudioSetFormat {
+			c.AudioFormat = msg.Format
+		}
+	}
+}
+
+const (
+	pixelFormatVerified = iota
+	pixelFormatRequested
+	pixelFormatDecoded
+)
+
+// checkPixelFormat is called by the main loop after each server message
+// has been read, with either the parsed message or the error that
+// occurred reading it.
+//
+// The RFB protocol has no way for a server to refuse a SetPixelFormat
+// request, and some servers silently keep sending pixel data in the
+// old format. Since pixel data isn't self-describing, such updates are
+// decoded using the wrong number of bytes per pixel, which throws the
+// connection out of sync. This is detected as a read error in the first
+// update after SetPixelFormat, or in the message following it, and a
+// warning is logged to help diagnose the otherwise confusing failure.
+func (c *ClientConn) checkPixelFormat(msg ServerMessage, err error) {
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	if c.pixelFormatCheck == pixelFormatVerified {
+		return
+	}
+
+	if err != nil {
+		c.logf("server may have ignored SetPixelFormat (%d bits per pixel): %s",
+			c.PixelFormat.BPP, err)
+		return
+	}
+
+	if _, ok := msg.(*FramebufferUpdateMessage); ok && c.pixelFormatCheck == pixelFormatRequested {
+		c.pixelFormatCheck = pixelFormatDecoded
+	} else if c.pixelFormatCheck == pixelFormatDecoded {
+		c.pixelFormatCheck = pixelFormatVerified
+	}
+}
+
+// ClientName returns the friendly name of the connection, as set by
+// ClientConfig.ClientName.
+func (c *ClientConn) ClientName() string {
+	return c.config.ClientName
+}
+
+// logf reports a problem using ClientConfig.Logf, if set. The message is
+// prefixed with the package and the name of the connection.
+func (c *ClientConn) logf(format string, v ...interface{}) {
+	if c.config == nil || c.config.Logf == nil {
+		return
+	}
+
+	prefix := "vnc: "
+	if c.config.ClientName != "" {
+		prefix += c.config.ClientName + ": "
+	}
+
+	c.config.Logf(prefix+format, v...)
+}
+
 const pvLen = 12 // ProtocolVersion message length.
 
+// The default ClientConfig.MaxDesktopNameLength.
+const defaultMaxDesktopNameLength = 4096
+
+// The default ClientConfig.MaxFramebufferPixels.
+const defaultMaxFramebufferPixels = 1 << 26
+
+// checkFramebufferSize checks a framebuffer size announced by the server
+// against ClientConfig.MaxFramebufferPixels.
+func (c *ClientConn) checkFramebufferSize(width, height uint16) error {
+	maxPixels := defaultMaxFramebufferPixels
+	if c.config != nil && c.config.MaxFramebufferPixels > 0 {
+		maxPixels = c.config.MaxFramebufferPixels
+	}
+
+	if pixels := int(width) * int(height); pixels > maxPixels {
+		return fmt.Errorf("framebuffer size %dx%d exceeds the maximum of %d pixels", width, height, maxPixels)
+	}
+
+	return nil
+}
+
 func parseProtocolVersion(pv []byte) (uint, uint, error) {
 	var major, minor uint
 
@@ -299,43 +1597,108 @@ func parseProtocolVersion(pv []byte) (uint, uint, error) {
 	return major, minor, nil
 }
 
+// HandshakePhase is a phase of the handshake with the server.
+type HandshakePhase int
+
+const (
+	// HandshakeVersion is the exchange of the ProtocolVersion messages.
+	HandshakeVersion HandshakePhase = iota
+
+	// HandshakeSecurity is the choice of the security type, the
+	// authentication and the SecurityResult.
+	HandshakeSecurity
+
+	// HandshakeInit is the exchange of the ClientInit and ServerInit
+	// messages.
+	HandshakeInit
+)
+
+func (p HandshakePhase) String() string {
+	switch p {
+	case HandshakeVersion:
+		return "version"
+	case HandshakeSecurity:
+		return "security"
+	case HandshakeInit:
+		return "initialization"
+	}
+
+	return fmt.Sprintf("HandshakePhase(%d)", int(p))
+}
+
+// HandshakeClosedError is returned by Client when the server closes the
+// connection during the handshake. Servers commonly do this when they
+// refuse the client, such as for its address, rather than sending a
+// reason, so the phase tells a refusal, usually in the version or
+// security phase, apart from a connection lost later on. Err is the
+// error of the read or write that failed, such as io.EOF.
+type HandshakeClosedError struct {
+	Phase HandshakePhase
+	Err   error
+}
+
+func (e *HandshakeClosedError) Error() string {
+	return fmt.Sprintf("server closed the connection during the %s handshake: %s", e.Phase, e.Err)
+}
+
+func (e *HandshakeClosedError) Unwrap() error {
+	return e.Err
+}
+
+// handshakeClosed returns a HandshakeClosedError for err if it shows that
+// the server closed the connection, and err otherwise.
+func handshakeClosed(phase HandshakePhase, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) {
+		return &HandshakeClosedError{Phase: phase, Err: err}
+	}
+
+	return err
+}
+
 func (c *ClientConn) handshake() error {
 	var protocolVersion [pvLen]byte
 
 	// 7.1.1, read the ProtocolVersion message sent by the server.
 	if _, err := io.ReadFull(c.c, protocolVersion[:]); err != nil {
-		return err
+		return handshakeClosed(HandshakeVersion, err)
 	}
 
 	maxMajor, maxMinor, err := parseProtocolVersion(protocolVersion[:])
 	if err != nil {
 		return err
 	}
+
+	if c.config.MaxProtocolVersion != "" {
+		capMajor, capMinor, err := parseProtocolVersion(
+			[]byte(strings.TrimSuffix(c.config.MaxProtocolVersion, "\n") + "\n"))
+		if err != nil {
+			return fmt.Errorf("invalid MaxProtocolVersion %q: %s", c.config.MaxProtocolVersion, err)
+		}
+
+		if capMajor < maxMajor || (capMajor == maxMajor && capMinor < maxMinor) {
+			maxMajor, maxMinor = capMajor, capMinor
+		}
+	}
 	if maxMajor < 3 {
 		return fmt.Errorf("unsupported major version, less than 3: %d", maxMajor)
 	}
-	if maxMinor < 8 {
-		return fmt.Errorf("unsupported minor version, less than 8: %d", maxMinor)
-	}
-
-	// Respond with the version we will support
-	if _, err = c.c.Write([]byte("RFB 003.008\n")); err != nil {
-		return err
-	}
-
-	// 7.1.2 Security Handshake from server
-	var numSecurityTypes uint8
-	if err = binary.Read(c.c, binary.BigEndian, &numSecurityTypes); err != nil {
-		return err
+	if maxMajor == 3 && maxMinor < 3 {
+		return fmt.Errorf("unsupported minor version, less than 3: %d", maxMinor)
 	}
 
-	if numSecurityTypes == 0 {
-		return fmt.Errorf("no security types: %s", c.readErrorReason())
+	// Respond with the version we will support. Versions 3.4 to 3.6 are
+	// treated as 3.3, as the RFC requires.
+	minor := uint(8)
+	if maxMajor == 3 && maxMinor < 8 {
+		minor = 3
+		if maxMinor == 7 {
+			minor = 7
+		}
 	}
 
-	securityTypes := make([]uint8, numSecurityTypes)
-	if err = binary.Read(c.c, binary.BigEndian, &securityTypes); err != nil {
-		return err
+	c.protocolVersion = fmt.Sprintf("RFB 003.%03d", minor)
+	if _, err = c.c.Write([]byte(c.protocolVersion + "\n")); err != nil {
+		return handshakeClosed(HandshakeVersion, err)
 	}
 
 	clientSecurityTypes := c.config.Auth
@@ -343,24 +1706,25 @@ func (c *ClientConn) handshake() error {
 		clientSecurityTypes = []ClientAuth{new(ClientAuthNone)}
 	}
 
-	var auth ClientAuth
-FindAuth:
-	for _, curAuth := range clientSecurityTypes {
-		for _, securityType := range securityTypes {
-			if curAuth.SecurityType() == securityType {
-				// We use the first matching supported authentication
-				auth = curAuth
-				break FindAuth
-			}
-		}
+	if err = c.securityHandshake(clientSecurityTypes, minor); err != nil {
+		return handshakeClosed(HandshakeSecurity, err)
 	}
 
-	if auth == nil {
-		return fmt.Errorf("no suitable auth schemes found. server supported: %#v", securityTypes)
-	}
+	return handshakeClosed(HandshakeInit, c.initialize())
+}
 
-	// Respond back with the security type we'll use
-	if err = binary.Write(c.c, binary.BigEndian, auth.SecurityType()); err != nil {
+// securityHandshake chooses one of auths for the security type offered
+// by the server, authenticates with it and reads the SecurityResult.
+func (c *ClientConn) securityHandshake(auths []ClientAuth, minor uint) error {
+	// 7.1.2 Security Handshake from server
+	var auth ClientAuth
+	var err error
+	if minor == 3 {
+		auth, err = c.readSecurityType33(auths)
+	} else {
+		auth, err = c.chooseSecurityType(auths)
+	}
+	if err != nil {
 		return err
 	}
 
@@ -368,23 +1732,49 @@ FindAuth:
 		return err
 	}
 
-	// 7.1.3 SecurityResult Handshake
-	var securityResult uint32
-	if err = binary.Read(c.c, binary.BigEndian, &securityResult); err != nil {
-		return err
+	// Security types such as VeNCrypt continue over a tunnel.
+	if authConn, ok := auth.(ClientAuthConn); ok && authConn.Conn() != nil {
+		c.c = authConn.Conn()
 	}
 
-	if securityResult == 1 {
-		return fmt.Errorf("security handshake failed: %s", c.readErrorReason())
+	c.SecurityType = auth.SecurityType()
+	c.Security = SecurityInfo{Type: c.SecurityType}
+	if tunnel, ok := auth.(ClientAuthTunnel); ok {
+		c.Security = tunnel.SecurityInfo()
 	}
 
+	// 7.1.3 SecurityResult Handshake. Versions before 3.8 don't send it
+	// for the None security type, nor a reason for failures.
+	if minor == 8 || c.SecurityType != 1 {
+		var securityResult uint32
+		if err = binary.Read(c.c, binary.BigEndian, &securityResult); err != nil {
+			return err
+		}
+
+		if securityResult != 0 {
+			c.authFailed = minor == 8
+			return c.securityResultError(securityResult, minor)
+		}
+	}
+
+	if c.config.OnAuthenticated != nil {
+		c.config.OnAuthenticated(c.Security)
+	}
+
+	return nil
+}
+
+// initialize sends the ClientInit message and reads the ServerInit
+// message, once the security handshake has succeeded.
+func (c *ClientConn) initialize() error {
 	// 7.3.1 ClientInit
 	var sharedFlag uint8 = 1
 	if c.config.Exclusive {
 		sharedFlag = 0
 	}
 
-	if err = binary.Write(c.c, binary.BigEndian, sharedFlag); err != nil {
+	err := binary.Write(c.c, binary.BigEndian, sharedFlag)
+	if err != nil {
 		return err
 	}
 
@@ -397,16 +1787,33 @@ FindAuth:
 		return err
 	}
 
+	if err = c.checkFramebufferSize(c.FrameBufferWidth, c.FrameBufferHeight); err != nil {
+		return err
+	}
+
 	// Read the pixel format
 	if err = readPixelFormat(c.c, &c.PixelFormat); err != nil {
 		return err
 	}
 
+	if !c.PixelFormat.TrueColor {
+		c.ColorMap = DefaultColorMap256()
+	}
+
 	var nameLength uint32
 	if err = binary.Read(c.c, binary.BigEndian, &nameLength); err != nil {
 		return err
 	}
 
+	maxNameLength := c.config.MaxDesktopNameLength
+	if maxNameLength == 0 {
+		maxNameLength = defaultMaxDesktopNameLength
+	}
+
+	if nameLength > maxNameLength {
+		return fmt.Errorf("desktop name length %d exceeds the maximum of %d", nameLength, maxNameLength)
+	}
+
 	nameBytes := make([]uint8, nameLength)
 	if err = binary.Read(c.c, binary.BigEndian, &nameBytes); err != nil {
 		return err
@@ -420,9 +1827,160 @@ FindAuth:
 // mainLoop reads messages sent from the server and routes them to the
 // proper channels for users of the client to read.
 func (c *ClientConn) mainLoop() {
-	defer c.Close()
+	var err error
+	defer func() { c.disconnected(err) }()
+	defer c.closeObservers()
+	defer c.closeUpdateWaiters()
+	defer c.closeBellWaiters()
+	defer c.closeFileTransfers()
+
+	typeMap := c.serverMessageTypes()
+
+	if c.config.InputOnly {
+		if err = c.SetPixelFormat(NewPixelFormatBGR233()); err != nil {
+			return
+		}
+	}
+
+	if c.autoUpdating() {
+		if err = c.requestViewportUpdate(false); err != nil {
+			return
+		}
+	}
+
+	var prev ServerMessage
+	for {
+		var messageType uint8
+		if err = binary.Read(c.c, binary.BigEndian, &messageType); err != nil {
+			break
+		}
+
+		var updateSeq uint64
+		var readStart time.Time
+		if messageType == new(FramebufferUpdateMessage).Type() {
+			updateSeq = c.updateStarted()
+			c.recordResponse()
+			readStart = time.Now()
+		}
+
+		var msg ServerMessage
+		msg, err = serverMessageType(typeMap, messageType, prev)
+		if update, ok := prev.(*FramebufferUpdateMessage); ok && err != nil {
+			if raw := rawRectangle(update.Rectangles); raw != nil {
+				err = c.pixelFormatMismatch(raw, fmt.Sprintf("unsupported message type %d following %T", messageType, prev))
+			}
+		}
+		if err != nil {
+			c.checkPixelFormat(nil, err)
+			c.logf("%s", err)
+			break
+		}
+		if err = c.checkNegotiated(msg); err != nil {
+			c.logf("%s", err)
+			break
+		}
+
+		var parsedMsg ServerMessage
+		parsedMsg, err = msg.Read(c, c.c)
+		readTime := time.Since(readStart)
+		c.checkPixelFormat(parsedMsg, err)
+		if errors.Is(err, ErrProtocolDesync) || errors.Is(err, ErrSpecViolation) {
+			c.logf("%s", err)
+		}
+		if err != nil {
+			break
+		}
+
+		prev = parsedMsg
+		c.observeFeatures(parsedMsg)
+		c.notifyObservers(parsedMsg)
+
+		switch msg := parsedMsg.(type) {
+		case *UltraVNCFileTransferMessage, *UltraVNCTextChatMessage:
+			if c.config.UltraVNCMessageHandler != nil {
+				c.config.UltraVNCMessageHandler(parsedMsg)
+			}
+			continue
+		case *FileListDataMessage, *FileDownloadDataMessage, *FileDownloadFailedMessage:
+			if c.fileTransferMessage(parsedMsg) {
+				continue
+			}
+		case *QEMUAudioMessage:
+			if msg.Operation == AudioData && c.config.AudioCh != nil {
+				c.config.AudioCh <- msg.Data
+				continue
+			}
+		case *ServerCutTextMessage:
+			if c.config.CutTextAsTitle != nil {
+				if title, ok := c.config.CutTextAsTitle(msg.Text); ok {
+					c.DesktopName = title
+					continue
+				}
+			}
 
-	// Build the map of available server messages
+			c.clipboardChanged(msg.Text)
+		case *SetColorMapEntriesMessage:
+			c.colorMapChanged()
+		case *EndOfContinuousUpdatesMessage:
+			if err = c.continuousUpdatesEnded(); err != nil {
+				return
+			}
+		case *GIIServerMessage:
+			if msg.SubType == GIIVersion {
+				if err = c.answerGIIVersion(msg); err != nil {
+					return
+				}
+			}
+		case *BellMessage:
+			c.bellReceived()
+		case *FenceMessage:
+			var ping bool
+			ping, err = c.handleFence(msg)
+			if err != nil {
+				return
+			}
+			if ping {
+				continue
+			}
+		}
+
+		if update, ok := parsedMsg.(*FramebufferUpdateMessage); ok {
+			c.updateReceived()
+
+			if err = c.handleFramebufferUpdate(update); err != nil {
+				break
+			}
+
+			if err = c.adaptQuality(readTime, time.Now()); err != nil {
+				break
+			}
+
+			if err = c.paceFrame(); err != nil {
+				break
+			}
+
+			waited := c.updateHandled(updateSeq, update)
+
+			if c.config.ServerMessageCh == nil && c.config.ColorPool != nil && !c.observed() && !waited {
+				c.config.ColorPool.Release(update)
+			}
+
+			if len(update.Rectangles) == 0 && c.config.SkipEmptyUpdates {
+				continue
+			}
+		}
+
+		if c.config.ServerMessageCh == nil {
+			continue
+		}
+
+		c.config.ServerMessageCh <- parsedMsg
+	}
+}
+
+// serverMessageTypes returns the messages that can be read from the
+// server, by type.
+func (c *ClientConn) serverMessageTypes() map[uint8]ServerMessage {
 	typeMap := make(map[uint8]ServerMessage)
 
 	defaultMessages := []ServerMessage{
@@ -430,6 +1988,15 @@ func (c *ClientConn) mainLoop() {
 		new(SetColorMapEntriesMessage),
 		new(BellMessage),
 		new(ServerCutTextMessage),
+		new(UltraVNCFileTransferMessage),
+		new(UltraVNCTextChatMessage),
+		new(FileListDataMessage),
+		new(FileDownloadDataMessage),
+		new(FileDownloadFailedMessage),
+		new(QEMUAudioMessage),
+		new(FenceMessage),
+		new(EndOfContinuousUpdatesMessage),
+		new(GIIServerMessage),
 	}
 
 	for _, msg := range defaultMessages {
@@ -442,29 +2009,294 @@ func (c *ClientConn) mainLoop() {
 		}
 	}
 
-	for {
-		var messageType uint8
-		if err := binary.Read(c.c, binary.BigEndian, &messageType); err != nil {
-			break
+	return typeMap
+}
+
+// serverMessageType looks up the message of a type read from the server
+// in typeMap. An unknown message type means that the previous message,
+// prev, was not read correctly, or that the server sent a message that
+// was never negotiated, and fails with ErrProtocolDesync.
+func serverMessageType(typeMap map[uint8]ServerMessage, messageType uint8, prev ServerMessage) (ServerMessage, error) {
+	msg, ok := typeMap[messageType]
+	if ok {
+		return msg, nil
+	}
+
+	if prev == nil {
+		return nil, fmt.Errorf("%w: unsupported message type %d", ErrProtocolDesync, messageType)
+	}
+
+	return nil, fmt.Errorf("%w: unsupported message type %d following %T", ErrProtocolDesync, messageType, prev)
+}
+
+// sendFrame sends a copy of the framebuffer on FramebufferCh, limited to
+// MaxDecodeFPS frames per second.
+func (c *ClientConn) sendFrame() {
+	if c.config.FramebufferCh == nil || !c.config.KeepFramebuffer || c.config.FramebufferTileSize > 0 {
+		return
+	}
+
+	if c.config.MaxDecodeFPS <= 0 {
+		c.config.FramebufferCh <- c.Framebuffer()
+		return
+	}
+
+	interval := time.Second / time.Duration(c.config.MaxDecodeFPS)
+
+	c.fbLock.Lock()
+	if c.framePending {
+		// The pending frame will pick up this update when it is sent.
+		c.fbLock.Unlock()
+		return
+	}
+
+	wait := interval - time.Since(c.frameSent)
+	if wait <= 0 {
+		c.frameSent = time.Now()
+		c.fbLock.Unlock()
+		c.config.FramebufferCh <- c.Framebuffer()
+		return
+	}
+
+	c.framePending = true
+	c.frameTimer = time.AfterFunc(wait, func() {
+		c.fbLock.Lock()
+		c.framePending = false
+		c.frameTimer = nil
+		c.frameSent = time.Now()
+		c.fbLock.Unlock()
+
+		// No frames are sent once the connection is closed, when the
+		// consumer may no longer be reading them.
+		c.closeLock.Lock()
+		closed := c.closed
+		c.closeLock.Unlock()
+		if closed {
+			return
 		}
 
-		msg, ok := typeMap[messageType]
-		if !ok {
-			// Unsupported message type! Bad!
-			break
+		c.config.FramebufferCh <- c.Framebuffer()
+	})
+	c.fbLock.Unlock()
+}
+
+// stopFrameTimer drops the coalesced frame waiting to be sent, if any.
+func (c *ClientConn) stopFrameTimer() {
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	if c.frameTimer != nil {
+		c.frameTimer.Stop()
+		c.frameTimer = nil
+		c.framePending = false
+	}
+}
+
+// resetTightStreams resets the Tight zlib streams whose bits are set in
+// the low four bits of a Tight compression control byte.
+func (c *ClientConn) resetTightStreams(control uint8) {
+	for i := range c.tightStreams {
+		if control&(1<<uint(i)) != 0 {
+			c.tightStreams[i].reset()
 		}
+	}
+}
 
-		parsedMsg, err := msg.Read(c, c.c)
-		if err != nil {
-			break
+// handleFramebufferUpdate applies a FramebufferUpdate to the state of the
+// connection, and sends any requests that follow from it.
+func (c *ClientConn) handleFramebufferUpdate(update *FramebufferUpdateMessage) error {
+	c.recordFirstFrame()
+
+	var oldWidth, oldHeight, newWidth, newHeight uint16
+
+	c.fbLock.Lock()
+	fb := c.fb
+	if c.fb != nil {
+		oldWidth, oldHeight = c.fb.Width, c.fb.Height
+		c.fb.Apply(update)
+		newWidth, newHeight = c.fb.Width, c.fb.Height
+	} else if c.tiledFB != nil {
+		oldWidth, oldHeight = c.tiledFB.Width, c.tiledFB.Height
+		c.tiledFB.Apply(update)
+		newWidth, newHeight = c.tiledFB.Width, c.tiledFB.Height
+	}
+	c.fbLock.Unlock()
+
+	if (oldWidth != newWidth || oldHeight != newHeight) && c.config.OnResize != nil {
+		c.config.OnResize(oldWidth, oldHeight, newWidth, newHeight)
+	}
+
+	if len(update.Rectangles) > 0 || !c.config.SkipEmptyUpdates {
+		// Only this goroutine changes the framebuffer, so it can be
+		// read without fbLock until the next update.
+		if fb != nil && c.config.OnFrame != nil {
+			c.config.OnFrame(fb)
 		}
 
-		if c.config.ServerMessageCh == nil {
+		c.sendFrame()
+	}
+
+	c.checkEncodingFallback(update)
+
+	if err := c.requestPreferredResolution(); err != nil {
+		return err
+	}
+
+	c.fbLock.Lock()
+	refresh := c.refreshPending
+	c.refreshPending = false
+	c.fbLock.Unlock()
+
+	if refresh {
+		if err := c.Refresh(); err != nil {
+			return err
+		}
+	}
+
+	if c.autoUpdating() && !c.continuousUpdating() {
+		return c.requestFollowUp(update)
+	}
+
+	return nil
+}
+
+// chooseSecurityType reads the security types offered by the server, and
+// responds with the first of auths that the server supports.
+func (c *ClientConn) chooseSecurityType(auths []ClientAuth) (ClientAuth, error) {
+	var numSecurityTypes uint8
+	if err := binary.Read(c.c, binary.BigEndian, &numSecurityTypes); err != nil {
+		return nil, err
+	}
+
+	if numSecurityTypes == 0 {
+		return nil, fmt.Errorf("no security types: %s", c.readErrorReason())
+	}
+
+	securityTypes := make([]uint8, numSecurityTypes)
+	if err := binary.Read(c.c, binary.BigEndian, &securityTypes); err != nil {
+		return nil, err
+	}
+
+	var auth ClientAuth
+FindAuth:
+	for _, curAuth := range auths {
+		if !c.securityTypeAllowed(curAuth.SecurityType()) {
 			continue
 		}
 
-		c.config.ServerMessageCh <- parsedMsg
+		for _, securityType := range securityTypes {
+			if curAuth.SecurityType() == securityType {
+				// We use the first matching supported authentication
+				auth = curAuth
+				break FindAuth
+			}
+		}
+	}
+
+	if auth == nil && len(c.config.RequiredSecurityTypes) > 0 {
+		return nil, fmt.Errorf("%w: server supported: %v, required: %v",
+			ErrSecurityTypeNotAllowed, securityTypes, c.config.RequiredSecurityTypes)
 	}
+	if auth == nil {
+		return nil, fmt.Errorf("no suitable auth schemes found. server supported: %#v", securityTypes)
+	}
+
+	// Respond back with the security type we'll use
+	if err := binary.Write(c.c, binary.BigEndian, auth.SecurityType()); err != nil {
+		return nil, err
+	}
+
+	return auth, nil
+}
+
+// readSecurityType33 reads the security type chosen by a server using
+// version 3.3 of the protocol, where the client has no say in it, and
+// returns the matching one of auths.
+func (c *ClientConn) readSecurityType33(auths []ClientAuth) (ClientAuth, error) {
+	var securityType uint32
+	if err := binary.Read(c.c, binary.BigEndian, &securityType); err != nil {
+		return nil, err
+	}
+
+	if securityType == 0 {
+		return nil, fmt.Errorf("no security types: %s", c.readErrorReason())
+	}
+
+	if len(c.config.RequiredSecurityTypes) > 0 && (securityType > 0xff || !c.securityTypeAllowed(uint8(securityType))) {
+		return nil, fmt.Errorf("%w: server requires: %d, required: %v",
+			ErrSecurityTypeNotAllowed, securityType, c.config.RequiredSecurityTypes)
+	}
+
+	for _, auth := range auths {
+		if uint32(auth.SecurityType()) == securityType {
+			return auth, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no suitable auth schemes found. server requires: %d", securityType)
+}
+
+// ErrSecurityTypeNotAllowed is returned by Client when the server doesn't
+// offer any of ClientConfig.RequiredSecurityTypes, which may be a sign of
+// a man in the middle downgrading the security of the connection.
+var ErrSecurityTypeNotAllowed = errors.New("security type not allowed")
+
+// securityTypeAllowed reports whether a security type is allowed by
+// ClientConfig.RequiredSecurityTypes.
+func (c *ClientConn) securityTypeAllowed(securityType uint8) bool {
+	if len(c.config.RequiredSecurityTypes) == 0 {
+		return true
+	}
+
+	for _, required := range c.config.RequiredSecurityTypes {
+		if securityType == required {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ErrAuthFailed is returned by Client when the server rejects the
+// authentication, such as for a wrong password.
+var ErrAuthFailed = errors.New("security handshake failed")
+
+// ErrAuthTooManyAttempts is returned by Client when the server rejects
+// the authentication because of too many failed attempts, and may be
+// locking out further attempts for a while. Servers report this either
+// with a SecurityResult of 2, or a failure whose reason says so.
+// Applications should back off before trying again.
+var ErrAuthTooManyAttempts = errors.New("security handshake failed, too many attempts")
+
+// The SecurityResult sent by some servers, such as RealVNC, when there
+// have been too many failed attempts.
+const securityResultTooManyAttempts = 2
+
+// securityResultError returns the error for a failed SecurityResult,
+// reading the reason sent along with it by version 3.8 servers.
+func (c *ClientConn) securityResultError(result uint32, minor uint) error {
+	reason := ""
+	if minor >= 8 {
+		reason = c.readErrorReason()
+	}
+
+	err := ErrAuthFailed
+	if result == securityResultTooManyAttempts || strings.Contains(strings.ToLower(reason), "too many") {
+		err = ErrAuthTooManyAttempts
+	}
+
+	switch {
+	case result != 1 && result != securityResultTooManyAttempts:
+		if reason == "" {
+			return fmt.Errorf("%w (result %d)", err, result)
+		}
+
+		return fmt.Errorf("%w (result %d): %s", err, result, reason)
+	case reason == "":
+		return err
+	}
+
+	return fmt.Errorf("%w: %s", err, reason)
 }
 
 func (c *ClientConn) readErrorReason() string {
@@ -3,6 +3,7 @@ package vnc
 import (
 	"net"
 
+	"crypto/cipher"
 	"crypto/des"
 	"encoding/binary"
 )
@@ -18,6 +19,28 @@ type ClientAuth interface {
 	Handshake(net.Conn) error
 }
 
+// SecurityInfo describes the security negotiated for a connection.
+type SecurityInfo struct {
+	// Type is the security type chosen during the handshake.
+	Type uint8
+
+	// For security types that tunnel another authentication method,
+	// such as VeNCrypt or Tight, Tunnel names the tunnel and SubType is
+	// the sub-authentication used inside of it. They are empty for
+	// other security types.
+	Tunnel  string
+	SubType uint32
+}
+
+// A ClientAuthTunnel is a ClientAuth that negotiates a tunnel and a
+// sub-authentication as part of its handshake. After the handshake,
+// SecurityInfo reports the details of what was negotiated.
+type ClientAuthTunnel interface {
+	ClientAuth
+
+	SecurityInfo() SecurityInfo
+}
+
 // ClientAuthNone is the "none" authentication. See 7.2.1
 type ClientAuthNone byte
 
@@ -32,6 +55,25 @@ func (*ClientAuthNone) Handshake(net.Conn) error {
 // PasswordAuth is VNC authentication, 7.2.2
 type PasswordAuth struct {
 	Password string
+
+	// PasswordFunc, if set, is called for the password in place of
+	// Password, once the server has sent its challenge. This lets the
+	// password come from a prompt, a keychain or a secrets manager,
+	// without being kept in the configuration.
+	PasswordFunc func() (string, error)
+
+	// DisableBitReversal uses the bytes of the password as the DES key
+	// as they are. VNC authentication reverses the bits of each byte of
+	// the key, as the RFB protocol requires, but a few non-standard
+	// servers don't. Only set this for such a server.
+	DisableBitReversal bool
+
+	// DESProvider, if set, creates the DES cipher used to encrypt the
+	// challenge, in place of des.NewCipher from the standard library.
+	// This is for environments such as FIPS mode builds, where the
+	// standard DES implementation may be unavailable or not allowed,
+	// and a compliant module has to be used instead.
+	DESProvider func(key []byte) (cipher.Block, error)
 }
 
 func (p *PasswordAuth) SecurityType() uint8 {
@@ -44,7 +86,15 @@ func (p *PasswordAuth) Handshake(c net.Conn) error {
 		return err
 	}
 
-	crypted, err := p.encrypt(p.Password, randomValue)
+	password := p.Password
+	if p.PasswordFunc != nil {
+		var err error
+		if password, err = p.PasswordFunc(); err != nil {
+			return err
+		}
+	}
+
+	crypted, err := p.encrypt(password, randomValue)
 
 	if (err != nil) {
 		return err
@@ -104,10 +154,24 @@ func (p *PasswordAuth) encrypt(key string, bytes []byte) ([]byte, error) {
 	}
 
 	for i := 0; i < len(key); i++ {
-		keyBytes[i] = p.reverseBits(key[i])
+		if p.DisableBitReversal {
+			keyBytes[i] = key[i]
+		} else {
+			keyBytes[i] = p.reverseBits(key[i])
+		}
+	}
+
+	newCipher := des.NewCipher
+	if p.DESProvider != nil {
+		newCipher = p.DESProvider
 	}
 
-	block, err := des.NewCipher(keyBytes)
+	block, err := newCipher(keyBytes)
+
+	// Don't leave a copy of the key around.
+	for i := range keyBytes {
+		keyBytes[i] = 0
+	}
 
 	if err != nil {
 		return nil, err
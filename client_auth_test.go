@@ -1,10 +1,12 @@
 package vnc
 
 import (
-	"testing"
+	"bytes"
+	"crypto/cipher"
+	"errors"
 	"net"
+	"testing"
 	"time"
-	"bytes"
 )
 
 type fakeNetConnection struct {
@@ -166,4 +168,179 @@ func TestClientAuthPasswordReject_Impl(t *testing.T) {
 	if !conn.Finished {
 		t.Fatal("PasswordAuth didn't complete properly")
 	}
-}
\ No newline at end of file
+}
+
+func TestClientAuthPassword_KnownVectors(t *testing.T) {
+	// The challenge is the only input to the response besides the
+	// password, so a fixed challenge gives a reproducible response. The
+	// expected responses were computed independently with OpenSSL, using
+	// the bit reversed password as the DES key.
+	challenge := []byte{
+		0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+		0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	}
+
+	tests := []struct {
+		password string
+		expected []byte
+	}{
+		{"password", []byte{
+			0xb8, 0x66, 0x92, 0x41, 0x25, 0xc8, 0xee, 0xbb,
+			0x9d, 0xeb, 0xc1, 0xdb, 0x61, 0xc5, 0x38, 0xe2,
+		}},
+		// Only the first 8 characters are used.
+		{"password123", []byte{
+			0xb8, 0x66, 0x92, 0x41, 0x25, 0xc8, 0xee, 0xbb,
+			0x9d, 0xeb, 0xc1, 0xdb, 0x61, 0xc5, 0x38, 0xe2,
+		}},
+		// Short passwords are padded with zeros.
+		{"pw", []byte{
+			0x85, 0x86, 0x00, 0xd9, 0xaf, 0x14, 0x3c, 0x9e,
+			0x65, 0x41, 0xd3, 0xdd, 0x92, 0xa8, 0x35, 0xd0,
+		}},
+	}
+
+	for _, tt := range tests {
+		auth := &PasswordAuth{Password: tt.password}
+		conn := &fakeNetConnection{DataToSend: challenge, ExpectData: tt.expected, Test: t}
+		if err := auth.Handshake(conn); err != nil {
+			t.Fatalf("password %q: %s", tt.password, err)
+		}
+
+		if !conn.Matched {
+			t.Fatalf("password %q: wrong response", tt.password)
+		}
+	}
+}
+
+func TestClientAuthPassword_PasswordFunc(t *testing.T) {
+	challenge := []byte{
+		0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+		0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	}
+	expected := []byte{
+		0xb8, 0x66, 0x92, 0x41, 0x25, 0xc8, 0xee, 0xbb,
+		0x9d, 0xeb, 0xc1, 0xdb, 0x61, 0xc5, 0x38, 0xe2,
+	}
+
+	calls := 0
+	auth := &PasswordAuth{
+		Password: "ignored",
+		PasswordFunc: func() (string, error) {
+			calls++
+			return "password", nil
+		},
+	}
+
+	conn := &fakeNetConnection{DataToSend: challenge, ExpectData: expected, Test: t}
+	if err := auth.Handshake(conn); err != nil {
+		t.Fatalf("error in handshake: %s", err)
+	}
+
+	if calls != 1 {
+		t.Fatalf("PasswordFunc called %d times, want 1", calls)
+	}
+	if !conn.Matched {
+		t.Fatal("wrong response")
+	}
+
+	auth.PasswordFunc = func() (string, error) {
+		return "", errors.New("prompt cancelled")
+	}
+
+	conn = &fakeNetConnection{DataToSend: challenge, Test: t}
+	if err := auth.Handshake(conn); err == nil || err.Error() != "prompt cancelled" {
+		t.Fatalf("err = %v, want the error of PasswordFunc", err)
+	}
+	if conn.Finished {
+		t.Fatal("response sent despite the error")
+	}
+}
+
+func TestClientAuthPassword_DisableBitReversal(t *testing.T) {
+	challenge := []byte{
+		0xa4, 0x51, 0x3f, 0xa5, 0x1f, 0x87, 0x06, 0x10,
+		0xa4, 0x5f, 0xae, 0xbf, 0x4d, 0xac, 0x12, 0x22,
+	}
+
+	tests := []struct {
+		disable  bool
+		expected []byte
+	}{
+		{false, []byte{
+			0x71, 0xe4, 0x41, 0x30, 0x43, 0x65, 0x4e, 0x39,
+			0xda, 0x6d, 0x49, 0x93, 0x43, 0xf6, 0x5e, 0x29,
+		}},
+		{true, []byte{
+			0x44, 0x62, 0xcf, 0x95, 0x14, 0x1f, 0x5c, 0xc9,
+			0x2e, 0x23, 0xd7, 0x2a, 0xaa, 0xcd, 0x9f, 0x66,
+		}},
+	}
+
+	for _, tt := range tests {
+		auth := &PasswordAuth{Password: "Ch_#!T@8", DisableBitReversal: tt.disable}
+
+		conn := &fakeNetConnection{DataToSend: challenge, ExpectData: tt.expected, Test: t}
+		if err := auth.Handshake(conn); err != nil {
+			t.Fatalf("error in handshake: %s", err)
+		}
+		if !conn.Matched {
+			t.Fatalf("DisableBitReversal %v: wrong response", tt.disable)
+		}
+	}
+}
+
+// invertCipher is a cipher.Block that inverts the bits of each block.
+type invertCipher struct{}
+
+func (invertCipher) BlockSize() int { return 8 }
+
+func (invertCipher) Encrypt(dst, src []byte) {
+	for i := 0; i < 8; i++ {
+		dst[i] = ^src[i]
+	}
+}
+
+func (c invertCipher) Decrypt(dst, src []byte) { c.Encrypt(dst, src) }
+
+func TestClientAuthPassword_DESProvider(t *testing.T) {
+	challenge := []byte{
+		0xa4, 0x51, 0x3f, 0xa5, 0x1f, 0x87, 0x06, 0x10,
+		0xa4, 0x5f, 0xae, 0xbf, 0x4d, 0xac, 0x12, 0x22,
+	}
+
+	expected := make([]byte, len(challenge))
+	for i, b := range challenge {
+		expected[i] = ^b
+	}
+
+	var key []byte
+	auth := &PasswordAuth{
+		Password: "ab",
+		DESProvider: func(k []byte) (cipher.Block, error) {
+			key = append([]byte(nil), k...)
+			return invertCipher{}, nil
+		},
+	}
+
+	conn := &fakeNetConnection{DataToSend: challenge, ExpectData: expected, Test: t}
+	if err := auth.Handshake(conn); err != nil {
+		t.Fatalf("error in handshake: %s", err)
+	}
+	if !conn.Matched {
+		t.Fatal("the challenge wasn't encrypted with the injected cipher")
+	}
+
+	// The key is still prepared as VNC authentication requires.
+	if !bytes.Equal(key, []byte{0x86, 0x46, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("DESProvider called with key %v", key)
+	}
+
+	auth.DESProvider = func([]byte) (cipher.Block, error) {
+		return nil, errors.New("DES is not available")
+	}
+	conn = &fakeNetConnection{DataToSend: challenge, Test: t}
+	if err := auth.Handshake(conn); err == nil || err.Error() != "DES is not available" {
+		t.Fatalf("err = %v, want the DESProvider error", err)
+	}
+}
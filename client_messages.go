@@ -0,0 +1,392 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode"
+)
+
+// A ClientMessage implements a message sent from the client to the
+// server. Messages are sent using ClientConn.Send, which passes them
+// through ClientConfig.BeforeSend first.
+type ClientMessage interface {
+	// The type of the message that is sent down on the wire.
+	Type() uint8
+
+	// Serialize writes the whole message, including its type, to the
+	// writer.
+	Serialize(io.Writer) error
+
+	// Deserialize reads the contents of the message from the reader. At
+	// the point this is called, the message type has already been read
+	// from the reader. This should return a new ClientMessage that is the
+	// appropriate type.
+	Deserialize(io.Reader) (ClientMessage, error)
+}
+
+// ReadClientMessage reads a message sent by a client, such as when
+// proxying or recording a connection. Besides the messages implemented
+// by this package, the messages in extra are recognized, and take
+// precedence over the built-in messages of the same type.
+func ReadClientMessage(r io.Reader, extra []ClientMessage) (ClientMessage, error) {
+	var messageType uint8
+	if err := binary.Read(r, binary.BigEndian, &messageType); err != nil {
+		return nil, err
+	}
+
+	for _, msg := range extra {
+		if msg.Type() == messageType {
+			return msg.Deserialize(r)
+		}
+	}
+
+	for _, msg := range builtinClientMessages {
+		if msg.Type() == messageType {
+			return msg.Deserialize(r)
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported client message type: %d", messageType)
+}
+
+// builtinClientMessages are the client messages implemented by this
+// package, used by ReadClientMessage.
+var builtinClientMessages = []ClientMessage{
+	new(SetPixelFormatMessage),
+	new(SetEncodingsMessage),
+	new(FramebufferUpdateRequestMessage),
+	new(KeyEventMessage),
+	new(PointerEventMessage),
+	new(ClientCutTextMessage),
+	new(FenceMessage),
+	new(SetDesktopSizeMessage),
+	new(QEMUAudioClientMessage),
+	new(EnableContinuousUpdatesMessage),
+	new(GIIVersionMessage),
+	new(FileListRequestMessage),
+	new(FileDownloadRequestMessage),
+	new(FileDownloadCancelMessage),
+}
+
+// SetPixelFormatMessage sets the format in which pixel values should be
+// sent in FramebufferUpdate messages from the server.
+//
+// See RFC 6143 Section 7.5.1
+type SetPixelFormatMessage struct {
+	PixelFormat PixelFormat
+}
+
+func (*SetPixelFormatMessage) Type() uint8 {
+	return 0
+}
+
+func (m *SetPixelFormatMessage) Serialize(w io.Writer) error {
+	var data [20]byte
+	data[0] = m.Type()
+
+	pfBytes, err := writePixelFormat(&m.PixelFormat)
+	if err != nil {
+		return err
+	}
+
+	// Copy the pixel format bytes into the proper slice location
+	copy(data[4:], pfBytes)
+
+	_, err = w.Write(data[:])
+	return err
+}
+
+func (*SetPixelFormatMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	var padding [3]byte
+	if _, err := io.ReadFull(r, padding[:]); err != nil {
+		return nil, err
+	}
+
+	var result SetPixelFormatMessage
+	if err := readPixelFormat(r, &result.PixelFormat); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// SetEncodingsMessage sets the encoding types in which the pixel data can
+// be sent from the server.
+//
+// See RFC 6143 Section 7.5.2
+type SetEncodingsMessage struct {
+	Encodings []Encoding
+}
+
+func (*SetEncodingsMessage) Type() uint8 {
+	return 2
+}
+
+func (m *SetEncodingsMessage) Serialize(w io.Writer) error {
+	data := make([]interface{}, 3+len(m.Encodings))
+	data[0] = m.Type()
+	data[1] = uint8(0)
+	data[2] = uint16(len(m.Encodings))
+
+	for i, enc := range m.Encodings {
+		data[3+i] = int32(enc.Type())
+	}
+
+	return writeMessage(w, data)
+}
+
+func (*SetEncodingsMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	var header struct {
+		Padding uint8
+		Count   uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+
+	types := make([]int32, header.Count)
+	if err := binary.Read(r, binary.BigEndian, types); err != nil {
+		return nil, err
+	}
+
+	builtin := make(map[int32]Encoding)
+	for _, enc := range BuiltinEncodings() {
+		builtin[enc.Type()] = enc
+	}
+	builtin[0] = new(RawEncoding)
+	builtin[-224] = new(LastRectPseudoEncoding)
+
+	result := SetEncodingsMessage{Encodings: make([]Encoding, len(types))}
+	for i, encType := range types {
+		enc, ok := builtin[encType]
+		switch {
+		case ok:
+			result.Encodings[i] = enc
+		case encType >= -32 && encType <= -23:
+			result.Encodings[i] = &JPEGQualityPseudoEncoding{Level: uint8(encType + 32)}
+		case encType >= -256 && encType <= -247:
+			result.Encodings[i] = &CompressionLevelPseudoEncoding{Level: uint8(encType + 256)}
+		default:
+			result.Encodings[i] = &UnsupportedEncoding{EncodingType: encType}
+		}
+	}
+
+	return &result, nil
+}
+
+// UnsupportedEncoding stands in for an encoding not implemented by this
+// package, in a SetEncodingsMessage read using ReadClientMessage.
+// Rectangles in the encoding can't be decoded.
+type UnsupportedEncoding struct {
+	EncodingType int32
+}
+
+func (e *UnsupportedEncoding) Type() int32 {
+	return e.EncodingType
+}
+
+func (e *UnsupportedEncoding) Read(*ClientConn, *Rectangle, io.Reader) (Encoding, error) {
+	return nil, fmt.Errorf("unsupported encoding type: %d", e.EncodingType)
+}
+
+// FramebufferUpdateRequestMessage requests a framebuffer update of the
+// given area from the server.
+//
+// See RFC 6143 Section 7.5.3
+type FramebufferUpdateRequestMessage struct {
+	Incremental bool
+	X, Y        uint16
+	Width       uint16
+	Height      uint16
+}
+
+func (*FramebufferUpdateRequestMessage) Type() uint8 {
+	return 3
+}
+
+func (m *FramebufferUpdateRequestMessage) Serialize(w io.Writer) error {
+	var incrementalByte uint8 = 0
+	if m.Incremental {
+		incrementalByte = 1
+	}
+
+	return writeMessage(w, []interface{}{
+		m.Type(),
+		incrementalByte,
+		m.X, m.Y, m.Width, m.Height,
+	})
+}
+
+func (*FramebufferUpdateRequestMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	var incrementalByte uint8
+	if err := binary.Read(r, binary.BigEndian, &incrementalByte); err != nil {
+		return nil, err
+	}
+
+	result := FramebufferUpdateRequestMessage{Incremental: incrementalByte != 0}
+	data := []interface{}{
+		&result.X,
+		&result.Y,
+		&result.Width,
+		&result.Height,
+	}
+
+	for _, val := range data {
+		if err := binary.Read(r, binary.BigEndian, val); err != nil {
+			return nil, err
+		}
+	}
+
+	return &result, nil
+}
+
+// KeyEventMessage indicates a key press or release, using the X Window
+// System "keysym" value of the key.
+//
+// See RFC 6143 Section 7.5.4
+type KeyEventMessage struct {
+	Down   bool
+	Keysym uint32
+}
+
+func (*KeyEventMessage) Type() uint8 {
+	return 4
+}
+
+func (m *KeyEventMessage) Serialize(w io.Writer) error {
+	var downFlag uint8 = 0
+	if m.Down {
+		downFlag = 1
+	}
+
+	return writeMessage(w, []interface{}{
+		m.Type(),
+		downFlag,
+		uint8(0),
+		uint8(0),
+		m.Keysym,
+	})
+}
+
+func (*KeyEventMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	var data struct {
+		DownFlag uint8
+		Padding  [2]uint8
+		Keysym   uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &data); err != nil {
+		return nil, err
+	}
+
+	return &KeyEventMessage{Down: data.DownFlag != 0, Keysym: data.Keysym}, nil
+}
+
+// PointerEventMessage indicates pointer movement or a pointer button
+// press or release. Mask is a bitwise mask of the pressed buttons.
+//
+// See RFC 6143 Section 7.5.5
+type PointerEventMessage struct {
+	Mask ButtonMask
+	X, Y uint16
+}
+
+func (*PointerEventMessage) Type() uint8 {
+	return 5
+}
+
+func (m *PointerEventMessage) Serialize(w io.Writer) error {
+	return writeMessage(w, []interface{}{
+		m.Type(),
+		uint8(m.Mask),
+		m.X,
+		m.Y,
+	})
+}
+
+func (*PointerEventMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	var result PointerEventMessage
+	data := []interface{}{
+		&result.Mask,
+		&result.X,
+		&result.Y,
+	}
+
+	for _, val := range data {
+		if err := binary.Read(r, binary.BigEndian, val); err != nil {
+			return nil, err
+		}
+	}
+
+	return &result, nil
+}
+
+// ClientCutTextMessage tells the server that the client has new text in
+// its cut buffer. The text must only contain Latin-1 characters.
+//
+// See RFC 6143 Section 7.5.6
+type ClientCutTextMessage struct {
+	Text string
+}
+
+func (*ClientCutTextMessage) Type() uint8 {
+	return 6
+}
+
+func (m *ClientCutTextMessage) Serialize(w io.Writer) error {
+	text := make([]byte, 0, len(m.Text))
+	for _, char := range m.Text {
+		if char > unicode.MaxLatin1 {
+			return fmt.Errorf("Character '%c' is not valid Latin-1", char)
+		}
+
+		text = append(text, uint8(char))
+	}
+
+	return writeMessage(w, []interface{}{
+		m.Type(),
+		uint8(0),
+		uint8(0),
+		uint8(0),
+		uint32(len(text)),
+		text,
+	})
+}
+
+func (*ClientCutTextMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	var header struct {
+		Padding [3]uint8
+		Length  uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+
+	text, err := readBytes(r, header.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	// Latin-1 maps directly onto the first 256 code points.
+	runes := make([]rune, len(text))
+	for i, b := range text {
+		runes[i] = rune(b)
+	}
+
+	return &ClientCutTextMessage{Text: string(runes)}, nil
+}
+
+// writeMessage writes the values of a message to w in network byte
+// order, as a single write.
+func writeMessage(w io.Writer, data []interface{}) error {
+	var buf bytes.Buffer
+	for _, val := range data {
+		if err := binary.Write(&buf, binary.BigEndian, val); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,299 @@
+package vnc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestClientConn_BeforeSend(t *testing.T) {
+	const blocked = 0xffeb // Super_L
+
+	conn, server := newTestClientConn(&ClientConfig{
+		BeforeSend: func(msg ClientMessage) (ClientMessage, bool) {
+			switch msg := msg.(type) {
+			case *KeyEventMessage:
+				return msg, msg.Keysym != blocked
+			case *PointerEventMessage:
+				// Swap the left and right buttons.
+				swapped := *msg
+				swapped.Mask = msg.Mask&^(ButtonLeft|ButtonRight) |
+					(msg.Mask&ButtonLeft)<<2 | (msg.Mask&ButtonRight)>>2
+				return &swapped, true
+			}
+
+			return msg, true
+		},
+	})
+	defer server.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		for _, send := range []func() error{
+			func() error { return conn.KeyEvent(blocked, true) },
+			func() error { return conn.KeyEvent('a', true) },
+			func() error { return conn.KeyEvent(blocked, false) },
+			func() error { return conn.PointerEvent(ButtonLeft, 10, 20) },
+		} {
+			if err := send(); err != nil {
+				errCh <- err
+				return
+			}
+		}
+
+		errCh <- conn.Close()
+	}()
+
+	data, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("error reading messages: %s", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("error sending messages: %s", err)
+	}
+
+	expected := []byte{
+		4, 1, 0, 0, 0, 0, 0, 'a', // KeyEvent
+		5, uint8(ButtonRight), 0, 10, 0, 20, // PointerEvent
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("sent %v, want %v", data, expected)
+	}
+}
+
+func TestClientConn_SendChord(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+
+	const chords = 50
+	const pointerEvents = 200
+	chord := []uint32{0xffe3, 0xffe9, 0xffbf} // Ctrl+Alt+F2
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < chords; i++ {
+			conn.SendChord(chord...)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < pointerEvents; i++ {
+			conn.PointerEvent(0, uint16(i), uint16(i))
+		}
+	}()
+	go func() {
+		wg.Wait()
+		conn.Close()
+	}()
+
+	data, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("error reading messages: %s", err)
+	}
+
+	// Each chord must be sent as six consecutive key events.
+	var keys []string
+	var pointers int
+	for len(data) > 0 {
+		switch data[0] {
+		case 4:
+			keys = append(keys, fmt.Sprintf("%d:%x", data[1], binary.BigEndian.Uint32(data[4:8])))
+			data = data[8:]
+		case 5:
+			if len(keys)%6 != 0 {
+				t.Fatalf("pointer event interleaved with chord after %v", keys[len(keys)-len(keys)%6:])
+			}
+			pointers++
+			data = data[6:]
+		default:
+			t.Fatalf("unexpected message type %d", data[0])
+		}
+	}
+
+	if pointers != pointerEvents || len(keys) != 6*chords {
+		t.Fatalf("received %d pointer and %d key events", pointers, len(keys))
+	}
+
+	expected := []string{"1:ffe3", "1:ffe9", "1:ffbf", "0:ffbf", "0:ffe9", "0:ffe3"}
+	for i, key := range keys {
+		if key != expected[i%6] {
+			t.Fatalf("key event %d = %s, want %s", i, key, expected[i%6])
+		}
+	}
+}
+
+func TestReadClientMessage_RoundTrip(t *testing.T) {
+	messages := []ClientMessage{
+		&SetPixelFormatMessage{PixelFormat: testPixelFormat},
+		&SetEncodingsMessage{Encodings: []Encoding{
+			new(TightEncoding),
+			new(RawEncoding),
+			&UnsupportedEncoding{EncodingType: 16},
+		}},
+		&FramebufferUpdateRequestMessage{Incremental: true, X: 1, Y: 2, Width: 300, Height: 400},
+		&KeyEventMessage{Down: true, Keysym: 0xffe1},
+		&PointerEventMessage{Mask: ButtonLeft, X: 10, Y: 20},
+		&ClientCutTextMessage{Text: "caf\u00e9"},
+		&FenceMessage{Flags: FenceRequest | FenceBlockBefore, Payload: []byte("abc")},
+		&SetDesktopSizeMessage{Width: 800, Height: 600, Screens: []Screen{
+			{ID: 1, Width: 800, Height: 600},
+		}},
+		&QEMUAudioClientMessage{Operation: AudioEnable},
+		&QEMUAudioClientMessage{Operation: AudioSetFormat, Format: AudioFormat{
+			SampleFormat: AudioFormatS16, Channels: 2, Frequency: 44100,
+		}},
+		&EnableContinuousUpdatesMessage{Enable: true, X: 1, Y: 2, Width: 300, Height: 400},
+	}
+
+	for _, msg := range messages {
+		var buf bytes.Buffer
+		if err := msg.Serialize(&buf); err != nil {
+			t.Fatalf("error serializing %T: %s", msg, err)
+		}
+		serialized := append([]byte(nil), buf.Bytes()...)
+
+		result, err := ReadClientMessage(&buf, nil)
+		if err != nil {
+			t.Fatalf("error reading %T: %s", msg, err)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("%d bytes of %T left unread", buf.Len(), msg)
+		}
+		if !reflect.DeepEqual(result, msg) {
+			t.Fatalf("read %#v, want %#v", result, msg)
+		}
+
+		buf.Reset()
+		if err := result.Serialize(&buf); err != nil {
+			t.Fatalf("error serializing %T: %s", result, err)
+		}
+		if !bytes.Equal(buf.Bytes(), serialized) {
+			t.Fatalf("%T serialized to %v, then %v", msg, serialized, buf.Bytes())
+		}
+	}
+}
+
+func TestReadClientMessage_Extra(t *testing.T) {
+	data := []byte{4, 1, 0, 0, 0, 0, 0, 'a'}
+
+	msg, err := ReadClientMessage(bytes.NewReader(data[:1]), nil)
+	if err == nil {
+		t.Fatalf("expected error reading a truncated message, got %#v", msg)
+	}
+
+	if _, err := ReadClientMessage(bytes.NewReader([]byte{200}), nil); err == nil {
+		t.Fatal("expected error reading an unknown message type")
+	}
+
+	extra := []ClientMessage{new(recordingKeyEvent)}
+	msg, err = ReadClientMessage(bytes.NewReader(data), extra)
+	if err != nil {
+		t.Fatalf("error reading message: %s", err)
+	}
+	if _, ok := msg.(*recordingKeyEvent); !ok {
+		t.Fatalf("read %T, want the extra message", msg)
+	}
+}
+
+// recordingKeyEvent replaces the built-in KeyEventMessage when reading
+// client messages.
+type recordingKeyEvent struct {
+	KeyEventMessage
+}
+
+func (e *recordingKeyEvent) Deserialize(r io.Reader) (ClientMessage, error) {
+	msg, err := e.KeyEventMessage.Deserialize(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordingKeyEvent{*msg.(*KeyEventMessage)}, nil
+}
+
+// bufferedConn is a connection that buffers its writes until flushed.
+type bufferedConn struct {
+	net.Conn
+	w *bufio.Writer
+}
+
+func (c *bufferedConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *bufferedConn) Flush() error {
+	return c.w.Flush()
+}
+
+func TestClientConn_Flush(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	conn := &ClientConn{
+		c:      &bufferedConn{Conn: client, w: bufio.NewWriter(client)},
+		config: &ClientConfig{},
+	}
+
+	for _, down := range []bool{true, false} {
+		if err := conn.KeyEvent('a', down); err != nil {
+			t.Fatalf("error sending key event: %s", err)
+		}
+	}
+
+	readCh := make(chan []byte, 1)
+	go func() {
+		data := make([]byte, 16)
+		io.ReadFull(server, data)
+		readCh <- data
+	}()
+
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("error flushing: %s", err)
+	}
+
+	expected := []byte{4, 1, 0, 0, 0, 0, 0, 'a', 4, 0, 0, 0, 0, 0, 0, 'a'}
+	if data := <-readCh; !bytes.Equal(data, expected) {
+		t.Fatalf("read %v, want %v", data, expected)
+	}
+}
+
+func TestClientConn_ReleaseAllKeys(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+
+	go func() {
+		for _, keysym := range []uint32{0xffe1, 'a', 0xffe3, 'b'} {
+			conn.KeyEvent(keysym, true)
+		}
+		conn.KeyEvent('b', false)
+		conn.KeyEvent('a', true) // Repeat
+		conn.ReleaseAllKeys()
+		conn.ReleaseAllKeys() // Nothing left to release
+		conn.Close()
+	}()
+
+	data, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("error reading messages: %s", err)
+	}
+
+	var releases []uint32
+	for i := 6 * 8; i < len(data); i += 8 {
+		if data[i] != 4 || data[i+1] != 0 {
+			t.Fatalf("unexpected message: %v", data[i:i+8])
+		}
+		releases = append(releases, binary.BigEndian.Uint32(data[i+4:i+8]))
+	}
+
+	expected := []uint32{0xffe3, 'a', 0xffe1}
+	if fmt.Sprint(releases) != fmt.Sprint(expected) {
+		t.Fatalf("released %x, want %x", releases, expected)
+	}
+}
@@ -1,9 +1,15 @@
 package vnc
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func newMockServer(t *testing.T, version string) string {
@@ -16,13 +22,14 @@ func newMockServer(t *testing.T, version string) string {
 		defer ln.Close()
 		c, err := ln.Accept()
 		if err != nil {
-			t.Fatalf("error accepting conn: %s", err)
+			t.Errorf("error accepting conn: %s", err)
+			return
 		}
 		defer c.Close()
 
 		_, err = c.Write([]byte(fmt.Sprintf("RFB %s\n", version)))
 		if err != nil {
-			t.Fatal("failed writing version")
+			t.Error("failed writing version")
 		}
 	}()
 
@@ -46,7 +53,7 @@ func TestClient_LowMajorVersion(t *testing.T) {
 }
 
 func TestClient_LowMinorVersion(t *testing.T) {
-	nc, err := net.Dial("tcp", newMockServer(t, "003.007"))
+	nc, err := net.Dial("tcp", newMockServer(t, "003.002"))
 	if err != nil {
 		t.Fatalf("error connecting to mock server: %s", err)
 	}
@@ -56,7 +63,7 @@ func TestClient_LowMinorVersion(t *testing.T) {
 		t.Fatal("error expected")
 	}
 
-	if err.Error() != "unsupported minor version, less than 8: 7" {
+	if err.Error() != "unsupported minor version, less than 3: 2" {
 		t.Fatalf("unexpected error: %s", err)
 	}
 }
@@ -93,3 +100,896 @@ func TestParseProtocolVersion(t *testing.T) {
 		}
 	}
 }
+
+// newTestClientConn returns a ClientConn on one end of an in-memory pipe,
+// as if the handshake had already completed, along with the server end of
+// the pipe. The main loop is not started.
+func newTestClientConn(cfg *ClientConfig) (*ClientConn, net.Conn) {
+	client, server := net.Pipe()
+	return &ClientConn{c: client, config: cfg}, server
+}
+
+// testPixelFormat is a 32 bits per pixel, little endian true color format
+// used by tests that decode pixel data.
+var testPixelFormat = PixelFormat{
+	BPP:        32,
+	Depth:      24,
+	TrueColor:  true,
+	RedMax:     255,
+	GreenMax:   255,
+	BlueMax:    255,
+	RedShift:   16,
+	GreenShift: 8,
+	BlueShift:  0,
+}
+
+// rgb returns the color of a pixel in testPixelFormat with the given
+// channel values, scaled to 16 bits.
+func rgb(r, g, b uint8) Color {
+	return Color{R: uint16(r) * 0x101, G: uint16(g) * 0x101, B: uint16(b) * 0x101}
+}
+
+// expectUpdateRequest reads a FramebufferUpdateRequest from the server end
+// of a test connection and fails the test if it doesn't match.
+func expectUpdateRequest(t *testing.T, server net.Conn, incremental bool, x, y, width, height uint16) {
+	var msg [10]byte
+	if _, err := io.ReadFull(server, msg[:]); err != nil {
+		t.Fatalf("error reading update request: %s", err)
+	}
+
+	var incrementalByte byte
+	if incremental {
+		incrementalByte = 1
+	}
+
+	var expected bytes.Buffer
+	expected.Write([]byte{3, incrementalByte})
+	binary.Write(&expected, binary.BigEndian, []uint16{x, y, width, height})
+	if !bytes.Equal(msg[:], expected.Bytes()) {
+		t.Fatalf("update request = %v, want %v", msg, expected.Bytes())
+	}
+}
+
+// writeRawUpdate writes a FramebufferUpdate with a single Raw rectangle
+// of the given color, encoded using testPixelFormat.
+func writeRawUpdate(t *testing.T, server net.Conn, x, y, width, height uint16, color Color) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 1})
+	binary.Write(&buf, binary.BigEndian, []uint16{x, y, width, height})
+	binary.Write(&buf, binary.BigEndian, int32(0))
+
+	pixel := uint32(color.R>>8)<<16 | uint32(color.G>>8)<<8 | uint32(color.B>>8)
+	for i := 0; i < int(width)*int(height); i++ {
+		binary.Write(&buf, binary.LittleEndian, pixel)
+	}
+
+	if _, err := server.Write(buf.Bytes()); err != nil {
+		t.Fatalf("error writing update: %s", err)
+	}
+}
+
+func TestClientConn_Viewport(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{
+		KeepFramebuffer: true,
+		AutoUpdate:      true,
+	})
+	defer server.Close()
+
+	background := rgb(1, 2, 3)
+	conn.FrameBufferWidth = 1920
+	conn.FrameBufferHeight = 1080
+	conn.PixelFormat = testPixelFormat
+	conn.fb = NewFramebuffer(1920, 1080)
+	for i := range conn.fb.Colors {
+		conn.fb.Colors[i] = background
+	}
+
+	go conn.mainLoop()
+	expectUpdateRequest(t, server, false, 0, 0, 1920, 1080)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.SetViewport(100, 300, 200, 200)
+	}()
+	expectUpdateRequest(t, server, false, 100, 300, 200, 200)
+	if err := <-errCh; err != nil {
+		t.Fatalf("error setting viewport: %s", err)
+	}
+
+	updated := rgb(0x10, 0x20, 0x30)
+	writeRawUpdate(t, server, 100, 300, 200, 200, updated)
+	expectUpdateRequest(t, server, true, 100, 300, 200, 200)
+
+	fb := conn.Framebuffer()
+	for y := 0; y < 1080; y++ {
+		for x := 0; x < 1920; x++ {
+			expected := background
+			if x >= 100 && x < 300 && y >= 300 && y < 500 {
+				expected = updated
+			}
+
+			if actual := fb.Colors[y*1920+x]; actual != expected {
+				t.Fatalf("pixel (%d, %d) = %#v, want %#v", x, y, actual, expected)
+			}
+		}
+	}
+}
+
+// serveTestHandshake performs the server side of an RFB 3.8 handshake
+// offering the given security types, and sends a ServerInit for a 640x480
+// frame buffer in testPixelFormat named "test". If auth is not nil, it is
+// called to perform the server side of the chosen security type.
+func serveTestHandshake(server net.Conn, securityTypes []uint8, auth func(net.Conn, uint8) error) error {
+	if err := serveTestSecurity(server, securityTypes, auth); err != nil {
+		return err
+	}
+
+	return writeTestServerInit(server, 4, "test")
+}
+
+// serveTestSecurity performs the server side of the handshake up to, and
+// including, reading the shared flag.
+func serveTestSecurity(server net.Conn, securityTypes []uint8, auth func(net.Conn, uint8) error) error {
+	if _, err := server.Write([]byte("RFB 003.008\n")); err != nil {
+		return err
+	}
+
+	var version [12]byte
+	if _, err := io.ReadFull(server, version[:]); err != nil {
+		return err
+	}
+
+	server.Write([]byte{uint8(len(securityTypes))})
+	server.Write(securityTypes)
+
+	var securityType [1]byte
+	if _, err := io.ReadFull(server, securityType[:]); err != nil {
+		return err
+	}
+
+	if auth != nil {
+		if err := auth(server, securityType[0]); err != nil {
+			return err
+		}
+	}
+
+	// SecurityResult OK
+	server.Write([]byte{0, 0, 0, 0})
+
+	var sharedFlag [1]byte
+	_, err := io.ReadFull(server, sharedFlag[:])
+	return err
+}
+
+// writeTestServerInit writes a 640x480 ServerInit with the given desktop
+// name, announced as being nameLength bytes long.
+func writeTestServerInit(server net.Conn, nameLength uint32, name string) error {
+	pfBytes, err := writePixelFormat(&testPixelFormat)
+	if err != nil {
+		return err
+	}
+
+	var serverInit bytes.Buffer
+	binary.Write(&serverInit, binary.BigEndian, []uint16{640, 480})
+	serverInit.Write(pfBytes)
+	binary.Write(&serverInit, binary.BigEndian, nameLength)
+	serverInit.WriteString(name)
+	_, err = server.Write(serverInit.Bytes())
+	return err
+}
+
+func TestClientConn_Refresh(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+
+	// The whole frame buffer is requested, even with a viewport set.
+	conn.FrameBufferWidth = 1280
+	conn.FrameBufferHeight = 720
+	conn.viewport = Rectangle{X: 10, Y: 10, Width: 100, Height: 100}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.Refresh()
+	}()
+	expectUpdateRequest(t, server, false, 0, 0, 1280, 720)
+	if err := <-errCh; err != nil {
+		t.Fatalf("error refreshing: %s", err)
+	}
+}
+
+func TestClient_SharedFlag(t *testing.T) {
+	for _, exclusive := range []bool{false, true} {
+		client, server := net.Pipe()
+
+		flagCh := make(chan byte, 1)
+		go func() {
+			defer close(flagCh)
+
+			server.Write([]byte("RFB 003.008\n"))
+			io.ReadFull(server, make([]byte, 12))
+			server.Write([]byte{1, 1})
+			io.ReadFull(server, make([]byte, 1))
+			server.Write([]byte{0, 0, 0, 0})
+
+			var sharedFlag [1]byte
+			if _, err := io.ReadFull(server, sharedFlag[:]); err != nil {
+				return
+			}
+			flagCh <- sharedFlag[0]
+
+			writeTestServerInit(server, 4, "test")
+		}()
+
+		conn, err := Client(client, &ClientConfig{Exclusive: exclusive})
+		if err != nil {
+			t.Fatalf("error connecting: %s", err)
+		}
+
+		expected := byte(1)
+		if exclusive {
+			expected = 0
+		}
+		if flag := <-flagCh; flag != expected {
+			t.Fatalf("Exclusive %v: shared flag = %d, want %d", exclusive, flag, expected)
+		}
+
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestClient_SecurityType(t *testing.T) {
+	tests := []struct {
+		offered  []uint8
+		auth     []ClientAuth
+		expected uint8
+	}{
+		{[]uint8{1}, nil, 1},
+		{[]uint8{1, 2}, []ClientAuth{&PasswordAuth{Password: "secret"}}, 2},
+	}
+
+	for _, tt := range tests {
+		client, server := net.Pipe()
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- serveTestHandshake(server, tt.offered, func(c net.Conn, securityType uint8) error {
+				if securityType != 2 {
+					return nil
+				}
+
+				// VNC authentication challenge and response
+				c.Write(make([]byte, 16))
+				_, err := io.ReadFull(c, make([]byte, 16))
+				return err
+			})
+		}()
+
+		conn, err := Client(client, &ClientConfig{Auth: tt.auth})
+		if err != nil {
+			t.Fatalf("error connecting: %s", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("error in mock server: %s", err)
+		}
+
+		if conn.SecurityType != tt.expected {
+			t.Errorf("SecurityType = %d, want %d", conn.SecurityType, tt.expected)
+		}
+		if conn.Security.Type != tt.expected {
+			t.Errorf("Security.Type = %d, want %d", conn.Security.Type, tt.expected)
+		}
+
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestClient_SecurityResultFailure(t *testing.T) {
+	tests := []struct {
+		result   uint32
+		reason   string
+		expected error
+		message  string
+	}{
+		{1, "bad password", ErrAuthFailed, "security handshake failed: bad password"},
+		{1, "Too many security failures", ErrAuthTooManyAttempts, "too many attempts: Too many security failures"},
+		{2, "account locked", ErrAuthTooManyAttempts, "too many attempts: account locked"},
+		{3, "", ErrAuthFailed, "security handshake failed (result 3)"},
+	}
+
+	for _, tt := range tests {
+		client, server := net.Pipe()
+
+		go func() {
+			serveTestSecurity(server, []uint8{1}, func(c net.Conn, securityType uint8) error {
+				var failure bytes.Buffer
+				binary.Write(&failure, binary.BigEndian, tt.result)
+				binary.Write(&failure, binary.BigEndian, uint32(len(tt.reason)))
+				failure.WriteString(tt.reason)
+				c.Write(failure.Bytes())
+				return errors.New("failed")
+			})
+		}()
+
+		_, err := Client(client, &ClientConfig{})
+		if !errors.Is(err, tt.expected) {
+			t.Fatalf("result %d: err = %v, want %v", tt.result, err, tt.expected)
+		}
+		if !strings.Contains(err.Error(), tt.message) {
+			t.Fatalf("result %d: error %q doesn't contain %q", tt.result, err, tt.message)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestClient_HandshakeClosed(t *testing.T) {
+	tests := []struct {
+		phase HandshakePhase
+		serve func(net.Conn)
+	}{
+		{HandshakeVersion, func(net.Conn) {}},
+		{HandshakeSecurity, func(server net.Conn) {
+			server.Write([]byte("RFB 003.008\n"))
+			io.ReadFull(server, make([]byte, 12))
+		}},
+		{HandshakeSecurity, func(server net.Conn) {
+			server.Write([]byte("RFB 003.008\n"))
+			io.ReadFull(server, make([]byte, 12))
+			server.Write([]byte{1, 1})
+			io.ReadFull(server, make([]byte, 1))
+		}},
+		{HandshakeInit, func(server net.Conn) {
+			server.Write([]byte("RFB 003.008\n"))
+			io.ReadFull(server, make([]byte, 12))
+			server.Write([]byte{1, 1})
+			io.ReadFull(server, make([]byte, 1))
+			server.Write([]byte{0, 0, 0, 0})
+			io.ReadFull(server, make([]byte, 1))
+			server.Write([]byte{0, 4})
+		}},
+	}
+
+	for i, tt := range tests {
+		client, server := net.Pipe()
+
+		go func() {
+			tt.serve(server)
+			server.Close()
+		}()
+
+		_, err := Client(client, &ClientConfig{})
+		var closedErr *HandshakeClosedError
+		if !errors.As(err, &closedErr) {
+			t.Fatalf("%d: err = %v, want a HandshakeClosedError", i, err)
+		}
+		if closedErr.Phase != tt.phase {
+			t.Fatalf("%d: closed during the %s phase, want %s", i, closedErr.Phase, tt.phase)
+		}
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("%d: err = %v doesn't wrap the EOF", i, err)
+		}
+		if expected := fmt.Sprintf("during the %s handshake", tt.phase); !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%d: error %q doesn't contain %q", i, err, expected)
+		}
+
+		client.Close()
+	}
+}
+
+func TestClientConn_PauseResume(t *testing.T) {
+	msgCh := make(chan ServerMessage, 2)
+	conn, server := newTestClientConn(&ClientConfig{
+		AutoUpdate:      true,
+		ServerMessageCh: msgCh,
+	})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 640
+	conn.FrameBufferHeight = 480
+	conn.PixelFormat = testPixelFormat
+
+	go conn.mainLoop()
+	expectUpdateRequest(t, server, false, 0, 0, 640, 480)
+
+	conn.Pause()
+
+	// An empty update followed by a bell. Neither may trigger a request.
+	server.Write([]byte{0, 0, 0, 0, 2})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-msgCh:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for message while paused")
+		}
+	}
+
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := server.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("unexpected data while paused (%d bytes)", n)
+	}
+	server.SetReadDeadline(time.Time{})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.Resume()
+	}()
+	expectUpdateRequest(t, server, false, 0, 0, 640, 480)
+	if err := <-errCh; err != nil {
+		t.Fatalf("error resuming: %s", err)
+	}
+}
+
+func TestClientConfig_UpdateStrategy(t *testing.T) {
+	viewport := Rectangle{X: 100, Y: 100, Width: 200, Height: 200}
+	full := Rectangle{Width: 640, Height: 480}
+	changed := Rectangle{X: 150, Y: 150, Width: 10, Height: 10}
+
+	tests := []struct {
+		strategy  UpdateStrategy
+		first     Rectangle
+		followUps []Rectangle
+	}{
+		{UpdateStrategyViewport, viewport, []Rectangle{viewport}},
+		{UpdateStrategyFullScreen, full, []Rectangle{full}},
+		{UpdateStrategyDirtyFollowUp, viewport, []Rectangle{changed, viewport}},
+	}
+
+	for _, tt := range tests {
+		conn, server := newTestClientConn(&ClientConfig{
+			AutoUpdate:     true,
+			UpdateStrategy: tt.strategy,
+		})
+
+		conn.FrameBufferWidth = 640
+		conn.FrameBufferHeight = 480
+		conn.PixelFormat = testPixelFormat
+		conn.viewport = viewport
+
+		go conn.mainLoop()
+		expectUpdateRequest(t, server, false, tt.first.X, tt.first.Y, tt.first.Width, tt.first.Height)
+
+		writeRawUpdate(t, server, changed.X, changed.Y, changed.Width, changed.Height, rgb(1, 2, 3))
+		for _, r := range tt.followUps {
+			expectUpdateRequest(t, server, true, r.X, r.Y, r.Width, r.Height)
+		}
+
+		server.Close()
+	}
+}
+
+func TestClientConn_Err(t *testing.T) {
+	disconnected := make(chan struct{})
+	conn, server := newTestClientConn(&ClientConfig{
+		OnDisconnected: func(error) { close(disconnected) },
+	})
+
+	if err := conn.Err(); err != nil {
+		t.Fatalf("Err = %v on a new connection", err)
+	}
+
+	go conn.mainLoop()
+	server.Close()
+	<-disconnected
+
+	if err := conn.Err(); err != io.EOF {
+		t.Fatalf("Err = %v after the server closed the connection, want %v", err, io.EOF)
+	}
+
+	conn, server = newTestClientConn(&ClientConfig{})
+	defer server.Close()
+
+	conn.Close()
+	if err := conn.Err(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Err = %v after Close, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestClientConn_EmptyUpdate(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		msgCh := make(chan ServerMessage, 2)
+		conn, server := newTestClientConn(&ClientConfig{
+			AutoUpdate:       true,
+			ServerMessageCh:  msgCh,
+			SkipEmptyUpdates: skip,
+		})
+
+		conn.FrameBufferWidth = 640
+		conn.FrameBufferHeight = 480
+		conn.PixelFormat = testPixelFormat
+
+		go conn.mainLoop()
+		expectUpdateRequest(t, server, false, 0, 0, 640, 480)
+
+		// An update without rectangles is answered with the next request,
+		// and the loop goes on to read the bell after it.
+		server.Write([]byte{0, 0, 0, 0})
+		expectUpdateRequest(t, server, true, 0, 0, 640, 480)
+		server.Write([]byte{2})
+
+		var received []ServerMessage
+		for len(received) == 0 || received[len(received)-1].Type() != 2 {
+			select {
+			case msg := <-msgCh:
+				received = append(received, msg)
+			case <-time.After(time.Second):
+				t.Fatalf("SkipEmptyUpdates %v: timeout waiting for the bell", skip)
+			}
+		}
+
+		if skip && len(received) != 1 {
+			t.Fatalf("received %d messages, want only the bell", len(received))
+		}
+		if !skip {
+			update, ok := received[0].(*FramebufferUpdateMessage)
+			if !ok || len(received) != 2 || update.NumRectangles() != 0 {
+				t.Fatalf("received %v, want an empty update and the bell", received)
+			}
+		}
+
+		server.Close()
+	}
+}
+
+func TestClient_DesktopNameTooLong(t *testing.T) {
+	nc, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		if err := serveTestSecurity(server, []uint8{1}, nil); err != nil {
+			return
+		}
+
+		writeTestServerInit(server, 1<<30, "")
+	}()
+
+	_, err := Client(nc, &ClientConfig{MaxDesktopNameLength: 1024})
+	if err == nil {
+		t.Fatal("expected error for oversized desktop name")
+	}
+	if !strings.Contains(err.Error(), "desktop name") {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestClientConn_ClientName(t *testing.T) {
+	var logged []string
+	conn := &ClientConn{config: &ClientConfig{
+		ClientName: "kiosk-1",
+		Logf: func(format string, v ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, v...))
+		},
+	}}
+
+	if name := conn.ClientName(); name != "kiosk-1" {
+		t.Fatalf("ClientName = %q", name)
+	}
+
+	conn.logf("something happened: %d", 42)
+	if len(logged) != 1 || logged[0] != "vnc: kiosk-1: something happened: 42" {
+		t.Fatalf("logged %q", logged)
+	}
+}
+
+func TestClient_RequiredSecurityTypes(t *testing.T) {
+	for _, version := range []string{"RFB 003.008\n", "RFB 003.003\n"} {
+		client, server := net.Pipe()
+
+		go func() {
+			server.Write([]byte(version))
+			io.ReadFull(server, make([]byte, 12))
+
+			// The server only offers None, as if a man in the middle had
+			// removed VeNCrypt from the list.
+			if version == "RFB 003.003\n" {
+				binary.Write(server, binary.BigEndian, uint32(1))
+			} else {
+				server.Write([]byte{1, 1})
+			}
+		}()
+
+		_, err := Client(client, &ClientConfig{
+			Auth:                  []ClientAuth{&VeNCryptAuth{}, new(ClientAuthNone)},
+			RequiredSecurityTypes: []uint8{19},
+		})
+		if !errors.Is(err, ErrSecurityTypeNotAllowed) {
+			t.Fatalf("%q: err = %v, want %v", version, err, ErrSecurityTypeNotAllowed)
+		}
+
+		client.Close()
+		server.Close()
+	}
+
+	// A required type offered by the server is used.
+	client, server := net.Pipe()
+	defer server.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serveTestHandshake(server, []uint8{2, 1}, nil)
+	}()
+
+	conn, err := Client(client, &ClientConfig{
+		Auth:                  []ClientAuth{&PasswordAuth{Password: "secret"}, new(ClientAuthNone)},
+		RequiredSecurityTypes: []uint8{1},
+	})
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer conn.Close()
+	if err := <-errCh; err != nil {
+		t.Fatalf("error in mock server: %s", err)
+	}
+	if conn.SecurityType != 1 {
+		t.Fatalf("security type %d, want 1", conn.SecurityType)
+	}
+}
+
+func TestClient_Version33Failure(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		server.Write([]byte("RFB 003.003\n"))
+		io.ReadFull(server, make([]byte, 12))
+
+		// The server picks the security type, here 0 for failure,
+		// followed by the reason.
+		reason := "too many connections"
+		binary.Write(server, binary.BigEndian, []uint32{0, uint32(len(reason))})
+		server.Write([]byte(reason))
+	}()
+
+	_, err := Client(client, &ClientConfig{})
+	if err == nil {
+		t.Fatal("error expected")
+	}
+
+	if err.Error() != "no security types: too many connections" {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestClient_OldVersions(t *testing.T) {
+	for _, version := range []string{"003.003", "003.005", "003.007"} {
+		client, server := net.Pipe()
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- func() error {
+				server.Write([]byte("RFB " + version + "\n"))
+
+				var response [12]byte
+				if _, err := io.ReadFull(server, response[:]); err != nil {
+					return err
+				}
+
+				expected := "RFB 003.003\n"
+				if version == "003.007" {
+					expected = "RFB 003.007\n"
+				}
+				if string(response[:]) != expected {
+					return fmt.Errorf("client responded with %q, want %q", response, expected)
+				}
+
+				if version == "003.007" {
+					server.Write([]byte{1, 1})
+					if _, err := io.ReadFull(server, make([]byte, 1)); err != nil {
+						return err
+					}
+				} else {
+					binary.Write(server, binary.BigEndian, uint32(1))
+				}
+
+				// No SecurityResult is sent for the None security type.
+				if _, err := io.ReadFull(server, make([]byte, 1)); err != nil {
+					return err
+				}
+
+				return writeTestServerInit(server, 4, "test")
+			}()
+		}()
+
+		conn, err := Client(client, &ClientConfig{})
+		if err != nil {
+			t.Fatalf("%s: error connecting: %s", version, err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("%s: error in mock server: %s", version, err)
+		}
+
+		if conn.SecurityType != 1 || conn.DesktopName != "test" {
+			t.Fatalf("%s: SecurityType = %d, DesktopName = %q", version, conn.SecurityType, conn.DesktopName)
+		}
+
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestClient_MaxProtocolVersion(t *testing.T) {
+	tests := []struct {
+		max      string
+		expected string
+	}{
+		{"RFB 003.003", "RFB 003.003\n"},
+		{"RFB 003.007\n", "RFB 003.007\n"},
+		{"RFB 004.000", "RFB 003.008\n"},
+	}
+
+	for _, tt := range tests {
+		client, server := net.Pipe()
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- func() error {
+				server.Write([]byte("RFB 003.008\n"))
+
+				var response [12]byte
+				if _, err := io.ReadFull(server, response[:]); err != nil {
+					return err
+				}
+				if string(response[:]) != tt.expected {
+					return fmt.Errorf("client responded with %q, want %q", response, tt.expected)
+				}
+
+				if tt.expected == "RFB 003.003\n" {
+					binary.Write(server, binary.BigEndian, uint32(1))
+				} else {
+					server.Write([]byte{1, 1})
+					if _, err := io.ReadFull(server, make([]byte, 1)); err != nil {
+						return err
+					}
+				}
+
+				if tt.expected == "RFB 003.008\n" {
+					server.Write([]byte{0, 0, 0, 0})
+				}
+
+				if _, err := io.ReadFull(server, make([]byte, 1)); err != nil {
+					return err
+				}
+
+				return writeTestServerInit(server, 4, "test")
+			}()
+		}()
+
+		conn, err := Client(client, &ClientConfig{MaxProtocolVersion: tt.max})
+		if err != nil {
+			t.Fatalf("%s: error connecting: %s", tt.max, err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("%s: error in mock server: %s", tt.max, err)
+		}
+
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestClient_MaxProtocolVersionInvalid(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go server.Write([]byte("RFB 003.008\n"))
+
+	_, err := Client(client, &ClientConfig{MaxProtocolVersion: "3.3"})
+	if err == nil || !strings.Contains(err.Error(), "invalid MaxProtocolVersion") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClient_LifecycleCallbacks(t *testing.T) {
+	for _, serverCloses := range []bool{false, true} {
+		client, server := net.Pipe()
+
+		events := make(chan string, 10)
+		cfg := &ClientConfig{
+			OnAuthenticated: func(info SecurityInfo) {
+				events <- fmt.Sprintf("authenticated %d", info.Type)
+			},
+			OnConnected: func(info ServerInfo) {
+				events <- fmt.Sprintf("connected %s %s %dx%d",
+					info.ProtocolVersion, info.DesktopName, info.FrameBufferWidth, info.FrameBufferHeight)
+			},
+			OnDisconnected: func(err error) {
+				events <- fmt.Sprintf("disconnected %v", err)
+			},
+		}
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- serveTestHandshake(server, []uint8{1}, nil)
+		}()
+
+		conn, err := Client(client, cfg)
+		if err != nil {
+			t.Fatalf("error connecting: %s", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("error in mock server: %s", err)
+		}
+
+		expected := []string{
+			"authenticated 1",
+			"connected RFB 003.008 test 640x480",
+			"disconnected <nil>",
+		}
+		if serverCloses {
+			server.Close()
+			expected[2] = "disconnected EOF"
+		} else {
+			conn.Close()
+		}
+
+		for _, e := range expected {
+			select {
+			case event := <-events:
+				if event != e {
+					t.Fatalf("event = %q, want %q", event, e)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timeout waiting for %q", e)
+			}
+		}
+
+		// Closing the connection again doesn't report it a second time.
+		conn.Close()
+		select {
+		case event := <-events:
+			t.Fatalf("unexpected event: %q", event)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		server.Close()
+	}
+}
+
+func TestClient_UpdateStallTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	stalled := make(chan struct{}, 1)
+	disconnected := make(chan error, 1)
+	cfg := &ClientConfig{
+		UpdateStallTimeout: 20 * time.Millisecond,
+		OnStall:            func() { stalled <- struct{}{} },
+		CloseOnStall:       true,
+		OnDisconnected:     func(err error) { disconnected <- err },
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serveTestHandshake(server, []uint8{1}, nil)
+	}()
+
+	conn, err := Client(client, cfg)
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer conn.Close()
+	if err := <-errCh; err != nil {
+		t.Fatalf("error in mock server: %s", err)
+	}
+
+	// The server reads the request, but never sends an update.
+	go conn.FramebufferUpdateRequest(false, 0, 0, 640, 480)
+	expectUpdateRequest(t, server, false, 0, 0, 640, 480)
+
+	select {
+	case <-stalled:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for OnStall")
+	}
+
+	select {
+	case err := <-disconnected:
+		if err != ErrUpdateStalled {
+			t.Fatalf("disconnected with %v, want ErrUpdateStalled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for OnDisconnected")
+	}
+}
@@ -0,0 +1,172 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ExtendedClipboardPseudoEncoding declares that the client supports the
+// extended clipboard protocol, which allows the clipboard to carry other
+// formats than Latin-1 text. Servers supporting it announce their
+// capabilities with a Caps message, which is made available by
+// ClientConn.ClipboardCaps.
+type ExtendedClipboardPseudoEncoding struct{}
+
+func (*ExtendedClipboardPseudoEncoding) Type() int32 {
+	return -1063131698 // 0xC0A1E5CE
+}
+
+func (*ExtendedClipboardPseudoEncoding) Read(*ClientConn, *Rectangle, io.Reader) (Encoding, error) {
+	return &ExtendedClipboardPseudoEncoding{}, nil
+}
+
+// ClipboardFormat is a bit mask of clipboard formats, as used by the
+// extended clipboard protocol.
+type ClipboardFormat uint32
+
+// All clipboard formats of the extended clipboard protocol.
+const (
+	ClipboardText ClipboardFormat = 1 << iota
+	ClipboardRTF
+	ClipboardHTML
+	ClipboardDIB
+	ClipboardFiles
+)
+
+// Actions of the extended clipboard protocol, sent in the high bits of
+// the flags of each ExtendedClipboardMessage.
+const (
+	ClipboardActionCaps    uint32 = 1 << 24
+	ClipboardActionRequest uint32 = 1 << 25
+	ClipboardActionPeek    uint32 = 1 << 26
+	ClipboardActionNotify  uint32 = 1 << 27
+	ClipboardActionProvide uint32 = 1 << 28
+)
+
+// ClipboardCaps are the extended clipboard capabilities of a server.
+type ClipboardCaps struct {
+	// Formats supported by the server.
+	Formats ClipboardFormat
+
+	// The largest amount of data, in bytes, for each of the supported
+	// formats that the server accepts without explicitly requesting it.
+	MaxUnsolicitedSize map[ClipboardFormat]uint32
+}
+
+// Supports reports whether the server supports a clipboard format.
+func (caps *ClipboardCaps) Supports(format ClipboardFormat) bool {
+	return caps.Formats&format == format
+}
+
+// ExtendedClipboardMessage is a ServerCutText message using the extended
+// clipboard protocol. Flags contains the clipboard formats and action of
+// the message, and Data the remainder of the message.
+type ExtendedClipboardMessage struct {
+	Flags uint32
+	Data  []byte
+}
+
+func (*ExtendedClipboardMessage) Type() uint8 {
+	return 3
+}
+
+func (*ExtendedClipboardMessage) Read(c *ClientConn, r io.Reader) (ServerMessage, error) {
+	return new(ServerCutTextMessage).Read(c, r)
+}
+
+// readExtendedClipboard reads the payload of an extended clipboard
+// message, updating the clipboard capabilities of the connection when
+// the message is a Caps message.
+func readExtendedClipboard(c *ClientConn, r io.Reader, length uint32) (ServerMessage, error) {
+	if length < 4 {
+		return nil, fmt.Errorf("extended clipboard message too short: %d", length)
+	}
+
+	var result ExtendedClipboardMessage
+	if err := binary.Read(r, binary.BigEndian, &result.Flags); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if result.Data, err = readBytes(r, length-4); err != nil {
+		return nil, err
+	}
+
+	if result.Flags&ClipboardActionCaps != 0 {
+		caps, err := parseClipboardCaps(result.Flags, result.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		c.clipboardLock.Lock()
+		c.clipboardCaps = caps
+		c.clipboardLock.Unlock()
+	}
+
+	return &result, nil
+}
+
+// parseClipboardCaps parses the maximum unsolicited sizes that follow the
+// flags of a Caps message, one for each format set in the flags.
+func parseClipboardCaps(flags uint32, data []byte) (*ClipboardCaps, error) {
+	caps := &ClipboardCaps{
+		Formats:            ClipboardFormat(flags & 0xFFFF),
+		MaxUnsolicitedSize: make(map[ClipboardFormat]uint32),
+	}
+
+	r := bytes.NewReader(data)
+	for bit := uint(0); bit < 16; bit++ {
+		format := ClipboardFormat(1 << bit)
+		if !caps.Supports(format) {
+			continue
+		}
+
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, fmt.Errorf("extended clipboard caps too short: %s", err)
+		}
+
+		caps.MaxUnsolicitedSize[format] = size
+	}
+
+	return caps, nil
+}
+
+// ClipboardCaps returns the extended clipboard capabilities of the
+// server, or nil if the server hasn't announced any. They are only
+// announced once the ExtendedClipboardPseudoEncoding has been sent using
+// SetEncodings. The capabilities returned must not be modified.
+func (c *ClientConn) ClipboardCaps() *ClipboardCaps {
+	c.clipboardLock.Lock()
+	defer c.clipboardLock.Unlock()
+
+	return c.clipboardCaps
+}
+
+// SetClipboard sends text to the server with CutText, unless it is the
+// same as the clipboard text last sent, or last received from the server
+// with ServerCutText. This keeps viewers that mirror the clipboard in
+// both directions from sending text back to the server that just sent it,
+// which would otherwise loop. Call CutText to send text regardless.
+func (c *ClientConn) SetClipboard(text string) error {
+	c.clipboardLock.Lock()
+	unchanged := c.clipboardKnown && text == c.clipboardText
+	c.clipboardLock.Unlock()
+
+	if unchanged {
+		return nil
+	}
+
+	return c.CutText(text)
+}
+
+// clipboardChanged records the clipboard text last sent or received.
+func (c *ClientConn) clipboardChanged(text string) {
+	c.clipboardLock.Lock()
+	defer c.clipboardLock.Unlock()
+
+	c.clipboardText = text
+	c.clipboardKnown = true
+}
@@ -0,0 +1,157 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerCutTextMessage_ClipboardCaps(t *testing.T) {
+	data := []byte{
+		0, 0, 0, // Padding
+		0xff, 0xff, 0xff, 0xf4, // Length -12
+		0x01, 0x00, 0x00, 0x05, // Caps, text and HTML
+		0x00, 0x00, 0x10, 0x00, // Text max size
+		0x00, 0x00, 0x20, 0x00, // HTML max size
+		2, // The next message
+	}
+
+	conn := &ClientConn{}
+	r := bytes.NewReader(data)
+	msg, err := new(ServerCutTextMessage).Read(conn, r)
+	if err != nil {
+		t.Fatalf("error reading message: %s", err)
+	}
+
+	if _, ok := msg.(*ExtendedClipboardMessage); !ok {
+		t.Fatalf("unexpected message: %#v", msg)
+	}
+	if r.Len() != 1 {
+		t.Fatalf("message left %d bytes unread, want 1", r.Len())
+	}
+
+	caps := conn.ClipboardCaps()
+	if caps == nil {
+		t.Fatal("ClipboardCaps not set")
+	}
+	if !caps.Supports(ClipboardText) || !caps.Supports(ClipboardHTML) {
+		t.Fatalf("caps don't include text and HTML: %#v", caps)
+	}
+	if caps.Supports(ClipboardRTF) {
+		t.Fatalf("caps unexpectedly include RTF: %#v", caps)
+	}
+	if size := caps.MaxUnsolicitedSize[ClipboardText]; size != 0x1000 {
+		t.Fatalf("text max size = %d, want %d", size, 0x1000)
+	}
+	if size := caps.MaxUnsolicitedSize[ClipboardHTML]; size != 0x2000 {
+		t.Fatalf("HTML max size = %d, want %d", size, 0x2000)
+	}
+
+	if err := conn.CutText(string(make([]byte, 0x1001))); err == nil {
+		t.Fatal("expected error for cut text exceeding the maximum size")
+	}
+}
+
+func TestClientConfig_CutTextAsTitle(t *testing.T) {
+	msgCh := make(chan ServerMessage, 2)
+	conn, server := newTestClientConn(&ClientConfig{
+		ServerMessageCh: msgCh,
+		CutTextAsTitle: func(text string) (string, bool) {
+			return strings.CutPrefix(text, "\x00title:")
+		},
+	})
+	defer server.Close()
+
+	go conn.mainLoop()
+
+	for _, text := range []string{"\x00title:My Desktop", "clipboard"} {
+		msg := []byte{3, 0, 0, 0}
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(text)))
+		server.Write(append(msg, text...))
+	}
+
+	// Only the cut text that isn't a title is passed on.
+	select {
+	case msg := <-msgCh:
+		if text := msg.(*ServerCutTextMessage).Text; text != "clipboard" {
+			t.Fatalf("cut text = %q, want %q", text, "clipboard")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for cut text")
+	}
+
+	if conn.DesktopName != "My Desktop" {
+		t.Fatalf("DesktopName = %q, want %q", conn.DesktopName, "My Desktop")
+	}
+}
+
+func TestClientConn_SetClipboard(t *testing.T) {
+	msgCh := make(chan ServerMessage, 1)
+	conn, server := newTestClientConn(&ClientConfig{ServerMessageCh: msgCh})
+	defer server.Close()
+
+	go conn.mainLoop()
+
+	sent := make(chan ClientMessage, 4)
+	go func() {
+		for {
+			msg, err := ReadClientMessage(server, nil)
+			if err != nil {
+				close(sent)
+				return
+			}
+			sent <- msg
+		}
+	}()
+
+	expectSent := func(expected string) {
+		select {
+		case msg := <-sent:
+			if text := msg.(*ClientCutTextMessage).Text; text != expected {
+				t.Fatalf("sent %q, want %q", text, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q not sent", expected)
+		}
+	}
+	expectNothing := func() {
+		select {
+		case msg := <-sent:
+			t.Fatalf("unexpected %#v", msg)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// Repeating the same text only sends it once.
+	for i := 0; i < 2; i++ {
+		if err := conn.SetClipboard("local"); err != nil {
+			t.Fatalf("error setting clipboard: %s", err)
+		}
+	}
+	expectSent("local")
+	expectNothing()
+
+	// Text received from the server isn't echoed back.
+	text := "remote"
+	msg := binary.BigEndian.AppendUint32([]byte{3, 0, 0, 0}, uint32(len(text)))
+	server.Write(append(msg, text...))
+	<-msgCh
+
+	if err := conn.SetClipboard("remote"); err != nil {
+		t.Fatalf("error setting clipboard: %s", err)
+	}
+	expectNothing()
+
+	// CutText always sends.
+	if err := conn.CutText("remote"); err != nil {
+		t.Fatalf("error sending cut text: %s", err)
+	}
+	expectSent("remote")
+
+	if err := conn.SetClipboard("local"); err != nil {
+		t.Fatalf("error setting clipboard: %s", err)
+	}
+	expectSent("local")
+}
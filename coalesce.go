@@ -0,0 +1,71 @@
+package vnc
+
+import (
+	"bufio"
+	"time"
+)
+
+// write writes the data of client messages to the connection, or to the
+// write buffer if ClientConfig.WriteCoalesceDelay is set. The buffer is
+// flushed right away if urgent is set, and after the delay otherwise. It
+// must be called with writeLock held.
+func (c *ClientConn) write(data []byte, urgent bool) error {
+	delay := c.config.WriteCoalesceDelay
+	if delay <= 0 && c.writeBuf == nil {
+		_, err := c.c.Write(data)
+		return err
+	}
+
+	if c.writeBuf == nil {
+		c.writeBuf = bufio.NewWriter(c.c)
+	}
+
+	// Write errors are kept by the buffer, so an error flushing it from
+	// the timer is returned by the next write.
+	if _, err := c.writeBuf.Write(data); err != nil {
+		return err
+	}
+
+	if urgent || delay <= 0 {
+		return c.flushWrites()
+	}
+
+	if c.flushTimer == nil {
+		c.flushTimer = time.AfterFunc(delay, func() {
+			c.writeLock.Lock()
+			defer c.writeLock.Unlock()
+
+			c.flushWrites()
+		})
+	}
+
+	return nil
+}
+
+// flushWrites writes out the write buffer, if there is one. It must be
+// called with writeLock held.
+func (c *ClientConn) flushWrites() error {
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+
+	if c.writeBuf == nil {
+		return nil
+	}
+
+	return c.writeBuf.Flush()
+}
+
+// urgentMessages reports whether any of msgs is answered by the server,
+// so that holding it back would delay the answer.
+func urgentMessages(msgs []ClientMessage) bool {
+	for _, msg := range msgs {
+		switch msg.(type) {
+		case *FramebufferUpdateRequestMessage, *FenceMessage:
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,119 @@
+package vnc
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingConn is a connection that discards what is written to it, and
+// counts the writes.
+type countingConn struct {
+	net.Conn
+
+	lock   sync.Mutex
+	writes int
+	bytes  int
+}
+
+func (cc *countingConn) Write(b []byte) (int, error) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	cc.writes++
+	cc.bytes += len(b)
+	return len(b), nil
+}
+
+func (cc *countingConn) counts() (int, int) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	return cc.writes, cc.bytes
+}
+
+// typeText sends a key press and release for each character of text.
+func typeText(conn *ClientConn, text string) error {
+	for _, r := range text {
+		if err := conn.KeyEvent(uint32(r), true); err != nil {
+			return err
+		}
+		if err := conn.KeyEvent(uint32(r), false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestClientConn_WriteCoalesceDelay(t *testing.T) {
+	cc := &countingConn{}
+	conn := &ClientConn{c: cc, config: &ClientConfig{WriteCoalesceDelay: time.Hour}}
+
+	if err := typeText(conn, "hello"); err != nil {
+		t.Fatalf("error typing: %s", err)
+	}
+	if writes, _ := cc.counts(); writes != 0 {
+		t.Fatalf("%d writes before Flush, want 0", writes)
+	}
+
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("error flushing: %s", err)
+	}
+	if writes, n := cc.counts(); writes != 1 || n != 10*8 {
+		t.Fatalf("%d writes of %d bytes after Flush, want 1 of %d", writes, n, 10*8)
+	}
+
+	// Requests that the server answers are written immediately, along
+	// with what was held back before them.
+	typeText(conn, "a")
+	if err := conn.FramebufferUpdateRequest(true, 0, 0, 10, 10); err != nil {
+		t.Fatalf("error requesting update: %s", err)
+	}
+	if writes, n := cc.counts(); writes != 2 || n != 12*8+10 {
+		t.Fatalf("%d writes of %d bytes after the request, want 2 of %d", writes, n, 12*8+10)
+	}
+
+	// Messages held back are written once the delay has passed.
+	conn.config.WriteCoalesceDelay = time.Millisecond
+	typeText(conn, "b")
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if writes, _ := cc.counts(); writes == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the delayed write")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func BenchmarkClientConn_TypingBurst(b *testing.B) {
+	for _, tt := range []struct {
+		name  string
+		delay time.Duration
+	}{
+		{"Unbuffered", 0},
+		{"Coalesced", time.Hour},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			cc := &countingConn{}
+			conn := &ClientConn{c: cc, config: &ClientConfig{WriteCoalesceDelay: tt.delay}}
+
+			for i := 0; i < b.N; i++ {
+				if err := typeText(conn, "the quick brown fox"); err != nil {
+					b.Fatalf("error typing: %s", err)
+				}
+				if err := conn.Flush(); err != nil {
+					b.Fatalf("error flushing: %s", err)
+				}
+			}
+
+			writes, _ := cc.counts()
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
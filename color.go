@@ -1,6 +1,79 @@
 package vnc
 
+import "time"
+
 // Color represents a single color in a color map.
 type Color struct {
 	R, G, B uint16
 }
+
+// RGBA implements the color.Color interface, treating each channel as a
+// 16-bit value. Colors are always fully opaque.
+func (c Color) RGBA() (r, g, b, a uint32) {
+	return uint32(c.R), uint32(c.G), uint32(c.B), 0xffff
+}
+
+// DefaultColorMap256 returns a color map with the 6x6x6 color cube in
+// the first 216 entries, followed by a ramp of 40 grays ending in white.
+// It is used for color-mapped pixel formats until the server has sent
+// its own colors using SetColorMapEntries.
+func DefaultColorMap256() [256]Color {
+	var colorMap [256]Color
+
+	i := 0
+	for r := 0; r < 6; r++ {
+		for g := 0; g < 6; g++ {
+			for b := 0; b < 6; b++ {
+				colorMap[i] = Color{
+					R: uint16(r * 0xffff / 5),
+					G: uint16(g * 0xffff / 5),
+					B: uint16(b * 0xffff / 5),
+				}
+				i++
+			}
+		}
+	}
+
+	for gray := 1; i < len(colorMap); gray++ {
+		level := uint16(gray * 0xffff / 40)
+		colorMap[i] = Color{R: level, G: level, B: level}
+		i++
+	}
+
+	return colorMap
+}
+
+// The default ClientConfig.ColorMapChangeDelay.
+const defaultColorMapChangeDelay = 10 * time.Millisecond
+
+// colorMapChanged schedules a call of OnColorMapChanged with the current
+// color map, replacing any pending call, so that a burst of changes is
+// reported once it is over. It must be called from the main loop, which
+// is the only goroutine changing the color map.
+func (c *ClientConn) colorMapChanged() {
+	if c.config.OnColorMapChanged == nil || c.PixelFormat.TrueColor {
+		return
+	}
+
+	delay := c.config.ColorMapChangeDelay
+	if delay <= 0 {
+		delay = defaultColorMapChangeDelay
+	}
+
+	c.colorMapLock.Lock()
+	defer c.colorMapLock.Unlock()
+
+	c.colorMapPending = c.ColorMap
+	if c.colorMapTimer != nil && c.colorMapTimer.Stop() {
+		c.colorMapTimer.Reset(delay)
+		return
+	}
+
+	c.colorMapTimer = time.AfterFunc(delay, func() {
+		c.colorMapLock.Lock()
+		colorMap := c.colorMapPending
+		c.colorMapLock.Unlock()
+
+		c.config.OnColorMapChanged(colorMap)
+	})
+}
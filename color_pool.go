@@ -0,0 +1,88 @@
+package vnc
+
+import "sync"
+
+// A ColorPool holds color buffers for reuse by the decoders. Setting
+// ClientConfig.ColorPool makes the pixel data of decoded rectangles come
+// from the pool, which avoids allocating a new buffer for every
+// rectangle of every update, and the garbage collection that goes with
+// it when updates arrive continuously.
+//
+// The zero value is an empty pool ready to use. A ColorPool may be
+// shared by several connections.
+type ColorPool struct {
+	pool sync.Pool
+}
+
+// Get returns a buffer of n colors from the pool, or a newly allocated
+// one if the pool has no buffer that is large enough. The contents of
+// the buffer are undefined.
+func (p *ColorPool) Get(n int) []Color {
+	if buf, ok := p.pool.Get().(*[]Color); ok && cap(*buf) >= n {
+		return (*buf)[:n]
+	}
+
+	return make([]Color, n)
+}
+
+// Put returns a buffer to the pool. The buffer must not be used after
+// it has been returned.
+func (p *ColorPool) Put(colors []Color) {
+	if cap(colors) == 0 {
+		return
+	}
+
+	p.pool.Put(&colors)
+}
+
+// Release returns the pixel data of all of the rectangles of a
+// FramebufferUpdate to the pool, once the user of the connection is done
+// with the message. The Colors of the rectangles are set to nil.
+func (p *ColorPool) Release(msg *FramebufferUpdateMessage) {
+	for i := range msg.Rectangles {
+		switch enc := msg.Rectangles[i].Enc.(type) {
+		case *RawEncoding:
+			p.Put(enc.Colors)
+			enc.Colors = nil
+		case *ZlibEncoding:
+			p.Put(enc.Colors)
+			enc.Colors = nil
+		case *HextileEncoding:
+			p.Put(enc.Colors)
+			enc.Colors = nil
+		case *RREEncoding:
+			p.Put(enc.Colors)
+			enc.Colors = nil
+		case *CoRREEncoding:
+			p.Put(enc.Colors)
+			enc.Colors = nil
+		case *TightEncoding:
+			p.Put(enc.Colors)
+			enc.Colors = nil
+		case *TightPNGEncoding:
+			p.Put(enc.Colors)
+			enc.Colors = nil
+		}
+	}
+}
+
+// colorBuffer returns a buffer for n decoded colors, from the pool of
+// the connection if it has one.
+func (c *ClientConn) colorBuffer(n int) []Color {
+	if c.config != nil && c.config.ColorPool != nil {
+		return c.config.ColorPool.Get(n)
+	}
+
+	return make([]Color, n)
+}
+
+// pixelBuffer returns a buffer for n bytes of pixel data. The buffer is
+// reused by every call, so it is only valid until the next call, and may
+// only be used from the goroutine reading from the server.
+func (c *ClientConn) pixelBuffer(n int) []byte {
+	if cap(c.pixelBytes) < n {
+		c.pixelBytes = make([]byte, n)
+	}
+
+	return c.pixelBytes[:n]
+}
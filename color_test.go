@@ -0,0 +1,214 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultColorMap256(t *testing.T) {
+	colorMap := DefaultColorMap256()
+
+	if black := (Color{}); colorMap[0] != black {
+		t.Fatalf("color 0 = %#v, want %#v", colorMap[0], black)
+	}
+
+	white := Color{R: 0xffff, G: 0xffff, B: 0xffff}
+	if colorMap[255] != white {
+		t.Fatalf("color 255 = %#v, want %#v", colorMap[255], white)
+	}
+
+	// The color cube is indexed by 36*r + 6*g + b.
+	if red := (Color{R: 0xffff}); colorMap[5*36] != red {
+		t.Fatalf("color %d = %#v, want %#v", 5*36, colorMap[5*36], red)
+	}
+
+	// Grays increase towards white.
+	for i := 217; i < 256; i++ {
+		if colorMap[i].R <= colorMap[i-1].R || colorMap[i].R != colorMap[i].B {
+			t.Fatalf("color %d = %#v is not a lighter gray than %#v", i, colorMap[i], colorMap[i-1])
+		}
+	}
+}
+
+func TestSetColorMapEntriesMessage_16Bit(t *testing.T) {
+	conn := &ClientConn{
+		PixelFormat:       PixelFormat{BPP: 8, Depth: 8},
+		FrameBufferWidth:  1,
+		FrameBufferHeight: 1,
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0})
+	binary.Write(&buf, binary.BigEndian, []uint16{255, 2}) // First color, count
+	binary.Write(&buf, binary.BigEndian, []uint16{0xffff, 0x0000, 0x8000})
+	binary.Write(&buf, binary.BigEndian, []uint16{1, 2, 3}) // Past the end of the map
+
+	if _, err := new(SetColorMapEntriesMessage).Read(conn, &buf); err != nil {
+		t.Fatalf("error reading SetColorMapEntries: %s", err)
+	}
+
+	want := Color{R: 0xffff, G: 0x0000, B: 0x8000}
+	if conn.ColorMap[255] != want {
+		t.Fatalf("ColorMap[255] = %#v, want %#v", conn.ColorMap[255], want)
+	}
+
+	rect := &Rectangle{Width: 1, Height: 1}
+	enc, err := new(RawEncoding).Read(conn, rect, bytes.NewReader([]byte{255}))
+	if err != nil {
+		t.Fatalf("error reading raw rectangle: %s", err)
+	}
+
+	if colors := enc.(*RawEncoding).Colors; colors[0] != want {
+		t.Fatalf("decoded %#v, want %#v", colors[0], want)
+	}
+}
+
+func TestSetColorMapEntriesMessage_TrueColor(t *testing.T) {
+	var logged []string
+	conn := &ClientConn{
+		config: &ClientConfig{
+			Logf: func(format string, v ...interface{}) {
+				logged = append(logged, fmt.Sprintf(format, v...))
+			},
+		},
+		PixelFormat: testPixelFormat,
+		ColorMap:    DefaultColorMap256(),
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 1}) // First color, count
+	binary.Write(&buf, binary.BigEndian, []uint16{0xffff, 0xffff, 0xffff})
+	buf.Write([]byte{2}) // Bell
+
+	msg, err := new(SetColorMapEntriesMessage).Read(conn, &buf)
+	if err != nil {
+		t.Fatalf("error reading SetColorMapEntries: %s", err)
+	}
+
+	// The message is read in full, and passed on.
+	if buf.Len() != 1 {
+		t.Fatalf("%d bytes left, want 1", buf.Len())
+	}
+	if colors := msg.(*SetColorMapEntriesMessage).Colors; len(colors) != 1 {
+		t.Fatalf("%d colors, want 1", len(colors))
+	}
+
+	// The color map is unchanged.
+	if conn.ColorMap != DefaultColorMap256() {
+		t.Fatal("color map modified in a true color pixel format")
+	}
+
+	if len(logged) != 1 || !strings.Contains(logged[0], "true color") {
+		t.Fatalf("unexpected messages logged: %q", logged)
+	}
+}
+
+func TestClientConn_PalettedImage(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{KeepFramebuffer: true})
+	defer server.Close()
+
+	conn.PixelFormat = PixelFormat{BPP: 8, Depth: 8}
+	conn.ColorMap = DefaultColorMap256()
+	conn.ColorMap[7] = rgb(0x12, 0x34, 0x56)
+
+	conn.fb = NewFramebuffer(3, 1)
+	conn.fb.Colors = []Color{conn.ColorMap[7], conn.ColorMap[200], rgb(0x13, 0x34, 0x56)}
+
+	img, err := conn.PalettedImage()
+	if err != nil {
+		t.Fatalf("error getting image: %s", err)
+	}
+
+	if len(img.Palette) != 256 {
+		t.Fatalf("palette has %d colors, want 256", len(img.Palette))
+	}
+	for i, c := range img.Palette {
+		if c != conn.ColorMap[i] {
+			t.Fatalf("palette color %d is %v, want %v", i, c, conn.ColorMap[i])
+		}
+	}
+
+	// A color that isn't in the color map gets the closest one.
+	if expected := []uint8{7, 200, 7}; !bytes.Equal(img.Pix, expected) {
+		t.Fatalf("pixels %v, want %v", img.Pix, expected)
+	}
+
+	// A tiled framebuffer gives the same image.
+	tiled := NewTiledFramebuffer(3, 1, 2)
+	tiled.Apply(&FramebufferUpdateMessage{Rectangles: []Rectangle{
+		{Width: 3, Height: 1, Enc: &RawEncoding{Colors: conn.fb.Colors}},
+	}})
+	conn.fb, conn.tiledFB = nil, tiled
+
+	img, err = conn.PalettedImage()
+	if err != nil {
+		t.Fatalf("error getting image of a tiled framebuffer: %s", err)
+	}
+	if expected := []uint8{7, 200, 7}; !bytes.Equal(img.Pix, expected) {
+		t.Fatalf("tiled framebuffer pixels %v, want %v", img.Pix, expected)
+	}
+
+	conn.PixelFormat = testPixelFormat
+	if _, err := conn.PalettedImage(); err == nil {
+		t.Fatal("expected error for a true color pixel format")
+	}
+}
+
+func TestClientConn_OnColorMapChanged(t *testing.T) {
+	changedCh := make(chan [256]Color, 4)
+	conn, server := newTestClientConn(&ClientConfig{
+		OnColorMapChanged:   func(colorMap [256]Color) { changedCh <- colorMap },
+		ColorMapChangeDelay: 50 * time.Millisecond,
+	})
+	defer server.Close()
+
+	conn.PixelFormat = PixelFormat{BPP: 8, Depth: 8}
+	conn.ColorMap = DefaultColorMap256()
+
+	go conn.mainLoop()
+
+	// Three changes in a burst, the last one overriding the first.
+	var burst bytes.Buffer
+	for i, entry := range []struct {
+		index uint16
+		color Color
+	}{
+		{1, rgb(0x10, 0, 0)},
+		{2, rgb(0, 0x20, 0)},
+		{1, rgb(0, 0, 0x30)},
+	} {
+		burst.Write([]byte{1, 0})
+		binary.Write(&burst, binary.BigEndian, []uint16{entry.index, 1, entry.color.R, entry.color.G, entry.color.B})
+
+		// The last message is held back a little, which still counts
+		// as part of the burst.
+		if i == 1 {
+			server.Write(burst.Bytes())
+			burst.Reset()
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	server.Write(burst.Bytes())
+
+	var colorMap [256]Color
+	select {
+	case colorMap = <-changedCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the color map change")
+	}
+
+	if colorMap[1] != rgb(0, 0, 0x30) || colorMap[2] != rgb(0, 0x20, 0) {
+		t.Fatalf("colors 1 and 2 = %#v, %#v", colorMap[1], colorMap[2])
+	}
+
+	select {
+	case <-changedCh:
+		t.Fatal("the burst was reported more than once")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
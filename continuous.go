@@ -0,0 +1,212 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ContinuousUpdatesPseudoEncoding declares that the client supports
+// continuous updates, where the server sends updates of a region as it
+// changes, without waiting for FramebufferUpdateRequests. It is only
+// sent by SetEncodings if ClientConfig.ContinuousUpdates is set.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#continuousupdates-pseudo-encoding
+type ContinuousUpdatesPseudoEncoding struct{}
+
+func (*ContinuousUpdatesPseudoEncoding) Type() int32 {
+	return -313
+}
+
+func (*ContinuousUpdatesPseudoEncoding) Read(*ClientConn, *Rectangle, io.Reader) (Encoding, error) {
+	return &ContinuousUpdatesPseudoEncoding{}, nil
+}
+
+// EndOfContinuousUpdatesMessage is sent by a server that supports
+// continuous updates, once in response to the client sending the
+// ContinuousUpdatesPseudoEncoding, and whenever continuous updates have
+// been disabled.
+type EndOfContinuousUpdatesMessage struct{}
+
+func (*EndOfContinuousUpdatesMessage) Type() uint8 {
+	return 150
+}
+
+func (*EndOfContinuousUpdatesMessage) Read(*ClientConn, io.Reader) (ServerMessage, error) {
+	return &EndOfContinuousUpdatesMessage{}, nil
+}
+
+// EnableContinuousUpdatesMessage enables or disables continuous updates
+// of a region of the frame buffer. See ClientConn.EnableContinuousUpdates.
+type EnableContinuousUpdatesMessage struct {
+	Enable bool
+	X, Y   uint16
+	Width  uint16
+	Height uint16
+}
+
+func (*EnableContinuousUpdatesMessage) Type() uint8 {
+	return 150
+}
+
+func (m *EnableContinuousUpdatesMessage) Serialize(w io.Writer) error {
+	var enableByte uint8
+	if m.Enable {
+		enableByte = 1
+	}
+
+	return writeMessage(w, []interface{}{
+		m.Type(),
+		enableByte,
+		m.X, m.Y, m.Width, m.Height,
+	})
+}
+
+func (*EnableContinuousUpdatesMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	var data struct {
+		Enable uint8
+		X, Y   uint16
+		Width  uint16
+		Height uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &data); err != nil {
+		return nil, err
+	}
+
+	return &EnableContinuousUpdatesMessage{
+		Enable: data.Enable != 0,
+		X:      data.X,
+		Y:      data.Y,
+		Width:  data.Width,
+		Height: data.Height,
+	}, nil
+}
+
+// EnableContinuousUpdates asks the server to send updates of the given
+// region as it changes, or, if enable is false, to stop doing so. While
+// continuous updates are enabled, the automatic update loop of
+// ClientConfig.AutoUpdate stops sending incremental update requests. The
+// server confirms that they have been disabled with an
+// EndOfContinuousUpdatesMessage, after which the loop resumes.
+//
+// This requires the ContinuousUpdatesPseudoEncoding to have been sent
+// using SetEncodings, and the server to have announced its support by
+// sending an EndOfContinuousUpdatesMessage.
+func (c *ClientConn) EnableContinuousUpdates(enable bool, x, y, width, height uint16) error {
+	advertised := false
+	for _, enc := range c.Encs {
+		if enc.Type() == new(ContinuousUpdatesPseudoEncoding).Type() {
+			advertised = true
+		}
+	}
+	if !advertised {
+		return fmt.Errorf("continuous updates require the ContinuousUpdates pseudo-encoding to be sent using SetEncodings")
+	}
+
+	c.fbLock.Lock()
+	supported := c.continuousSupported
+	c.fbLock.Unlock()
+
+	if !supported {
+		return fmt.Errorf("the server does not support continuous updates")
+	}
+
+	return c.Send(&EnableContinuousUpdatesMessage{
+		Enable: enable,
+		X:      x,
+		Y:      y,
+		Width:  width,
+		Height: height,
+	})
+}
+
+// continuousUpdatesEnded records that the server supports continuous
+// updates, and that they are disabled, as announced by an
+// EndOfContinuousUpdatesMessage. If they were enabled, the automatic
+// update loop is resumed.
+func (c *ClientConn) continuousUpdatesEnded() error {
+	c.fbLock.Lock()
+	wasActive := c.continuousActive
+	wasSupported := c.continuousSupported
+	c.continuousSupported = true
+	c.continuousActive = false
+	c.fbLock.Unlock()
+
+	// The first announcement is the server's response to the
+	// pseudo-encoding, when LowLatencyMode starts continuous updates.
+	if !wasSupported && c.config.LowLatencyMode {
+		region, ok := c.viewportRegion()
+		if !ok {
+			return nil
+		}
+
+		return c.EnableContinuousUpdates(true, region.X, region.Y, region.Width, region.Height)
+	}
+
+	if wasActive && c.autoUpdating() {
+		return c.requestViewportUpdate(true)
+	}
+
+	return nil
+}
+
+// continuousUpdating reports whether continuous updates are enabled, in
+// which case the server doesn't need update requests.
+func (c *ClientConn) continuousUpdating() bool {
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	return c.continuousActive
+}
+
+// framePrefix starts the payload of the fences sent by LowLatencyMode,
+// to tell them apart from other fences.
+var framePrefix = []byte("frame")
+
+// paceFrame sends a fence request once LowLatencyFenceInterval frames
+// have been handled with continuous updates in LowLatencyMode, unless the
+// previous one is still unanswered.
+func (c *ClientConn) paceFrame() error {
+	if !c.config.LowLatencyMode {
+		return nil
+	}
+
+	interval := c.config.LowLatencyFenceInterval
+	if interval <= 0 {
+		interval = 1
+	}
+
+	c.fbLock.Lock()
+	send := false
+	if c.continuousActive {
+		c.framesSinceFence++
+		if c.framesSinceFence >= interval && !c.frameFencePending {
+			c.framesSinceFence = 0
+			c.frameFencePending = true
+			send = true
+		}
+	}
+	c.fbLock.Unlock()
+
+	if !send {
+		return nil
+	}
+
+	return c.Fence(FenceRequest|FenceBlockBefore, framePrefix)
+}
+
+// frameFenceAnswered reports whether a fence from the server answers the
+// last fence sent by paceFrame, in which case another one may be sent.
+func (c *ClientConn) frameFenceAnswered(msg *FenceMessage) bool {
+	if !bytes.Equal(msg.Payload, framePrefix) {
+		return false
+	}
+
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	answered := c.frameFencePending
+	c.frameFencePending = false
+	return answered
+}
@@ -0,0 +1,234 @@
+package vnc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestClientConn_ContinuousUpdatesAdvertised(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		conn, server := newTestClientConn(&ClientConfig{ContinuousUpdates: enabled})
+		server.Close()
+
+		advertised := false
+		for _, enc := range conn.EnabledEncodings() {
+			if enc.Type() == -313 {
+				advertised = true
+			}
+		}
+		if advertised != enabled {
+			t.Fatalf("ContinuousUpdates %v: advertised = %v", enabled, advertised)
+		}
+
+		if err := conn.EnableContinuousUpdates(true, 0, 0, 640, 480); err == nil {
+			t.Fatalf("ContinuousUpdates %v: expected error before SetEncodings", enabled)
+		}
+	}
+}
+
+func TestClientConn_ContinuousUpdates(t *testing.T) {
+	msgCh := make(chan ServerMessage, 2)
+	conn, server := newTestClientConn(&ClientConfig{
+		AutoUpdate:        true,
+		ContinuousUpdates: true,
+		ServerMessageCh:   msgCh,
+	})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 640
+	conn.FrameBufferHeight = 480
+	conn.PixelFormat = testPixelFormat
+
+	go conn.mainLoop()
+	expectUpdateRequest(t, server, false, 0, 0, 640, 480)
+
+	encs := conn.EnabledEncodings()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.SetEncodings(encs)
+	}()
+	if _, err := io.ReadFull(server, make([]byte, 4+4*len(encs))); err != nil {
+		t.Fatalf("error reading SetEncodings: %s", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("error setting encodings: %s", err)
+	}
+
+	expectMessage := func() {
+		select {
+		case <-msgCh:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for message")
+		}
+	}
+
+	// The server announces its support.
+	server.Write([]byte{150})
+	expectMessage()
+
+	go func() {
+		errCh <- conn.EnableContinuousUpdates(true, 0, 0, 640, 480)
+	}()
+	data := make([]byte, 10)
+	if _, err := io.ReadFull(server, data); err != nil {
+		t.Fatalf("error reading EnableContinuousUpdates: %s", err)
+	}
+	if expected := []byte{150, 1, 0, 0, 0, 0, 2, 128, 1, 224}; !bytes.Equal(data, expected) {
+		t.Fatalf("read %v, want %v", data, expected)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("error enabling continuous updates: %s", err)
+	}
+
+	// An empty update doesn't trigger a request anymore.
+	server.Write([]byte{0, 0, 0, 0})
+	expectMessage()
+
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := server.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("unexpected data with continuous updates (%d bytes)", n)
+	}
+	server.SetReadDeadline(time.Time{})
+
+	// Once the server ends continuous updates, the loop resumes.
+	server.Write([]byte{150})
+	expectUpdateRequest(t, server, true, 0, 0, 640, 480)
+	expectMessage()
+}
+
+func TestClientConn_LowLatencyMode(t *testing.T) {
+	msgCh := make(chan ServerMessage, 8)
+	conn, server := newTestClientConn(&ClientConfig{
+		LowLatencyMode:          true,
+		LowLatencyFenceInterval: 2,
+		ServerMessageCh:         msgCh,
+	})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 640
+	conn.FrameBufferHeight = 480
+	conn.PixelFormat = testPixelFormat
+	conn.Encs = conn.EnabledEncodings()
+
+	go conn.mainLoop()
+
+	// Continuous updates are enabled once the server supports them.
+	server.Write([]byte{150})
+	data := make([]byte, 10)
+	if _, err := io.ReadFull(server, data); err != nil {
+		t.Fatalf("error reading EnableContinuousUpdates: %s", err)
+	}
+	if expected := []byte{150, 1, 0, 0, 0, 0, 2, 128, 1, 224}; !bytes.Equal(data, expected) {
+		t.Fatalf("read %v, want %v", data, expected)
+	}
+
+	expectFence := func() {
+		fence, err := ReadClientMessage(server, nil)
+		if err != nil {
+			t.Fatalf("error reading fence: %s", err)
+		}
+		if msg, ok := fence.(*FenceMessage); !ok || msg.Flags != FenceRequest|FenceBlockBefore {
+			t.Fatalf("read %#v, want a fence request", fence)
+		}
+	}
+	expectNothing := func() {
+		server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if n, err := server.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("unexpected data (%d bytes)", n)
+		}
+		server.SetReadDeadline(time.Time{})
+	}
+
+	// A fence follows every second frame.
+	server.Write([]byte{0, 0, 0, 0})
+	expectNothing()
+	server.Write([]byte{0, 0, 0, 0})
+	expectFence()
+
+	// No further fence is sent until the last one has been answered, after
+	// which the frames handled in the mean time count towards the next one.
+	server.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0})
+	expectNothing()
+
+	var response bytes.Buffer
+	(&FenceMessage{Flags: FenceBlockBefore, Payload: []byte("frame")}).Serialize(&response)
+	server.Write(response.Bytes())
+	server.Write([]byte{0, 0, 0, 0})
+	expectFence()
+
+	// The answer to the fence isn't passed on.
+	for len(msgCh) > 0 {
+		if msg := <-msgCh; msg.Type() == 248 {
+			t.Fatal("the answer to a fence was passed on")
+		}
+	}
+}
+
+func TestClientConn_ContinuousUpdatesLastRect(t *testing.T) {
+	// TightVNC servers end updates with LastRect even if the client
+	// hasn't sent the pseudo-encoding.
+	for _, advertised := range []bool{true, false} {
+		testContinuousUpdatesLastRect(t, advertised)
+	}
+}
+
+func testContinuousUpdatesLastRect(t *testing.T, advertised bool) {
+	msgCh := make(chan ServerMessage, 4)
+	conn, server := newTestClientConn(&ClientConfig{
+		AutoUpdate:        true,
+		ContinuousUpdates: true,
+		ServerMessageCh:   msgCh,
+	})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 640
+	conn.FrameBufferHeight = 480
+	conn.PixelFormat = testPixelFormat
+	conn.Encs = conn.EnabledEncodings()
+	if advertised {
+		conn.Encs = append(conn.Encs, new(LastRectPseudoEncoding))
+	}
+	conn.continuousSupported = true
+	conn.continuousActive = true
+
+	go conn.mainLoop()
+	expectUpdateRequest(t, server, false, 0, 0, 640, 480)
+
+	// Two updates ended by LastRect, sent back to back without a
+	// request in between, as TightVNC does with continuous updates.
+	var data bytes.Buffer
+	for i := uint16(0); i < 2; i++ {
+		data.Write([]byte{0, 0, 0xff, 0xff})
+		data.Write([]byte{0, byte(i), 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 1, 2, 3, 0})
+		data.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0x20})
+	}
+	go server.Write(data.Bytes())
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-msgCh:
+			update, ok := msg.(*FramebufferUpdateMessage)
+			if !ok {
+				t.Fatalf("advertised %v: message %d is %T, want an update", advertised, i, msg)
+			}
+			if len(update.Rectangles) != 1 || update.Rectangles[0].X != uint16(i) {
+				t.Fatalf("advertised %v: update %d has rectangles %v", advertised, i, update.Rectangles)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("advertised %v: timeout waiting for update %d", advertised, i)
+		}
+	}
+
+	// No request is sent for either of them.
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := server.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("advertised %v: unexpected data with continuous updates (%d bytes)", advertised, n)
+	}
+	server.SetReadDeadline(time.Time{})
+
+	if err := conn.Err(); err != nil {
+		t.Fatalf("advertised %v: connection failed: %s", advertised, err)
+	}
+}
@@ -0,0 +1,119 @@
+package vnc
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+)
+
+// CursorPosPseudoEncoding reports the position of the cursor on the
+// server, such as after it has been moved by an application. The
+// position is carried in the X and Y of the rectangle, and is stored in
+// ClientConn.CursorPosition.
+type CursorPosPseudoEncoding struct {
+	Position image.Point
+}
+
+func (*CursorPosPseudoEncoding) Type() int32 {
+	return -232
+}
+
+func (*CursorPosPseudoEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	position := image.Pt(int(rect.X), int(rect.Y))
+	c.CursorPosition = position
+
+	if c.config != nil && c.config.OnCursorPos != nil {
+		c.config.OnCursorPos(position)
+	}
+
+	return &CursorPosPseudoEncoding{Position: position}, nil
+}
+
+// CursorPseudoEncoding carries the shape of the cursor, for clients that
+// draw the cursor themselves, in which case the server leaves it out of
+// the frame buffer. The hotspot, the pixel of the cursor image that is at
+// the position of the pointer, is carried in the X and Y of the
+// rectangle. Pixels outside of the mask sent along with the image are
+// transparent in Image. An empty image hides the cursor.
+//
+// This is not one of the BuiltinEncodings, since the server stops
+// drawing the cursor once it is sent using SetEncodings. The last cursor
+// received is drawn by ClientConn.CompositeCursor.
+type CursorPseudoEncoding struct {
+	Image   *image.NRGBA
+	Hotspot image.Point
+}
+
+func (*CursorPseudoEncoding) Type() int32 {
+	return -239
+}
+
+// The largest cursor accepted, in each dimension.
+const maxCursorSize = 1024
+
+func (*CursorPseudoEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	if rect.Width > maxCursorSize || rect.Height > maxCursorSize {
+		return nil, fmt.Errorf("cursor of %dx%d pixels exceeds the maximum of %dx%d",
+			rect.Width, rect.Height, maxCursorSize, maxCursorSize)
+	}
+	if err := c.PixelFormat.checkBPP(); err != nil {
+		return nil, err
+	}
+
+	width, height := int(rect.Width), int(rect.Height)
+	pixelBytes := make([]byte, c.PixelFormat.RawRectangleSize(*rect))
+	if _, err := io.ReadFull(r, pixelBytes); err != nil {
+		return nil, err
+	}
+
+	maskRow := (width + 7) / 8
+	mask := make([]byte, maskRow*height)
+	if _, err := io.ReadFull(r, mask); err != nil {
+		return nil, err
+	}
+
+	colors := make([]Color, width*height)
+	if err := c.decodeFormat().DecodeInto(colors, pixelBytes, &c.ColorMap); err != nil {
+		return nil, err
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if mask[y*maskRow+x/8]&(0x80>>uint(x%8)) == 0 {
+				continue
+			}
+
+			col := colors[y*width+x]
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(col.R >> 8), G: uint8(col.G >> 8), B: uint8(col.B >> 8), A: 0xff})
+		}
+	}
+
+	result := &CursorPseudoEncoding{Image: img, Hotspot: image.Pt(int(rect.X), int(rect.Y))}
+
+	c.fbLock.Lock()
+	c.cursor = result
+	c.fbLock.Unlock()
+
+	return result, nil
+}
+
+// CompositeCursor draws the last cursor sent by the server with the
+// CursorPseudoEncoding onto dst, with its hotspot at pos, such as the
+// position of the pointer in the coordinates of dst. Only the pixels of
+// the cursor mask are drawn. Nothing is drawn if the server hasn't sent
+// a cursor, or has hidden it.
+func (c *ClientConn) CompositeCursor(dst draw.Image, pos image.Point) {
+	c.fbLock.Lock()
+	cursor := c.cursor
+	c.fbLock.Unlock()
+
+	if cursor == nil {
+		return
+	}
+
+	bounds := cursor.Image.Bounds().Add(pos.Sub(cursor.Hotspot))
+	draw.Draw(dst, bounds, cursor.Image, image.Point{}, draw.Over)
+}
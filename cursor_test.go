@@ -0,0 +1,87 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestCursorPosPseudoEncoding(t *testing.T) {
+	var reported []image.Point
+	conn := &ClientConn{
+		Encs: []Encoding{new(CursorPosPseudoEncoding)},
+		config: &ClientConfig{
+			OnCursorPos: func(p image.Point) {
+				reported = append(reported, p)
+			},
+		},
+	}
+
+	data := []byte{
+		0,    // Padding
+		0, 1, // Number of rectangles
+		0, 10, 0, 20, 0, 0, 0, 0, // At 10,20 without a size
+		0xff, 0xff, 0xff, 0x18, // CursorPos
+	}
+
+	msg, err := new(FramebufferUpdateMessage).Read(conn, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+
+	expected := image.Pt(10, 20)
+	enc := msg.(*FramebufferUpdateMessage).Rectangles[0].Enc.(*CursorPosPseudoEncoding)
+	if enc.Position != expected {
+		t.Fatalf("Position = %s, want %s", enc.Position, expected)
+	}
+	if conn.CursorPosition != expected {
+		t.Fatalf("CursorPosition = %s, want %s", conn.CursorPosition, expected)
+	}
+	if len(reported) != 1 || reported[0] != expected {
+		t.Fatalf("OnCursorPos called with %v, want [%s]", reported, expected)
+	}
+}
+
+func TestClientConn_CompositeCursor(t *testing.T) {
+	conn := &ClientConn{
+		Encs:        []Encoding{new(CursorPseudoEncoding)},
+		PixelFormat: testPixelFormat,
+	}
+
+	// A red 3x3 cursor with its hotspot in the middle, masked to a plus.
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 1})
+	binary.Write(&buf, binary.BigEndian, []uint16{1, 1, 3, 3})
+	binary.Write(&buf, binary.BigEndian, int32(-239))
+	for i := 0; i < 9; i++ {
+		buf.Write([]byte{0, 0, 0xff, 0})
+	}
+	buf.Write([]byte{0x40, 0xe0, 0x40})
+
+	if _, err := new(FramebufferUpdateMessage).Read(conn, &buf); err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+
+	background := color.RGBA{B: 0xff, A: 0xff}
+	dst := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+	conn.CompositeCursor(dst, image.Pt(5, 5))
+
+	red := color.RGBA{R: 0xff, A: 0xff}
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			expected := background
+			if (x == 5 && y >= 4 && y <= 6) || (y == 5 && x >= 4 && x <= 6) {
+				expected = red
+			}
+
+			if c := dst.RGBAAt(x, y); c != expected {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, c, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package vnc
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SetDecodeContext sets the context that the FramebufferUpdates read from
+// then on are decoded under, or removes it if ctx is nil. Once ctx is
+// done, the update being decoded is abandoned between two rectangles, or
+// in the middle of one, by interrupting the read from the server that is
+// blocked, so that a large update doesn't hold up the goroutine reading
+// from the server.
+//
+// The rest of an abandoned update can't be skipped, since its length is
+// only known by decoding it, so the connection is closed with an error
+// wrapping both ErrProtocolDesync and the error of ctx. Even if the
+// remaining data could be drained, the zlib streams of the Zlib, ZRLE
+// and Tight encodings would be missing the data of the update, so a new
+// connection is needed to carry on. Updates that were read in full
+// before ctx was done are handled as usual.
+func (c *ClientConn) SetDecodeContext(ctx context.Context) {
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	c.decodeCtx = ctx
+}
+
+// decodeContext returns the context set with SetDecodeContext, if any.
+func (c *ClientConn) decodeContext() context.Context {
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	return c.decodeCtx
+}
+
+// watchDecodeContext interrupts reading from the server once ctx is done,
+// by setting a read deadline in the past. The returned function stops
+// watching ctx, given the result of reading an update: an update that
+// was read in full is kept, clearing the deadline again, while the error
+// of one that was abandoned is replaced by one wrapping
+// ErrProtocolDesync and the error of ctx.
+func (c *ClientConn) watchDecodeContext(ctx context.Context) func(error) error {
+	stop := func() bool { return true }
+	interrupted := make(chan struct{})
+	if c.c != nil {
+		stop = context.AfterFunc(ctx, func() {
+			c.c.SetReadDeadline(time.Now())
+			close(interrupted)
+		})
+	}
+
+	return func(err error) error {
+		if !stop() {
+			<-interrupted
+			if err == nil {
+				c.c.SetReadDeadline(time.Time{})
+			}
+		}
+
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("%w: FramebufferUpdate abandoned: %w", ErrProtocolDesync, ctx.Err())
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,63 @@
+package vnc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClientConn_SetDecodeContext(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+	conn.FrameBufferWidth, conn.FrameBufferHeight = 1000, 1000
+	conn.PixelFormat = testPixelFormat
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn.SetDecodeContext(ctx)
+
+	// An update read in full is kept, and the connection can still be
+	// read from afterwards.
+	go server.Write([]byte{0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 1, 2, 3, 0})
+	if _, err := new(FramebufferUpdateMessage).Read(conn, conn.c); err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+
+	// A Raw rectangle of 1000x1000 pixels, of which the server only
+	// sends the first row before stalling.
+	header := []byte{0, 0, 1, 0, 0, 0, 0, 0x03, 0xe8, 0x03, 0xe8, 0, 0, 0, 0}
+	go func() {
+		server.Write(header)
+		server.Write(make([]byte, 4*1000))
+	}()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := new(FramebufferUpdateMessage).Read(conn, conn.c)
+		result <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancelled := time.Now()
+	cancel()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrProtocolDesync) || !errors.Is(err, context.Canceled) {
+			t.Fatalf("err = %v, want ErrProtocolDesync and context.Canceled", err)
+		}
+		if elapsed := time.Since(cancelled); elapsed > 500*time.Millisecond {
+			t.Fatalf("update abandoned %s after cancelling", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("update not abandoned after cancelling")
+	}
+
+	// Updates are abandoned between rectangles as well, once the
+	// context is done.
+	go server.Write([]byte{0, 0, 1})
+	if _, err := new(FramebufferUpdateMessage).Read(conn, conn.c); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v for an update read after cancelling", err)
+	}
+}
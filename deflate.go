@@ -0,0 +1,98 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// WrapDeflate wraps a connection in a simple transport compression layer
+// used by some gateways and tunnels, for use with Client. This is not
+// part of RFB, and must only be used with a gateway that expects it; a
+// VNC server will not understand the compressed data.
+//
+// Each direction of the connection is a single raw DEFLATE stream (RFC
+// 1951). The data of each write is compressed and flushed, and sent as a
+// frame of its own, preceded by the length of the compressed data as a
+// 32-bit big endian integer.
+func WrapDeflate(conn net.Conn) net.Conn {
+	dc := &deflateConn{Conn: conn}
+	dc.frames.r = conn
+	dc.reader = flate.NewReader(&dc.frames)
+
+	// NewWriter only fails for invalid compression levels.
+	dc.writer, _ = flate.NewWriter(&dc.output, flate.DefaultCompression)
+
+	return dc
+}
+
+// deflateConn is a connection wrapped by WrapDeflate.
+type deflateConn struct {
+	net.Conn
+
+	frames deflateFrameReader
+	reader io.Reader
+
+	writeLock sync.Mutex
+	writer    *flate.Writer
+	output    bytes.Buffer
+}
+
+func (dc *deflateConn) Read(b []byte) (int, error) {
+	return dc.reader.Read(b)
+}
+
+func (dc *deflateConn) Write(b []byte) (int, error) {
+	dc.writeLock.Lock()
+	defer dc.writeLock.Unlock()
+
+	// Leave room for the length, which is filled in once the data has
+	// been compressed.
+	dc.output.Reset()
+	dc.output.Write([]byte{0, 0, 0, 0})
+
+	if _, err := dc.writer.Write(b); err != nil {
+		return 0, err
+	}
+	if err := dc.writer.Flush(); err != nil {
+		return 0, err
+	}
+
+	frame := dc.output.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	if _, err := dc.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// deflateFrameReader reads the compressed data of the frames sent by the
+// other end of a deflateConn, as one continuous stream.
+type deflateFrameReader struct {
+	r         io.Reader
+	remaining uint32
+}
+
+func (fr *deflateFrameReader) Read(b []byte) (int, error) {
+	for fr.remaining == 0 {
+		if err := binary.Read(fr.r, binary.BigEndian, &fr.remaining); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint32(len(b)) > fr.remaining {
+		b = b[:fr.remaining]
+	}
+
+	n, err := fr.r.Read(b)
+	fr.remaining -= uint32(n)
+	if err == io.EOF && fr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
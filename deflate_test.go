@@ -0,0 +1,76 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestWrapDeflate_RoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	wrapped := WrapDeflate(client)
+
+	messages := [][]byte{
+		[]byte("RFB 003.008\n"),
+		bytes.Repeat([]byte{0xab}, 4096),
+		{1},
+	}
+
+	go func() {
+		for _, msg := range messages {
+			wrapped.Write(msg)
+		}
+	}()
+
+	// Each write is a frame of its own, which can be decompressed as
+	// soon as it has arrived.
+	var stream bytes.Buffer
+	decompressed := flate.NewReader(&stream)
+	for _, msg := range messages {
+		var length uint32
+		if err := binary.Read(server, binary.BigEndian, &length); err != nil {
+			t.Fatalf("error reading frame length: %s", err)
+		}
+		if _, err := io.CopyN(&stream, server, int64(length)); err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+
+		data := make([]byte, len(msg))
+		if _, err := io.ReadFull(decompressed, data); err != nil {
+			t.Fatalf("error decompressing frame: %s", err)
+		}
+		if !bytes.Equal(data, msg) {
+			t.Fatalf("decompressed %v, want %v", data, msg)
+		}
+	}
+}
+
+func TestWrapDeflate_Client(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serveTestHandshake(WrapDeflate(server), []uint8{1}, nil)
+	}()
+
+	conn, err := Client(WrapDeflate(client), &ClientConfig{})
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer conn.Close()
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("error in mock server: %s", err)
+	}
+
+	if conn.DesktopName != "test" || conn.FrameBufferWidth != 640 {
+		t.Fatalf("unexpected ServerInit: %q, %dx%d", conn.DesktopName, conn.FrameBufferWidth, conn.FrameBufferHeight)
+	}
+}
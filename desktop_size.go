@@ -0,0 +1,180 @@
+package vnc
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Screen is a single screen of a frame buffer, as used by the
+// ExtendedDesktopSize pseudo-encoding and SetDesktopSize.
+type Screen struct {
+	ID     uint32
+	X      uint16
+	Y      uint16
+	Width  uint16
+	Height uint16
+	Flags  uint32
+}
+
+// Reasons for an ExtendedDesktopSize rectangle.
+const (
+	DesktopSizeReasonServer uint16 = iota
+	DesktopSizeReasonClient
+	DesktopSizeReasonOtherClient
+)
+
+// Status codes of an ExtendedDesktopSize rectangle, reporting the result
+// of a SetDesktopSize request.
+const (
+	DesktopSizeStatusOK uint16 = iota
+	DesktopSizeStatusProhibited
+	DesktopSizeStatusOutOfResources
+	DesktopSizeStatusInvalidLayout
+)
+
+// ExtendedDesktopSizePseudoEncoding declares that the client supports
+// changes to the frame buffer size and screen layout, and requesting
+// them with SetDesktopSize.
+//
+// The server announces its support by sending a rectangle in this
+// encoding with DesktopSizeReasonServer. The result of a SetDesktopSize
+// request is reported with DesktopSizeReasonClient and a Status. The
+// frame buffer size of the connection is only changed when the Status
+// is DesktopSizeStatusOK.
+type ExtendedDesktopSizePseudoEncoding struct {
+	Reason  uint16
+	Status  uint16
+	Screens []Screen
+}
+
+func (*ExtendedDesktopSizePseudoEncoding) Type() int32 {
+	return -308
+}
+
+func (*ExtendedDesktopSizePseudoEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	var numScreens uint8
+	if err := binary.Read(r, binary.BigEndian, &numScreens); err != nil {
+		return nil, err
+	}
+
+	// Read off the padding
+	var padding [3]byte
+	if _, err := io.ReadFull(r, padding[:]); err != nil {
+		return nil, err
+	}
+
+	result := &ExtendedDesktopSizePseudoEncoding{
+		Reason:  rect.X,
+		Status:  rect.Y,
+		Screens: make([]Screen, numScreens),
+	}
+
+	for i := range result.Screens {
+		if err := binary.Read(r, binary.BigEndian, &result.Screens[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	c.extendedDesktopSize = true
+	if result.Status == DesktopSizeStatusOK {
+		if err := c.checkFramebufferSize(rect.Width, rect.Height); err != nil {
+			return nil, err
+		}
+
+		c.setDimensions(rect.Width, rect.Height)
+		c.screens = result.Screens
+	}
+
+	return result, nil
+}
+
+// SetDesktopSize requests the server to change the size of the frame
+// buffer, and the layout of its screens. If screens is empty, a single
+// screen covering the whole frame buffer is requested. The server
+// replies with an ExtendedDesktopSize rectangle reporting the result.
+//
+// This requires the ExtendedDesktopSizePseudoEncoding to have been sent
+// using SetEncodings.
+func (c *ClientConn) SetDesktopSize(width, height uint16, screens []Screen) error {
+	if len(screens) == 0 {
+		screen := Screen{Width: width, Height: height}
+		if len(c.screens) > 0 {
+			screen.ID = c.screens[0].ID
+			screen.Flags = c.screens[0].Flags
+		}
+
+		screens = []Screen{screen}
+	}
+
+	return c.Send(&SetDesktopSizeMessage{Width: width, Height: height, Screens: screens})
+}
+
+// SetDesktopSizeMessage requests a change of the size and screen layout
+// of the remote frame buffer. See ClientConn.SetDesktopSize.
+type SetDesktopSizeMessage struct {
+	Width   uint16
+	Height  uint16
+	Screens []Screen
+}
+
+func (*SetDesktopSizeMessage) Type() uint8 {
+	return 251
+}
+
+func (m *SetDesktopSizeMessage) Serialize(w io.Writer) error {
+	data := []interface{}{
+		m.Type(),
+		uint8(0),
+		m.Width,
+		m.Height,
+		uint8(len(m.Screens)),
+		uint8(0),
+	}
+
+	for _, screen := range m.Screens {
+		data = append(data, screen)
+	}
+
+	return writeMessage(w, data)
+}
+
+func (*SetDesktopSizeMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	var header struct {
+		Padding1 uint8
+		Width    uint16
+		Height   uint16
+		Count    uint8
+		Padding2 uint8
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+
+	result := SetDesktopSizeMessage{
+		Width:   header.Width,
+		Height:  header.Height,
+		Screens: make([]Screen, header.Count),
+	}
+	if err := binary.Read(r, binary.BigEndian, result.Screens); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// requestPreferredResolution requests the preferred resolution of the
+// configuration once the server has announced its support for the
+// ExtendedDesktopSize pseudo-encoding.
+func (c *ClientConn) requestPreferredResolution() error {
+	preferred := c.config.PreferredResolution
+	if preferred.X <= 0 || preferred.Y <= 0 || !c.extendedDesktopSize || c.resolutionRequested {
+		return nil
+	}
+
+	c.resolutionRequested = true
+	if int(c.FrameBufferWidth) == preferred.X && int(c.FrameBufferHeight) == preferred.Y {
+		return nil
+	}
+
+	return c.SetDesktopSize(uint16(preferred.X), uint16(preferred.Y), nil)
+}
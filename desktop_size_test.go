@@ -0,0 +1,175 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// writeExtendedDesktopSize writes a FramebufferUpdate with a single
+// ExtendedDesktopSize rectangle describing a single screen with ID 7.
+func writeExtendedDesktopSize(t *testing.T, server net.Conn, reason, status, width, height uint16) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 1})
+	binary.Write(&buf, binary.BigEndian, []uint16{reason, status, width, height})
+	binary.Write(&buf, binary.BigEndian, int32(-308))
+	buf.Write([]byte{1, 0, 0, 0})
+	binary.Write(&buf, binary.BigEndian, &Screen{ID: 7, Width: width, Height: height})
+
+	if _, err := server.Write(buf.Bytes()); err != nil {
+		t.Fatalf("error writing update: %s", err)
+	}
+}
+
+func testPreferredResolution(t *testing.T, status uint16) *ClientConn {
+	msgCh := make(chan ServerMessage, 2)
+	conn, server := newTestClientConn(&ClientConfig{
+		PreferredResolution: image.Point{1280, 720},
+		ServerMessageCh:     msgCh,
+	})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 800
+	conn.FrameBufferHeight = 600
+	conn.Encs = []Encoding{new(ExtendedDesktopSizePseudoEncoding)}
+
+	go conn.mainLoop()
+
+	writeExtendedDesktopSize(t, server, DesktopSizeReasonServer, DesktopSizeStatusOK, 800, 600)
+
+	var request [24]byte
+	if _, err := io.ReadFull(server, request[:]); err != nil {
+		t.Fatalf("error reading SetDesktopSize: %s", err)
+	}
+
+	expected := []byte{
+		251, 0, 0x05, 0x00, 0x02, 0xd0, 1, 0, // 1280x720, one screen
+		0, 0, 0, 7, 0, 0, 0, 0, 0x05, 0x00, 0x02, 0xd0, 0, 0, 0, 0,
+	}
+	if !bytes.Equal(request[:], expected) {
+		t.Fatalf("SetDesktopSize = %v, want %v", request, expected)
+	}
+
+	if status == DesktopSizeStatusOK {
+		writeExtendedDesktopSize(t, server, DesktopSizeReasonClient, status, 1280, 720)
+	} else {
+		writeExtendedDesktopSize(t, server, DesktopSizeReasonClient, status, 800, 600)
+	}
+
+	var enc *ExtendedDesktopSizePseudoEncoding
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-msgCh:
+			enc = msg.(*FramebufferUpdateMessage).Rectangles[0].Enc.(*ExtendedDesktopSizePseudoEncoding)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for update")
+		}
+	}
+
+	if enc.Reason != DesktopSizeReasonClient || enc.Status != status {
+		t.Fatalf("unexpected result: %#v", enc)
+	}
+
+	return conn
+}
+
+func TestClientConn_PreferredResolution(t *testing.T) {
+	conn := testPreferredResolution(t, DesktopSizeStatusOK)
+	if conn.FrameBufferWidth != 1280 || conn.FrameBufferHeight != 720 {
+		t.Fatalf("size = %dx%d, want 1280x720", conn.FrameBufferWidth, conn.FrameBufferHeight)
+	}
+}
+
+func TestClientConn_PreferredResolutionRejected(t *testing.T) {
+	conn := testPreferredResolution(t, DesktopSizeStatusProhibited)
+	if conn.FrameBufferWidth != 800 || conn.FrameBufferHeight != 600 {
+		t.Fatalf("size = %dx%d, want 800x600", conn.FrameBufferWidth, conn.FrameBufferHeight)
+	}
+}
+
+func TestExtendedDesktopSize_LargerThanFramebuffer(t *testing.T) {
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  640,
+		FrameBufferHeight: 480,
+		Encs:              []Encoding{new(ExtendedDesktopSizePseudoEncoding)},
+		config:            &ClientConfig{},
+	}
+
+	// The resize follows raw pixel data, where a real rectangle outside
+	// of the framebuffer would be taken as a pixel format mismatch.
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 2})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 1, 1})
+	binary.Write(&buf, binary.BigEndian, int32(0))
+	buf.Write([]byte{1, 2, 3, 0})
+	binary.Write(&buf, binary.BigEndian, []uint16{DesktopSizeReasonServer, DesktopSizeStatusOK, 1920, 1080})
+	binary.Write(&buf, binary.BigEndian, int32(-308))
+	buf.Write([]byte{1, 0, 0, 0})
+	binary.Write(&buf, binary.BigEndian, &Screen{ID: 7, Width: 1920, Height: 1080})
+
+	msg, err := new(FramebufferUpdateMessage).Read(conn, &buf)
+	if err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+
+	if n := msg.(*FramebufferUpdateMessage).NumRectangles(); n != 2 {
+		t.Fatalf("read %d rectangles, want 2", n)
+	}
+	if conn.FrameBufferWidth != 1920 || conn.FrameBufferHeight != 1080 {
+		t.Fatalf("framebuffer is %dx%d, want 1920x1080", conn.FrameBufferWidth, conn.FrameBufferHeight)
+	}
+
+	// Pixel data outside of the framebuffer is still rejected.
+	rect := Rectangle{X: 1900, Width: 100, Height: 1}
+	if _, err := new(RawEncoding).Read(conn, &rect, bytes.NewReader(make([]byte, 400))); err == nil {
+		t.Fatal("expected error reading a rectangle outside of the framebuffer")
+	}
+}
+
+func TestClientConn_Dimensions(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 640
+	conn.FrameBufferHeight = 480
+	conn.Encs = []Encoding{new(DesktopSizePseudoEncoding)}
+
+	go conn.mainLoop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint16(1); i <= 100; i++ {
+			var buf bytes.Buffer
+			buf.Write([]byte{0, 0, 0, 1})
+			binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 640 + i, 480 + i})
+			binary.Write(&buf, binary.BigEndian, int32(-223))
+			if _, err := server.Write(buf.Bytes()); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The size is read while the main loop resizes the framebuffer,
+	// which the race detector would catch if it wasn't synchronized.
+	deadline := time.Now().Add(time.Second)
+	for {
+		width, height := conn.Dimensions()
+		if width-640 != height-480 {
+			t.Fatalf("inconsistent dimensions %dx%d", width, height)
+		}
+		if width == 740 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for the resizes, at %dx%d", width, height)
+		}
+	}
+
+	<-done
+}
@@ -0,0 +1,156 @@
+package vnc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The port VNC servers listen on for display number 0.
+const defaultPort = 5900
+
+// Dial connects to the VNC server at addr and performs the handshake
+// using the given configuration. The context bounds the time spent
+// connecting and performing the handshake; it has no effect on the
+// connection once Dial has returned.
+//
+// The address can be given in any of these forms:
+//
+//	host          port 5900
+//	host:N        display number N (port 5900+N) if N < 100, else port N
+//	host::port    the given port
+//	vnc://host    port 5900, or the port given in the URL
+//
+// IPv6 literals can be used as the host, enclosed in brackets, as in
+// [::1]:1 or [::1]::5900. A plain IPv6 literal without brackets, such as
+// ::1, is taken as a host on port 5900.
+//
+// When the host name resolves to both IPv4 and IPv6 addresses, Dial
+// tries them in parallel as described by RFC 6555 ("Happy Eyeballs"), so
+// that a broken network family doesn't delay the connection.
+func Dial(ctx context.Context, addr string, cfg *ClientConfig) (*ClientConn, error) {
+	hostPort, err := parseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+
+	// Abort the handshake if the context is cancelled.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			nc.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	conn := &ClientConn{
+		c:              nc,
+		config:         cfg,
+		connectStarted: started,
+	}
+
+	err = conn.handshake()
+	close(done)
+	<-stopped
+
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, err
+	}
+
+	nc.SetDeadline(time.Time{})
+	conn.start()
+
+	return conn, nil
+}
+
+// parseAddress turns one of the address forms accepted by Dial into a
+// host:port suitable for net.Dial.
+func parseAddress(addr string) (string, error) {
+	if strings.HasPrefix(addr, "vnc://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return "", err
+		}
+
+		port := u.Port()
+		if port == "" {
+			port = strconv.Itoa(defaultPort)
+		}
+
+		return net.JoinHostPort(u.Hostname(), port), nil
+	}
+
+	// A plain IPv6 literal, such as ::1, would otherwise be mistaken for
+	// host::port.
+	if isIPv6(addr) {
+		return net.JoinHostPort(addr, strconv.Itoa(defaultPort)), nil
+	}
+
+	// The "::" separating the port from an IPv6 literal comes after the
+	// closing bracket.
+	hostEnd := 0
+	if strings.HasPrefix(addr, "[") {
+		if hostEnd = strings.Index(addr, "]"); hostEnd < 0 {
+			return "", fmt.Errorf("missing ']' in address %q", addr)
+		}
+	}
+
+	if i := strings.Index(addr[hostEnd:], "::"); i >= 0 {
+		host := strings.Trim(addr[:hostEnd+i], "[]")
+		return net.JoinHostPort(host, addr[hostEnd+i+2:]), nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		// No port given.
+		return net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(defaultPort)), nil
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port or display number in %q", addr)
+	}
+
+	// Small numbers are display numbers, relative to the default port.
+	if port < 100 {
+		port += defaultPort
+	}
+
+	return net.JoinHostPort(host, strconv.FormatUint(port, 10)), nil
+}
+
+// isIPv6 reports whether addr is an IPv6 literal, optionally with a zone,
+// without brackets or a port.
+func isIPv6(addr string) bool {
+	if i := strings.LastIndex(addr, "%"); i >= 0 {
+		addr = addr[:i]
+	}
+
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() == nil
+}
@@ -0,0 +1,85 @@
+package vnc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+		isErr    bool
+	}{
+		{"example.com", "example.com:5900", false},
+		{"example.com:0", "example.com:5900", false},
+		{"example.com:1", "example.com:5901", false},
+		{"example.com:99", "example.com:5999", false},
+		{"example.com:5902", "example.com:5902", false},
+		{"example.com::1", "example.com:1", false},
+		{"vnc://example.com", "example.com:5900", false},
+		{"vnc://example.com:5905", "example.com:5905", false},
+		{"vnc://example.com:1/", "example.com:1", false},
+		{"example.com:display", "", true},
+		{"::1", "[::1]:5900", false},
+		{"fe80::1%eth0", "[fe80::1%eth0]:5900", false},
+		{"[::1]", "[::1]:5900", false},
+		{"[::1]:1", "[::1]:5901", false},
+		{"[2001:db8::1]:5910", "[2001:db8::1]:5910", false},
+		{"[::1]::5", "[::1]:5", false},
+		{"vnc://[::1]:5901", "[::1]:5901", false},
+		{"[::1", "", true},
+	}
+
+	for _, tt := range tests {
+		actual, err := parseAddress(tt.addr)
+		if err != nil && !tt.isErr {
+			t.Fatalf("parseAddress(%q) unexpected error %v", tt.addr, err)
+		}
+		if err == nil && tt.isErr {
+			t.Fatalf("parseAddress(%q) expected error", tt.addr)
+		}
+		if actual != tt.expected {
+			t.Errorf("parseAddress(%q) = %q, want %q", tt.addr, actual, tt.expected)
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer ln.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer c.Close()
+
+		errCh <- serveTestHandshake(c, []uint8{1}, nil)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	conn, err := Dial(ctx, "127.0.0.1::"+port, &ClientConfig{})
+	if err != nil {
+		t.Fatalf("error dialing: %s", err)
+	}
+	defer conn.Close()
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("error in mock server: %s", err)
+	}
+	if conn.DesktopName != "test" {
+		t.Fatalf("DesktopName = %q, want %q", conn.DesktopName, "test")
+	}
+}
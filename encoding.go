@@ -1,10 +1,10 @@
 package vnc
 
 import (
-	"bytes"
-	"compress/zlib"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"sort"
 )
 
 // An Encoding implements a method for encoding pixel data that is
@@ -24,50 +24,217 @@ type Encoding interface {
 // See RFC 6143 Section 7.7.1
 type RawEncoding struct {
 	Colors []Color
+
+	// If RowFunc is set on the RawEncoding passed to SetEncodings, raw
+	// rectangles are decoded one row at a time, and RowFunc is called
+	// with each row instead of building Colors, which is left empty.
+	// This avoids holding the pixels of large rectangles in memory. The
+	// y coordinate of the row is in framebuffer coordinates. The row is
+	// only valid until RowFunc returns. Rectangles decoded this way are
+	// not applied to the framebuffer kept with KeepFramebuffer.
+	RowFunc func(rect *Rectangle, y uint16, row []Color)
+
+	// If KeepPixels is set on the RawEncoding passed to SetEncodings, raw
+	// rectangles are not decoded into Colors, which is left nil. Pixels
+	// holds the pixel data instead, as sent by the server in the pixel
+	// format of the connection, for users that pass it on unchanged,
+	// such as proxies. Rectangles decoded this way are not applied to
+	// the framebuffer kept with KeepFramebuffer.
+	KeepPixels bool
+	Pixels     []byte
 }
 
 func (*RawEncoding) Type() int32 {
 	return 0
 }
 
-func (*RawEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
-	bytesPerPixel := c.PixelFormat.BPP / 8
-	pixelBytes := make([]uint8, bytesPerPixel)
+func (re *RawEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	// An empty rectangle has no pixel data to read. Colors is empty rather
+	// than nil, the same as for any other rectangle.
+	if rect.empty() {
+		if re.KeepPixels {
+			return &RawEncoding{KeepPixels: true, Pixels: []byte{}}, nil
+		}
+
+		return &RawEncoding{Colors: []Color{}, RowFunc: re.RowFunc}, nil
+	}
+
+	if err := c.checkRectangle(rect); err != nil {
+		return nil, err
+	}
+
+	if c.config != nil && c.config.InputOnly {
+		if err := c.discardRawPixels(r, rect); err != nil {
+			return nil, err
+		}
 
-	var byteOrder binary.ByteOrder = binary.LittleEndian
-	if c.PixelFormat.BigEndian {
-		byteOrder = binary.BigEndian
+		return &RawEncoding{}, nil
 	}
 
-	colors := make([]Color, int(rect.Height)*int(rect.Width))
+	if re.KeepPixels {
+		pixelBytes := make([]byte, c.PixelFormat.RawRectangleSize(*rect))
+		if err := readRawPixels(r, pixelBytes, rect, 0, len(pixelBytes)); err != nil {
+			return nil, err
+		}
+
+		return &RawEncoding{KeepPixels: true, Pixels: pixelBytes}, nil
+	}
+
+	if re.RowFunc != nil {
+		return re.readRows(c, rect, r)
+	}
+
+	pixels := int(rect.Height) * int(rect.Width)
+	pixelBytes := c.pixelBuffer(c.PixelFormat.RawRectangleSize(*rect))
+	if err := readRawPixels(r, pixelBytes, rect, 0, len(pixelBytes)); err != nil {
+		return nil, err
+	}
+
+	colors := c.colorBuffer(pixels)
+	if err := c.decodeFormat().DecodeInto(colors, pixelBytes, &c.ColorMap); err != nil {
+		return nil, err
+	}
+
+	return &RawEncoding{Colors: colors}, nil
+}
+
+// readRows decodes a rectangle row by row, passing each row to RowFunc.
+func (re *RawEncoding) readRows(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	bytesPerPixel := int(c.PixelFormat.BPP / 8)
+	rowBytes := c.pixelBuffer(int(rect.Width) * bytesPerPixel)
+	row := make([]Color, rect.Width)
 
 	for y := uint16(0); y < rect.Height; y++ {
-		for x := uint16(0); x < rect.Width; x++ {
-			if _, err := io.ReadFull(r, pixelBytes); err != nil {
-				return nil, err
-			}
+		if err := readRawPixels(r, rowBytes, rect, int(y)*len(rowBytes), len(rowBytes)*int(rect.Height)); err != nil {
+			return nil, err
+		}
 
-			var rawPixel uint32
-			if c.PixelFormat.BPP == 8 {
-				rawPixel = uint32(pixelBytes[0])
-			} else if c.PixelFormat.BPP == 16 {
-				rawPixel = uint32(byteOrder.Uint16(pixelBytes))
-			} else if c.PixelFormat.BPP == 32 {
-				rawPixel = byteOrder.Uint32(pixelBytes)
-			}
+		if err := c.decodeFormat().DecodeInto(row, rowBytes, &c.ColorMap); err != nil {
+			return nil, err
+		}
 
-			color := &colors[int(y)*int(rect.Width)+int(x)]
-			if c.PixelFormat.TrueColor {
-				color.R = uint16((rawPixel >> c.PixelFormat.RedShift) & uint32(c.PixelFormat.RedMax))
-				color.G = uint16((rawPixel >> c.PixelFormat.GreenShift) & uint32(c.PixelFormat.GreenMax))
-				color.B = uint16((rawPixel >> c.PixelFormat.BlueShift) & uint32(c.PixelFormat.BlueMax))
-			} else {
-				*color = c.ColorMap[rawPixel]
-			}
+		re.RowFunc(rect, rect.Y+y, row)
+	}
+
+	return &RawEncoding{RowFunc: re.RowFunc}, nil
+}
+
+// discardRawPixels reads the pixel data of a raw rectangle without
+// decoding it, for ClientConfig.InputOnly, through a buffer of at most
+// rawDiscardSize bytes.
+func (c *ClientConn) discardRawPixels(r io.Reader, rect *Rectangle) error {
+	size := c.PixelFormat.RawRectangleSize(*rect)
+	buf := c.pixelBuffer(minInt(size, rawDiscardSize))
+	for offset := 0; offset < size; offset += len(buf) {
+		if err := readRawPixels(r, buf[:minInt(len(buf), size-offset)], rect, offset, size); err != nil {
+			return err
 		}
 	}
 
-	return &RawEncoding{colors}, nil
+	return nil
+}
+
+// The size of the buffer that discardRawPixels reads pixel data into.
+const rawDiscardSize = 32 * 1024
+
+// readRawPixels reads the next len(b) bytes of the pixel data of a raw
+// rectangle of size bytes, of which offset bytes have been read already.
+// Short reads are retried until b is full. If the connection ends before
+// then, the error is an io.ErrUnexpectedEOF saying how much of the
+// rectangle was read, rather than an io.EOF that would look like the
+// server closing the connection between messages.
+func readRawPixels(r io.Reader, b []byte, rect *Rectangle, offset, size int) error {
+	n, err := io.ReadFull(r, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: raw rectangle %dx%d at %d,%d ended after %d of %d bytes",
+			io.ErrUnexpectedEOF, rect.Width, rect.Height, rect.X, rect.Y, offset+n, size)
+	}
+
+	return err
+}
+
+// checkRectangle checks that a rectangle of pixel data lies within the
+// framebuffer, before anything is allocated for its pixels. This keeps a
+// malformed or malicious rectangle from exhausting memory. It is only used by
+// real encodings, since the dimensions of pseudo-encoding rectangles
+// needn't fit; see inFramebuffer.
+//
+// It also checks that the pixels can be decoded at all. RFB only allows
+// 8, 16 and 32 bits per pixel, but some old servers use packed pixel
+// formats of fewer bits, such as 16 colors in 4 bits. Those are rejected
+// here, rather than being read with the wrong number of bytes.
+func (c *ClientConn) checkRectangle(rect *Rectangle) error {
+	if err := c.PixelFormat.checkBPP(); err != nil {
+		return fmt.Errorf("%s, a pixel format of 8, 16 or 32 bits per pixel must be set with SetPixelFormat", err)
+	}
+
+	if !c.inFramebuffer(rect) {
+		return fmt.Errorf("rectangle %dx%d at %d,%d is outside of the %dx%d framebuffer",
+			rect.Width, rect.Height, rect.X, rect.Y, c.FrameBufferWidth, c.FrameBufferHeight)
+	}
+
+	return nil
+}
+
+// inFramebuffer reports whether a rectangle lies within the framebuffer.
+// This only applies to real encodings. The dimensions of a rectangle of
+// a pseudo-encoding have a meaning of their own, such as the new size of
+// the framebuffer for DesktopSize and ExtendedDesktopSize, or the size of
+// the cursor image, and may well exceed the current framebuffer.
+func (c *ClientConn) inFramebuffer(rect *Rectangle) bool {
+	return int(rect.X)+int(rect.Width) <= int(c.FrameBufferWidth) &&
+		int(rect.Y)+int(rect.Height) <= int(c.FrameBufferHeight)
+}
+
+// CopyRectEncoding tells the client to copy a rectangle of pixel data it
+// already has, from the source position to the rectangle. The source may
+// have been painted by an earlier rectangle of the same update, so it
+// must be copied from the framebuffer as it is after all of the
+// preceding rectangles have been applied, as Framebuffer.Apply does.
+//
+// See RFC 6143 Section 7.7.2
+type CopyRectEncoding struct {
+	SrcX uint16
+	SrcY uint16
+
+	// Src is the region to copy from, for users that keep a frame
+	// buffer of their own. Its position is SrcX and SrcY, and its width
+	// and height are those of the destination rectangle, since the
+	// source isn't sent with dimensions of its own. Src.Enc is nil.
+	Src Rectangle
+}
+
+func (*CopyRectEncoding) Type() int32 {
+	return 1
+}
+
+func (*CopyRectEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	if err := c.checkRectangle(rect); err != nil {
+		return nil, err
+	}
+
+	var result CopyRectEncoding
+	if err := binary.Read(r, binary.BigEndian, &result.SrcX); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &result.SrcY); err != nil {
+		return nil, err
+	}
+
+	result.Src = Rectangle{
+		X:      result.SrcX,
+		Y:      result.SrcY,
+		Width:  rect.Width,
+		Height: rect.Height,
+	}
+
+	if c.strict() && !c.inFramebuffer(&result.Src) {
+		return nil, fmt.Errorf("%w: CopyRect source %dx%d at %d,%d is outside of the %dx%d framebuffer",
+			ErrSpecViolation, rect.Width, rect.Height, result.SrcX, result.SrcY, c.FrameBufferWidth, c.FrameBufferHeight)
+	}
+
+	return &result, nil
 }
 
 // DesktopSize Pseudo-Encoding declares that the client is capable
@@ -76,9 +243,12 @@ func (*RawEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding,
 // See RFC 6143 7.8.2
 type DesktopSizePseudoEncoding struct{}
 
-func (*DesktopSizePseudoEncoding) Read(c *vnc.ClientConn, rect *vnc.Rectangle, r io.Reader) (vnc.Encoding, error) {
-	c.FrameBufferWidth = rect.Width
-	c.FrameBufferHeight = rect.Height
+func (*DesktopSizePseudoEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	if err := c.checkFramebufferSize(rect.Width, rect.Height); err != nil {
+		return nil, err
+	}
+
+	c.setDimensions(rect.Width, rect.Height)
 	return &DesktopSizePseudoEncoding{}, nil
 }
 
@@ -86,52 +256,253 @@ func (*DesktopSizePseudoEncoding) Type() int32 {
 	return -223
 }
 
+// LastRectPseudoEncoding declares that the client understands a
+// FramebufferUpdate that ends with a LastRect rectangle, rather than
+// after the number of rectangles given in its header. Servers use this
+// to start sending an update before they know how many rectangles it
+// holds. The LastRect rectangle itself is not included in the update.
+// Since some servers send it regardless, updates ended by LastRect are
+// decoded even if it wasn't sent with SetEncodings, unless
+// ClientConfig.StrictMode is set.
+type LastRectPseudoEncoding struct{}
+
+func (*LastRectPseudoEncoding) Read(*ClientConn, *Rectangle, io.Reader) (Encoding, error) {
+	return &LastRectPseudoEncoding{}, nil
+}
+
+func (*LastRectPseudoEncoding) Type() int32 {
+	return -224
+}
+
+// JPEGQualityPseudoEncoding sets the quality of the JPEG data the server
+// sends with the Tight encodings, from 0 for the lowest to 9 for the
+// highest. Servers such as TigerVNC only send JPEG data once a quality
+// level has been sent with SetEncodings. See ClientConfig.AdaptiveQuality.
+type JPEGQualityPseudoEncoding struct {
+	Level uint8
+}
+
+func (e *JPEGQualityPseudoEncoding) Read(*ClientConn, *Rectangle, io.Reader) (Encoding, error) {
+	return &JPEGQualityPseudoEncoding{Level: e.Level}, nil
+}
+
+func (e *JPEGQualityPseudoEncoding) Type() int32 {
+	return -32 + int32(e.Level)
+}
+
+// CompressionLevelPseudoEncoding sets how hard the server compresses the
+// data of the Zlib and Tight encodings, from 0 for the fastest to 9 for
+// the smallest.
+type CompressionLevelPseudoEncoding struct {
+	Level uint8
+}
+
+func (e *CompressionLevelPseudoEncoding) Read(*ClientConn, *Rectangle, io.Reader) (Encoding, error) {
+	return &CompressionLevelPseudoEncoding{Level: e.Level}, nil
+}
+
+func (e *CompressionLevelPseudoEncoding) Type() int32 {
+	return -256 + int32(e.Level)
+}
+
 // ZlibEncoding is Zlib encoded pixel data
 //
 // See RFC 6143 8.4.2
 type ZlibEncoding struct {
-	Colors     []vnc.Color
-	zlibReader *io.ReadCloser
-	zlibData   bytes.Buffer
+	Colors []Color
+
+	// A single zlib stream is used for each RFB protocol connection, so
+	// its state is kept in the encoding registered with SetEncodings.
+	stream zlibStream
 }
 
-func (ze *ZlibEncoding) Read(c *vnc.ClientConn, rect *vnc.Rectangle, r io.Reader) (vnc.Encoding, error) {
+func (ze *ZlibEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	if err := c.checkRectangle(rect); err != nil {
+		return nil, err
+	}
+
 	var compressedLength uint32
 	if err := binary.Read(r, binary.BigEndian, &compressedLength); err != nil {
 		return nil, err
 	}
 
-	// The RFB protocol expects us to read the entire compressed length;
-	// no more (which could happen if we just passed the reader through
-	// zlib.NewReader, due to the input not being a io.ByteReader), and
-	// no less (which could happen if the compressed length was larger
-	// than what's strictly required for the rect's colors), so we read
-	// all of the data up front, appending it to a buffer that the zlib
-	// decoding processes independently.
-	limitedReader := io.LimitedReader{r, int64(compressedLength)}
-	readBytes, err := io.Copy(&ze.zlibData, &limitedReader)
-	if uint32(readBytes) != compressedLength || err != nil {
-		return nil, err
+	// Creating the stream needs at least its header, which an empty
+	// rectangle may not carry.
+	if rect.empty() && compressedLength == 0 {
+		return &ZlibEncoding{Colors: []Color{}}, nil
 	}
 
-	// A single zlib stream is used for each RFB protocol connection,
-	// so we must re-use the zlib reader between each decode, as we
-	// can only read the zlib header once.
-	if ze.zlibReader == nil {
-		if zlibReader, err := zlib.NewReader(&ze.zlibData); err != nil {
-			return nil, err
-		} else {
-			ze.zlibReader = &zlibReader
-		}
+	zr, err := ze.stream.read(r, int(compressedLength), c.zlibBufferSize())
+	if err != nil {
+		return nil, err
 	}
 
-	if rawEnc, err := (&vnc.RawEncoding{}).Read(c, rect, *ze.zlibReader); err != nil {
+	lr := c.limitDecompressed(rect, &ze.stream, zr)
+	rawEnc, err := new(RawEncoding).Read(c, rect, lr)
+	if err != nil {
 		return nil, err
-	} else {
-		return &ZlibEncoding{Colors: rawEnc.(*vnc.RawEncoding).Colors}, nil
 	}
+	if err := lr.finish(); err != nil {
+		return nil, err
+	}
+
+	return &ZlibEncoding{Colors: rawEnc.(*RawEncoding).Colors}, nil
 }
 
 func (*ZlibEncoding) Type() int32 {
 	return 6
 }
+
+// BuiltinEncodings returns new instances of all of the encodings and
+// pseudo-encodings implemented by this package, ready to be passed to
+// SetEncodings. Encodings are returned in order of preference.
+func BuiltinEncodings() []Encoding {
+	return []Encoding{
+		new(CopyRectEncoding),
+		new(TightEncoding),
+		new(TightPNGEncoding),
+		new(ZlibEncoding),
+		new(HextileEncoding),
+		new(CoRREEncoding),
+		new(RREEncoding),
+		new(RawEncoding),
+		new(DesktopSizePseudoEncoding),
+		new(ExtendedDesktopSizePseudoEncoding),
+		new(CursorPosPseudoEncoding),
+		new(ExtendedClipboardPseudoEncoding),
+		new(FencePseudoEncoding),
+		new(ContinuousUpdatesPseudoEncoding),
+		new(QEMUAudioPseudoEncoding),
+	}
+}
+
+// pseudoEncodingOrder is the order in which pseudo-encodings are sent by
+// SetEncodings, following the real encodings. Servers such as TigerVNC
+// expect the JPEG quality and compression levels to come right after the
+// real encodings, followed by the cursor pseudo-encodings.
+var pseudoEncodingOrder = []func(encType int32) bool{
+	func(t int32) bool { return t >= -32 && t <= -23 },                // JPEG quality
+	func(t int32) bool { return t >= -256 && t <= -247 },              // Compression level
+	func(t int32) bool { return t == -239 || t == -240 || t == -314 }, // Cursor
+	func(t int32) bool { return t == -232 },                           // CursorPos
+	func(t int32) bool { return t == -223 || t == -308 },              // DesktopSize
+	func(t int32) bool { return t == -224 },                           // LastRect
+}
+
+// isPseudoEncoding reports whether an encoding type is a pseudo-encoding,
+// which doesn't carry pixel data. TightPNG is the only real encoding
+// with a negative type.
+func isPseudoEncoding(encType int32) bool {
+	return encType < 0 && encType != -260
+}
+
+// encodingRank returns the position of an encoding type in the order
+// used by orderEncodings.
+func encodingRank(encType int32) int {
+	if !isPseudoEncoding(encType) {
+		return 0
+	}
+
+	for i, matches := range pseudoEncodingOrder {
+		if matches(encType) {
+			return i + 1
+		}
+	}
+
+	return len(pseudoEncodingOrder) + 1
+}
+
+// orderEncodings sorts encodings in the order described by SetEncodings,
+// keeping the order of encodings of the same rank.
+func orderEncodings(encs []Encoding) {
+	sort.SliceStable(encs, func(i, j int) bool {
+		return encodingRank(encs[i].Type()) < encodingRank(encs[j].Type())
+	})
+}
+
+// limitEncodings returns the first max encodings, which are those of
+// highest priority. If Raw is in encs but would be left out, it takes
+// the place of the last one kept, after the other real encodings.
+func limitEncodings(encs []Encoding, max int) []Encoding {
+	if max <= 0 || len(encs) <= max {
+		return encs
+	}
+
+	rawType := new(RawEncoding).Type()
+	var raw Encoding
+	for i, enc := range encs {
+		if enc.Type() == rawType {
+			if i < max {
+				return encs[:max]
+			}
+			raw = enc
+		}
+	}
+	if raw == nil {
+		return encs[:max]
+	}
+
+	limited := make([]Encoding, 0, max)
+	limited = append(limited, encs[:max-1]...)
+	at := len(limited)
+	for i, enc := range limited {
+		if isPseudoEncoding(enc.Type()) {
+			at = i
+			break
+		}
+	}
+
+	limited = append(limited, nil)
+	copy(limited[at+1:], limited[at:])
+	limited[at] = raw
+	return limited
+}
+
+// encodingNames are the names of known encoding types, including those
+// this package doesn't implement.
+var encodingNames = map[int32]string{
+	0:           "Raw",
+	1:           "CopyRect",
+	2:           "RRE",
+	4:           "CoRRE",
+	5:           "Hextile",
+	6:           "Zlib",
+	7:           "Tight",
+	8:           "ZlibHex",
+	16:          "ZRLE",
+	-223:        "DesktopSize",
+	-224:        "LastRect",
+	-232:        "CursorPos",
+	-239:        "Cursor",
+	-240:        "XCursor",
+	-257:        "QEMUPointerMotionChange",
+	-258:        "QEMUExtendedKeyEvent",
+	-259:        "QEMUAudio",
+	-260:        "TightPNG",
+	-261:        "QEMULEDState",
+	-305:        "gii",
+	-307:        "DesktopName",
+	-308:        "ExtendedDesktopSize",
+	-309:        "xvp",
+	-312:        "Fence",
+	-313:        "ContinuousUpdates",
+	-314:        "CursorWithAlpha",
+	-1063131698: "ExtendedClipboard",
+}
+
+// EncodingName returns a human readable name of an encoding type, such
+// as "Raw" for type 0. The number is returned for unknown types.
+func EncodingName(encType int32) string {
+	switch {
+	case encType >= -32 && encType <= -23:
+		return fmt.Sprintf("JPEGQuality%d", encType+32)
+	case encType >= -256 && encType <= -247:
+		return fmt.Sprintf("CompressionLevel%d", encType+256)
+	}
+
+	if name, ok := encodingNames[encType]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Encoding(%d)", encType)
+}
@@ -0,0 +1,951 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// rawUpdate returns the body of a FramebufferUpdate, following the
+// message type, with a single raw rectangle of the given color in
+// testPixelFormat.
+func rawUpdate(width, height uint16, color Color) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 1})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0, width, height})
+	binary.Write(&buf, binary.BigEndian, int32(0))
+
+	pixel := uint32(color.R>>8)<<16 | uint32(color.G>>8)<<8 | uint32(color.B>>8)
+	for i := 0; i < int(width)*int(height); i++ {
+		binary.Write(&buf, binary.LittleEndian, pixel)
+	}
+
+	return buf.Bytes()
+}
+
+func TestRawEncoding_ColorPool(t *testing.T) {
+	pool := new(ColorPool)
+	conn := &ClientConn{
+		config:            &ClientConfig{ColorPool: pool},
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+		PixelFormat:       testPixelFormat,
+	}
+
+	for _, color := range []Color{rgb(1, 2, 3), rgb(4, 5, 6)} {
+		msg, err := new(FramebufferUpdateMessage).Read(conn, bytes.NewReader(rawUpdate(16, 16, color)))
+		if err != nil {
+			t.Fatalf("error reading update: %s", err)
+		}
+
+		update := msg.(*FramebufferUpdateMessage)
+		enc := update.Rectangles[0].Enc.(*RawEncoding)
+		if len(enc.Colors) != 16*16 {
+			t.Fatalf("got %d colors, want %d", len(enc.Colors), 16*16)
+		}
+		for i, c := range enc.Colors {
+			if c != color {
+				t.Fatalf("color %d = %#v, want %#v", i, c, color)
+			}
+		}
+
+		pool.Release(update)
+		if enc.Colors != nil {
+			t.Fatal("colors not cleared by Release")
+		}
+	}
+}
+
+func benchmarkRawEncoding(b *testing.B, pool *ColorPool) {
+	conn := &ClientConn{
+		config:            &ClientConfig{ColorPool: pool},
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+		PixelFormat:       testPixelFormat,
+	}
+
+	data := rawUpdate(256, 256, rgb(1, 2, 3))
+	r := bytes.NewReader(data)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		msg, err := new(FramebufferUpdateMessage).Read(conn, r)
+		if err != nil {
+			b.Fatalf("error reading update: %s", err)
+		}
+
+		if pool != nil {
+			pool.Release(msg.(*FramebufferUpdateMessage))
+		}
+	}
+}
+
+func BenchmarkRawEncoding(b *testing.B) {
+	benchmarkRawEncoding(b, nil)
+}
+
+func BenchmarkRawEncoding_ColorPool(b *testing.B) {
+	benchmarkRawEncoding(b, new(ColorPool))
+}
+
+func TestBuiltinEncodings(t *testing.T) {
+	types := make(map[int32]bool)
+	for _, enc := range BuiltinEncodings() {
+		if name := EncodingName(enc.Type()); name == fmt.Sprintf("Encoding(%d)", enc.Type()) {
+			t.Errorf("encoding %d has no name", enc.Type())
+		}
+
+		types[enc.Type()] = true
+	}
+
+	for _, tt := range []struct {
+		encType int32
+		name    string
+	}{
+		{0, "Raw"},
+		{6, "Zlib"},
+	} {
+		if !types[tt.encType] {
+			t.Errorf("encoding %d missing from BuiltinEncodings", tt.encType)
+		}
+		if name := EncodingName(tt.encType); name != tt.name {
+			t.Errorf("EncodingName(%d) = %q, want %q", tt.encType, name, tt.name)
+		}
+	}
+
+	if name := EncodingName(-28); name != "JPEGQuality4" {
+		t.Errorf("EncodingName(-28) = %q, want %q", name, "JPEGQuality4")
+	}
+	if name := EncodingName(1234); name != "Encoding(1234)" {
+		t.Errorf("EncodingName(1234) = %q, want %q", name, "Encoding(1234)")
+	}
+}
+
+func TestClientConn_DisableEncodings(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{DisableZlib: true})
+	defer server.Close()
+
+	for _, enc := range conn.EnabledEncodings() {
+		if enc.Type() == 6 {
+			t.Fatal("disabled Zlib encoding is enabled")
+		}
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.SetEncodings([]Encoding{new(ZlibEncoding), new(CopyRectEncoding)})
+	}()
+
+	request := make([]byte, 8)
+	if _, err := io.ReadFull(server, request); err != nil {
+		t.Fatalf("error reading SetEncodings: %s", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("error setting encodings: %s", err)
+	}
+
+	expected := []byte{2, 0, 0, 1, 0, 0, 0, 1}
+	if !bytes.Equal(request, expected) {
+		t.Fatalf("request = %v, want %v", request, expected)
+	}
+	if len(conn.Encs) != 1 || conn.Encs[0].Type() != 1 {
+		t.Fatalf("Encs = %v, want only CopyRect", conn.Encs)
+	}
+}
+
+func TestClientConn_DisableHextile(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{DisableHextile: true})
+	defer server.Close()
+
+	for _, enc := range conn.EnabledEncodings() {
+		if enc.Type() == 5 {
+			t.Fatal("disabled Hextile encoding is enabled")
+		}
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.SetEncodings([]Encoding{new(HextileEncoding), new(CopyRectEncoding)})
+	}()
+
+	request := make([]byte, 8)
+	if _, err := io.ReadFull(server, request); err != nil {
+		t.Fatalf("error reading SetEncodings: %s", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("error setting encodings: %s", err)
+	}
+
+	expected := []byte{2, 0, 0, 1, 0, 0, 0, 1}
+	if !bytes.Equal(request, expected) {
+		t.Fatalf("request = %v, want %v", request, expected)
+	}
+	if len(conn.Encs) != 1 || conn.Encs[0].Type() != 1 {
+		t.Fatalf("Encs = %v, want only CopyRect", conn.Encs)
+	}
+}
+
+func TestClientConn_DisableRRE(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{DisableRRE: true})
+	defer server.Close()
+
+	for _, enc := range conn.EnabledEncodings() {
+		if enc.Type() == 2 || enc.Type() == 4 {
+			t.Fatalf("disabled %s encoding is enabled", EncodingName(enc.Type()))
+		}
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.SetEncodings([]Encoding{
+			new(RREEncoding), new(CoRREEncoding), new(CopyRectEncoding)})
+	}()
+
+	request := make([]byte, 8)
+	if _, err := io.ReadFull(server, request); err != nil {
+		t.Fatalf("error reading SetEncodings: %s", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("error setting encodings: %s", err)
+	}
+
+	expected := []byte{2, 0, 0, 1, 0, 0, 0, 1}
+	if !bytes.Equal(request, expected) {
+		t.Fatalf("request = %v, want %v", request, expected)
+	}
+	if len(conn.Encs) != 1 || conn.Encs[0].Type() != 1 {
+		t.Fatalf("Encs = %v, want only CopyRect", conn.Encs)
+	}
+}
+
+func TestRawEncoding_RowFunc(t *testing.T) {
+	var rows []uint16
+	conn := &ClientConn{
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+		PixelFormat:       testPixelFormat,
+		Encs: []Encoding{&RawEncoding{
+			RowFunc: func(rect *Rectangle, y uint16, row []Color) {
+				if len(row) != int(rect.Width) {
+					t.Fatalf("row %d has %d colors, want %d", y, len(row), rect.Width)
+				}
+				if row[0] != rgb(1, 2, 3) {
+					t.Fatalf("row %d color = %#v", y, row[0])
+				}
+
+				rows = append(rows, y)
+			},
+		}},
+	}
+
+	data := rawUpdate(16, 8, rgb(1, 2, 3))
+	msg, err := new(FramebufferUpdateMessage).Read(conn, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+
+	if len(rows) != 8 {
+		t.Fatalf("RowFunc called %d times, want 8", len(rows))
+	}
+	for i, y := range rows {
+		if y != uint16(i) {
+			t.Fatalf("row %d has y = %d", i, y)
+		}
+	}
+
+	if colors := msg.(*FramebufferUpdateMessage).Rectangles[0].Enc.(*RawEncoding).Colors; colors != nil {
+		t.Fatalf("Colors = %d colors, want none", len(colors))
+	}
+}
+
+func TestFramebufferUpdateMessage_EmptyRectangles(t *testing.T) {
+	conn := &ClientConn{
+		Encs:              []Encoding{new(ZlibEncoding), new(DesktopSizePseudoEncoding)},
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  4,
+		FrameBufferHeight: 4,
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 4})
+	binary.Write(&buf, binary.BigEndian, []uint16{1, 1, 0, 0})
+	binary.Write(&buf, binary.BigEndian, int32(0)) // Raw
+	binary.Write(&buf, binary.BigEndian, []uint16{1, 1, 3, 0})
+	binary.Write(&buf, binary.BigEndian, int32(0)) // Raw
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 0, 0})
+	binary.Write(&buf, binary.BigEndian, int32(6)) // Zlib
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 0, 0})
+	binary.Write(&buf, binary.BigEndian, int32(-223)) // DesktopSize
+
+	msg, err := new(FramebufferUpdateMessage).Read(conn, &buf)
+	if err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes left unread", buf.Len())
+	}
+
+	rects := msg.(*FramebufferUpdateMessage).Rectangles
+	for i, colors := range [][]Color{
+		rects[0].Enc.(*RawEncoding).Colors,
+		rects[1].Enc.(*RawEncoding).Colors,
+		rects[2].Enc.(*ZlibEncoding).Colors,
+	} {
+		if colors == nil || len(colors) != 0 {
+			t.Fatalf("rectangle %d: Colors = %#v, want empty", i, colors)
+		}
+	}
+
+	if conn.FrameBufferWidth != 0 || conn.FrameBufferHeight != 0 {
+		t.Fatalf("size is %dx%d after a 0x0 DesktopSize", conn.FrameBufferWidth, conn.FrameBufferHeight)
+	}
+
+	fb := NewFramebuffer(4, 4)
+	fb.Apply(msg.(*FramebufferUpdateMessage))
+	if fb.Width != 0 || fb.Height != 0 || len(fb.Colors) != 0 {
+		t.Fatalf("framebuffer is %dx%d with %d colors", fb.Width, fb.Height, len(fb.Colors))
+	}
+}
+
+func TestDecodeRectangle(t *testing.T) {
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+	}
+
+	rect := Rectangle{Width: 2, Height: 1}
+	enc, err := DecodeRectangle(conn, rect, 0, []byte{1, 2, 3, 0, 4, 5, 6, 0})
+	if err != nil {
+		t.Fatalf("error decoding: %s", err)
+	}
+
+	colors := enc.(*RawEncoding).Colors
+	if colors[0] != rgb(3, 2, 1) || colors[1] != rgb(6, 5, 4) {
+		t.Fatalf("decoded %v", colors)
+	}
+
+	if _, err := DecodeRectangle(conn, rect, 6, nil); err == nil {
+		t.Fatal("expected error decoding an encoding that hasn't been set")
+	}
+}
+
+func ExampleDecodeHex() {
+	conn := &ClientConn{
+		PixelFormat:       *NewPixelFormatRGB888(),
+		FrameBufferWidth:  640,
+		FrameBufferHeight: 480,
+	}
+
+	// Two pixels of a Raw rectangle, pasted from a capture.
+	enc, err := DecodeHex(conn, 0, Rectangle{Width: 2, Height: 1}, `
+		ff 00 00 00 00 80 00 00
+	`)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, color := range enc.(*RawEncoding).Colors {
+		fmt.Printf("%04x %04x %04x\n", color.R, color.G, color.B)
+	}
+
+	// Output:
+	// 0000 0000 ffff
+	// 0000 8080 0000
+}
+
+func TestDecodeHex(t *testing.T) {
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+	}
+
+	rect := Rectangle{Width: 2, Height: 1}
+	for _, data := range []string{"0102030004050600", "01:02:03:00:04:05:06:00", "01 02 03 00\n04 05 06 00\n"} {
+		enc, err := DecodeHex(conn, 0, rect, data)
+		if err != nil {
+			t.Fatalf("error decoding %q: %s", data, err)
+		}
+
+		colors := enc.(*RawEncoding).Colors
+		if colors[0] != rgb(3, 2, 1) || colors[1] != rgb(6, 5, 4) {
+			t.Fatalf("decoded %v from %q", colors, data)
+		}
+	}
+
+	if _, err := DecodeHex(conn, 0, rect, "01020x"); err == nil {
+		t.Fatal("expected error for invalid hex data")
+	}
+}
+
+func FuzzDecodeRectangle(f *testing.F) {
+	encodings := []int32{0, 1, 6, 7, -260}
+
+	f.Add(uint8(0), uint8(2), uint8(1), []byte{1, 2, 3, 0, 4, 5, 6, 0})
+	f.Add(uint8(2), uint8(1), uint8(1), append([]byte{0, 0, 0, 13},
+		0x78, 0x9c, 0x62, 0x64, 0x62, 0x06, 0x04, 0x00, 0x00, 0xff, 0xff, 0x00, 0x00))
+	f.Add(uint8(3), uint8(4), uint8(4), []byte{0x80, 1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, encoding, width, height uint8, data []byte) {
+		conn := &ClientConn{
+			Encs:              BuiltinEncodings(),
+			FrameBufferWidth:  256,
+			FrameBufferHeight: 256,
+			PixelFormat:       testPixelFormat,
+		}
+
+		rect := Rectangle{Width: uint16(width), Height: uint16(height)}
+		encType := encodings[int(encoding)%len(encodings)]
+		enc, err := DecodeRectangle(conn, rect, encType, data)
+		if err != nil {
+			return
+		}
+
+		if enc.Type() != encType {
+			t.Fatalf("decoded %T for encoding %d", enc, encType)
+		}
+	})
+}
+
+func BenchmarkDecodeRectangle_Raw(b *testing.B) {
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+	}
+
+	rect := Rectangle{Width: 256, Height: 256}
+	data := rawUpdate(rect.Width, rect.Height, rgb(1, 2, 3))[15:]
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeRectangle(conn, rect, 0, data); err != nil {
+			b.Fatalf("error decoding: %s", err)
+		}
+	}
+}
+
+func BenchmarkDecodeRectangle_Zlib(b *testing.B) {
+	conn := &ClientConn{
+		Encs:              []Encoding{new(ZlibEncoding)},
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+		PixelFormat:       testPixelFormat,
+	}
+
+	rect := Rectangle{Width: 256, Height: 256}
+	pixels := rawUpdate(rect.Width, rect.Height, rgb(1, 2, 3))[15:]
+
+	// Each rectangle is the next chunk of a single zlib stream, as sent by
+	// the server, so the chunks are compressed as the benchmark goes.
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(pixels)))
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		buf.Reset()
+		binary.Write(&buf, binary.BigEndian, uint32(0))
+		w.Write(pixels)
+		w.Flush()
+		data := buf.Bytes()
+		binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+		b.StartTimer()
+
+		if _, err := DecodeRectangle(conn, rect, 6, data); err != nil {
+			b.Fatalf("error decoding: %s", err)
+		}
+	}
+}
+
+// FuzzDecode reads arbitrary FramebufferUpdate messages with all of the
+// built-in encodings, which must fail with an error rather than panic on
+// malformed data.
+func FuzzDecode(f *testing.F) {
+	formats := []PixelFormat{
+		testPixelFormat,
+		*NewPixelFormatRGB565(),
+		{BPP: 8, Depth: 8},
+	}
+
+	f.Add(uint8(0), rawUpdate(2, 2, rgb(1, 2, 3)))
+	f.Add(uint8(1), []byte{0, 0, 1, 0, 0, 0, 0, 0, 2, 0, 2, 0, 0, 0, 7, 0x80, 1, 2})
+	f.Add(uint8(2), []byte{0, 0, 2,
+		0, 0, 0, 0, 0, 2, 0, 2, 0, 0, 0, 1, 0, 1, 0, 1,
+		0, 0, 0, 0, 0, 10, 0, 10, 0xff, 0xff, 0xff, 0x21})
+
+	f.Fuzz(func(t *testing.T, format uint8, data []byte) {
+		conn := &ClientConn{
+			config:            &ClientConfig{MaxFramebufferPixels: 256 * 256},
+			Encs:              BuiltinEncodings(),
+			FrameBufferWidth:  64,
+			FrameBufferHeight: 64,
+			PixelFormat:       formats[int(format)%len(formats)],
+			ColorMap:          DefaultColorMap256(),
+		}
+
+		msg, err := new(FramebufferUpdateMessage).Read(conn, bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		fb := NewFramebuffer(conn.FrameBufferWidth, conn.FrameBufferHeight)
+		fb.Apply(msg.(*FramebufferUpdateMessage))
+	})
+}
+
+func TestFramebufferUpdateMessage_Bounds(t *testing.T) {
+	tests := []struct {
+		rect    []uint16
+		encType int32
+	}{
+		{[]uint16{0, 0, 0xffff, 0xffff}, 0}, // Raw
+		{[]uint16{60, 0, 8, 1}, 0},          // Raw
+		{[]uint16{0, 60, 1, 8}, 6},          // Zlib
+		{[]uint16{0, 0, 0xffff, 0xffff}, 7}, // Tight
+		{[]uint16{0, 0, 65, 1}, 1},          // CopyRect
+		{[]uint16{0, 0, 0xffff, 0xffff}, -223},
+	}
+
+	for _, tt := range tests {
+		conn := &ClientConn{
+			Encs:              BuiltinEncodings(),
+			FrameBufferWidth:  64,
+			FrameBufferHeight: 64,
+			PixelFormat:       testPixelFormat,
+		}
+
+		var buf bytes.Buffer
+		buf.Write([]byte{0, 0, 1})
+		binary.Write(&buf, binary.BigEndian, tt.rect)
+		binary.Write(&buf, binary.BigEndian, tt.encType)
+		buf.Write([]byte{0x80, 0, 0, 0, 0, 0, 0, 0})
+
+		if _, err := new(FramebufferUpdateMessage).Read(conn, &buf); err == nil {
+			t.Fatalf("expected error reading %v in encoding %d", tt.rect, tt.encType)
+		}
+	}
+}
+
+func TestFramebufferUpdateMessage_PackedPixels(t *testing.T) {
+	// 16 colors, two pixels per byte.
+	format := PixelFormat{BPP: 4, Depth: 4}
+
+	for _, encType := range []int32{0, 1, 6, 7} {
+		conn := &ClientConn{
+			Encs:              BuiltinEncodings(),
+			FrameBufferWidth:  64,
+			FrameBufferHeight: 64,
+			PixelFormat:       format,
+		}
+
+		var buf bytes.Buffer
+		buf.Write([]byte{0, 0, 1})
+		binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 2, 1})
+		binary.Write(&buf, binary.BigEndian, encType)
+		buf.Write([]byte{0x12})
+
+		_, err := new(FramebufferUpdateMessage).Read(conn, &buf)
+		if err == nil || !strings.Contains(err.Error(), "unsupported bits per pixel: 4") {
+			t.Fatalf("encoding %d: unexpected error: %v", encType, err)
+		}
+	}
+}
+
+func TestClientConn_SetEncodingsOrder(t *testing.T) {
+	encs := []Encoding{
+		new(DesktopSizePseudoEncoding),
+		&UnsupportedEncoding{EncodingType: -23}, // JPEG quality 9
+		new(TightEncoding),
+		new(FencePseudoEncoding),
+		new(CursorPosPseudoEncoding),
+		&UnsupportedEncoding{EncodingType: -254}, // Compression level 2
+		new(TightPNGEncoding),
+		&UnsupportedEncoding{EncodingType: -239}, // Cursor
+		new(RawEncoding),
+	}
+
+	tests := []struct {
+		keepOrder bool
+		expected  []int32
+	}{
+		{false, []int32{7, -260, 0, -23, -254, -239, -232, -223, -312}},
+		{true, []int32{-223, -23, 7, -312, -232, -254, -260, -239, 0}},
+	}
+
+	for _, tt := range tests {
+		conn, server := newTestClientConn(&ClientConfig{KeepEncodingOrder: tt.keepOrder})
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- conn.SetEncodings(append([]Encoding(nil), encs...))
+		}()
+
+		msg, err := ReadClientMessage(server, nil)
+		if err != nil {
+			t.Fatalf("error reading SetEncodings: %s", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("error setting encodings: %s", err)
+		}
+		server.Close()
+
+		var types []int32
+		for _, enc := range msg.(*SetEncodingsMessage).Encodings {
+			types = append(types, enc.Type())
+		}
+
+		if fmt.Sprint(types) != fmt.Sprint(tt.expected) {
+			t.Fatalf("KeepEncodingOrder %v: sent %v, want %v", tt.keepOrder, types, tt.expected)
+		}
+	}
+}
+
+func TestClientConn_MaxAdvertisedEncodings(t *testing.T) {
+	encs := []Encoding{
+		new(TightEncoding),
+		new(ZlibEncoding),
+		new(CopyRectEncoding),
+		new(RawEncoding),
+		new(DesktopSizePseudoEncoding),
+		new(FencePseudoEncoding),
+	}
+
+	tests := []struct {
+		max      int
+		expected []int32
+	}{
+		{0, []int32{7, 6, 1, 0, -223, -312}},
+		{6, []int32{7, 6, 1, 0, -223, -312}},
+		{5, []int32{7, 6, 1, 0, -223}},
+		{4, []int32{7, 6, 1, 0}},
+		{3, []int32{7, 6, 0}},
+		{1, []int32{0}},
+	}
+
+	for _, tt := range tests {
+		conn, server := newTestClientConn(&ClientConfig{MaxAdvertisedEncodings: tt.max})
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- conn.SetEncodings(encs)
+		}()
+
+		msg, err := ReadClientMessage(server, nil)
+		if err != nil {
+			t.Fatalf("error reading SetEncodings: %s", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("error setting encodings: %s", err)
+		}
+		server.Close()
+
+		var types []int32
+		for _, enc := range msg.(*SetEncodingsMessage).Encodings {
+			types = append(types, enc.Type())
+		}
+
+		if fmt.Sprint(types) != fmt.Sprint(tt.expected) {
+			t.Fatalf("MaxAdvertisedEncodings %d: sent %v, want %v", tt.max, types, tt.expected)
+		}
+	}
+
+	// Raw is placed after the other real encodings that are kept.
+	limited := limitEncodings([]Encoding{
+		new(TightEncoding),
+		new(DesktopSizePseudoEncoding),
+		new(FencePseudoEncoding),
+		new(RawEncoding),
+	}, 3)
+	var types []int32
+	for _, enc := range limited {
+		types = append(types, enc.Type())
+	}
+	if expected := []int32{7, 0, -223}; fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Fatalf("limited to %v, want %v", types, expected)
+	}
+}
+
+func TestClientConn_ForceEncoding(t *testing.T) {
+	// Forcing an encoding overrides the flags disabling it.
+	conn, server := newTestClientConn(&ClientConfig{DisableTight: true})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 800
+	conn.FrameBufferHeight = 600
+
+	if err := conn.ForceEncoding(12345); err == nil {
+		t.Fatal("expected error forcing an unknown encoding")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.ForceEncoding(new(TightEncoding).Type())
+	}()
+
+	msg, err := ReadClientMessage(server, nil)
+	if err != nil {
+		t.Fatalf("error reading SetEncodings: %s", err)
+	}
+
+	var types []int32
+	for _, enc := range msg.(*SetEncodingsMessage).Encodings {
+		types = append(types, enc.Type())
+	}
+	if fmt.Sprint(types) != "[7 0]" {
+		t.Fatalf("sent encodings %v, want [7 0]", types)
+	}
+
+	expectUpdateRequest(t, server, false, 0, 0, 800, 600)
+	if err := <-errCh; err != nil {
+		t.Fatalf("error forcing encoding: %s", err)
+	}
+}
+
+func TestClientConn_LowCPU(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{LowCPU: true})
+	defer server.Close()
+
+	var enabled []int32
+	for _, enc := range conn.EnabledEncodings() {
+		enabled = append(enabled, enc.Type())
+	}
+
+	expected := []int32{1, 5, 0, -223, -308, -232, -1063131698, -312, -259}
+	if fmt.Sprint(enabled) != fmt.Sprint(expected) {
+		t.Fatalf("EnabledEncodings = %v, want %v", enabled, expected)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.SetEncodings([]Encoding{
+			new(TightEncoding),
+			new(HextileEncoding),
+			&UnsupportedEncoding{EncodingType: -23}, // JPEG quality 9
+			new(ZlibEncoding),
+			new(RawEncoding),
+			&UnsupportedEncoding{EncodingType: -254}, // Compression level 2
+		})
+	}()
+
+	msg, err := ReadClientMessage(server, nil)
+	if err != nil {
+		t.Fatalf("error reading SetEncodings: %s", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("error setting encodings: %s", err)
+	}
+
+	var sent []int32
+	for _, enc := range msg.(*SetEncodingsMessage).Encodings {
+		sent = append(sent, enc.Type())
+	}
+
+	if expected := []int32{5, 0, -254}; fmt.Sprint(sent) != fmt.Sprint(expected) {
+		t.Fatalf("sent %v, want %v", sent, expected)
+	}
+}
+
+func TestClientConn_InputOnly(t *testing.T) {
+	msgCh := make(chan ServerMessage, 2)
+	conn, server := newTestClientConn(&ClientConfig{InputOnly: true, ServerMessageCh: msgCh})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 640
+	conn.FrameBufferHeight = 480
+	conn.PixelFormat = testPixelFormat
+
+	// Raw is the only real encoding, without the cursor.
+	for _, enc := range conn.EnabledEncodings() {
+		if encType := enc.Type(); (encType != 0 && !isPseudoEncoding(encType)) || encType == -239 {
+			t.Fatalf("encoding %d enabled", encType)
+		}
+	}
+	conn.Encs = conn.EnabledEncodings()
+
+	go conn.mainLoop()
+
+	// The minimal pixel format is set first.
+	msg, err := ReadClientMessage(server, nil)
+	if err != nil {
+		t.Fatalf("error reading SetPixelFormat: %s", err)
+	}
+	setPixelFormat, ok := msg.(*SetPixelFormatMessage)
+	if !ok || setPixelFormat.PixelFormat != *NewPixelFormatBGR233() {
+		t.Fatalf("read %#v, want SetPixelFormat with BGR233", msg)
+	}
+
+	// Updates are read, without decoding them.
+	var update bytes.Buffer
+	update.Write([]byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 64, 0, 64, 0, 0, 0, 0})
+	update.Write(bytes.Repeat([]byte{0xff}, 64*64))
+	update.WriteByte(2)
+	go server.Write(update.Bytes())
+
+	for _, expected := range []uint8{0, 2} {
+		msg := <-msgCh
+		if msg.Type() != expected {
+			t.Fatalf("received message type %d, want %d", msg.Type(), expected)
+		}
+		if update, ok := msg.(*FramebufferUpdateMessage); ok {
+			if colors := update.Rectangles[0].Enc.(*RawEncoding).Colors; colors != nil {
+				t.Fatalf("raw rectangle decoded into %d colors", len(colors))
+			}
+		}
+	}
+
+	// Input is sent as usual.
+	go conn.KeyEvent(0x61, true)
+	msg, err = ReadClientMessage(server, nil)
+	if err != nil {
+		t.Fatalf("error reading KeyEvent: %s", err)
+	}
+	if key, ok := msg.(*KeyEventMessage); !ok || key.Keysym != 0x61 || !key.Down {
+		t.Fatalf("read %#v, want a KeyEvent", msg)
+	}
+
+	// Discarding the pixels allocates nothing but the encoding.
+	conn = &ClientConn{
+		config:            &ClientConfig{InputOnly: true},
+		FrameBufferWidth:  640,
+		FrameBufferHeight: 480,
+		PixelFormat:       testPixelFormat,
+	}
+	data := make([]byte, 4*640*480)
+	r := bytes.NewReader(data)
+	rect := &Rectangle{Width: 640, Height: 480}
+	allocs := testing.AllocsPerRun(10, func() {
+		r.Reset(data)
+		if _, err := new(RawEncoding).Read(conn, rect, r); err != nil {
+			t.Fatalf("error reading rectangle: %s", err)
+		}
+		if r.Len() != 0 {
+			t.Fatalf("%d bytes left unread", r.Len())
+		}
+	})
+	if allocs > 1 {
+		t.Fatalf("%v allocations per rectangle, want 1", allocs)
+	}
+}
+
+func TestCopyRectEncoding_Src(t *testing.T) {
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+		Encs:              []Encoding{new(CopyRectEncoding)},
+	}
+
+	rect := Rectangle{X: 100, Y: 50, Width: 30, Height: 20}
+	enc, err := DecodeRectangle(conn, rect, 1, []byte{0, 10, 0, 200})
+	if err != nil {
+		t.Fatalf("error decoding: %s", err)
+	}
+
+	copyRect := enc.(*CopyRectEncoding)
+	expected := Rectangle{X: 10, Y: 200, Width: 30, Height: 20}
+	if copyRect.Src != expected || copyRect.SrcX != 10 || copyRect.SrcY != 200 {
+		t.Fatalf("decoded %+v, want source %+v", *copyRect, expected)
+	}
+}
+
+func TestRawEncoding_KeepPixels(t *testing.T) {
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+		Encs:              []Encoding{&RawEncoding{KeepPixels: true}},
+	}
+
+	data := []byte{1, 2, 3, 0, 4, 5, 6, 0}
+	enc, err := DecodeRectangle(conn, Rectangle{Width: 2, Height: 1}, 0, data)
+	if err != nil {
+		t.Fatalf("error decoding: %s", err)
+	}
+
+	raw := enc.(*RawEncoding)
+	if !bytes.Equal(raw.Pixels, data) || raw.Colors != nil {
+		t.Fatalf("decoded pixels %v and %d colors, want %v", raw.Pixels, len(raw.Colors), data)
+	}
+
+	// Short pixel data is still an error.
+	if _, err := DecodeRectangle(conn, Rectangle{Width: 3, Height: 1}, 0, data); err == nil {
+		t.Fatal("expected error for short pixel data")
+	}
+}
+
+// chunkReader returns the data of r in reads of at most n bytes.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *chunkReader) Read(b []byte) (int, error) {
+	if len(b) > cr.n {
+		b = b[:cr.n]
+	}
+
+	return cr.r.Read(b)
+}
+
+func TestRawEncoding_ShortReads(t *testing.T) {
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+	}
+
+	data := []byte{
+		1, 2, 3, 0, 4, 5, 6, 0, 7, 8, 9, 0,
+		10, 11, 12, 0, 13, 14, 15, 0, 16, 17, 18, 0,
+	}
+	expected := []Color{
+		rgb(3, 2, 1), rgb(6, 5, 4), rgb(9, 8, 7),
+		rgb(12, 11, 10), rgb(15, 14, 13), rgb(18, 17, 16),
+	}
+
+	encs := []*RawEncoding{
+		{},
+		{RowFunc: func(*Rectangle, uint16, []Color) {}},
+		{KeepPixels: true},
+	}
+
+	for i, re := range encs {
+		rect := Rectangle{X: 10, Y: 20, Width: 3, Height: 2}
+
+		// Pixels split across reads are put back together.
+		enc, err := re.Read(conn, &rect, &chunkReader{bytes.NewReader(data), 3})
+		if err != nil {
+			t.Fatalf("%d: error decoding: %s", i, err)
+		}
+		if i == 0 {
+			checkColors(t, enc.(*RawEncoding).Colors, expected)
+		}
+
+		// A rectangle cut short is an unexpected EOF, even if it ends
+		// right where a read did.
+		for _, length := range []int{0, 12, 20} {
+			_, err := re.Read(conn, &rect, &chunkReader{bytes.NewReader(data[:length]), 3})
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("%d: err = %v for %d bytes, want %v", i, err, length, io.ErrUnexpectedEOF)
+			}
+
+			want := fmt.Sprintf("raw rectangle 3x2 at 10,20 ended after %d of 24 bytes", length)
+			if !strings.Contains(err.Error(), want) {
+				t.Fatalf("%d: error %q doesn't contain %q", i, err, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package vnc
+
+// Feature is a protocol extension that servers announce support for
+// implicitly, by starting to use it once the client has sent its
+// pseudo-encoding with SetEncodings. See ClientConn.SupportsFeature.
+type Feature int
+
+const (
+	// FeatureDesktopSize is support for resizing the framebuffer, seen
+	// in a DesktopSize or ExtendedDesktopSize rectangle.
+	FeatureDesktopSize Feature = iota
+
+	// FeatureExtendedDesktopSize is support for multiple screens and for
+	// SetDesktopSize, seen in an ExtendedDesktopSize rectangle.
+	FeatureExtendedDesktopSize
+
+	// FeatureCursor is support for a local cursor, seen in a Cursor
+	// rectangle.
+	FeatureCursor
+
+	// FeatureCursorPos is support for cursor position updates, seen in a
+	// CursorPos rectangle.
+	FeatureCursorPos
+
+	// FeatureLastRect is support for ending updates early, seen in a
+	// LastRect rectangle.
+	FeatureLastRect
+
+	// FeatureContinuousUpdates is support for continuous updates, seen in
+	// an EndOfContinuousUpdatesMessage.
+	FeatureContinuousUpdates
+
+	// FeatureFence is support for fences, seen in a Fence request from
+	// the server.
+	FeatureFence
+
+	// FeatureExtendedClipboard is support for the extended clipboard,
+	// seen in a Caps message.
+	FeatureExtendedClipboard
+
+	// FeatureGII is support for the General Input Interface, seen in a
+	// GII version message.
+	FeatureGII
+)
+
+// featureEncodings are the encoding types whose rectangles show that the
+// server supports each feature.
+var featureEncodings = map[Feature][]int32{
+	FeatureDesktopSize:         {-223, -308},
+	FeatureExtendedDesktopSize: {-308},
+	FeatureCursor:              {-239},
+	FeatureCursorPos:           {-232},
+	FeatureLastRect:            {-224},
+}
+
+// SupportsFeature reports whether the server has shown that it supports
+// a feature, by using it. Since servers only start using a feature when
+// they need to, such as sending a Cursor rectangle once the cursor has
+// changed, this may report false for a while after SetEncodings even if
+// the server supports the feature. Viewers can use it to enable the
+// parts of their user interface that depend on a feature once it
+// becomes available.
+func (c *ClientConn) SupportsFeature(f Feature) bool {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	if c.features[f] {
+		return true
+	}
+
+	for _, encType := range featureEncodings[f] {
+		if _, ok := c.encodingStats[encType]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// observeFeatures records the features shown to be supported by a
+// message from the server. Features seen in rectangles come from the
+// statistics of each encoding instead.
+func (c *ClientConn) observeFeatures(msg ServerMessage) {
+	var f Feature
+	switch msg := msg.(type) {
+	case *EndOfContinuousUpdatesMessage:
+		f = FeatureContinuousUpdates
+	case *FenceMessage:
+		if msg.Flags&FenceRequest == 0 {
+			return
+		}
+		f = FeatureFence
+	case *ExtendedClipboardMessage:
+		if msg.Flags&ClipboardActionCaps == 0 {
+			return
+		}
+		f = FeatureExtendedClipboard
+	case *GIIServerMessage:
+		if msg.SubType != GIIVersion {
+			return
+		}
+		f = FeatureGII
+	default:
+		return
+	}
+
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	if c.features == nil {
+		c.features = make(map[Feature]bool)
+	}
+	c.features[f] = true
+}
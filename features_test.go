@@ -0,0 +1,47 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestClientConn_SupportsFeature(t *testing.T) {
+	conn := &ClientConn{
+		Encs:        []Encoding{new(CursorPseudoEncoding)},
+		PixelFormat: testPixelFormat,
+	}
+
+	if conn.SupportsFeature(FeatureCursor) {
+		t.Fatal("cursor supported before any Cursor rectangle")
+	}
+
+	// A 1x1 Cursor rectangle.
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 1})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 1, 1})
+	binary.Write(&buf, binary.BigEndian, int32(-239))
+	buf.Write([]byte{0, 0, 0xff, 0, 0x80})
+
+	if _, err := new(FramebufferUpdateMessage).Read(conn, &buf); err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+
+	if !conn.SupportsFeature(FeatureCursor) {
+		t.Fatal("cursor not supported after a Cursor rectangle")
+	}
+	if conn.SupportsFeature(FeatureDesktopSize) {
+		t.Fatal("desktop size supported without a DesktopSize rectangle")
+	}
+
+	// Only fence requests from the server show its support, since
+	// responses answer the client's requests.
+	conn.observeFeatures(&FenceMessage{})
+	if conn.SupportsFeature(FeatureFence) {
+		t.Fatal("fences supported after a fence response")
+	}
+	conn.observeFeatures(&FenceMessage{Flags: FenceRequest})
+	if !conn.SupportsFeature(FeatureFence) {
+		t.Fatal("fences not supported after a fence request")
+	}
+}
@@ -0,0 +1,194 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// FencePseudoEncoding declares that the client supports the Fence
+// extension, which lets either side synchronize with the stream of
+// messages sent by the other.
+type FencePseudoEncoding struct{}
+
+func (*FencePseudoEncoding) Type() int32 {
+	return -312
+}
+
+func (*FencePseudoEncoding) Read(*ClientConn, *Rectangle, io.Reader) (Encoding, error) {
+	return &FencePseudoEncoding{}, nil
+}
+
+// Flags of a Fence message.
+const (
+	FenceBlockBefore uint32 = 1 << 0
+	FenceBlockAfter  uint32 = 1 << 1
+	FenceSyncNext    uint32 = 1 << 2
+	FenceRequest     uint32 = 1 << 31
+)
+
+// fenceFlags are the flags the client supports in responses.
+const fenceFlags = FenceBlockBefore | FenceBlockAfter | FenceSyncNext
+
+// maxFencePayload is the largest payload allowed in a Fence message.
+const maxFencePayload = 64
+
+// FenceMessage is a Fence message, which is sent by both the client and
+// the server. Fence requests from the server, which have FenceRequest
+// set, are answered automatically by the connection.
+type FenceMessage struct {
+	Flags   uint32
+	Payload []byte
+}
+
+func (*FenceMessage) Type() uint8 {
+	return 248
+}
+
+func (*FenceMessage) Read(c *ClientConn, r io.Reader) (ServerMessage, error) {
+	// Read off the padding
+	var padding [3]byte
+	if _, err := io.ReadFull(r, padding[:]); err != nil {
+		return nil, err
+	}
+
+	var result FenceMessage
+	if err := binary.Read(r, binary.BigEndian, &result.Flags); err != nil {
+		return nil, err
+	}
+
+	var length uint8
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	if length > maxFencePayload {
+		return nil, fmt.Errorf("fence payload too long: %d", length)
+	}
+
+	result.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, result.Payload); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (m *FenceMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	msg, err := m.Read(nil, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.(*FenceMessage), nil
+}
+
+// Fence sends a Fence message to the server. The payload may be at most
+// 64 bytes, and is echoed back by the server in its response if flags
+// contains FenceRequest.
+func (c *ClientConn) Fence(flags uint32, payload []byte) error {
+	return c.Send(&FenceMessage{Flags: flags, Payload: payload})
+}
+
+func (m *FenceMessage) Serialize(w io.Writer) error {
+	if len(m.Payload) > maxFencePayload {
+		return fmt.Errorf("fence payload too long: %d", len(m.Payload))
+	}
+
+	return writeMessage(w, []interface{}{
+		m.Type(),
+		[3]uint8{},
+		m.Flags,
+		uint8(len(m.Payload)),
+		m.Payload,
+	})
+}
+
+// Ping measures the round trip time to the server, by sending a Fence
+// request and waiting for the server to respond to it. Since the request
+// has FenceBlockBefore set, the response is only sent once the server
+// has processed all of the messages sent before it, which makes this an
+// application level measurement rather than a network level one.
+//
+// The server must support the Fence extension, which it announces by
+// sending a Fence request after the client has sent FencePseudoEncoding
+// using SetEncodings. Ping waits until ctx is done if no response is
+// received.
+func (c *ClientConn) Ping(ctx context.Context) (time.Duration, error) {
+	c.pingLock.Lock()
+	if c.pings == nil {
+		c.pings = make(map[uint32]chan struct{})
+	}
+	c.pingSeq++
+	seq := c.pingSeq
+	done := make(chan struct{})
+	c.pings[seq] = done
+	c.pingLock.Unlock()
+
+	defer func() {
+		c.pingLock.Lock()
+		delete(c.pings, seq)
+		c.pingLock.Unlock()
+	}()
+
+	start := time.Now()
+	if err := c.Fence(FenceRequest|FenceBlockBefore, pingPayload(seq)); err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-done:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// pingPrefix starts the payload of fences sent by Ping, to tell them
+// apart from fences sent by the user of the connection.
+var pingPrefix = []byte("ping")
+
+func pingPayload(seq uint32) []byte {
+	payload := make([]byte, len(pingPrefix)+4)
+	copy(payload, pingPrefix)
+	binary.BigEndian.PutUint32(payload[len(pingPrefix):], seq)
+	return payload
+}
+
+// handleFence answers fence requests from the server, and completes
+// pending pings. It reports whether the message was a response to a
+// ping, or to a fence of LowLatencyMode, in which case it isn't passed
+// on to the user.
+func (c *ClientConn) handleFence(msg *FenceMessage) (bool, error) {
+	if msg.Flags&FenceRequest != 0 {
+		// Messages are handled in order, so everything received before
+		// the request has been processed already, satisfying all of the
+		// flags we support.
+		return false, c.Fence(msg.Flags&fenceFlags, msg.Payload)
+	}
+
+	if c.frameFenceAnswered(msg) {
+		return true, nil
+	}
+
+	if len(msg.Payload) != len(pingPrefix)+4 || !bytes.HasPrefix(msg.Payload, pingPrefix) {
+		return false, nil
+	}
+
+	seq := binary.BigEndian.Uint32(msg.Payload[len(pingPrefix):])
+
+	c.pingLock.Lock()
+	defer c.pingLock.Unlock()
+
+	done, ok := c.pings[seq]
+	if !ok {
+		return false, nil
+	}
+
+	close(done)
+	delete(c.pings, seq)
+	return true, nil
+}
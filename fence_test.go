@@ -0,0 +1,120 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// readFence reads a Fence message sent by the client.
+func readFence(r io.Reader) (*FenceMessage, error) {
+	var messageType uint8
+	if err := binary.Read(r, binary.BigEndian, &messageType); err != nil {
+		return nil, err
+	}
+
+	msg, err := new(FenceMessage).Read(nil, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.(*FenceMessage), nil
+}
+
+// writeFence writes a Fence message to the client.
+func writeFence(w io.Writer, flags uint32, payload []byte) error {
+	var buf bytes.Buffer
+	buf.Write([]byte{248, 0, 0, 0})
+	binary.Write(&buf, binary.BigEndian, flags)
+	buf.WriteByte(uint8(len(payload)))
+	buf.Write(payload)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// echoFences answers the fence requests of the client, after delay.
+func echoFences(server net.Conn, delay time.Duration) {
+	for {
+		msg, err := readFence(server)
+		if err != nil {
+			return
+		}
+
+		time.Sleep(delay)
+		if err := writeFence(server, msg.Flags&^FenceRequest, msg.Payload); err != nil {
+			return
+		}
+	}
+}
+
+func TestClientConn_Ping(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+
+	go conn.mainLoop()
+	go echoFences(server, 20*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		rtt, err := conn.Ping(context.Background())
+		if err != nil {
+			t.Fatalf("error pinging: %s", err)
+		}
+		if rtt < 20*time.Millisecond || rtt > time.Second {
+			t.Fatalf("rtt = %s, want about 20ms", rtt)
+		}
+	}
+
+	if len(conn.pings) != 0 {
+		t.Fatalf("%d pings left pending", len(conn.pings))
+	}
+}
+
+func TestClientConn_PingTimeout(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+
+	go conn.mainLoop()
+	go func() {
+		// Consume the fence, but never respond to it.
+		readFence(server)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := conn.Ping(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestClientConn_FenceRequest(t *testing.T) {
+	messageCh := make(chan ServerMessage, 1)
+	conn, server := newTestClientConn(&ClientConfig{ServerMessageCh: messageCh})
+	defer server.Close()
+
+	go conn.mainLoop()
+
+	payload := []byte("sync")
+	go writeFence(server, FenceRequest|FenceBlockBefore|1<<10, payload)
+
+	response, err := readFence(server)
+	if err != nil {
+		t.Fatalf("error reading fence response: %s", err)
+	}
+	if response.Flags != FenceBlockBefore {
+		t.Fatalf("flags = %#x, want %#x", response.Flags, FenceBlockBefore)
+	}
+	if !bytes.Equal(response.Payload, payload) {
+		t.Fatalf("payload = %q, want %q", response.Payload, payload)
+	}
+
+	msg := (<-messageCh).(*FenceMessage)
+	if msg.Flags&FenceRequest == 0 {
+		t.Fatalf("request not passed on, flags = %#x", msg.Flags)
+	}
+}
@@ -0,0 +1,492 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// The TightVNC file transfer messages implemented here are those of the
+// TightVNC 1.x protocol, which servers such as LibVNCServer and TightVNC
+// enable among the capabilities of the Tight security type. The client
+// doesn't check that the server announced them; a server that doesn't
+// implement them will likely close the connection.
+
+// fileListError is set in the flags of a FileListData message when the
+// server couldn't read the directory.
+const fileListError = 0x80
+
+// RemoteFile is an entry of a directory listed with ListDir.
+type RemoteFile struct {
+	Name  string
+	IsDir bool
+
+	// The size and modification time of files. They are zero for
+	// directories.
+	Size    uint32
+	ModTime time.Time
+}
+
+// FileListRequestMessage asks the server for the entries of a directory,
+// which it sends in a FileListDataMessage.
+type FileListRequestMessage struct {
+	Flags uint8
+	Path  string
+}
+
+func (*FileListRequestMessage) Type() uint8 {
+	return 130
+}
+
+func (m *FileListRequestMessage) Serialize(w io.Writer) error {
+	if len(m.Path) > 0xffff {
+		return fmt.Errorf("path of %d bytes is too long", len(m.Path))
+	}
+
+	return writeMessage(w, []interface{}{
+		m.Type(),
+		m.Flags,
+		uint16(len(m.Path)),
+		[]byte(m.Path),
+	})
+}
+
+func (*FileListRequestMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	var result FileListRequestMessage
+	if err := binary.Read(r, binary.BigEndian, &result.Flags); err != nil {
+		return nil, err
+	}
+
+	path, err := readFileTransferString(r)
+	if err != nil {
+		return nil, err
+	}
+	result.Path = path
+
+	return &result, nil
+}
+
+// FileDownloadRequestMessage asks the server for the contents of a file,
+// starting at Position, which it sends in FileDownloadDataMessages.
+type FileDownloadRequestMessage struct {
+	Path     string
+	Position uint32
+}
+
+func (*FileDownloadRequestMessage) Type() uint8 {
+	return 131
+}
+
+func (m *FileDownloadRequestMessage) Serialize(w io.Writer) error {
+	if len(m.Path) > 0xffff {
+		return fmt.Errorf("path of %d bytes is too long", len(m.Path))
+	}
+
+	return writeMessage(w, []interface{}{
+		m.Type(),
+		uint8(0),
+		uint16(len(m.Path)),
+		m.Position,
+		[]byte(m.Path),
+	})
+}
+
+func (*FileDownloadRequestMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	var header struct {
+		CompressionLevel uint8
+		PathLength       uint16
+		Position         uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+
+	path, err := readBytes(r, uint32(header.PathLength))
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileDownloadRequestMessage{Path: string(path), Position: header.Position}, nil
+}
+
+// FileDownloadCancelMessage stops a download before the server has sent
+// all of the file.
+type FileDownloadCancelMessage struct {
+	Reason string
+}
+
+func (*FileDownloadCancelMessage) Type() uint8 {
+	return 134
+}
+
+func (m *FileDownloadCancelMessage) Serialize(w io.Writer) error {
+	reason := m.Reason
+	if len(reason) > 0xffff {
+		reason = reason[:0xffff]
+	}
+
+	return writeMessage(w, []interface{}{
+		m.Type(),
+		uint8(0),
+		uint16(len(reason)),
+		[]byte(reason),
+	})
+}
+
+func (*FileDownloadCancelMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	var padding uint8
+	if err := binary.Read(r, binary.BigEndian, &padding); err != nil {
+		return nil, err
+	}
+
+	reason, err := readFileTransferString(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileDownloadCancelMessage{Reason: reason}, nil
+}
+
+// FileListDataMessage holds the entries of the directory asked for with a
+// FileListRequestMessage. Failed is set if the server couldn't read it.
+type FileListDataMessage struct {
+	Flags  uint8
+	Failed bool
+	Files  []RemoteFile
+}
+
+func (*FileListDataMessage) Type() uint8 {
+	return 130
+}
+
+func (*FileListDataMessage) Read(c *ClientConn, r io.Reader) (ServerMessage, error) {
+	var header struct {
+		Flags          uint8
+		Files          uint16
+		DataSize       uint16
+		CompressedSize uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+
+	sizes := make([]struct{ Size, ModTime uint32 }, header.Files)
+	if err := binary.Read(r, binary.BigEndian, sizes); err != nil {
+		return nil, err
+	}
+
+	names, err := readFileTransferData(r, header.DataSize, header.CompressedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	result := FileListDataMessage{
+		Flags:  header.Flags,
+		Failed: header.Flags&fileListError != 0,
+		Files:  make([]RemoteFile, len(sizes)),
+	}
+
+	// The names follow each other, each terminated by a NUL. Directories
+	// have a size of 0xFFFFFFFF.
+	for i, size := range sizes {
+		end := bytes.IndexByte(names, 0)
+		if end < 0 {
+			return nil, fmt.Errorf("file list of %d files has %d names", len(sizes), i)
+		}
+
+		file := &result.Files[i]
+		file.Name = string(names[:end])
+		names = names[end+1:]
+
+		if size.Size == 0xffffffff {
+			file.IsDir = true
+			continue
+		}
+
+		file.Size = size.Size
+		file.ModTime = time.Unix(int64(size.ModTime), 0)
+	}
+
+	return &result, nil
+}
+
+// FileDownloadDataMessage holds a piece of the file asked for with a
+// FileDownloadRequestMessage. The last message of a download has no Data,
+// and sets End and the modification time of the file.
+type FileDownloadDataMessage struct {
+	Data    []byte
+	End     bool
+	ModTime time.Time
+}
+
+func (*FileDownloadDataMessage) Type() uint8 {
+	return 131
+}
+
+func (*FileDownloadDataMessage) Read(c *ClientConn, r io.Reader) (ServerMessage, error) {
+	var header struct {
+		CompressionLevel uint8
+		RealSize         uint16
+		CompressedSize   uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+
+	if header.RealSize == 0 && header.CompressedSize == 0 {
+		var modTime uint32
+		if err := binary.Read(r, binary.BigEndian, &modTime); err != nil {
+			return nil, err
+		}
+
+		return &FileDownloadDataMessage{End: true, ModTime: time.Unix(int64(modTime), 0)}, nil
+	}
+
+	data, err := readFileTransferData(r, header.RealSize, header.CompressedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileDownloadDataMessage{Data: data}, nil
+}
+
+// FileDownloadFailedMessage ends a download that the server couldn't
+// carry out, such as for a file that doesn't exist.
+type FileDownloadFailedMessage struct {
+	Reason string
+}
+
+func (*FileDownloadFailedMessage) Type() uint8 {
+	return 133
+}
+
+func (*FileDownloadFailedMessage) Read(c *ClientConn, r io.Reader) (ServerMessage, error) {
+	var padding uint8
+	if err := binary.Read(r, binary.BigEndian, &padding); err != nil {
+		return nil, err
+	}
+
+	reason, err := readFileTransferString(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileDownloadFailedMessage{Reason: reason}, nil
+}
+
+// readFileTransferString reads a string preceded by its 16-bit length.
+func readFileTransferString(r io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+
+	data, err := readBytes(r, uint32(length))
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// readFileTransferData reads compressedSize bytes of data, which are
+// compressed with zlib unless they are already size bytes long.
+func readFileTransferData(r io.Reader, size, compressedSize uint16) ([]byte, error) {
+	data, err := readBytes(r, uint32(compressedSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if compressedSize == size {
+		return data, nil
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed file transfer data: %s", err)
+	}
+
+	result := make([]byte, size)
+	if _, err := io.ReadFull(zr, result); err != nil {
+		return nil, fmt.Errorf("invalid compressed file transfer data: %s", err)
+	}
+
+	return result, nil
+}
+
+// ListDir lists a directory of the server, using the TightVNC file
+// transfer messages. The format of the path is that of the server, such
+// as "/home/user" or "C:\Users". Messages are handled as usual while
+// waiting for the listing, which isn't sent on ServerMessageCh. Only one
+// file transfer runs at a time, so this waits for any other to finish
+// first. It returns net.ErrClosed if the connection ends first.
+func (c *ClientConn) ListDir(path string) ([]RemoteFile, error) {
+	t := c.startFileTransfer()
+	defer c.finishFileTransfer(t)
+
+	if err := c.Send(&FileListRequestMessage{Path: path}); err != nil {
+		return nil, err
+	}
+
+	msg, err := t.receive()
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := msg.(*FileListDataMessage)
+	if !ok {
+		return nil, fmt.Errorf("listing %q: unexpected file transfer message type %d", path, msg.Type())
+	}
+	if list.Failed {
+		return nil, fmt.Errorf("listing %q: the server couldn't read the directory", path)
+	}
+
+	return list.Files, nil
+}
+
+// DownloadFile downloads a file of the server to w, using the TightVNC
+// file transfer messages, and returns once all of it has been written.
+// The main loop waits for each piece of the file to be written before it
+// reads the next message, so a slow writer holds up the updates. If w
+// fails, the download is canceled and its error is returned. As with
+// ListDir, only one file transfer runs at a time.
+func (c *ClientConn) DownloadFile(remotePath string, w io.Writer) error {
+	t := c.startFileTransfer()
+	defer c.finishFileTransfer(t)
+
+	if err := c.Send(&FileDownloadRequestMessage{Path: remotePath}); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := t.receive()
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *FileDownloadDataMessage:
+			if msg.End {
+				return nil
+			}
+
+			if _, err := w.Write(msg.Data); err != nil {
+				// The rest of the file is left to the main loop, which
+				// mustn't wait for it to be taken while the cancel is sent.
+				c.stopFileTransfer(t)
+				if cancelErr := c.Send(&FileDownloadCancelMessage{Reason: err.Error()}); cancelErr != nil {
+					return cancelErr
+				}
+
+				return err
+			}
+		case *FileDownloadFailedMessage:
+			return fmt.Errorf("downloading %q: %s", remotePath, msg.Reason)
+		default:
+			return fmt.Errorf("downloading %q: unexpected file transfer message type %d", remotePath, msg.Type())
+		}
+	}
+}
+
+// fileTransfer is the file transfer in progress, to which the main loop
+// hands the file transfer messages it reads.
+type fileTransfer struct {
+	ch chan ServerMessage
+
+	// done is closed once the transfer no longer takes messages, and
+	// closed is closed once the main loop no longer reads any.
+	done   chan struct{}
+	closed chan struct{}
+}
+
+// receive waits for the next file transfer message.
+func (t *fileTransfer) receive() (ServerMessage, error) {
+	select {
+	case msg := <-t.ch:
+		return msg, nil
+	case <-t.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// startFileTransfer waits for any other file transfer to finish, and
+// starts taking the file transfer messages, before the request is sent.
+func (c *ClientConn) startFileTransfer() *fileTransfer {
+	c.transferLock.Lock()
+
+	c.fileLock.Lock()
+	defer c.fileLock.Unlock()
+
+	t := &fileTransfer{
+		ch:     make(chan ServerMessage),
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	if c.filesClosed {
+		close(t.closed)
+	}
+
+	c.fileTransfer = t
+	return t
+}
+
+func (c *ClientConn) finishFileTransfer(t *fileTransfer) {
+	c.stopFileTransfer(t)
+	c.transferLock.Unlock()
+}
+
+// stopFileTransfer stops handing file transfer messages to t.
+func (c *ClientConn) stopFileTransfer(t *fileTransfer) {
+	c.fileLock.Lock()
+	defer c.fileLock.Unlock()
+
+	if c.fileTransfer == t {
+		c.fileTransfer = nil
+		close(t.done)
+	}
+}
+
+// fileTransferActive reports whether a file transfer is in progress.
+func (c *ClientConn) fileTransferActive() bool {
+	c.fileLock.Lock()
+	defer c.fileLock.Unlock()
+
+	return c.fileTransfer != nil
+}
+
+// fileTransferMessage is called by the main loop for each file transfer
+// message, and hands it to the transfer in progress. It returns false if
+// there is none, such as for the rest of a canceled download.
+func (c *ClientConn) fileTransferMessage(msg ServerMessage) bool {
+	c.fileLock.Lock()
+	t := c.fileTransfer
+	c.fileLock.Unlock()
+
+	if t == nil {
+		return false
+	}
+
+	select {
+	case t.ch <- msg:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// closeFileTransfers fails the file transfer in progress, and any later
+// one, once no more messages will be read.
+func (c *ClientConn) closeFileTransfers() {
+	c.fileLock.Lock()
+	defer c.fileLock.Unlock()
+
+	if c.fileTransfer != nil {
+		close(c.fileTransfer.closed)
+	}
+
+	c.filesClosed = true
+}
@@ -0,0 +1,177 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockFileServer implements the TightVNC file transfer messages on the
+// server end of a connection, for the directories and files given by path.
+type mockFileServer struct {
+	t       *testing.T
+	server  net.Conn
+	dirs    map[string][]RemoteFile
+	files   map[string][]byte
+	chunk   int
+	cancels chan string
+}
+
+func (s *mockFileServer) serve() {
+	for {
+		msg, err := ReadClientMessage(s.server, nil)
+		if err != nil {
+			return
+		}
+
+		var buf bytes.Buffer
+		switch msg := msg.(type) {
+		case *FileListRequestMessage:
+			files, ok := s.dirs[msg.Path]
+			if !ok {
+				writeMessage(&buf, []interface{}{uint8(130), uint8(fileListError), uint16(0), uint16(0), uint16(0)})
+				break
+			}
+
+			var names bytes.Buffer
+			for _, file := range files {
+				names.WriteString(file.Name)
+				names.WriteByte(0)
+			}
+
+			// The names are compressed, as TightVNC servers may do.
+			var compressed bytes.Buffer
+			zw := zlib.NewWriter(&compressed)
+			zw.Write(names.Bytes())
+			zw.Close()
+
+			writeMessage(&buf, []interface{}{uint8(130), uint8(0), uint16(len(files)), uint16(names.Len()), uint16(compressed.Len())})
+			for _, file := range files {
+				size, modTime := file.Size, uint32(file.ModTime.Unix())
+				if file.IsDir {
+					size, modTime = 0xffffffff, 0
+				}
+				writeMessage(&buf, []interface{}{size, modTime})
+			}
+			buf.Write(compressed.Bytes())
+		case *FileDownloadRequestMessage:
+			data, ok := s.files[msg.Path]
+			if !ok {
+				reason := "no such file"
+				writeMessage(&buf, []interface{}{uint8(133), uint8(0), uint16(len(reason)), []byte(reason)})
+				break
+			}
+
+			for len(data) > 0 {
+				n := minInt(s.chunk, len(data))
+				writeMessage(&buf, []interface{}{uint8(131), uint8(0), uint16(n), uint16(n), data[:n]})
+				data = data[n:]
+			}
+			writeMessage(&buf, []interface{}{uint8(131), uint8(0), uint16(0), uint16(0), uint32(1234)})
+		case *FileDownloadCancelMessage:
+			s.cancels <- msg.Reason
+			continue
+		default:
+			s.t.Errorf("unexpected client message %T", msg)
+			return
+		}
+
+		if _, err := s.server.Write(buf.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// failingWriter fails once more than after bytes are written to it.
+type failingWriter struct {
+	after int
+}
+
+var errWriterFull = errors.New("writer full")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.after < len(p) {
+		return 0, errWriterFull
+	}
+
+	w.after -= len(p)
+	return len(p), nil
+}
+
+func TestClientConn_FileTransfer(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	modTime := time.Unix(1600000000, 0)
+	mock := &mockFileServer{
+		t:      t,
+		server: server,
+		dirs: map[string][]RemoteFile{
+			"/home": {
+				{Name: "docs", IsDir: true},
+				{Name: "notes.txt", Size: uint32(len(content)), ModTime: modTime},
+			},
+		},
+		files:   map[string][]byte{"/home/notes.txt": content},
+		chunk:   300,
+		cancels: make(chan string, 1),
+	}
+	go mock.serve()
+	go conn.mainLoop()
+
+	files, err := conn.ListDir("/home")
+	if err != nil {
+		t.Fatalf("error listing directory: %s", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("listed %d files, want 2", len(files))
+	}
+	if files[0] != (RemoteFile{Name: "docs", IsDir: true}) {
+		t.Fatalf("files[0] = %+v, want the docs directory", files[0])
+	}
+	if f := files[1]; f.Name != "notes.txt" || f.IsDir || f.Size != uint32(len(content)) || !f.ModTime.Equal(modTime) {
+		t.Fatalf("files[1] = %+v, want notes.txt of %d bytes", f, len(content))
+	}
+
+	if _, err := conn.ListDir("/missing"); err == nil || !strings.Contains(err.Error(), "couldn't read") {
+		t.Fatalf("err = %v listing a missing directory", err)
+	}
+
+	var buf bytes.Buffer
+	if err := conn.DownloadFile("/home/notes.txt", &buf); err != nil {
+		t.Fatalf("error downloading file: %s", err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Fatalf("downloaded %d bytes, want %d", buf.Len(), len(content))
+	}
+
+	err = conn.DownloadFile("/home/missing.txt", &buf)
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Fatalf("err = %v downloading a missing file", err)
+	}
+
+	// A failing writer cancels the download. The rest of the file is
+	// skipped by the main loop.
+	if err := conn.DownloadFile("/home/notes.txt", &failingWriter{after: 300}); err != errWriterFull {
+		t.Fatalf("err = %v, want %v", err, errWriterFull)
+	}
+	select {
+	case reason := <-mock.cancels:
+		if reason != errWriterFull.Error() {
+			t.Fatalf("canceled with reason %q", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("download not canceled")
+	}
+
+	server.Close()
+	if _, err := conn.ListDir("/home"); err != net.ErrClosed && !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("err = %v after the connection closed", err)
+	}
+}
@@ -0,0 +1,244 @@
+package vnc
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"image"
+	"image/color"
+)
+
+// Framebuffer is a client-side copy of the pixel data of a remote frame
+// buffer. Colors holds Width*Height entries in row-major order.
+type Framebuffer struct {
+	Width  uint16
+	Height uint16
+	Colors []Color
+}
+
+// NewFramebuffer returns a black framebuffer of the given dimensions.
+func NewFramebuffer(width, height uint16) *Framebuffer {
+	return &Framebuffer{
+		Width:  width,
+		Height: height,
+		Colors: make([]Color, int(width)*int(height)),
+	}
+}
+
+// SubImage returns a copy of the region of the framebuffer covered by r.
+// The region is clipped to the framebuffer, so the returned image may be
+// smaller than r, or empty if r lies outside of the framebuffer. The
+// coordinates of the returned image are those of the framebuffer.
+func (fb *Framebuffer) SubImage(r Rectangle) image.Image {
+	bounds := image.Rect(int(r.X), int(r.Y), int(r.X)+int(r.Width), int(r.Y)+int(r.Height))
+	bounds = bounds.Intersect(image.Rect(0, 0, int(fb.Width), int(fb.Height)))
+
+	img := image.NewRGBA64(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := fb.Colors[y*int(fb.Width)+x]
+			img.SetRGBA64(x, y, color.RGBA64{R: c.R, G: c.G, B: c.B, A: 0xffff})
+		}
+	}
+
+	return img
+}
+
+// Checksum returns a 64-bit FNV-1a hash of the dimensions and the
+// colors of the framebuffer. Framebuffers with equal contents have equal
+// checksums, which makes it easy to compare decoded frames against known
+// good ones in tests.
+func (fb *Framebuffer) Checksum() uint64 {
+	h := fnv.New64a()
+
+	var buf [6]byte
+	binary.BigEndian.PutUint16(buf[0:], fb.Width)
+	binary.BigEndian.PutUint16(buf[2:], fb.Height)
+	h.Write(buf[:4])
+
+	for _, c := range fb.Colors {
+		binary.BigEndian.PutUint16(buf[0:], c.R)
+		binary.BigEndian.PutUint16(buf[2:], c.G)
+		binary.BigEndian.PutUint16(buf[4:], c.B)
+		h.Write(buf[:])
+	}
+
+	return h.Sum64()
+}
+
+// FramebufferDiff compares two framebuffers pixel by pixel. It reports
+// whether any pixel differs, and the smallest rectangle containing all
+// of the differing pixels.
+//
+// Framebuffers of different dimensions are always considered changed,
+// in which case the returned rectangle covers the larger of the two.
+func FramebufferDiff(a, b *Framebuffer) (changed bool, bbox Rectangle) {
+	return FramebufferDiffTolerance(a, b, 0)
+}
+
+// FramebufferDiffTolerance is like FramebufferDiff, but ignores pixels
+// where each of the red, green and blue channels differ by no more than
+// tolerance. This is useful to filter out noise from lossy encodings.
+func FramebufferDiffTolerance(a, b *Framebuffer, tolerance uint16) (changed bool, bbox Rectangle) {
+	if a.Width != b.Width || a.Height != b.Height {
+		bbox.Width = a.Width
+		if b.Width > bbox.Width {
+			bbox.Width = b.Width
+		}
+
+		bbox.Height = a.Height
+		if b.Height > bbox.Height {
+			bbox.Height = b.Height
+		}
+
+		return true, bbox
+	}
+
+	var minX, minY, maxX, maxY uint16
+	for y := uint16(0); y < a.Height; y++ {
+		for x := uint16(0); x < a.Width; x++ {
+			i := int(y)*int(a.Width) + int(x)
+			if !colorDiffers(a.Colors[i], b.Colors[i], tolerance) {
+				continue
+			}
+
+			if !changed {
+				minX, minY, maxX, maxY = x, y, x, y
+				changed = true
+				continue
+			}
+
+			if x < minX {
+				minX = x
+			}
+			if x > maxX {
+				maxX = x
+			}
+			if y > maxY {
+				maxY = y
+			}
+		}
+	}
+
+	if !changed {
+		return false, bbox
+	}
+
+	bbox.X = minX
+	bbox.Y = minY
+	bbox.Width = maxX - minX + 1
+	bbox.Height = maxY - minY + 1
+	return true, bbox
+}
+
+// colorDiffers reports whether any channel of a and b differ by more
+// than tolerance.
+func colorDiffers(a, b Color, tolerance uint16) bool {
+	return channelDelta(a.R, b.R) > tolerance ||
+		channelDelta(a.G, b.G) > tolerance ||
+		channelDelta(a.B, b.B) > tolerance
+}
+
+func channelDelta(a, b uint16) uint16 {
+	if a > b {
+		return a - b
+	}
+
+	return b - a
+}
+
+// Apply paints the rectangles of a FramebufferUpdate into the
+// framebuffer, strictly in the order they were received, so that a
+// CopyRect copies pixels painted by the rectangles before it. Rectangles
+// are clipped to the framebuffer, and pixels outside of the updated
+// rectangles are left untouched. A DesktopSize or successful
+// ExtendedDesktopSize rectangle resizes the framebuffer, keeping the
+// contents of the area common to both sizes. Such a rectangle may come
+// anywhere in the update, and the rectangles after it are clipped to the
+// new size.
+func (fb *Framebuffer) Apply(msg *FramebufferUpdateMessage) {
+	for i := range msg.Rectangles {
+		rect := &msg.Rectangles[i]
+
+		switch enc := rect.Enc.(type) {
+		case *RawEncoding:
+			fb.paint(rect, enc.Colors)
+		case *ZlibEncoding:
+			fb.paint(rect, enc.Colors)
+		case *HextileEncoding:
+			fb.paint(rect, enc.Colors)
+		case *RREEncoding:
+			paintRRE(rect, enc.Colors, enc.Background, enc.Subrects, fb.paint)
+		case *CoRREEncoding:
+			paintRRE(rect, enc.Colors, enc.Background, enc.Subrects, fb.paint)
+		case *TightEncoding:
+			fb.paintTight(rect, enc.Colors, enc.Image, enc.JPEG)
+		case *TightPNGEncoding:
+			fb.paintTight(rect, enc.Colors, enc.Image, enc.JPEG)
+		case *CopyRectEncoding:
+			src := Rectangle{X: enc.SrcX, Y: enc.SrcY, Width: rect.Width, Height: rect.Height}
+			fb.paint(rect, fb.colors(src))
+		case *DesktopSizePseudoEncoding:
+			fb.resize(rect.Width, rect.Height)
+		case *ExtendedDesktopSizePseudoEncoding:
+			if enc.Status == DesktopSizeStatusOK {
+				fb.resize(rect.Width, rect.Height)
+			}
+		}
+	}
+}
+
+// paintTight paints a Tight rectangle, which holds either colors or, for
+// JPEG rectangles read with ClientConfig.TightYCbCr or
+// ClientConfig.TightRawJPEG, an image or its data.
+func (fb *Framebuffer) paintTight(rect *Rectangle, colors []Color, img *image.YCbCr, jpegData []byte) {
+	fb.paint(rect, tightColors(colors, img, jpegData))
+}
+
+// paint copies the colors of a rectangle into the framebuffer.
+func (fb *Framebuffer) paint(rect *Rectangle, colors []Color) {
+	if len(colors) < int(rect.Width)*int(rect.Height) {
+		return
+	}
+
+	width := int(rect.Width)
+	if int(rect.X)+width > int(fb.Width) {
+		width = int(fb.Width) - int(rect.X)
+	}
+
+	for y := 0; y < int(rect.Height); y++ {
+		fbY := int(rect.Y) + y
+		if fbY >= int(fb.Height) || width <= 0 {
+			break
+		}
+
+		src := colors[y*int(rect.Width) : y*int(rect.Width)+width]
+		copy(fb.Colors[fbY*int(fb.Width)+int(rect.X):], src)
+	}
+}
+
+// colors returns a copy of the colors of a rectangle of the framebuffer.
+// It returns nil if the rectangle doesn't fit in the framebuffer.
+func (fb *Framebuffer) colors(rect Rectangle) []Color {
+	if int(rect.X)+int(rect.Width) > int(fb.Width) || int(rect.Y)+int(rect.Height) > int(fb.Height) {
+		return nil
+	}
+
+	colors := make([]Color, 0, int(rect.Width)*int(rect.Height))
+	for y := int(rect.Y); y < int(rect.Y)+int(rect.Height); y++ {
+		start := y*int(fb.Width) + int(rect.X)
+		colors = append(colors, fb.Colors[start:start+int(rect.Width)]...)
+	}
+
+	return colors
+}
+
+// resize changes the dimensions of the framebuffer.
+func (fb *Framebuffer) resize(width, height uint16) {
+	if width == fb.Width && height == fb.Height {
+		return
+	}
+
+	resized := NewFramebuffer(width, height)
+	resized.paint(&Rectangle{Width: fb.Width, Height: fb.Height}, fb.Colors)
+	*fb = *resized
+}
@@ -0,0 +1,447 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestFramebufferDiff(t *testing.T) {
+	a := NewFramebuffer(20, 10)
+	b := NewFramebuffer(20, 10)
+
+	changed, _ := FramebufferDiff(a, b)
+	if changed {
+		t.Fatal("identical framebuffers reported as changed")
+	}
+
+	// Change a 5x5 region in the bottom right corner.
+	for y := 5; y < 10; y++ {
+		for x := 15; x < 20; x++ {
+			b.Colors[y*20+x] = Color{R: 10, G: 20, B: 30}
+		}
+	}
+
+	changed, bbox := FramebufferDiff(a, b)
+	if !changed {
+		t.Fatal("expected framebuffers to differ")
+	}
+
+	expected := Rectangle{X: 15, Y: 5, Width: 5, Height: 5}
+	if bbox != expected {
+		t.Fatalf("bbox = %#v, want %#v", bbox, expected)
+	}
+
+	changed, _ = FramebufferDiffTolerance(a, b, 30)
+	if changed {
+		t.Fatal("difference within tolerance reported as changed")
+	}
+
+	changed, bbox = FramebufferDiffTolerance(a, b, 15)
+	if !changed {
+		t.Fatal("expected difference outside tolerance")
+	}
+	if bbox != expected {
+		t.Fatalf("bbox = %#v, want %#v", bbox, expected)
+	}
+}
+
+func TestFramebufferDiff_Size(t *testing.T) {
+	changed, bbox := FramebufferDiff(NewFramebuffer(10, 20), NewFramebuffer(15, 5))
+	if !changed {
+		t.Fatal("differently sized framebuffers reported as unchanged")
+	}
+
+	expected := Rectangle{Width: 15, Height: 20}
+	if bbox != expected {
+		t.Fatalf("bbox = %#v, want %#v", bbox, expected)
+	}
+}
+
+func TestClientConn_MaxDecodeFPS(t *testing.T) {
+	frameCh := make(chan *Framebuffer, 100)
+	conn, server := newTestClientConn(&ClientConfig{
+		KeepFramebuffer: true,
+		FramebufferCh:   frameCh,
+		MaxDecodeFPS:    10,
+	})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 1
+	conn.FrameBufferHeight = 1
+	conn.PixelFormat = testPixelFormat
+	conn.fb = NewFramebuffer(1, 1)
+
+	go conn.mainLoop()
+
+	start := time.Now()
+	for i := 1; i <= 60; i++ {
+		writeRawUpdate(t, server, 0, 0, 1, 1, rgb(uint8(i), 0, 0))
+	}
+	elapsed := time.Since(start)
+
+	// Wait for the last coalesced frame to be sent.
+	time.Sleep(150 * time.Millisecond)
+
+	frames := len(frameCh)
+	maxFrames := int(elapsed/(100*time.Millisecond)) + 2
+	if frames == 0 || frames > maxFrames {
+		t.Fatalf("received %d frames in %s, want between 1 and %d", frames, elapsed, maxFrames)
+	}
+
+	var last *Framebuffer
+	for i := 0; i < frames; i++ {
+		last = <-frameCh
+	}
+	if last.Colors[0] != rgb(60, 0, 0) {
+		t.Fatalf("last frame has color %#v, want the latest update", last.Colors[0])
+	}
+}
+
+func TestClientConn_MaxDecodeFPSClosed(t *testing.T) {
+	frameCh := make(chan *Framebuffer, 10)
+	disconnectedCh := make(chan struct{})
+	conn, server := newTestClientConn(&ClientConfig{
+		KeepFramebuffer: true,
+		FramebufferCh:   frameCh,
+		MaxDecodeFPS:    5,
+		OnDisconnected:  func(error) { close(disconnectedCh) },
+	})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 1
+	conn.FrameBufferHeight = 1
+	conn.PixelFormat = testPixelFormat
+	conn.fb = NewFramebuffer(1, 1)
+
+	go conn.mainLoop()
+
+	// The first update is sent right away, and the second waits for the
+	// interval to pass.
+	writeRawUpdate(t, server, 0, 0, 1, 1, rgb(1, 0, 0))
+	<-frameCh
+	writeRawUpdate(t, server, 0, 0, 1, 1, rgb(2, 0, 0))
+
+	server.Close()
+	<-disconnectedCh
+
+	// The pending frame is dropped once the connection has closed.
+	select {
+	case <-frameCh:
+		t.Fatal("frame sent after the connection closed")
+	case <-time.After(400 * time.Millisecond):
+	}
+}
+
+func TestFramebuffer_SubImage(t *testing.T) {
+	fb := NewFramebuffer(64, 48)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			fb.Colors[y*64+x] = Color{R: uint16(x), G: uint16(y), B: 0xffff}
+		}
+	}
+
+	img := fb.SubImage(Rectangle{X: 20, Y: 30, Width: 10, Height: 10})
+	if bounds := img.Bounds(); bounds != image.Rect(20, 30, 30, 40) {
+		t.Fatalf("bounds = %s, want %s", bounds, image.Rect(20, 30, 30, 40))
+	}
+
+	for y := 30; y < 40; y++ {
+		for x := 20; x < 30; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if r != uint32(x) || g != uint32(y) || b != 0xffff || a != 0xffff {
+				t.Fatalf("pixel (%d, %d) = %d, %d, %d, %d", x, y, r, g, b, a)
+			}
+		}
+	}
+
+	// Regions exceeding the framebuffer are clipped.
+	img = fb.SubImage(Rectangle{X: 60, Y: 40, Width: 10, Height: 10})
+	if bounds := img.Bounds(); bounds != image.Rect(60, 40, 64, 48) {
+		t.Fatalf("bounds = %s, want %s", bounds, image.Rect(60, 40, 64, 48))
+	}
+}
+
+func TestFramebuffer_Checksum(t *testing.T) {
+	a := NewFramebuffer(16, 8)
+	b := NewFramebuffer(16, 8)
+	for i := range a.Colors {
+		a.Colors[i] = Color{R: uint16(i), G: 0x1234, B: uint16(i * 7)}
+		b.Colors[i] = a.Colors[i]
+	}
+
+	if a.Checksum() != b.Checksum() {
+		t.Fatalf("checksums of identical framebuffers differ: %x != %x", a.Checksum(), b.Checksum())
+	}
+
+	b.Colors[37].B++
+	if a.Checksum() == b.Checksum() {
+		t.Fatal("checksum unchanged by a differing pixel")
+	}
+
+	// The same pixels in a different shape are a different framebuffer.
+	if NewFramebuffer(16, 8).Checksum() == NewFramebuffer(8, 16).Checksum() {
+		t.Fatal("checksum unchanged by the dimensions")
+	}
+}
+
+func TestFramebuffer_ApplyCopyRect(t *testing.T) {
+	conn := &ClientConn{
+		Encs:              []Encoding{new(CopyRectEncoding)},
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+		PixelFormat:       testPixelFormat,
+	}
+
+	// A raw rectangle painting the top left corner, followed by a
+	// CopyRect of it in the same update.
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 2})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 2, 2})
+	binary.Write(&buf, binary.BigEndian, int32(0))
+	for i := 0; i < 4; i++ {
+		binary.Write(&buf, binary.LittleEndian, uint32(0xff0000))
+	}
+	binary.Write(&buf, binary.BigEndian, []uint16{4, 3, 2, 2})
+	binary.Write(&buf, binary.BigEndian, int32(1))
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0})
+
+	msg, err := new(FramebufferUpdateMessage).Read(conn, &buf)
+	if err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+
+	fb := NewFramebuffer(8, 8)
+	fb.Apply(msg.(*FramebufferUpdateMessage))
+
+	red := rgb(255, 0, 0)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			expected := Color{}
+			if (x < 2 && y < 2) || (x >= 4 && x < 6 && y >= 3 && y < 5) {
+				expected = red
+			}
+
+			if c := fb.Colors[y*8+x]; c != expected {
+				t.Fatalf("pixel (%d, %d) = %#v, want %#v", x, y, c, expected)
+			}
+		}
+	}
+}
+
+func TestClientConn_OnResize(t *testing.T) {
+	type resize struct{ oldWidth, oldHeight, newWidth, newHeight uint16 }
+
+	var resizes []resize
+	conn, server := newTestClientConn(&ClientConfig{
+		KeepFramebuffer: true,
+		OnResize: func(oldWidth, oldHeight, newWidth, newHeight uint16) {
+			resizes = append(resizes, resize{oldWidth, oldHeight, newWidth, newHeight})
+		},
+	})
+	defer server.Close()
+
+	conn.fb = NewFramebuffer(4, 4)
+	conn.fb.Colors[0] = Color{R: 1}
+
+	// The CopyRect refers to pixels outside of the resized framebuffer,
+	// and is skipped.
+	err := conn.handleFramebufferUpdate(&FramebufferUpdateMessage{
+		Rectangles: []Rectangle{
+			{Width: 2, Height: 3, Enc: &DesktopSizePseudoEncoding{}},
+			{Width: 2, Height: 2, Enc: &CopyRectEncoding{SrcX: 2, SrcY: 2}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error handling update: %s", err)
+	}
+
+	expected := []resize{{4, 4, 2, 3}}
+	if len(resizes) != 1 || resizes[0] != expected[0] {
+		t.Fatalf("resizes = %v, want %v", resizes, expected)
+	}
+
+	fb := conn.Framebuffer()
+	if fb.Width != 2 || fb.Height != 3 {
+		t.Fatalf("framebuffer is %dx%d, want 2x3", fb.Width, fb.Height)
+	}
+	if fb.Colors[0] != (Color{R: 1}) {
+		t.Fatalf("contents not kept, color = %#v", fb.Colors[0])
+	}
+
+	// Updates that don't resize don't call OnResize.
+	conn.handleFramebufferUpdate(&FramebufferUpdateMessage{})
+	if len(resizes) != 1 {
+		t.Fatalf("OnResize called %d times, want 1", len(resizes))
+	}
+}
+
+func TestClientConn_DesktopSizeBeforePixels(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{KeepFramebuffer: true})
+	defer server.Close()
+
+	conn.PixelFormat = testPixelFormat
+	conn.Encs = []Encoding{new(DesktopSizePseudoEncoding)}
+	conn.FrameBufferWidth, conn.FrameBufferHeight = 2, 2
+	conn.fb = NewFramebuffer(2, 2)
+
+	// The DesktopSize comes first, followed by a Raw rectangle covering
+	// the new, larger, framebuffer.
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 2})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 4, 3})
+	binary.Write(&buf, binary.BigEndian, int32(-223))
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 4, 3})
+	binary.Write(&buf, binary.BigEndian, int32(0))
+	for i := 0; i < 4*3; i++ {
+		buf.Write([]byte{byte(i), 0, 0, 0})
+	}
+
+	msg, err := new(FramebufferUpdateMessage).Read(conn, &buf)
+	if err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+	if conn.FrameBufferWidth != 4 || conn.FrameBufferHeight != 3 {
+		t.Fatalf("size is %dx%d, want 4x3", conn.FrameBufferWidth, conn.FrameBufferHeight)
+	}
+
+	if err := conn.handleFramebufferUpdate(msg.(*FramebufferUpdateMessage)); err != nil {
+		t.Fatalf("error handling update: %s", err)
+	}
+
+	fb := conn.Framebuffer()
+	if fb.Width != 4 || fb.Height != 3 {
+		t.Fatalf("framebuffer is %dx%d, want 4x3", fb.Width, fb.Height)
+	}
+	for i, color := range fb.Colors {
+		if color != rgb(0, 0, uint8(i)) {
+			t.Fatalf("color %d = %#v", i, color)
+		}
+	}
+}
+
+func TestClientConn_ImageInto(t *testing.T) {
+	for _, tileSize := range []uint16{0, 2} {
+		conn, server := newTestClientConn(&ClientConfig{
+			KeepFramebuffer:     true,
+			FramebufferTileSize: tileSize,
+		})
+		server.Close()
+
+		if tileSize > 0 {
+			conn.tiledFB = NewTiledFramebuffer(3, 2, tileSize)
+		} else {
+			conn.fb = NewFramebuffer(3, 2)
+		}
+		err := conn.handleFramebufferUpdate(&FramebufferUpdateMessage{
+			Rectangles: []Rectangle{{X: 1, Y: 1, Width: 2, Height: 1, Enc: &RawEncoding{
+				Colors: []Color{{R: 0xff00, G: 0x1234}, {B: 0xffff}},
+			}}},
+		})
+		if err != nil {
+			t.Fatalf("error handling update: %s", err)
+		}
+
+		if err := conn.ImageInto(image.NewRGBA(image.Rect(0, 0, 2, 2))); err == nil {
+			t.Fatalf("tile size %d: no error for mismatched bounds", tileSize)
+		}
+
+		img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+		if err := conn.ImageInto(img); err != nil {
+			t.Fatalf("tile size %d: error copying image: %s", tileSize, err)
+		}
+
+		for _, tt := range []struct {
+			x, y     int
+			expected color.RGBA
+		}{
+			{0, 0, color.RGBA{A: 0xff}},
+			{1, 1, color.RGBA{R: 0xff, G: 0x12, A: 0xff}},
+			{2, 1, color.RGBA{B: 0xff, A: 0xff}},
+		} {
+			if actual := img.RGBAAt(tt.x, tt.y); actual != tt.expected {
+				t.Fatalf("tile size %d: pixel %d,%d = %v, want %v", tileSize, tt.x, tt.y, actual, tt.expected)
+			}
+		}
+	}
+
+	conn, server := newTestClientConn(&ClientConfig{})
+	server.Close()
+	if err := conn.ImageInto(image.NewRGBA(image.Rectangle{})); err == nil {
+		t.Fatal("no error without KeepFramebuffer")
+	}
+}
+
+func BenchmarkClientConn_ImageInto(b *testing.B) {
+	conn, server := newTestClientConn(&ClientConfig{KeepFramebuffer: true})
+	server.Close()
+	conn.fb = NewFramebuffer(1024, 768)
+
+	img := image.NewRGBA(image.Rect(0, 0, 1024, 768))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(img.Pix)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := conn.ImageInto(img); err != nil {
+			b.Fatalf("error copying image: %s", err)
+		}
+	}
+}
+
+func TestClientConfig_OnFrame(t *testing.T) {
+	var events []string
+	var painted []Color
+	msgCh := make(chan ServerMessage, 2)
+	conn, server := newTestClientConn(&ClientConfig{
+		KeepFramebuffer: true,
+		ServerMessageCh: msgCh,
+		OnRectangle: func(rect Rectangle) {
+			events = append(events, "rectangle")
+		},
+		OnFrame: func(fb *Framebuffer) {
+			events = append(events, "frame")
+			painted = append([]Color(nil), fb.Colors...)
+		},
+	})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 3
+	conn.FrameBufferHeight = 1
+	conn.PixelFormat = testPixelFormat
+	conn.fb = NewFramebuffer(3, 1)
+
+	go conn.mainLoop()
+
+	// An update of three rectangles, one pixel each.
+	colors := []Color{rgb(1, 2, 3), rgb(4, 5, 6), rgb(7, 8, 9)}
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 3})
+	for i, col := range colors {
+		binary.Write(&buf, binary.BigEndian, []uint16{uint16(i), 0, 1, 1})
+		binary.Write(&buf, binary.BigEndian, int32(0))
+		binary.Write(&buf, binary.LittleEndian, uint32(col.R>>8)<<16|uint32(col.G>>8)<<8|uint32(col.B>>8))
+	}
+	server.Write(buf.Bytes())
+	<-msgCh
+
+	if expected := []string{"rectangle", "rectangle", "rectangle", "frame"}; fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Fatalf("events %v, want %v", events, expected)
+	}
+	for i, col := range colors {
+		if painted[i] != col {
+			t.Fatalf("frame pixel %d = %#v, want %#v", i, painted[i], col)
+		}
+	}
+
+	// Each update is a frame of its own.
+	server.Write([]byte{0, 0, 0, 0})
+	<-msgCh
+	if n := len(events); n != 5 || events[4] != "frame" {
+		t.Fatalf("events %v after an empty update", events)
+	}
+}
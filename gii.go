@@ -0,0 +1,489 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// GIIPseudoEncoding declares that the client supports the General Input
+// Interface extension, which forwards input devices beyond the pointer,
+// such as tablets and joysticks, as devices with valuators. A server
+// that supports it answers with a GIIServerMessage of sub-type
+// GIIVersion, which the connection answers with a GIIVersionMessage.
+// Devices can then be created with a GIIDeviceCreationMessage, and their
+// valuators sent with GIIValuatorEventMessages.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#gii-pseudo-encoding
+type GIIPseudoEncoding struct{}
+
+func (*GIIPseudoEncoding) Type() int32 {
+	return -305
+}
+
+func (*GIIPseudoEncoding) Read(*ClientConn, *Rectangle, io.Reader) (Encoding, error) {
+	return &GIIPseudoEncoding{}, nil
+}
+
+// Sub-types of gii messages.
+const (
+	GIIInjectEvents      uint8 = 0
+	GIIVersion           uint8 = 1
+	GIIDeviceCreation    uint8 = 2
+	GIIDeviceDestruction uint8 = 3
+)
+
+// The version of the gii extension implemented by this package.
+const giiVersion = 1
+
+// The flag of the first byte of a gii message that is set when the rest
+// of the message is big endian.
+const giiBigEndian = 0x80
+
+// Event types of gii valuator events, and the masks of the events a
+// device can generate, for GIIDeviceCreationMessage.CanGenerate.
+const (
+	GIIValuatorRelative uint8 = 12
+	GIIValuatorAbsolute uint8 = 13
+
+	GIIValuatorRelativeMask uint32 = 1 << GIIValuatorRelative
+	GIIValuatorAbsoluteMask uint32 = 1 << GIIValuatorAbsolute
+)
+
+// GIIServerMessage is a gii message sent by the server. A message of
+// sub-type GIIVersion announces the range of versions of the extension
+// the server supports, and one of sub-type GIIDeviceCreation answers a
+// GIIDeviceCreationMessage with the origin of the new device, which is
+// zero if the device could not be created.
+type GIIServerMessage struct {
+	SubType uint8
+
+	MaximumVersion uint16
+	MinimumVersion uint16
+
+	DeviceOrigin uint32
+}
+
+func (*GIIServerMessage) Type() uint8 {
+	return 253
+}
+
+func (*GIIServerMessage) Read(c *ClientConn, r io.Reader) (ServerMessage, error) {
+	subType, order, data, err := readGIIMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := GIIServerMessage{SubType: subType}
+	switch subType {
+	case GIIVersion:
+		if len(data) < 4 {
+			return nil, fmt.Errorf("gii version message too short: %d bytes", len(data))
+		}
+
+		result.MaximumVersion = order.Uint16(data)
+		result.MinimumVersion = order.Uint16(data[2:])
+	case GIIDeviceCreation:
+		if len(data) < 4 {
+			return nil, fmt.Errorf("gii device creation response too short: %d bytes", len(data))
+		}
+
+		result.DeviceOrigin = order.Uint32(data)
+	default:
+		return nil, fmt.Errorf("unsupported gii server message: %d", subType)
+	}
+
+	return &result, nil
+}
+
+// readGIIMessage reads a gii message following its message type, which
+// starts with its sub-type and the byte order of the rest of the message,
+// and returns its data.
+func readGIIMessage(r io.Reader) (uint8, binary.ByteOrder, []byte, error) {
+	var endianAndSubType uint8
+	if err := binary.Read(r, binary.BigEndian, &endianAndSubType); err != nil {
+		return 0, nil, nil, err
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if endianAndSubType&giiBigEndian != 0 {
+		order = binary.BigEndian
+	}
+
+	var length uint16
+	if err := binary.Read(r, order, &length); err != nil {
+		return 0, nil, nil, err
+	}
+
+	data, err := readBytes(r, uint32(length))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	return endianAndSubType &^ giiBigEndian, order, data, nil
+}
+
+// answerGIIVersion answers the version announced by the server with the
+// version implemented by this package, if the server supports it.
+func (c *ClientConn) answerGIIVersion(msg *GIIServerMessage) error {
+	if msg.MinimumVersion > giiVersion || msg.MaximumVersion < giiVersion {
+		c.logf("gii versions %d to %d of the server are not supported", msg.MinimumVersion, msg.MaximumVersion)
+		return nil
+	}
+
+	return c.Send(&GIIVersionMessage{Version: giiVersion})
+}
+
+// GIIVersionMessage tells the server the version of the gii extension
+// used by the client. It is sent automatically in response to the
+// version announced by the server.
+type GIIVersionMessage struct {
+	Version uint16
+}
+
+func (*GIIVersionMessage) Type() uint8 {
+	return 253
+}
+
+func (m *GIIVersionMessage) Serialize(w io.Writer) error {
+	return writeMessage(w, []interface{}{
+		m.Type(),
+		giiBigEndian | GIIVersion,
+		uint16(2),
+		m.Version,
+	})
+}
+
+// Deserialize reads any of the gii client messages, which share a
+// message type.
+func (*GIIVersionMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	return readGIIClientMessage(r)
+}
+
+// GIIValuator describes a valuator of a gii device, such as an axis of a
+// joystick or the pressure of a tablet pen. The SI fields describe how
+// its values convert to the SI unit of SIUnit, as
+// (value + SIAdd) * SIMul / SIDiv * 2^SIShift.
+type GIIValuator struct {
+	Index       uint32
+	LongName    string
+	ShortName   string
+	RangeMin    int32
+	RangeCenter int32
+	RangeMax    int32
+	SIUnit      uint32
+	SIAdd       int32
+	SIMul       int32
+	SIDiv       int32
+	SIShift     int32
+}
+
+// SI units of gii valuators.
+const (
+	GIIUnitUnknown uint32 = iota
+	GIIUnitTime
+	GIIUnitFrequency
+	GIIUnitLength
+	GIIUnitVelocity
+	GIIUnitAcceleration
+	GIIUnitAngle
+	GIIUnitAngularVelocity
+	GIIUnitAngularAcceleration
+	GIIUnitArea
+	GIIUnitVolume
+	GIIUnitMass
+	GIIUnitForce
+	GIIUnitPressure
+	GIIUnitTorque
+	GIIUnitEnergy
+	GIIUnitPower
+	GIIUnitTemperature
+	GIIUnitCurrent
+	GIIUnitVoltage
+	GIIUnitResistance
+	GIIUnitCapacity
+	GIIUnitInductivity
+)
+
+// The sizes of the names of gii devices and valuators, including their
+// terminating nul byte, and of the parts of gii messages.
+const (
+	giiDeviceNameSize         = 32
+	giiValuatorLongNameSize   = 75
+	giiValuatorShortNameSize  = 5
+	giiDeviceCreationLength   = 56
+	giiValuatorLength         = 116
+	giiValuatorEventHeaderLen = 16
+)
+
+// GIIDeviceCreationMessage asks the server to create an input device,
+// which the server answers with a GIIServerMessage of sub-type
+// GIIDeviceCreation holding the origin of the device, used to send its
+// events.
+type GIIDeviceCreationMessage struct {
+	Name         string
+	VendorID     uint32
+	ProductID    uint32
+	CanGenerate  uint32
+	NumRegisters uint32
+	NumButtons   uint32
+	Valuators    []GIIValuator
+}
+
+func (*GIIDeviceCreationMessage) Type() uint8 {
+	return 253
+}
+
+func (m *GIIDeviceCreationMessage) Serialize(w io.Writer) error {
+	if len(m.Name) >= giiDeviceNameSize {
+		return fmt.Errorf("gii device name %q longer than %d bytes", m.Name, giiDeviceNameSize-1)
+	}
+
+	length := giiDeviceCreationLength + len(m.Valuators)*giiValuatorLength
+	if length > 0xffff {
+		return fmt.Errorf("too many gii valuators: %d", len(m.Valuators))
+	}
+
+	data := []interface{}{
+		m.Type(),
+		giiBigEndian | GIIDeviceCreation,
+		uint16(length),
+		giiName(m.Name, giiDeviceNameSize),
+		m.VendorID,
+		m.ProductID,
+		m.CanGenerate,
+		m.NumRegisters,
+		uint32(len(m.Valuators)),
+		m.NumButtons,
+	}
+
+	for _, v := range m.Valuators {
+		if len(v.LongName) >= giiValuatorLongNameSize || len(v.ShortName) >= giiValuatorShortNameSize {
+			return fmt.Errorf("gii valuator names %q and %q longer than %d and %d bytes",
+				v.LongName, v.ShortName, giiValuatorLongNameSize-1, giiValuatorShortNameSize-1)
+		}
+
+		data = append(data,
+			v.Index,
+			giiName(v.LongName, giiValuatorLongNameSize),
+			giiName(v.ShortName, giiValuatorShortNameSize),
+			v.RangeMin, v.RangeCenter, v.RangeMax,
+			v.SIUnit, v.SIAdd, v.SIMul, v.SIDiv, v.SIShift,
+		)
+	}
+
+	return writeMessage(w, data)
+}
+
+func (*GIIDeviceCreationMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	return readGIIClientMessage(r)
+}
+
+// giiName returns a name as a nul-padded array of size bytes.
+func giiName(name string, size int) []byte {
+	b := make([]byte, size)
+	copy(b, name)
+	return b
+}
+
+// GIIDeviceDestructionMessage asks the server to remove a device created
+// with a GIIDeviceCreationMessage.
+type GIIDeviceDestructionMessage struct {
+	DeviceOrigin uint32
+}
+
+func (*GIIDeviceDestructionMessage) Type() uint8 {
+	return 253
+}
+
+func (m *GIIDeviceDestructionMessage) Serialize(w io.Writer) error {
+	return writeMessage(w, []interface{}{
+		m.Type(),
+		giiBigEndian | GIIDeviceDestruction,
+		uint16(4),
+		m.DeviceOrigin,
+	})
+}
+
+func (*GIIDeviceDestructionMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	return readGIIClientMessage(r)
+}
+
+// GIIValuatorEventMessage sends the values of consecutive valuators of a
+// gii device, starting with the valuator of index First. The values are
+// positions, or changes of them if Relative is set.
+type GIIValuatorEventMessage struct {
+	DeviceOrigin uint32
+	Relative     bool
+	First        uint32
+	Values       []int32
+}
+
+func (*GIIValuatorEventMessage) Type() uint8 {
+	return 253
+}
+
+func (m *GIIValuatorEventMessage) Serialize(w io.Writer) error {
+	eventSize := giiValuatorEventHeaderLen + 4*len(m.Values)
+	if eventSize > 0xff {
+		return fmt.Errorf("too many gii valuator values: %d", len(m.Values))
+	}
+
+	eventType := GIIValuatorAbsolute
+	if m.Relative {
+		eventType = GIIValuatorRelative
+	}
+
+	return writeMessage(w, []interface{}{
+		m.Type(),
+		giiBigEndian | GIIInjectEvents,
+		uint16(eventSize),
+		uint8(eventSize),
+		eventType,
+		uint16(0),
+		m.DeviceOrigin,
+		m.First,
+		uint32(len(m.Values)),
+		m.Values,
+	})
+}
+
+func (*GIIValuatorEventMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	return readGIIClientMessage(r)
+}
+
+// readGIIClientMessage reads a gii client message following its message
+// type. Only messages injecting a single valuator event are supported
+// among those injecting events.
+func readGIIClientMessage(r io.Reader) (ClientMessage, error) {
+	subType, order, data, err := readGIIMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dr := bytes.NewReader(data)
+	switch subType {
+	case GIIVersion:
+		var result GIIVersionMessage
+		if err := binary.Read(dr, order, &result.Version); err != nil {
+			return nil, err
+		}
+
+		return &result, nil
+	case GIIDeviceCreation:
+		return readGIIDeviceCreation(dr, order)
+	case GIIDeviceDestruction:
+		var result GIIDeviceDestructionMessage
+		if err := binary.Read(dr, order, &result.DeviceOrigin); err != nil {
+			return nil, err
+		}
+
+		return &result, nil
+	case GIIInjectEvents:
+		return readGIIValuatorEvent(dr, order)
+	}
+
+	return nil, fmt.Errorf("unsupported gii client message: %d", subType)
+}
+
+func readGIIDeviceCreation(r io.Reader, order binary.ByteOrder) (ClientMessage, error) {
+	var header struct {
+		Name         [giiDeviceNameSize]byte
+		VendorID     uint32
+		ProductID    uint32
+		CanGenerate  uint32
+		NumRegisters uint32
+		NumValuators uint32
+		NumButtons   uint32
+	}
+	if err := binary.Read(r, order, &header); err != nil {
+		return nil, err
+	}
+
+	result := GIIDeviceCreationMessage{
+		Name:         giiString(header.Name[:]),
+		VendorID:     header.VendorID,
+		ProductID:    header.ProductID,
+		CanGenerate:  header.CanGenerate,
+		NumRegisters: header.NumRegisters,
+		NumButtons:   header.NumButtons,
+	}
+
+	for i := uint32(0); i < header.NumValuators; i++ {
+		var v struct {
+			Index       uint32
+			LongName    [giiValuatorLongNameSize]byte
+			ShortName   [giiValuatorShortNameSize]byte
+			RangeMin    int32
+			RangeCenter int32
+			RangeMax    int32
+			SIUnit      uint32
+			SIAdd       int32
+			SIMul       int32
+			SIDiv       int32
+			SIShift     int32
+		}
+		if err := binary.Read(r, order, &v); err != nil {
+			return nil, err
+		}
+
+		result.Valuators = append(result.Valuators, GIIValuator{
+			Index:       v.Index,
+			LongName:    giiString(v.LongName[:]),
+			ShortName:   giiString(v.ShortName[:]),
+			RangeMin:    v.RangeMin,
+			RangeCenter: v.RangeCenter,
+			RangeMax:    v.RangeMax,
+			SIUnit:      v.SIUnit,
+			SIAdd:       v.SIAdd,
+			SIMul:       v.SIMul,
+			SIDiv:       v.SIDiv,
+			SIShift:     v.SIShift,
+		})
+	}
+
+	return &result, nil
+}
+
+func readGIIValuatorEvent(r io.Reader, order binary.ByteOrder) (ClientMessage, error) {
+	var header struct {
+		EventSize    uint8
+		EventType    uint8
+		Padding      uint16
+		DeviceOrigin uint32
+		First        uint32
+		Count        uint32
+	}
+	if err := binary.Read(r, order, &header); err != nil {
+		return nil, err
+	}
+
+	if header.EventType != GIIValuatorRelative && header.EventType != GIIValuatorAbsolute {
+		return nil, fmt.Errorf("unsupported gii event type: %d", header.EventType)
+	}
+	if int(header.EventSize) != giiValuatorEventHeaderLen+4*int(header.Count) {
+		return nil, fmt.Errorf("gii valuator event of %d bytes has %d values", header.EventSize, header.Count)
+	}
+
+	result := GIIValuatorEventMessage{
+		DeviceOrigin: header.DeviceOrigin,
+		Relative:     header.EventType == GIIValuatorRelative,
+		First:        header.First,
+		Values:       make([]int32, header.Count),
+	}
+	if err := binary.Read(r, order, result.Values); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// giiString returns the string in a nul-padded name.
+func giiString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return string(b)
+}
@@ -0,0 +1,128 @@
+package vnc
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGIIValuatorEventMessage_Serialize(t *testing.T) {
+	msg := &GIIValuatorEventMessage{
+		DeviceOrigin: 0x01020304,
+		First:        2,
+		Values:       []int32{100, -1},
+	}
+
+	var buf bytes.Buffer
+	if err := msg.Serialize(&buf); err != nil {
+		t.Fatalf("error serializing: %s", err)
+	}
+
+	expected := []byte{
+		253, 0x80, 0, 24, // Big endian injected events
+		24, 13, 0, 0, // Absolute valuator event
+		1, 2, 3, 4, // Device origin
+		0, 0, 0, 2, // First
+		0, 0, 0, 2, // Count
+		0, 0, 0, 100,
+		0xff, 0xff, 0xff, 0xff,
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("serialized %v, want %v", buf.Bytes(), expected)
+	}
+
+	parsed, err := ReadClientMessage(&buf, nil)
+	if err != nil {
+		t.Fatalf("error reading message: %s", err)
+	}
+	if !reflect.DeepEqual(parsed, msg) {
+		t.Fatalf("read %#v, want %#v", parsed, msg)
+	}
+}
+
+func TestGIIDeviceCreationMessage_RoundTrip(t *testing.T) {
+	msg := &GIIDeviceCreationMessage{
+		Name:        "Tablet",
+		VendorID:    0x56a,
+		ProductID:   0x27,
+		CanGenerate: GIIValuatorAbsoluteMask,
+		NumButtons:  2,
+		Valuators: []GIIValuator{
+			{Index: 0, LongName: "Pressure", ShortName: "P", RangeMax: 2047, SIUnit: GIIUnitPressure, SIMul: 1, SIDiv: 1},
+			{Index: 1, LongName: "Tilt", ShortName: "T", RangeMin: -64, RangeMax: 63, SIUnit: GIIUnitAngle, SIMul: 1, SIDiv: 1},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := msg.Serialize(&buf); err != nil {
+		t.Fatalf("error serializing: %s", err)
+	}
+	if n := buf.Len(); n != 4+56+2*116 {
+		t.Fatalf("serialized %d bytes, want %d", n, 4+56+2*116)
+	}
+
+	parsed, err := ReadClientMessage(&buf, nil)
+	if err != nil {
+		t.Fatalf("error reading message: %s", err)
+	}
+	if !reflect.DeepEqual(parsed, msg) {
+		t.Fatalf("read %#v, want %#v", parsed, msg)
+	}
+
+	msg.Name = "A name that is too long for a gii device"
+	if err := msg.Serialize(io.Discard); err == nil {
+		t.Fatal("expected error for a long device name")
+	}
+}
+
+func TestGIIServerMessage_Read(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		expected GIIServerMessage
+	}{
+		// Little endian version.
+		{[]byte{1, 4, 0, 1, 0, 1, 0}, GIIServerMessage{SubType: GIIVersion, MaximumVersion: 1, MinimumVersion: 1}},
+		// Big endian device creation response.
+		{[]byte{0x82, 0, 4, 0, 0, 0, 7}, GIIServerMessage{SubType: GIIDeviceCreation, DeviceOrigin: 7}},
+	}
+
+	for _, tt := range tests {
+		msg, err := new(GIIServerMessage).Read(&ClientConn{}, bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatalf("error reading %v: %s", tt.data, err)
+		}
+		if *msg.(*GIIServerMessage) != tt.expected {
+			t.Fatalf("read %#v, want %#v", msg, tt.expected)
+		}
+	}
+}
+
+func TestClientConn_GIIVersion(t *testing.T) {
+	msgCh := make(chan ServerMessage, 1)
+	conn, server := newTestClientConn(&ClientConfig{ServerMessageCh: msgCh})
+	defer server.Close()
+
+	go conn.mainLoop()
+
+	// The version is answered, and the message delivered as usual.
+	server.Write([]byte{253, 0x81, 0, 4, 0, 2, 0, 1})
+
+	msg, err := ReadClientMessage(server, nil)
+	if err != nil {
+		t.Fatalf("error reading message: %s", err)
+	}
+	if version, ok := msg.(*GIIVersionMessage); !ok || version.Version != 1 {
+		t.Fatalf("answered %#v, want version 1", msg)
+	}
+
+	select {
+	case msg := <-msgCh:
+		if gii, ok := msg.(*GIIServerMessage); !ok || gii.MaximumVersion != 2 {
+			t.Fatalf("received %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the gii message")
+	}
+}
@@ -0,0 +1,265 @@
+package vnc
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// HextileEncoding divides a rectangle into tiles of 16x16 pixels, in
+// rows from left to right and top to bottom, the tiles at the right and
+// bottom edges being smaller if needed. Each tile is sent either as raw
+// pixels, or as a background color with subrectangles of other colors.
+// The background and foreground colors carry over from one tile to the
+// next, unless a tile specifies its own.
+//
+// Tiles only depend on each other through those colors, so the data of
+// the rectangle is read first, keeping track of the colors that apply
+// to each tile, and large rectangles then have their tiles decoded
+// concurrently. See ClientConfig.HextileWorkers.
+//
+// See RFC 6143 Section 7.7.4
+type HextileEncoding struct {
+	Colors []Color
+}
+
+func (*HextileEncoding) Type() int32 {
+	return 5
+}
+
+// The bits of the subencoding of a Hextile tile.
+const (
+	hextileRaw = 1 << iota
+	hextileBackgroundSpecified
+	hextileForegroundSpecified
+	hextileAnySubrects
+	hextileSubrectsColoured
+)
+
+const hextileTileSize = 16
+
+// The smallest number of tiles worth decoding in a goroutine of its own.
+const hextileTilesPerWorker = 16
+
+// hextileTile is a tile found while reading the data of a rectangle: its
+// position and size in the rectangle, the colors that apply to it, and
+// where its raw pixels or subrectangles start in the data.
+type hextileTile struct {
+	x, y, width, height    int
+	raw                    bool
+	background, foreground Color
+	subrects               int
+	coloured               bool
+	offset                 int
+}
+
+func (*HextileEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	if rect.empty() {
+		return &HextileEncoding{Colors: []Color{}}, nil
+	}
+
+	if err := c.checkRectangle(rect); err != nil {
+		return nil, err
+	}
+
+	format := c.decodeFormat()
+	bytesPerPixel := int(c.PixelFormat.BPP / 8)
+	width, height := int(rect.Width), int(rect.Height)
+
+	// The data of the rectangle is read into the pixel buffer of the
+	// connection, which is kept for the next rectangle.
+	data := c.pixelBuffer(0)
+	read := func(n int) (int, error) {
+		offset := len(data)
+		if cap(data)-offset < n {
+			grown := make([]byte, offset, 2*cap(data)+n)
+			copy(grown, data)
+			data = grown
+		}
+
+		data = data[:offset+n]
+		if _, err := io.ReadFull(r, data[offset:]); err != nil {
+			return 0, err
+		}
+
+		return offset, nil
+	}
+	pixel := func(offset int) (Color, error) {
+		var color [1]Color
+		err := format.decode(color[:], data[offset:offset+bytesPerPixel], &c.ColorMap)
+		return color[0], err
+	}
+
+	tiles := c.hextileTiles[:0]
+	var background, foreground Color
+	for y := 0; y < height; y += hextileTileSize {
+		for x := 0; x < width; x += hextileTileSize {
+			tile := hextileTile{
+				x:      x,
+				y:      y,
+				width:  minInt(hextileTileSize, width-x),
+				height: minInt(hextileTileSize, height-y),
+			}
+
+			offset, err := read(1)
+			if err != nil {
+				return nil, err
+			}
+			subencoding := data[offset]
+
+			if subencoding&hextileRaw != 0 {
+				tile.raw = true
+				if tile.offset, err = read(tile.width * tile.height * bytesPerPixel); err != nil {
+					return nil, err
+				}
+
+				tiles = append(tiles, tile)
+				continue
+			}
+
+			if subencoding&hextileBackgroundSpecified != 0 {
+				if offset, err = read(bytesPerPixel); err != nil {
+					return nil, err
+				}
+				if background, err = pixel(offset); err != nil {
+					return nil, err
+				}
+			}
+
+			if subencoding&hextileForegroundSpecified != 0 {
+				if offset, err = read(bytesPerPixel); err != nil {
+					return nil, err
+				}
+				if foreground, err = pixel(offset); err != nil {
+					return nil, err
+				}
+			}
+
+			tile.background, tile.foreground = background, foreground
+			if subencoding&hextileAnySubrects != 0 {
+				if offset, err = read(1); err != nil {
+					return nil, err
+				}
+				tile.subrects = int(data[offset])
+				tile.coloured = subencoding&hextileSubrectsColoured != 0
+
+				size := 2
+				if tile.coloured {
+					size += bytesPerPixel
+				}
+				if tile.offset, err = read(tile.subrects * size); err != nil {
+					return nil, err
+				}
+			}
+
+			tiles = append(tiles, tile)
+		}
+	}
+	c.pixelBytes = data
+	c.hextileTiles = tiles
+
+	colors := c.colorBuffer(width * height)
+	workers := c.hextileWorkers(len(tiles))
+	if workers == 1 {
+		if err := decodeHextileTiles(colors, width, tiles, data, format, &c.ColorMap); err != nil {
+			return nil, err
+		}
+
+		return &HextileEncoding{Colors: colors}, nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for i := 0; i < workers; i++ {
+		start, end := i*len(tiles)/workers, (i+1)*len(tiles)/workers
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = decodeHextileTiles(colors, width, tiles[start:end], data, format, &c.ColorMap)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &HextileEncoding{Colors: colors}, nil
+}
+
+// hextileWorkers returns the number of goroutines to decode a rectangle
+// of the given number of tiles with.
+func (c *ClientConn) hextileWorkers(tiles int) int {
+	workers := runtime.GOMAXPROCS(0)
+	if c.config != nil && c.config.HextileWorkers > 0 {
+		workers = c.config.HextileWorkers
+	}
+
+	return maxInt(1, minInt(workers, tiles/hextileTilesPerWorker))
+}
+
+// decodeHextileTiles paints tiles into dst, the colors of a rectangle of
+// the given width. Tiles don't overlap, so they may be decoded
+// concurrently.
+func decodeHextileTiles(dst []Color, width int, tiles []hextileTile, data []byte, format *PixelFormat, colorMap *[256]Color) error {
+	bytesPerPixel := int(format.BPP / 8)
+
+	for i := range tiles {
+		tile := &tiles[i]
+
+		if tile.raw {
+			rowBytes := tile.width * bytesPerPixel
+			for y := 0; y < tile.height; y++ {
+				row := dst[(tile.y+y)*width+tile.x:][:tile.width]
+				pixels := data[tile.offset+y*rowBytes:][:rowBytes]
+				if err := format.decode(row, pixels, colorMap); err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		for y := 0; y < tile.height; y++ {
+			row := dst[(tile.y+y)*width+tile.x:][:tile.width]
+			for x := range row {
+				row[x] = tile.background
+			}
+		}
+
+		offset := tile.offset
+		for j := 0; j < tile.subrects; j++ {
+			color := tile.foreground
+			if tile.coloured {
+				var colors [1]Color
+				if err := format.decode(colors[:], data[offset:offset+bytesPerPixel], colorMap); err != nil {
+					return err
+				}
+				color = colors[0]
+				offset += bytesPerPixel
+			}
+
+			x, y := int(data[offset]>>4), int(data[offset]&0xf)
+			w, h := int(data[offset+1]>>4)+1, int(data[offset+1]&0xf)+1
+			offset += 2
+
+			if x+w > tile.width || y+h > tile.height {
+				return fmt.Errorf("hextile subrectangle %dx%d at %d,%d is outside of the %dx%d tile at %d,%d",
+					w, h, x, y, tile.width, tile.height, tile.x, tile.y)
+			}
+
+			for sy := y; sy < y+h; sy++ {
+				row := dst[(tile.y+sy)*width+tile.x+x:][:w]
+				for sx := range row {
+					row[sx] = color
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// writeHextilePixel writes a pixel in testPixelFormat.
+func writeHextilePixel(buf *bytes.Buffer, color Color) {
+	pixel := uint32(color.R>>8)<<16 | uint32(color.G>>8)<<8 | uint32(color.B>>8)
+	binary.Write(buf, binary.LittleEndian, pixel)
+}
+
+// randomHextile returns the Hextile data of a rectangle whose tiles use
+// a random mix of subencodings.
+func randomHextile(rng *rand.Rand, width, height int) []byte {
+	randomColor := func() Color {
+		return rgb(uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)))
+	}
+
+	var buf bytes.Buffer
+	first := true
+	for y := 0; y < height; y += hextileTileSize {
+		for x := 0; x < width; x += hextileTileSize {
+			tileWidth, tileHeight := minInt(16, width-x), minInt(16, height-y)
+
+			if rng.Intn(4) == 0 {
+				buf.WriteByte(hextileRaw)
+				for i := 0; i < tileWidth*tileHeight; i++ {
+					writeHextilePixel(&buf, randomColor())
+				}
+				continue
+			}
+
+			// The first tile that isn't raw must specify its background,
+			// and later ones carry it over at random.
+			var subencoding uint8
+			if first || rng.Intn(2) == 0 {
+				subencoding |= hextileBackgroundSpecified
+			}
+			if first || rng.Intn(2) == 0 {
+				subencoding |= hextileForegroundSpecified
+			}
+			subrects := rng.Intn(8)
+			if subrects > 0 {
+				subencoding |= hextileAnySubrects
+				if rng.Intn(2) == 0 {
+					subencoding |= hextileSubrectsColoured
+				}
+			}
+			first = false
+
+			buf.WriteByte(subencoding)
+			if subencoding&hextileBackgroundSpecified != 0 {
+				writeHextilePixel(&buf, randomColor())
+			}
+			if subencoding&hextileForegroundSpecified != 0 {
+				writeHextilePixel(&buf, randomColor())
+			}
+			if subencoding&hextileAnySubrects == 0 {
+				continue
+			}
+
+			buf.WriteByte(uint8(subrects))
+			for i := 0; i < subrects; i++ {
+				if subencoding&hextileSubrectsColoured != 0 {
+					writeHextilePixel(&buf, randomColor())
+				}
+
+				sx, sy := rng.Intn(tileWidth), rng.Intn(tileHeight)
+				sw, sh := 1+rng.Intn(tileWidth-sx), 1+rng.Intn(tileHeight-sy)
+				buf.Write([]byte{uint8(sx<<4 | sy), uint8((sw-1)<<4 | (sh - 1))})
+			}
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func TestHextileEncoding_Read(t *testing.T) {
+	conn := &ClientConn{
+		config:            &ClientConfig{},
+		FrameBufferWidth:  20,
+		FrameBufferHeight: 18,
+		PixelFormat:       testPixelFormat,
+	}
+
+	red, green, blue, white := rgb(255, 0, 0), rgb(0, 255, 0), rgb(0, 0, 255), rgb(255, 255, 255)
+
+	var data bytes.Buffer
+
+	// A 16x16 red tile with a green subrectangle of 2x3 at 1,2.
+	data.WriteByte(hextileBackgroundSpecified | hextileForegroundSpecified | hextileAnySubrects)
+	writeHextilePixel(&data, red)
+	writeHextilePixel(&data, green)
+	data.Write([]byte{1, 0x12, 0x12})
+
+	// A 4x16 tile, keeping the colors, with a subrectangle at 3,15.
+	data.Write([]byte{hextileAnySubrects, 1, 0x3f, 0x00})
+
+	// A 16x2 raw tile, of blue pixels.
+	data.WriteByte(hextileRaw)
+	for i := 0; i < 16*2; i++ {
+		writeHextilePixel(&data, blue)
+	}
+
+	// A 4x2 tile with a white pixel at 0,1, keeping the red background.
+	data.Write([]byte{hextileAnySubrects | hextileSubrectsColoured, 1})
+	writeHextilePixel(&data, white)
+	data.Write([]byte{0x01, 0x00})
+
+	enc, err := new(HextileEncoding).Read(conn, &Rectangle{Width: 20, Height: 18}, &data)
+	if err != nil {
+		t.Fatalf("error reading rectangle: %s", err)
+	}
+	if data.Len() != 0 {
+		t.Fatalf("%d bytes left unread", data.Len())
+	}
+
+	colors := enc.(*HextileEncoding).Colors
+	for _, tt := range []struct {
+		x, y     int
+		expected Color
+	}{
+		{0, 0, red},
+		{1, 2, green},
+		{2, 4, green},
+		{3, 4, red},
+		{1, 5, red},
+		{16, 0, red},
+		{19, 15, green},
+		{18, 15, red},
+		{0, 16, blue},
+		{15, 17, blue},
+		{16, 16, red},
+		{16, 17, white},
+		{17, 17, red},
+	} {
+		if actual := colors[tt.y*20+tt.x]; actual != tt.expected {
+			t.Errorf("pixel %d,%d = %v, want %v", tt.x, tt.y, actual, tt.expected)
+		}
+	}
+
+	// Subrectangles must lie within their tile.
+	data.Reset()
+	data.Write([]byte{hextileBackgroundSpecified | hextileAnySubrects})
+	writeHextilePixel(&data, red)
+	data.Write([]byte{1, 0xf0, 0x10})
+	_, err = new(HextileEncoding).Read(conn, &Rectangle{Width: 16, Height: 16}, &data)
+	if err == nil || !strings.Contains(err.Error(), "outside of the 16x16 tile") {
+		t.Fatalf("err = %v for a subrectangle outside of its tile", err)
+	}
+}
+
+func TestHextileEncoding_Concurrent(t *testing.T) {
+	data := randomHextile(rand.New(rand.NewSource(1)), 300, 200)
+
+	var decoded [][]Color
+	for _, workers := range []int{1, 7} {
+		conn := &ClientConn{
+			config:            &ClientConfig{HextileWorkers: workers},
+			FrameBufferWidth:  300,
+			FrameBufferHeight: 200,
+			PixelFormat:       testPixelFormat,
+		}
+
+		r := bytes.NewReader(data)
+		enc, err := new(HextileEncoding).Read(conn, &Rectangle{Width: 300, Height: 200}, r)
+		if err != nil {
+			t.Fatalf("%d workers: error reading rectangle: %s", workers, err)
+		}
+		if r.Len() != 0 {
+			t.Fatalf("%d workers: %d bytes left unread", workers, r.Len())
+		}
+
+		decoded = append(decoded, enc.(*HextileEncoding).Colors)
+	}
+
+	for i := range decoded[0] {
+		if decoded[0][i] != decoded[1][i] {
+			t.Fatalf("pixel %d,%d decoded concurrently as %v, sequentially as %v",
+				i%300, i/300, decoded[1][i], decoded[0][i])
+		}
+	}
+}
+
+func BenchmarkHextileEncoding(b *testing.B) {
+	data := randomHextile(rand.New(rand.NewSource(1)), 1920, 1080)
+
+	for _, bb := range []struct {
+		name    string
+		workers int
+	}{
+		{"Sequential", 1},
+		{"Concurrent", 0},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			conn := &ClientConn{
+				config:            &ClientConfig{HextileWorkers: bb.workers, ColorPool: new(ColorPool)},
+				FrameBufferWidth:  1920,
+				FrameBufferHeight: 1080,
+				PixelFormat:       testPixelFormat,
+			}
+			rect := &Rectangle{Width: 1920, Height: 1080}
+			r := bytes.NewReader(data)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				r.Reset(data)
+				enc, err := new(HextileEncoding).Read(conn, rect, r)
+				if err != nil {
+					b.Fatalf("error reading rectangle: %s", err)
+				}
+
+				conn.config.ColorPool.Put(enc.(*HextileEncoding).Colors)
+			}
+		})
+	}
+}
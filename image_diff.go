@@ -0,0 +1,129 @@
+package vnc
+
+import "image"
+
+// ImageDiff returns Raw rectangles that turn the frame prev into next,
+// such as for a mock server, or a server built on this package, to send
+// in a FramebufferUpdate. Applying them to a Framebuffer holding prev
+// leaves it holding next.
+//
+// The rows that changed are split into bands of consecutive rows, and
+// each band into runs of columns that changed, giving one rectangle for
+// each separate region that changed, shrunk to fit it. Coordinates are
+// relative to the bounds of next. If prev is nil, or its size differs
+// from next, a single rectangle covers all of next.
+func ImageDiff(prev, next image.Image) []Rectangle {
+	bounds := next.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return nil
+	}
+
+	nextColors := imageColors(next)
+	if prev == nil || prev.Bounds().Dx() != width || prev.Bounds().Dy() != height {
+		return []Rectangle{{
+			Width:  uint16(width),
+			Height: uint16(height),
+			Enc:    &RawEncoding{Colors: nextColors},
+		}}
+	}
+
+	prevColors := imageColors(prev)
+	changed := func(x, y int) bool {
+		return prevColors[y*width+x] != nextColors[y*width+x]
+	}
+
+	rowChanged := make([]bool, height)
+	for y := range rowChanged {
+		for x := 0; x < width; x++ {
+			if changed(x, y) {
+				rowChanged[y] = true
+				break
+			}
+		}
+	}
+
+	var rects []Rectangle
+	for top := 0; top < height; {
+		if !rowChanged[top] {
+			top++
+			continue
+		}
+
+		bottom := top
+		for bottom < height && rowChanged[bottom] {
+			bottom++
+		}
+
+		for left := 0; left < width; {
+			if !columnChanged(changed, left, top, bottom) {
+				left++
+				continue
+			}
+
+			right := left
+			for right < width && columnChanged(changed, right, top, bottom) {
+				right++
+			}
+
+			// The columns that changed may have done so in only some of
+			// the rows of the band.
+			minY, maxY := bottom, top
+			for y := top; y < bottom; y++ {
+				for x := left; x < right; x++ {
+					if changed(x, y) {
+						minY, maxY = minInt(minY, y), maxInt(maxY, y+1)
+						break
+					}
+				}
+			}
+
+			rect := Rectangle{
+				X:      uint16(left),
+				Y:      uint16(minY),
+				Width:  uint16(right - left),
+				Height: uint16(maxY - minY),
+			}
+
+			colors := make([]Color, 0, int(rect.Width)*int(rect.Height))
+			for y := minY; y < maxY; y++ {
+				colors = append(colors, nextColors[y*width+left:y*width+right]...)
+			}
+			rect.Enc = &RawEncoding{Colors: colors}
+
+			rects = append(rects, rect)
+			left = right
+		}
+
+		top = bottom
+	}
+
+	return rects
+}
+
+// columnChanged reports whether any pixel of column x changed between
+// the rows top and bottom.
+func columnChanged(changed func(x, y int) bool, x, top, bottom int) bool {
+	for y := top; y < bottom; y++ {
+		if changed(x, y) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// imageColors returns the colors of an image in row-major order.
+func imageColors(img image.Image) []Color {
+	bounds := img.Bounds()
+
+	colors := make([]Color, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			colors = append(colors, Color{R: uint16(r), G: uint16(g), B: uint16(b)})
+		}
+	}
+
+	return colors
+}
@@ -0,0 +1,78 @@
+package vnc
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// imageFramebuffer returns a framebuffer holding the pixels of img.
+func imageFramebuffer(img image.Image) *Framebuffer {
+	bounds := img.Bounds()
+	fb := NewFramebuffer(uint16(bounds.Dx()), uint16(bounds.Dy()))
+	copy(fb.Colors, imageColors(img))
+	return fb
+}
+
+func TestImageDiff(t *testing.T) {
+	prev := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	draw.Draw(prev, prev.Bounds(), image.NewUniform(color.RGBA{0x10, 0x20, 0x30, 0xff}), image.Point{}, draw.Src)
+
+	changed := color.RGBA{0xff, 0, 0, 0xff}
+	tests := []struct {
+		regions  []image.Rectangle
+		expected []Rectangle
+	}{
+		{nil, nil},
+		{
+			[]image.Rectangle{image.Rect(10, 5, 20, 15)},
+			[]Rectangle{{X: 10, Y: 5, Width: 10, Height: 10}},
+		},
+		{
+			// Regions side by side, and one below them.
+			[]image.Rectangle{image.Rect(0, 0, 4, 4), image.Rect(40, 2, 44, 3), image.Rect(8, 30, 9, 48)},
+			[]Rectangle{
+				{X: 0, Y: 0, Width: 4, Height: 4},
+				{X: 40, Y: 2, Width: 4, Height: 1},
+				{X: 8, Y: 30, Width: 1, Height: 18},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		next := image.NewRGBA(prev.Bounds())
+		copy(next.Pix, prev.Pix)
+		for _, region := range tt.regions {
+			draw.Draw(next, region, image.NewUniform(changed), image.Point{}, draw.Src)
+		}
+
+		rects := ImageDiff(prev, next)
+		if len(rects) != len(tt.expected) {
+			t.Fatalf("%d: got %d rectangles, want %d", i, len(rects), len(tt.expected))
+		}
+		for j, rect := range rects {
+			enc := rect.Enc.(*RawEncoding)
+			if len(enc.Colors) != int(rect.Width)*int(rect.Height) {
+				t.Fatalf("%d: rectangle %d has %d colors", i, j, len(enc.Colors))
+			}
+
+			rect.Enc = nil
+			if rect != tt.expected[j] {
+				t.Fatalf("%d: rectangle %d is %+v, want %+v", i, j, rect, tt.expected[j])
+			}
+		}
+
+		fb := imageFramebuffer(prev)
+		fb.Apply(&FramebufferUpdateMessage{Rectangles: ImageDiff(prev, next)})
+		if fb.Checksum() != imageFramebuffer(next).Checksum() {
+			t.Fatalf("%d: applying the difference doesn't give the next frame", i)
+		}
+	}
+
+	// Without a previous frame of the same size, all of it is sent.
+	rects := ImageDiff(image.NewRGBA(image.Rect(0, 0, 10, 10)), prev)
+	if len(rects) != 1 || rects[0].Width != 64 || rects[0].Height != 48 {
+		t.Fatalf("got %+v, want a single 64x48 rectangle", rects)
+	}
+}
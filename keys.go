@@ -0,0 +1,76 @@
+package vnc
+
+import "unicode"
+
+// controlKeysyms are the keysyms of the control characters that have a
+// key of their own. Newlines are typed using Return.
+var controlKeysyms = map[rune]uint32{
+	'\b': 0xff08, // BackSpace
+	'\t': 0xff09, // Tab
+	'\n': 0xff0d, // Return
+	'\r': 0xff0d, // Return
+	0x1b: 0xff1b, // Escape
+	0x7f: 0xffff, // Delete
+}
+
+// KeysymForRune returns the X keysym that types r, and whether there is
+// one. Printable Latin-1 characters, including the ASCII punctuation,
+// have keysyms equal to their code points. Other printable characters
+// use the Unicode keysyms defined by X, the code point plus 0x01000000,
+// such as 0x010020ac for the euro sign. Of the control characters, only
+// those with keys of their own, such as tab and newline, have keysyms.
+func KeysymForRune(r rune) (uint32, bool) {
+	if keysym, ok := controlKeysyms[r]; ok {
+		return keysym, true
+	}
+
+	switch {
+	case r < 0 || r > unicode.MaxRune || !unicode.IsGraphic(r):
+		return 0, false
+	case r <= 0xff:
+		return uint32(r), true
+	}
+
+	return 0x01000000 | uint32(r), true
+}
+
+// ReleaseAllKeys sends a key up event for every key that has been sent as
+// pressed, but not yet released, such as when the viewer loses focus and
+// would otherwise leave modifiers stuck on the server. The keys are
+// released in the reverse order they were pressed, in a single write.
+func (c *ClientConn) ReleaseAllKeys() error {
+	c.keysLock.Lock()
+	msgs := make([]ClientMessage, 0, len(c.pressedKeys))
+	for i := len(c.pressedKeys) - 1; i >= 0; i-- {
+		msgs = append(msgs, &KeyEventMessage{Down: false, Keysym: c.pressedKeys[i]})
+	}
+	c.keysLock.Unlock()
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	return c.send(msgs...)
+}
+
+// keySent records a key event sent to the server, for ReleaseAllKeys.
+func (c *ClientConn) keySent(msg *KeyEventMessage) {
+	c.keysLock.Lock()
+	defer c.keysLock.Unlock()
+
+	for i, keysym := range c.pressedKeys {
+		if keysym == msg.Keysym {
+			if msg.Down {
+				// Repeated key down events don't need more releases.
+				return
+			}
+
+			c.pressedKeys = append(c.pressedKeys[:i], c.pressedKeys[i+1:]...)
+			return
+		}
+	}
+
+	if msg.Down {
+		c.pressedKeys = append(c.pressedKeys, msg.Keysym)
+	}
+}
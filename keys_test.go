@@ -0,0 +1,31 @@
+package vnc
+
+import "testing"
+
+func TestKeysymForRune(t *testing.T) {
+	tests := []struct {
+		r      rune
+		keysym uint32
+		ok     bool
+	}{
+		{'a', 0x61, true},
+		{'~', 0x7e, true},
+		{' ', 0x20, true},
+		{'é', 0xe9, true},
+		{' ', 0xa0, true},
+		{'€', 0x010020ac, true},
+		{'あ', 0x01003042, true},
+		{'\n', 0xff0d, true},
+		{'\t', 0xff09, true},
+		{0x01, 0, false},
+		{0x85, 0, false},
+		{-1, 0, false},
+	}
+
+	for _, tt := range tests {
+		keysym, ok := KeysymForRune(tt.r)
+		if keysym != tt.keysym || ok != tt.ok {
+			t.Fatalf("KeysymForRune(%U) = %#x, %v, want %#x, %v", tt.r, keysym, ok, tt.keysym, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package vnc
+
+// observerBuffer is the number of messages buffered for each observer.
+const observerBuffer = 64
+
+// Observe returns a channel that receives every message read from the
+// server, in addition to ServerMessageCh, for users that only observe the
+// session, such as for monitoring. Any number of observers can be added.
+//
+// Observers receive the same message values as ServerMessageCh, which
+// must not be modified. A slow observer never blocks the connection: if
+// its channel is full, the oldest message in it is dropped to make room.
+// The channel is closed when the connection is closed.
+func (c *ClientConn) Observe() <-chan ServerMessage {
+	c.observersLock.Lock()
+	defer c.observersLock.Unlock()
+
+	ch := make(chan ServerMessage, observerBuffer)
+	if c.observersClosed {
+		close(ch)
+		return ch
+	}
+
+	c.observers = append(c.observers, ch)
+	return ch
+}
+
+// observed reports whether there are any observers of the connection.
+func (c *ClientConn) observed() bool {
+	c.observersLock.Lock()
+	defer c.observersLock.Unlock()
+
+	return len(c.observers) > 0
+}
+
+// notifyObservers sends a message to all of the observers, dropping the
+// oldest message of those that are full.
+func (c *ClientConn) notifyObservers(msg ServerMessage) {
+	c.observersLock.Lock()
+	defer c.observersLock.Unlock()
+
+	for _, ch := range c.observers {
+		for sent := false; !sent; {
+			select {
+			case ch <- msg:
+				sent = true
+			default:
+				// Drop the oldest message to make room.
+				select {
+				case <-ch:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// closeObservers closes the channels of all of the observers, once no
+// more messages will be read.
+func (c *ClientConn) closeObservers() {
+	c.observersLock.Lock()
+	defer c.observersLock.Unlock()
+
+	for _, ch := range c.observers {
+		close(ch)
+	}
+
+	c.observers = nil
+	c.observersClosed = true
+}
@@ -0,0 +1,64 @@
+package vnc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClientConn_Observe(t *testing.T) {
+	messageCh := make(chan ServerMessage, 1)
+	conn, server := newTestClientConn(&ClientConfig{ServerMessageCh: messageCh})
+
+	first := conn.Observe()
+	second := conn.Observe()
+
+	go conn.mainLoop()
+
+	// Bell
+	if _, err := server.Write([]byte{2}); err != nil {
+		t.Fatalf("error writing bell: %s", err)
+	}
+
+	for _, ch := range []<-chan ServerMessage{messageCh, first, second} {
+		select {
+		case msg := <-ch:
+			if _, ok := msg.(*BellMessage); !ok {
+				t.Fatalf("received %T, want *BellMessage", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("bell not received")
+		}
+	}
+
+	server.Close()
+	for _, ch := range []<-chan ServerMessage{first, second} {
+		select {
+		case _, ok := <-ch:
+			if ok {
+				t.Fatal("unexpected message after close")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("observer channel not closed")
+		}
+	}
+}
+
+func TestClientConn_ObserveDropsOldest(t *testing.T) {
+	conn := &ClientConn{}
+	ch := conn.Observe()
+
+	// A slow observer doesn't block, and keeps the latest messages.
+	for i := 0; i < observerBuffer+10; i++ {
+		conn.notifyObservers(&ServerCutTextMessage{Text: fmt.Sprint(i)})
+	}
+
+	if len(ch) != observerBuffer {
+		t.Fatalf("%d messages buffered, want %d", len(ch), observerBuffer)
+	}
+
+	msg := (<-ch).(*ServerCutTextMessage)
+	if msg.Text != "10" {
+		t.Fatalf("oldest message = %q, want %q", msg.Text, "10")
+	}
+}
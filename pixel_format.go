@@ -3,6 +3,7 @@ package vnc
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
@@ -20,6 +21,320 @@ type PixelFormat struct {
 	RedShift   uint8
 	GreenShift uint8
 	BlueShift  uint8
+
+	// rawChannels keeps the channel values of true color pixels as they
+	// are, instead of scaling them to 16 bits. See
+	// ClientConfig.RawChannelValues.
+	rawChannels bool
+}
+
+// ByteOrder selects the byte order used to decode pixel data. See
+// ClientConfig.ForceByteOrder.
+type ByteOrder uint8
+
+const (
+	// ByteOrderAuto uses the byte order of the pixel format.
+	ByteOrderAuto ByteOrder = iota
+	ByteOrderLittle
+	ByteOrderBig
+)
+
+// NewPixelFormatRGB888 returns a true color pixel format with 8 bits per
+// channel, stored in a 32 bit pixel. The depth is 24, since the upper 8
+// bits of each pixel are unused.
+func NewPixelFormatRGB888() *PixelFormat {
+	return &PixelFormat{
+		BPP:        32,
+		Depth:      24,
+		TrueColor:  true,
+		RedMax:     255,
+		GreenMax:   255,
+		BlueMax:    255,
+		RedShift:   16,
+		GreenShift: 8,
+		BlueShift:  0,
+	}
+}
+
+// NewPixelFormatRGB565 returns a true color pixel format with 5 bits of
+// red and blue and 6 bits of green, stored in a 16 bit pixel.
+func NewPixelFormatRGB565() *PixelFormat {
+	return &PixelFormat{
+		BPP:        16,
+		Depth:      16,
+		TrueColor:  true,
+		RedMax:     31,
+		GreenMax:   63,
+		BlueMax:    31,
+		RedShift:   11,
+		GreenShift: 5,
+		BlueShift:  0,
+	}
+}
+
+// NewPixelFormatBGR233 returns a true color pixel format with 3 bits of
+// red and green and 2 bits of blue, stored in an 8 bit pixel.
+func NewPixelFormatBGR233() *PixelFormat {
+	return &PixelFormat{
+		BPP:        8,
+		Depth:      8,
+		TrueColor:  true,
+		RedMax:     7,
+		GreenMax:   7,
+		BlueMax:    3,
+		RedShift:   0,
+		GreenShift: 3,
+		BlueShift:  6,
+	}
+}
+
+// Decode decodes pixel data sent in this pixel format into colors. The
+// channels of true color pixels are scaled from the max of each channel
+// to 16 bits. For color-mapped formats, the pixel values are looked up
+// in colorMap.
+func (format *PixelFormat) Decode(data []byte, colorMap *[256]Color) ([]Color, error) {
+	if err := format.checkBPP(); err != nil {
+		return nil, err
+	}
+
+	bytesPerPixel := int(format.BPP / 8)
+	if len(data)%bytesPerPixel != 0 {
+		return nil, fmt.Errorf("pixel data length %d doesn't match %d bits per pixel", len(data), format.BPP)
+	}
+
+	colors := make([]Color, len(data)/bytesPerPixel)
+	if err := format.decode(colors, data, colorMap); err != nil {
+		return nil, err
+	}
+
+	return colors, nil
+}
+
+// DecodeInto is like Decode, but decodes the pixel data into dst instead
+// of allocating new colors. The data must hold exactly len(dst) pixels.
+func (format *PixelFormat) DecodeInto(dst []Color, data []byte, colorMap *[256]Color) error {
+	if err := format.checkBPP(); err != nil {
+		return err
+	}
+
+	if len(data) != len(dst)*int(format.BPP/8) {
+		return fmt.Errorf("pixel data length %d doesn't match %d pixels of %d bits", len(data), len(dst), format.BPP)
+	}
+
+	return format.decode(dst, data, colorMap)
+}
+
+// Encode encodes colors into pixel data in this pixel format. It is the
+// inverse of Decode: the 16-bit channels of true color pixels are scaled
+// down to the max of each channel, rounding to the nearest value. For
+// color-mapped formats, each color is encoded as the index of the
+// closest color in colorMap.
+func (format *PixelFormat) Encode(colors []Color, colorMap *[256]Color) ([]byte, error) {
+	if err := format.checkBPP(); err != nil {
+		return nil, err
+	}
+	if !format.TrueColor && colorMap == nil {
+		return nil, fmt.Errorf("a color map is required for color-mapped pixel formats")
+	}
+
+	bytesPerPixel := int(format.BPP / 8)
+	byteOrder := format.byteOrder()
+	data := make([]byte, len(colors)*bytesPerPixel)
+
+	for i, color := range colors {
+		var rawPixel uint32
+		if format.TrueColor {
+			rawPixel = format.channel(color.R, format.RedMax)<<format.RedShift |
+				format.channel(color.G, format.GreenMax)<<format.GreenShift |
+				format.channel(color.B, format.BlueMax)<<format.BlueShift
+		} else {
+			rawPixel = uint32(closestColor(colorMap, color))
+		}
+
+		pixelBytes := data[i*bytesPerPixel : (i+1)*bytesPerPixel]
+		switch format.BPP {
+		case 8:
+			pixelBytes[0] = uint8(rawPixel)
+		case 16:
+			byteOrder.PutUint16(pixelBytes, uint16(rawPixel))
+		case 32:
+			byteOrder.PutUint32(pixelBytes, rawPixel)
+		}
+	}
+
+	return data, nil
+}
+
+// decode decodes pixel data into dst, which must have room for exactly
+// the number of pixels in data.
+func (format *PixelFormat) decode(dst []Color, data []byte, colorMap *[256]Color) error {
+	if err := format.checkBPP(); err != nil {
+		return err
+	}
+	if !format.TrueColor && colorMap == nil {
+		return fmt.Errorf("a color map is required for color-mapped pixel formats")
+	}
+
+	bytesPerPixel := int(format.BPP / 8)
+	byteOrder := format.byteOrder()
+
+	for i := range dst {
+		pixelBytes := data[i*bytesPerPixel : (i+1)*bytesPerPixel]
+
+		var rawPixel uint32
+		switch format.BPP {
+		case 8:
+			rawPixel = uint32(pixelBytes[0])
+		case 16:
+			rawPixel = uint32(byteOrder.Uint16(pixelBytes))
+		case 32:
+			rawPixel = byteOrder.Uint32(pixelBytes)
+		}
+
+		color := &dst[i]
+		if format.TrueColor {
+			*color = format.color(
+				(rawPixel>>format.RedShift)&uint32(format.RedMax),
+				(rawPixel>>format.GreenShift)&uint32(format.GreenMax),
+				(rawPixel>>format.BlueShift)&uint32(format.BlueMax))
+		} else {
+			if rawPixel >= uint32(len(colorMap)) {
+				return fmt.Errorf("color map index out of range: %d", rawPixel)
+			}
+
+			*color = colorMap[rawPixel]
+		}
+	}
+
+	return nil
+}
+
+// RawRectangleSize returns the number of bytes that the pixel data of a
+// rectangle occupies on the wire in the Raw encoding, in this pixel format.
+func (format *PixelFormat) RawRectangleSize(rect Rectangle) int {
+	return int(rect.Width) * int(rect.Height) * int(format.BPP/8)
+}
+
+func (format *PixelFormat) checkBPP() error {
+	switch format.BPP {
+	case 8, 16, 32:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported bits per pixel: %d", format.BPP)
+}
+
+// color returns the Color of a true color pixel with the given channel
+// values, each ranging from zero to the max of the channel. The values
+// are scaled to the full 16 bits of a Color, so that, say, the 5 bit
+// channels of RGB565 and the 8 bit channels of RGB888 give the same
+// colors, the same as the 16 bit colors of a color map.
+func (format *PixelFormat) color(r, g, b uint32) Color {
+	if format.rawChannels {
+		return Color{R: uint16(r), G: uint16(g), B: uint16(b)}
+	}
+
+	return Color{
+		R: scaleChannel(r, format.RedMax),
+		G: scaleChannel(g, format.GreenMax),
+		B: scaleChannel(b, format.BlueMax),
+	}
+}
+
+// channel is the inverse of color, for a single 16 bit channel value.
+func (format *PixelFormat) channel(value, max uint16) uint32 {
+	if format.rawChannels {
+		return uint32(value) & uint32(max)
+	}
+
+	return (uint32(value)*uint32(max) + 0x7fff) / 0xffff
+}
+
+// scaleChannel scales a channel value ranging from zero to max to 16 bits.
+func scaleChannel(value uint32, max uint16) uint16 {
+	if max == 0 {
+		return 0
+	}
+
+	return uint16(value * 0xffff / uint32(max))
+}
+
+// PixelState is the state of a connection that determines how pixel data
+// from the server is decoded: the pixel format, and the color map used by
+// color-mapped pixel formats.
+type PixelState struct {
+	PixelFormat PixelFormat
+	ColorMap    [256]Color
+}
+
+// PixelState returns a snapshot of the pixel format and color map of the
+// connection. See RestorePixelState.
+func (c *ClientConn) PixelState() PixelState {
+	return PixelState{PixelFormat: c.PixelFormat, ColorMap: c.ColorMap}
+}
+
+// RestorePixelState sets the pixel format and color map of the
+// connection to a snapshot taken using PixelState, possibly of another
+// connection, so that pixel data sent in that state is decoded the same
+// way. This is useful to decode a copy of the data of another
+// connection, such as in a proxy or from a recording.
+//
+// Nothing is sent to the server: since the server picks the colors of
+// the color map, the state can only be restored locally. To have the
+// server send pixels in the restored pixel format, SetPixelFormat must
+// be called with it too. As with the PixelFormat and ColorMap fields, the
+// state must not be restored while a FramebufferUpdate is being decoded.
+func (c *ClientConn) RestorePixelState(state PixelState) {
+	c.PixelFormat = state.PixelFormat
+	c.ColorMap = state.ColorMap
+}
+
+// decodeFormat returns the pixel format used to decode pixel data from
+// the server, which is the pixel format of the connection with the byte
+// order overridden by ClientConfig.ForceByteOrder, and the scaling of
+// the channels by ClientConfig.RawChannelValues.
+func (c *ClientConn) decodeFormat() *PixelFormat {
+	if c.config == nil || (c.config.ForceByteOrder == ByteOrderAuto && !c.config.RawChannelValues) {
+		return &c.PixelFormat
+	}
+
+	format := c.PixelFormat
+	if c.config.ForceByteOrder != ByteOrderAuto {
+		format.BigEndian = c.config.ForceByteOrder == ByteOrderBig
+	}
+	format.rawChannels = c.config.RawChannelValues
+	return &format
+}
+
+func (format *PixelFormat) byteOrder() binary.ByteOrder {
+	if format.BigEndian {
+		return binary.BigEndian
+	}
+
+	return binary.LittleEndian
+}
+
+// closestColor returns the index of the color in the color map closest
+// to the given color.
+func closestColor(colorMap *[256]Color, color Color) uint8 {
+	var best uint8
+	var bestDistance uint64
+	for i, candidate := range colorMap {
+		dr := uint64(channelDelta(candidate.R, color.R))
+		dg := uint64(channelDelta(candidate.G, color.G))
+		db := uint64(channelDelta(candidate.B, color.B))
+
+		distance := dr*dr + dg*dg + db*db
+		if i == 0 || distance < bestDistance {
+			best = uint8(i)
+			bestDistance = distance
+		}
+		if distance == 0 {
+			break
+		}
+	}
+
+	return best
 }
 
 func readPixelFormat(r io.Reader, result *PixelFormat) error {
@@ -84,6 +399,12 @@ func readPixelFormat(r io.Reader, result *PixelFormat) error {
 }
 
 func writePixelFormat(format *PixelFormat) ([]byte, error) {
+	// The depth is the number of useful bits in a pixel, which some
+	// servers rely on, so it must be set separately from BPP.
+	if format.Depth == 0 || format.Depth > format.BPP {
+		return nil, fmt.Errorf("invalid depth %d for %d bits per pixel", format.Depth, format.BPP)
+	}
+
 	var buf bytes.Buffer
 
 	// Byte 1
@@ -147,5 +468,9 @@ func writePixelFormat(format *PixelFormat) ([]byte, error) {
 		}
 	}
 
-	return buf.Bytes()[0:16], nil
+	// The remaining bytes are padding, or unused color values if true
+	// color is disabled.
+	buf.Write(make([]byte, 16-buf.Len()))
+
+	return buf.Bytes(), nil
 }
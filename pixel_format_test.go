@@ -0,0 +1,386 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPixelFormat_RoundTrip(t *testing.T) {
+	rgb565 := PixelFormat{
+		BPP:        16,
+		Depth:      16,
+		BigEndian:  true,
+		TrueColor:  true,
+		RedMax:     31,
+		GreenMax:   63,
+		BlueMax:    31,
+		RedShift:   11,
+		GreenShift: 5,
+		BlueShift:  0,
+	}
+
+	tests := []struct {
+		format PixelFormat
+		colors []Color
+		data   []byte
+	}{
+		{
+			testPixelFormat,
+			[]Color{rgb(255, 0, 0), rgb(0x12, 0x34, 0x56)},
+			[]byte{0, 0, 255, 0, 0x56, 0x34, 0x12, 0},
+		},
+		{
+			// The 5 and 6 bit channels, 31, 0, 0 and 1, 2, 3, are scaled to
+			// 16 bits.
+			rgb565,
+			[]Color{{0xffff, 0, 0}, {0x0842, 0x0820, 0x18c6}},
+			[]byte{0xf8, 0x00, 0x08, 0x43},
+		},
+	}
+
+	for _, tt := range tests {
+		data, err := tt.format.Encode(tt.colors, nil)
+		if err != nil {
+			t.Fatalf("Encode(%v) error: %s", tt.colors, err)
+		}
+		if !bytes.Equal(data, tt.data) {
+			t.Fatalf("Encode(%v) = %v, want %v", tt.colors, data, tt.data)
+		}
+
+		colors, err := tt.format.Decode(data, nil)
+		if err != nil {
+			t.Fatalf("Decode(%v) error: %s", data, err)
+		}
+		if len(colors) != len(tt.colors) {
+			t.Fatalf("Decode(%v) = %v, want %v", data, colors, tt.colors)
+		}
+		for i := range colors {
+			if colors[i] != tt.colors[i] {
+				t.Fatalf("Decode(%v) = %v, want %v", data, colors, tt.colors)
+			}
+		}
+	}
+}
+
+func TestPixelFormat_ColorMap(t *testing.T) {
+	format := PixelFormat{BPP: 8, Depth: 8}
+
+	var colorMap [256]Color
+	colorMap[1] = Color{0xffff, 0, 0}
+	colorMap[2] = Color{0, 0xffff, 0}
+
+	data, err := format.Encode([]Color{{0, 0xffff, 0}, {0xfff0, 0x10, 0}}, &colorMap)
+	if err != nil {
+		t.Fatalf("Encode error: %s", err)
+	}
+	if !bytes.Equal(data, []byte{2, 1}) {
+		t.Fatalf("Encode = %v, want %v", data, []byte{2, 1})
+	}
+
+	colors, err := format.Decode(data, &colorMap)
+	if err != nil {
+		t.Fatalf("Decode error: %s", err)
+	}
+	if colors[0] != colorMap[2] || colors[1] != colorMap[1] {
+		t.Fatalf("Decode = %v", colors)
+	}
+}
+
+func TestClientConn_SetPixelFormatIgnored(t *testing.T) {
+	logCh := make(chan string, 10)
+	conn, server := newTestClientConn(&ClientConfig{
+		Logf: func(format string, v ...interface{}) {
+			logCh <- fmt.Sprintf(format, v...)
+		},
+	})
+	defer server.Close()
+
+	conn.PixelFormat = testPixelFormat
+
+	rgb332 := PixelFormat{
+		BPP:        8,
+		Depth:      8,
+		TrueColor:  true,
+		RedMax:     7,
+		GreenMax:   7,
+		BlueMax:    3,
+		RedShift:   5,
+		GreenShift: 2,
+		BlueShift:  0,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.SetPixelFormat(&rgb332)
+	}()
+
+	var request [20]byte
+	if _, err := io.ReadFull(server, request[:]); err != nil {
+		t.Fatalf("error reading SetPixelFormat: %s", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("error setting pixel format: %s", err)
+	}
+	if conn.PixelFormat != rgb332 {
+		t.Fatalf("pixel format = %#v, want %#v", conn.PixelFormat, rgb332)
+	}
+
+	go conn.mainLoop()
+
+	// The server ignores the request, and keeps sending 32 bits per
+	// pixel. The client only consumes two bytes of pixel data, and
+	// reads the red channel of the first pixel as the next message type.
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 1})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 2, 1})
+	binary.Write(&buf, binary.BigEndian, int32(0))
+	buf.Write([]byte{0x10, 0x20, 0xab, 0, 0x10, 0x20, 0xab, 0})
+	go server.Write(buf.Bytes())
+
+	select {
+	case msg := <-logCh:
+		if !strings.Contains(msg, "SetPixelFormat") {
+			t.Fatalf("unexpected warning: %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no warning logged for ignored SetPixelFormat")
+	}
+}
+
+func TestClientConn_SetPixelFormatDepth(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.SetPixelFormat(NewPixelFormatRGB888())
+	}()
+
+	var request [20]byte
+	if _, err := io.ReadFull(server, request[:]); err != nil {
+		t.Fatalf("error reading SetPixelFormat: %s", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("error setting pixel format: %s", err)
+	}
+
+	expected := [20]byte{
+		0, 0, 0, 0, // Type and padding
+		32, 24, 0, 1, // BPP, depth, big endian, true color
+		0, 255, 0, 255, 0, 255, // Max values
+		16, 8, 0, // Shifts
+		0, 0, 0, // Padding
+	}
+	if request != expected {
+		t.Fatalf("request = %v, want %v", request, expected)
+	}
+
+	invalid := NewPixelFormatRGB888()
+	invalid.Depth = 0
+	if err := conn.SetPixelFormat(invalid); err == nil {
+		t.Fatal("expected error for missing depth")
+	}
+}
+
+func TestClientConn_SetPixelFormatColorMap(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	conn.PixelFormat = testPixelFormat
+	colorMapped := PixelFormat{BPP: 8, Depth: 8}
+
+	// Switching to a color-mapped format starts from the default colors.
+	if err := conn.SetPixelFormat(&colorMapped); err != nil {
+		t.Fatalf("error setting pixel format: %s", err)
+	}
+	if conn.ColorMap != DefaultColorMap256() {
+		t.Fatal("color map not reset to the default colors")
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0})
+	binary.Write(&buf, binary.BigEndian, []uint16{7, 1}) // First color, count
+	binary.Write(&buf, binary.BigEndian, []uint16{0x1234, 0x5678, 0x9abc})
+	if _, err := new(SetColorMapEntriesMessage).Read(conn, &buf); err != nil {
+		t.Fatalf("error reading SetColorMapEntries: %s", err)
+	}
+	if conn.ColorMap[7] != (Color{R: 0x1234, G: 0x5678, B: 0x9abc}) {
+		t.Fatalf("ColorMap[7] = %v after SetColorMapEntries", conn.ColorMap[7])
+	}
+
+	// The colors set by the server don't carry over to a true color
+	// format, nor to the next color-mapped one.
+	if err := conn.SetPixelFormat(&testPixelFormat); err != nil {
+		t.Fatalf("error setting pixel format: %s", err)
+	}
+	if conn.ColorMap != ([256]Color{}) {
+		t.Fatal("color map not cleared for a true color format")
+	}
+
+	if err := conn.SetPixelFormat(&colorMapped); err != nil {
+		t.Fatalf("error setting pixel format: %s", err)
+	}
+	if conn.ColorMap != DefaultColorMap256() {
+		t.Fatalf("color map not reset to the default colors, ColorMap[7] = %v", conn.ColorMap[7])
+	}
+}
+
+func TestClientConn_ForceByteOrder(t *testing.T) {
+	// A single RGB565 pixel, 0xf800 (red) in big endian, which is 0x00f8
+	// (some blue and green) in little endian.
+	data := []byte{0xf8, 0x00}
+
+	tests := []struct {
+		order    ByteOrder
+		expected Color
+	}{
+		{ByteOrderAuto, Color{G: 7 * 0xffff / 63, B: 24 * 0xffff / 31}},
+		{ByteOrderLittle, Color{G: 7 * 0xffff / 63, B: 24 * 0xffff / 31}},
+		{ByteOrderBig, Color{R: 0xffff}},
+	}
+
+	for _, tt := range tests {
+		conn := &ClientConn{
+			config:            &ClientConfig{ForceByteOrder: tt.order},
+			FrameBufferWidth:  256,
+			FrameBufferHeight: 256,
+			PixelFormat:       *NewPixelFormatRGB565(),
+		}
+
+		enc, err := new(RawEncoding).Read(conn, &Rectangle{Width: 1, Height: 1}, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("error decoding: %s", err)
+		}
+
+		if c := enc.(*RawEncoding).Colors[0]; c != tt.expected {
+			t.Fatalf("byte order %d: color = %#v, want %#v", tt.order, c, tt.expected)
+		}
+	}
+}
+
+func TestPixelFormat_RawRectangleSize(t *testing.T) {
+	tests := []struct {
+		format   PixelFormat
+		rect     Rectangle
+		expected int
+	}{
+		{*NewPixelFormatRGB888(), Rectangle{Width: 100, Height: 50}, 20000},
+		{*NewPixelFormatRGB565(), Rectangle{Width: 100, Height: 50}, 10000},
+		{*NewPixelFormatBGR233(), Rectangle{X: 10, Y: 10, Width: 3, Height: 2}, 6},
+		{*NewPixelFormatRGB888(), Rectangle{Width: 0xffff, Height: 0xffff}, 0xffff * 0xffff * 4},
+		{*NewPixelFormatRGB888(), Rectangle{Width: 100}, 0},
+	}
+
+	for _, tt := range tests {
+		if size := tt.format.RawRectangleSize(tt.rect); size != tt.expected {
+			t.Errorf("%d bits, %dx%d: size = %d, want %d",
+				tt.format.BPP, tt.rect.Width, tt.rect.Height, size, tt.expected)
+		}
+	}
+}
+
+func TestClientConn_RestorePixelState(t *testing.T) {
+	source := &ClientConn{
+		PixelFormat:       *NewPixelFormatBGR233(),
+		FrameBufferWidth:  1,
+		FrameBufferHeight: 1,
+	}
+	source.PixelFormat.TrueColor = false
+	source.ColorMap = DefaultColorMap256()
+	source.ColorMap[7] = Color{R: 0x1234, G: 0x5678, B: 0x9abc}
+
+	state := source.PixelState()
+
+	// Changes to the connection after the snapshot don't affect it.
+	source.ColorMap[7] = Color{}
+
+	restored := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  1,
+		FrameBufferHeight: 1,
+	}
+	restored.RestorePixelState(state)
+
+	if restored.PixelFormat != state.PixelFormat {
+		t.Fatalf("PixelFormat = %#v, want %#v", restored.PixelFormat, state.PixelFormat)
+	}
+
+	enc, err := new(RawEncoding).Read(restored, &Rectangle{Width: 1, Height: 1}, bytes.NewReader([]byte{7}))
+	if err != nil {
+		t.Fatalf("error decoding: %s", err)
+	}
+
+	want := Color{R: 0x1234, G: 0x5678, B: 0x9abc}
+	if colors := enc.(*RawEncoding).Colors; colors[0] != want {
+		t.Fatalf("decoded %#v, want %#v", colors[0], want)
+	}
+}
+
+func TestPixelFormat_ChannelScaling(t *testing.T) {
+	format := NewPixelFormatRGB565()
+	format.BigEndian = true
+
+	tests := []struct {
+		pixel    uint16
+		expected Color
+	}{
+		{0xffff, Color{R: 0xffff, G: 0xffff, B: 0xffff}},
+		{0x0000, Color{}},
+		{0xf800, Color{R: 0xffff}},
+		{0x07e0, Color{G: 0xffff}},
+		{0x001f, Color{B: 0xffff}},
+
+		// Half of the 5 bit and 6 bit channels.
+		{0x8410, Color{R: 16 * 0xffff / 31, G: 32 * 0xffff / 63, B: 16 * 0xffff / 31}},
+	}
+
+	for _, tt := range tests {
+		colors, err := format.Decode([]byte{byte(tt.pixel >> 8), byte(tt.pixel)}, nil)
+		if err != nil {
+			t.Fatalf("%#04x: error decoding: %s", tt.pixel, err)
+		}
+		if colors[0] != tt.expected {
+			t.Fatalf("%#04x: color = %#v, want %#v", tt.pixel, colors[0], tt.expected)
+		}
+
+		// Encoding the color gives the same pixel.
+		data, err := format.Encode(colors, nil)
+		if err != nil {
+			t.Fatalf("%#04x: error encoding: %s", tt.pixel, err)
+		}
+		if pixel := uint16(data[0])<<8 | uint16(data[1]); pixel != tt.pixel {
+			t.Fatalf("%#04x: encoded as %#04x", tt.pixel, pixel)
+		}
+	}
+}
+
+func TestClientConn_RawChannelValues(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		conn := &ClientConn{
+			config:            &ClientConfig{RawChannelValues: raw},
+			FrameBufferWidth:  1,
+			FrameBufferHeight: 1,
+			PixelFormat:       *NewPixelFormatRGB565(),
+		}
+
+		// 31, 63, 31 in little endian.
+		enc, err := new(RawEncoding).Read(conn, &Rectangle{Width: 1, Height: 1}, bytes.NewReader([]byte{0xff, 0xff}))
+		if err != nil {
+			t.Fatalf("error decoding: %s", err)
+		}
+
+		expected := Color{R: 0xffff, G: 0xffff, B: 0xffff}
+		if raw {
+			expected = Color{R: 31, G: 63, B: 31}
+		}
+		if c := enc.(*RawEncoding).Colors[0]; c != expected {
+			t.Fatalf("raw %t: color = %#v, want %#v", raw, c, expected)
+		}
+	}
+}
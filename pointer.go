@@ -14,3 +14,57 @@ const (
 	Button7
 	Button8
 )
+
+// The wheel buttons, which servers treat as scrolling up, down, left and
+// right by one notch each time they are clicked.
+const wheelButtons = Button4 | Button5 | Button6 | Button7
+
+// WheelDelta is the scroll delta of one notch of a mouse wheel, in the
+// units used by ScrollDelta, as in Windows and Qt.
+const WheelDelta = 120
+
+// ScrollDelta scrolls at the pointer position x, y, such as in response
+// to a mouse wheel or trackpad. dx scrolls right and dy scrolls down, in
+// units of WheelDelta per notch. RFB can only scroll by whole notches,
+// using clicks of the wheel buttons, so each notch is sent as a click of
+// Button4 to Button7, and smaller, high resolution deltas are added up
+// until they make a notch. Buttons held down with PointerEvent stay
+// pressed. The clicks are written at once.
+func (c *ClientConn) ScrollDelta(x, y uint16, dx, dy int) error {
+	c.pointerLock.Lock()
+	c.scrollX += dx
+	c.scrollY += dy
+	stepsX := c.scrollX / WheelDelta
+	stepsY := c.scrollY / WheelDelta
+	c.scrollX -= stepsX * WheelDelta
+	c.scrollY -= stepsY * WheelDelta
+	mask := c.pointerMask &^ wheelButtons
+	c.pointerLock.Unlock()
+
+	var msgs []ClientMessage
+	msgs = appendWheelClicks(msgs, mask, x, y, stepsY, Button5, Button4)
+	msgs = appendWheelClicks(msgs, mask, x, y, stepsX, Button7, Button6)
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	return c.send(msgs...)
+}
+
+// appendWheelClicks appends a click of the positive wheel button for each
+// step, or of the negative one if steps is negative.
+func appendWheelClicks(msgs []ClientMessage, mask ButtonMask, x, y uint16, steps int, positive, negative ButtonMask) []ClientMessage {
+	button := positive
+	if steps < 0 {
+		button = negative
+		steps = -steps
+	}
+
+	for i := 0; i < steps; i++ {
+		msgs = append(msgs,
+			&PointerEventMessage{Mask: mask | button, X: x, Y: y},
+			&PointerEventMessage{Mask: mask, X: x, Y: y})
+	}
+
+	return msgs
+}
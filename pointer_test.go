@@ -0,0 +1,86 @@
+package vnc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// readPointerEvents reads n PointerEvent messages sent by the client, and
+// returns their button masks.
+func readPointerEvents(t *testing.T, r io.Reader, n int) []ButtonMask {
+	masks := make([]ButtonMask, n)
+	for i := range masks {
+		var msg [6]byte
+		if _, err := io.ReadFull(r, msg[:]); err != nil {
+			t.Fatalf("error reading pointer event: %s", err)
+		}
+		if msg[0] != 5 {
+			t.Fatalf("message type %d, want PointerEvent", msg[0])
+		}
+		if !bytes.Equal(msg[2:], []byte{0, 10, 0, 20}) {
+			t.Fatalf("pointer event at %v, want 10,20", msg[2:])
+		}
+
+		masks[i] = ButtonMask(msg[1])
+	}
+
+	return masks
+}
+
+func TestClientConn_ScrollDelta(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+	defer conn.Close()
+
+	tests := []struct {
+		dx, dy   int
+		expected []ButtonMask
+	}{
+		// Three notches down are three clicks of Button5.
+		{0, 3 * WheelDelta, []ButtonMask{Button5, 0, Button5, 0, Button5, 0}},
+
+		// High resolution deltas add up to a notch.
+		{0, -WheelDelta / 2, nil},
+		{0, -WheelDelta / 2, []ButtonMask{Button4, 0}},
+		{-WheelDelta, 0, []ButtonMask{Button6, 0}},
+		{0, 0, nil},
+	}
+
+	for i, tt := range tests {
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- conn.ScrollDelta(10, 20, tt.dx, tt.dy)
+		}()
+
+		masks := readPointerEvents(t, server, len(tt.expected))
+		if err := <-errCh; err != nil {
+			t.Fatalf("%d: error scrolling: %s", i, err)
+		}
+
+		for j := range masks {
+			if masks[j] != tt.expected[j] {
+				t.Fatalf("%d: masks = %v, want %v", i, masks, tt.expected)
+			}
+		}
+	}
+
+	// Buttons held down stay pressed while scrolling.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.PointerEvent(ButtonLeft, 10, 20)
+	}()
+	readPointerEvents(t, server, 1)
+	<-errCh
+
+	go func() {
+		errCh <- conn.ScrollDelta(10, 20, WheelDelta, 0)
+	}()
+	masks := readPointerEvents(t, server, 2)
+	if err := <-errCh; err != nil {
+		t.Fatalf("error scrolling: %s", err)
+	}
+	if masks[0] != ButtonLeft|Button7 || masks[1] != ButtonLeft {
+		t.Fatalf("masks = %v, want left button kept pressed", masks)
+	}
+}
@@ -0,0 +1,40 @@
+package vnc
+
+// SetPreviewMode switches the connection to a low quality preview of the
+// desktop, which takes far less bandwidth, and back. Enabling it sends
+// SetPixelFormat with NewPixelFormatBGR233, of 8 bits per pixel, and
+// disabling it sends the pixel format that was in use before, which
+// resets the color map the same way as any SetPixelFormat does. Either
+// way, a full update is requested, so that the framebuffer kept with
+// ClientConfig.KeepFramebuffer is redrawn in the new format. Pixel
+// formats set with SetPixelFormat while the preview is enabled are
+// replaced once it is disabled.
+//
+// The zlib streams of the connection are kept as they are, since servers
+// carry on with their own streams after a change of pixel format, and
+// only the data decompressed from them is in the new format. As with any
+// SetPixelFormat, updates the server sent before receiving it are still
+// in the old format.
+func (c *ClientConn) SetPreviewMode(enable bool) error {
+	c.previewLock.Lock()
+	defer c.previewLock.Unlock()
+
+	if enable == (c.previewRestore != nil) {
+		return nil
+	}
+
+	if enable {
+		restore := c.PixelFormat
+		if err := c.SetPixelFormat(NewPixelFormatBGR233()); err != nil {
+			return err
+		}
+		c.previewRestore = &restore
+	} else {
+		if err := c.SetPixelFormat(c.previewRestore); err != nil {
+			return err
+		}
+		c.previewRestore = nil
+	}
+
+	return c.Refresh()
+}
@@ -0,0 +1,56 @@
+package vnc
+
+import "testing"
+
+func TestClientConn_SetPreviewMode(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 640
+	conn.FrameBufferHeight = 480
+	conn.PixelFormat = testPixelFormat
+
+	setPreviewMode := func(enable bool, expected PixelFormat) {
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- conn.SetPreviewMode(enable)
+		}()
+
+		msg, err := ReadClientMessage(server, nil)
+		if err != nil {
+			t.Fatalf("enable %v: error reading SetPixelFormat: %s", enable, err)
+		}
+		if msg, ok := msg.(*SetPixelFormatMessage); !ok || msg.PixelFormat != expected {
+			t.Fatalf("enable %v: read %#v, want SetPixelFormat with %#v", enable, msg, expected)
+		}
+		expectUpdateRequest(t, server, false, 0, 0, 640, 480)
+		if err := <-errCh; err != nil {
+			t.Fatalf("enable %v: error: %s", enable, err)
+		}
+		if conn.PixelFormat != expected {
+			t.Fatalf("enable %v: pixel format %#v, want %#v", enable, conn.PixelFormat, expected)
+		}
+	}
+
+	setPreviewMode(true, *NewPixelFormatBGR233())
+
+	// Enabling it again changes nothing.
+	if err := conn.SetPreviewMode(true); err != nil {
+		t.Fatalf("error enabling preview again: %s", err)
+	}
+
+	// Pixels are decoded in BGR233: 3 bits of red at bit 0, 3 bits of
+	// green at bit 3 and 2 bits of blue at bit 6.
+	enc, err := DecodeRectangle(conn, Rectangle{Width: 3, Height: 1}, 0, []byte{0x07, 0x38, 0xc0})
+	if err != nil {
+		t.Fatalf("error decoding in BGR233: %s", err)
+	}
+	colors := enc.(*RawEncoding).Colors
+	for i, expected := range []Color{{R: 0xffff}, {G: 0xffff}, {B: 0xffff}} {
+		if colors[i] != expected {
+			t.Fatalf("pixel %d = %#v, want %#v", i, colors[i], expected)
+		}
+	}
+
+	setPreviewMode(false, testPixelFormat)
+}
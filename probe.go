@@ -0,0 +1,74 @@
+package vnc
+
+import (
+	"context"
+	"fmt"
+)
+
+// The width and height of the region requested by ProbeEncodings.
+const probeRegionSize = 64
+
+// ProbeEncodings finds out which encoding the server prefers to send
+// pixel data in, and settles on it. It is meant to be called once, right
+// after connecting: it sends SetEncodings with all the encodings enabled
+// in the ClientConfig, replacing any sent before, requests a full update
+// of a small region at the top left of the desktop, and then sends
+// SetEncodings again with the encoding that covered most of the update
+// first, followed by the others in their usual order. That encoding is
+// returned.
+//
+// The update is small, so that the probe is quick, and it is handled as
+// any other, so it also updates the framebuffer kept with
+// ClientConfig.KeepFramebuffer. As with RequestUpdate, an update the
+// server had already started may be taken as the answer.
+func (c *ClientConn) ProbeEncodings(ctx context.Context) (int32, error) {
+	encs := c.EnabledEncodings()
+	if err := c.SetEncodings(encs); err != nil {
+		return 0, err
+	}
+
+	width, height := c.Dimensions()
+	update, err := c.RequestUpdate(ctx, false, 0, 0,
+		uint16(minInt(probeRegionSize, int(width))), uint16(minInt(probeRegionSize, int(height))))
+	if err != nil {
+		return 0, err
+	}
+
+	// The encoding covering the most pixels is taken as the one the
+	// server chose, since servers may send parts of an update, such as
+	// small rectangles, in another.
+	areas := make(map[int32]uint64)
+	var chosen int32
+	for _, rect := range update.Rectangles {
+		if rect.Enc == nil || isPseudoEncoding(rect.Enc.Type()) {
+			continue
+		}
+
+		encType := rect.Enc.Type()
+		areas[encType] += uint64(rect.Width) * uint64(rect.Height)
+		if areas[encType] > areas[chosen] {
+			chosen = encType
+		}
+	}
+	if len(areas) == 0 {
+		return 0, fmt.Errorf("no pixel data in the update probing the encodings")
+	}
+
+	settled := make([]Encoding, 0, len(encs))
+	for _, enc := range encs {
+		if enc.Type() == chosen {
+			settled = append(settled, enc)
+		}
+	}
+	for _, enc := range encs {
+		if enc.Type() != chosen {
+			settled = append(settled, enc)
+		}
+	}
+
+	if err := c.SetEncodings(settled); err != nil {
+		return 0, err
+	}
+
+	return chosen, nil
+}
@@ -0,0 +1,91 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClientConn_ProbeEncodings(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 640
+	conn.FrameBufferHeight = 480
+	conn.PixelFormat = testPixelFormat
+
+	go conn.mainLoop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type result struct {
+		encType int32
+		err     error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		encType, err := conn.ProbeEncodings(ctx)
+		resultCh <- result{encType, err}
+	}()
+
+	readEncodings := func() []int32 {
+		msg, err := ReadClientMessage(server, nil)
+		if err != nil {
+			t.Fatalf("error reading SetEncodings: %s", err)
+		}
+		setEncodings, ok := msg.(*SetEncodingsMessage)
+		if !ok {
+			t.Fatalf("read %T, want SetEncodings", msg)
+		}
+
+		var types []int32
+		for _, enc := range setEncodings.Encodings {
+			types = append(types, enc.Type())
+		}
+		return types
+	}
+
+	// All the enabled encodings are advertised first, for a small region.
+	advertised := readEncodings()
+	if advertised[0] == 5 {
+		t.Fatalf("Hextile is already preferred in %v", advertised)
+	}
+	expectUpdateRequest(t, server, false, 0, 0, 64, 64)
+
+	// The server answers mostly in Hextile, with one of the rectangles
+	// in Raw.
+	var data bytes.Buffer
+	data.Write([]byte{0, 0, 0, 2})
+	data.Write([]byte{0, 0, 0, 0, 0, 64, 0, 64, 0, 0, 0, 5})
+	data.WriteByte(hextileBackgroundSpecified)
+	writeHextilePixel(&data, rgb(1, 2, 3))
+	data.Write(make([]byte, 15))
+	data.Write([]byte{0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0})
+	writeHextilePixel(&data, rgb(4, 5, 6))
+	go server.Write(data.Bytes())
+
+	settled := readEncodings()
+	r := <-resultCh
+	if r.err != nil {
+		t.Fatalf("error probing encodings: %s", r.err)
+	}
+	if r.encType != 5 {
+		t.Fatalf("probed encoding %d, want Hextile", r.encType)
+	}
+
+	// Hextile is now preferred, and nothing else changed.
+	if len(settled) != len(advertised) || settled[0] != 5 {
+		t.Fatalf("settled on %v after advertising %v", settled, advertised)
+	}
+	rest := make(map[int32]bool)
+	for _, encType := range settled[1:] {
+		rest[encType] = true
+	}
+	for _, encType := range advertised {
+		if encType != 5 && !rest[encType] {
+			t.Fatalf("encoding %d left out of %v", encType, settled)
+		}
+	}
+}
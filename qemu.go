@@ -0,0 +1,162 @@
+package vnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// QEMUAudioPseudoEncoding declares that the client supports receiving
+// audio from QEMU's VNC server. Once sent using SetEncodings, audio is
+// started with SetAudioFormat and EnableAudio.
+type QEMUAudioPseudoEncoding struct{}
+
+func (*QEMUAudioPseudoEncoding) Type() int32 {
+	return -259
+}
+
+func (*QEMUAudioPseudoEncoding) Read(*ClientConn, *Rectangle, io.Reader) (Encoding, error) {
+	return &QEMUAudioPseudoEncoding{}, nil
+}
+
+// Sample formats of QEMU audio.
+const (
+	AudioFormatU8 uint8 = iota
+	AudioFormatS8
+	AudioFormatU16
+	AudioFormatS16
+	AudioFormatU32
+	AudioFormatS32
+)
+
+// AudioFormat describes the format of the PCM samples of QEMU audio.
+type AudioFormat struct {
+	SampleFormat uint8
+	Channels     uint8
+	Frequency    uint32
+}
+
+// Operations of QEMU audio messages.
+const (
+	AudioStop uint16 = iota
+	AudioStart
+	AudioData
+)
+
+// QEMUAudioMessage is a QEMU audio message sent by the server. Operation
+// is one of AudioStop, AudioStart or AudioData, and Data holds the PCM
+// samples of an AudioData message, in the format set by SetAudioFormat.
+type QEMUAudioMessage struct {
+	Operation uint16
+	Data      []byte
+}
+
+func (*QEMUAudioMessage) Type() uint8 {
+	return 255
+}
+
+func (*QEMUAudioMessage) Read(c *ClientConn, r io.Reader) (ServerMessage, error) {
+	var subType uint8
+	if err := binary.Read(r, binary.BigEndian, &subType); err != nil {
+		return nil, err
+	}
+
+	if subType != 1 {
+		return nil, fmt.Errorf("unsupported QEMU server message: %d", subType)
+	}
+
+	var result QEMUAudioMessage
+	if err := binary.Read(r, binary.BigEndian, &result.Operation); err != nil {
+		return nil, err
+	}
+
+	if result.Operation != AudioData {
+		return &result, nil
+	}
+
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if result.Data, err = readBytes(r, length); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// SetAudioFormat sets the format of the audio samples sent by the server,
+// which is then available as ClientConn.AudioFormat.
+func (c *ClientConn) SetAudioFormat(format AudioFormat) error {
+	return c.Send(&QEMUAudioClientMessage{Operation: AudioSetFormat, Format: format})
+}
+
+// EnableAudio starts or stops the audio stream from the server. Audio
+// data is sent on ClientConfig.AudioCh if it is set, and as
+// QEMUAudioMessages otherwise.
+func (c *ClientConn) EnableAudio(enable bool) error {
+	if enable {
+		return c.Send(&QEMUAudioClientMessage{Operation: AudioEnable})
+	}
+
+	return c.Send(&QEMUAudioClientMessage{Operation: AudioDisable})
+}
+
+// Operations of QEMU audio client messages. AudioSetFormat is the only
+// one that sends the Format of a QEMUAudioClientMessage.
+const (
+	AudioEnable uint16 = iota
+	AudioDisable
+	AudioSetFormat
+)
+
+// QEMUAudioClientMessage is a QEMU audio message sent by the client,
+// which enables or disables audio, or sets its format.
+type QEMUAudioClientMessage struct {
+	Operation uint16
+	Format    AudioFormat
+}
+
+func (*QEMUAudioClientMessage) Type() uint8 {
+	return 255
+}
+
+func (m *QEMUAudioClientMessage) Serialize(w io.Writer) error {
+	data := []interface{}{
+		m.Type(),
+		uint8(1),
+		m.Operation,
+	}
+
+	if m.Operation == AudioSetFormat {
+		data = append(data, m.Format.SampleFormat, m.Format.Channels, m.Format.Frequency)
+	}
+
+	return writeMessage(w, data)
+}
+
+func (*QEMUAudioClientMessage) Deserialize(r io.Reader) (ClientMessage, error) {
+	var subType uint8
+	if err := binary.Read(r, binary.BigEndian, &subType); err != nil {
+		return nil, err
+	}
+
+	if subType != 1 {
+		return nil, fmt.Errorf("unsupported QEMU client message: %d", subType)
+	}
+
+	var result QEMUAudioClientMessage
+	if err := binary.Read(r, binary.BigEndian, &result.Operation); err != nil {
+		return nil, err
+	}
+
+	if result.Operation == AudioSetFormat {
+		if err := binary.Read(r, binary.BigEndian, &result.Format); err != nil {
+			return nil, err
+		}
+	}
+
+	return &result, nil
+}
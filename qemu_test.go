@@ -0,0 +1,69 @@
+package vnc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestQEMUAudioMessage_Read(t *testing.T) {
+	data := []byte{
+		1,    // Audio
+		0, 2, // Data
+		0, 0, 0, 4, // Length
+		0x01, 0x80, 0xff, 0x7f,
+	}
+
+	msg, err := new(QEMUAudioMessage).Read(&ClientConn{}, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error reading message: %s", err)
+	}
+
+	audio := msg.(*QEMUAudioMessage)
+	if audio.Operation != AudioData {
+		t.Fatalf("Operation = %d, want %d", audio.Operation, AudioData)
+	}
+	if !bytes.Equal(audio.Data, data[7:]) {
+		t.Fatalf("Data = %v, want %v", audio.Data, data[7:])
+	}
+}
+
+func TestClientConn_Audio(t *testing.T) {
+	audioCh := make(chan []byte, 1)
+	conn, server := newTestClientConn(&ClientConfig{AudioCh: audioCh})
+	defer server.Close()
+
+	format := AudioFormat{SampleFormat: AudioFormatS16, Channels: 2, Frequency: 44100}
+	go func() {
+		conn.SetAudioFormat(format)
+		conn.EnableAudio(true)
+	}()
+
+	expected := []byte{
+		255, 1, 0, 2, AudioFormatS16, 2, 0, 0, 0xac, 0x44, // Set format
+		255, 1, 0, 0, // Enable
+	}
+	request := make([]byte, len(expected))
+	if _, err := io.ReadFull(server, request); err != nil {
+		t.Fatalf("error reading request: %s", err)
+	}
+	if !bytes.Equal(request, expected) {
+		t.Fatalf("request = %v, want %v", request, expected)
+	}
+	if conn.AudioFormat != format {
+		t.Fatalf("AudioFormat = %#v, want %#v", conn.AudioFormat, format)
+	}
+
+	go conn.mainLoop()
+	server.Write([]byte{255, 1, 0, 2, 0, 0, 0, 2, 0x34, 0x12})
+
+	select {
+	case samples := <-audioCh:
+		if !bytes.Equal(samples, []byte{0x34, 0x12}) {
+			t.Fatalf("samples = %v", samples)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for audio data")
+	}
+}
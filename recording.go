@@ -0,0 +1,182 @@
+package vnc
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"time"
+)
+
+// RecordingMetadata describes a connection as it was negotiated during the
+// handshake, which a recording of the messages sent by the server after
+// the handshake doesn't tell. It is needed to decode such a recording
+// later on, and is meant to be stored next to it, using Write. See
+// ClientConn.RecordingMetadata and Replay.
+type RecordingMetadata struct {
+	ProtocolVersion   string
+	SecurityType      uint8
+	DesktopName       string
+	FrameBufferWidth  uint16
+	FrameBufferHeight uint16
+
+	// The friendly name of the recorded connection, from
+	// ClientConfig.ClientName, if any.
+	ClientName string
+
+	// The pixel format the server sends pixel data in, which is the
+	// last one set with SetPixelFormat, if any. The server doesn't
+	// announce a change of the pixel format in its messages, so a
+	// recording must not be started before SetPixelFormat is called.
+	PixelFormat PixelFormat
+}
+
+// RecordingMetadata returns the metadata needed to replay a recording of
+// the messages received from the server, starting from this point.
+func (c *ClientConn) RecordingMetadata() *RecordingMetadata {
+	width, height := c.Dimensions()
+
+	return &RecordingMetadata{
+		ProtocolVersion:   c.protocolVersion,
+		SecurityType:      c.SecurityType,
+		DesktopName:       c.DesktopName,
+		FrameBufferWidth:  width,
+		FrameBufferHeight: height,
+		ClientName:        c.ClientName(),
+		PixelFormat:       c.PixelFormat,
+	}
+}
+
+// Write writes the metadata to w as JSON, such as to a file next to the
+// recording it describes.
+func (m *RecordingMetadata) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(m)
+}
+
+// ReadRecordingMetadata reads metadata written by RecordingMetadata.Write.
+func ReadRecordingMetadata(r io.Reader) (*RecordingMetadata, error) {
+	var m RecordingMetadata
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, err
+	}
+
+	if err := m.PixelFormat.checkBPP(); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// Replay decodes a recording of the messages sent by a server after the
+// handshake, as described by the metadata, as if they were received over
+// a connection using the given configuration. The messages are delivered
+// as usual, such as on ServerMessageCh, and the frame buffer is kept if
+// KeepFramebuffer is set. All of the built-in encodings are decoded. If
+// the configuration has no ClientName, the replay is given that of the
+// recorded connection, so that it is labelled the same way by Logf.
+//
+// Messages sent using the returned connection are discarded. It ends
+// once the recording has been read, which is reported to OnDisconnected
+// as io.EOF, and r is closed if it is an io.Closer.
+func Replay(r io.Reader, meta *RecordingMetadata, cfg *ClientConfig) (*ClientConn, error) {
+	if err := meta.PixelFormat.checkBPP(); err != nil {
+		return nil, err
+	}
+
+	config := *cfg
+	if config.ClientName == "" {
+		config.ClientName = meta.ClientName
+	}
+
+	c := &ClientConn{
+		c:                 replayConn{r},
+		config:            &config,
+		protocolVersion:   meta.ProtocolVersion,
+		SecurityType:      meta.SecurityType,
+		Security:          SecurityInfo{Type: meta.SecurityType},
+		DesktopName:       meta.DesktopName,
+		FrameBufferWidth:  meta.FrameBufferWidth,
+		FrameBufferHeight: meta.FrameBufferHeight,
+		PixelFormat:       meta.PixelFormat,
+		ColorMap:          DefaultColorMap256(),
+		Encs:              BuiltinEncodings(),
+	}
+
+	if err := c.checkFramebufferSize(c.FrameBufferWidth, c.FrameBufferHeight); err != nil {
+		return nil, err
+	}
+
+	c.start()
+
+	return c, nil
+}
+
+// replayConn is the connection of a replayed recording, which reads the
+// recording and discards what is written.
+type replayConn struct {
+	r io.Reader
+}
+
+func (rc replayConn) Read(b []byte) (int, error) {
+	return rc.r.Read(b)
+}
+
+func (replayConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (rc replayConn) Close() error {
+	if closer, ok := rc.r.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+func (replayConn) LocalAddr() net.Addr {
+	return replayAddr{}
+}
+
+func (replayConn) RemoteAddr() net.Addr {
+	return replayAddr{}
+}
+
+func (replayConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (replayConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (replayConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// replayAddr is the address of both ends of a replayConn.
+type replayAddr struct{}
+
+func (replayAddr) Network() string {
+	return "replay"
+}
+
+func (replayAddr) String() string {
+	return "replay"
+}
+
+// tracingConn copies what is read from a connection to trace, for
+// ClientConfig.ReadTrace.
+type tracingConn struct {
+	net.Conn
+	trace io.Writer
+}
+
+func (tc *tracingConn) Read(b []byte) (int, error) {
+	n, err := tc.Conn.Read(b)
+	if n > 0 {
+		tc.trace.Write(b[:n])
+	}
+
+	return n, err
+}
@@ -0,0 +1,158 @@
+package vnc
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// waitUpdates waits for n framebuffer updates on msgCh.
+func waitUpdates(t *testing.T, msgCh <-chan ServerMessage, n int) {
+	for n > 0 {
+		select {
+		case msg := <-msgCh:
+			if _, ok := msg.(*FramebufferUpdateMessage); ok {
+				n--
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for update")
+		}
+	}
+}
+
+// teeConn is a connection that also writes what is written to it to w.
+type teeConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (tc *teeConn) Write(b []byte) (int, error) {
+	tc.w.Write(b)
+	return tc.Conn.Write(b)
+}
+
+func TestReplay_RoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serveTestHandshake(server, []uint8{1}, nil)
+	}()
+
+	msgCh := make(chan ServerMessage, 4)
+	conn, err := Client(client, &ClientConfig{
+		KeepFramebuffer: true,
+		ServerMessageCh: msgCh,
+		ClientName:      "kiosk-1",
+	})
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer conn.Close()
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("error in mock server: %s", err)
+	}
+
+	// Record everything the server sends after the handshake.
+	var recording bytes.Buffer
+	var metadata bytes.Buffer
+	if err := conn.RecordingMetadata().Write(&metadata); err != nil {
+		t.Fatalf("error writing metadata: %s", err)
+	}
+
+	recorded := &teeConn{Conn: server, w: &recording}
+	writeRawUpdate(t, recorded, 0, 0, 640, 480, rgb(1, 2, 3))
+	writeRawUpdate(t, recorded, 100, 200, 50, 20, rgb(0x40, 0x50, 0x60))
+	waitUpdates(t, msgCh, 2)
+
+	meta, err := ReadRecordingMetadata(&metadata)
+	if err != nil {
+		t.Fatalf("error reading metadata: %s", err)
+	}
+
+	expected := RecordingMetadata{
+		ProtocolVersion:   "RFB 003.008",
+		SecurityType:      1,
+		DesktopName:       "test",
+		FrameBufferWidth:  640,
+		FrameBufferHeight: 480,
+		ClientName:        "kiosk-1",
+		PixelFormat:       conn.PixelFormat,
+	}
+	if *meta != expected {
+		t.Fatalf("metadata = %#v, want %#v", *meta, expected)
+	}
+
+	replayCh := make(chan ServerMessage, 4)
+	disconnected := make(chan error, 1)
+	replay, err := Replay(&recording, meta, &ClientConfig{
+		KeepFramebuffer: true,
+		ServerMessageCh: replayCh,
+		OnDisconnected:  func(err error) { disconnected <- err },
+	})
+	if err != nil {
+		t.Fatalf("error replaying: %s", err)
+	}
+	if name := replay.ClientName(); name != "kiosk-1" {
+		t.Fatalf("replay ClientName = %q, want %q", name, "kiosk-1")
+	}
+	waitUpdates(t, replayCh, 2)
+
+	select {
+	case err := <-disconnected:
+		if err != io.EOF {
+			t.Fatalf("replay ended with %v, want %v", err, io.EOF)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the end of the replay")
+	}
+
+	if sum, want := replay.Framebuffer().Checksum(), conn.Framebuffer().Checksum(); sum != want {
+		t.Fatalf("replayed checksum %#x, want %#x", sum, want)
+	}
+}
+
+func TestClientConfig_ReadTrace(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serveTestHandshake(server, []uint8{1}, nil)
+	}()
+
+	var trace bytes.Buffer
+	msgCh := make(chan ServerMessage, 4)
+	conn, err := Client(client, &ClientConfig{ServerMessageCh: msgCh, ReadTrace: &trace})
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer conn.Close()
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("error in mock server: %s", err)
+	}
+
+	// The handshake isn't traced, only what follows it.
+	var sent bytes.Buffer
+	recorded := &teeConn{Conn: server, w: &sent}
+	writeRawUpdate(t, recorded, 0, 0, 4, 4, rgb(1, 2, 3))
+	recorded.Write([]byte{2})
+	writeRawUpdate(t, recorded, 1, 1, 2, 2, rgb(4, 5, 6))
+	waitUpdates(t, msgCh, 2)
+
+	if !bytes.Equal(trace.Bytes(), sent.Bytes()) {
+		t.Fatalf("traced %d bytes, want the %d bytes sent", trace.Len(), sent.Len())
+	}
+
+	// The trace decodes to the same messages.
+	replayCh := make(chan ServerMessage, 4)
+	if _, err := Replay(&trace, conn.RecordingMetadata(), &ClientConfig{ServerMessageCh: replayCh}); err != nil {
+		t.Fatalf("error replaying: %s", err)
+	}
+	waitUpdates(t, replayCh, 2)
+}
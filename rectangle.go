@@ -0,0 +1,67 @@
+package vnc
+
+// empty reports whether the rectangle has no pixels. Servers send such
+// rectangles with pseudo-encodings, and occasionally with real ones.
+func (r *Rectangle) empty() bool {
+	return r.Width == 0 || r.Height == 0
+}
+
+// Intersect returns the area covered by both r and other, and whether
+// they overlap at all. Rectangles that only touch don't overlap. The
+// encoding of the result is nil.
+func (r Rectangle) Intersect(other Rectangle) (Rectangle, bool) {
+	x0, y0 := maxInt(int(r.X), int(other.X)), maxInt(int(r.Y), int(other.Y))
+	x1 := minInt(int(r.X)+int(r.Width), int(other.X)+int(other.Width))
+	y1 := minInt(int(r.Y)+int(r.Height), int(other.Y)+int(other.Height))
+
+	if x1 <= x0 || y1 <= y0 {
+		return Rectangle{}, false
+	}
+
+	return Rectangle{X: uint16(x0), Y: uint16(y0), Width: uint16(x1 - x0), Height: uint16(y1 - y0)}, true
+}
+
+// Union returns the smallest rectangle containing both r and other. An
+// empty rectangle adds nothing to the union. The result is clipped to
+// the 16-bit coordinate space, and its encoding is nil.
+func (r Rectangle) Union(other Rectangle) Rectangle {
+	switch {
+	case other.empty():
+		return Rectangle{X: r.X, Y: r.Y, Width: r.Width, Height: r.Height}
+	case r.empty():
+		return Rectangle{X: other.X, Y: other.Y, Width: other.Width, Height: other.Height}
+	}
+
+	x0, y0 := minInt(int(r.X), int(other.X)), minInt(int(r.Y), int(other.Y))
+	x1 := maxInt(int(r.X)+int(r.Width), int(other.X)+int(other.Width))
+	y1 := maxInt(int(r.Y)+int(r.Height), int(other.Y)+int(other.Height))
+
+	return Rectangle{
+		X:      uint16(x0),
+		Y:      uint16(y0),
+		Width:  uint16(minInt(x1, 0xffff) - x0),
+		Height: uint16(minInt(y1, 0xffff) - y0),
+	}
+}
+
+// Contains reports whether the pixel at x, y is inside r.
+func (r Rectangle) Contains(x, y uint16) bool {
+	return x >= r.X && int(x) < int(r.X)+int(r.Width) &&
+		y >= r.Y && int(y) < int(r.Y)+int(r.Height)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,101 @@
+package vnc
+
+import "testing"
+
+func TestRectangle_Intersect(t *testing.T) {
+	tests := []struct {
+		a, b     Rectangle
+		expected Rectangle
+		overlaps bool
+	}{
+		// Overlapping
+		{Rectangle{X: 0, Y: 0, Width: 10, Height: 10}, Rectangle{X: 5, Y: 5, Width: 10, Height: 10},
+			Rectangle{X: 5, Y: 5, Width: 5, Height: 5}, true},
+		// Contained
+		{Rectangle{X: 0, Y: 0, Width: 10, Height: 10}, Rectangle{X: 2, Y: 3, Width: 4, Height: 5},
+			Rectangle{X: 2, Y: 3, Width: 4, Height: 5}, true},
+		// Adjacent
+		{Rectangle{X: 0, Y: 0, Width: 10, Height: 10}, Rectangle{X: 10, Y: 0, Width: 10, Height: 10},
+			Rectangle{}, false},
+		// Disjoint
+		{Rectangle{X: 0, Y: 0, Width: 10, Height: 10}, Rectangle{X: 20, Y: 20, Width: 1, Height: 1},
+			Rectangle{}, false},
+		// Empty
+		{Rectangle{X: 0, Y: 0, Width: 10, Height: 10}, Rectangle{X: 5, Y: 5},
+			Rectangle{}, false},
+		// Overflowing 16 bits when added up
+		{Rectangle{X: 0xfff0, Y: 0, Width: 0x0f, Height: 1}, Rectangle{X: 0xfff8, Y: 0, Width: 0x100, Height: 0x100},
+			Rectangle{X: 0xfff8, Y: 0, Width: 7, Height: 1}, true},
+	}
+
+	for _, tt := range tests {
+		result, overlaps := tt.a.Intersect(tt.b)
+		if result != tt.expected || overlaps != tt.overlaps {
+			t.Fatalf("%v.Intersect(%v) = %v, %v, want %v, %v", tt.a, tt.b, result, overlaps, tt.expected, tt.overlaps)
+		}
+
+		if result, _ := tt.b.Intersect(tt.a); result != tt.expected {
+			t.Fatalf("%v.Intersect(%v) = %v, want %v", tt.b, tt.a, result, tt.expected)
+		}
+	}
+}
+
+func TestRectangle_Union(t *testing.T) {
+	tests := []struct {
+		a, b     Rectangle
+		expected Rectangle
+	}{
+		// Overlapping
+		{Rectangle{X: 0, Y: 0, Width: 10, Height: 10}, Rectangle{X: 5, Y: 5, Width: 10, Height: 10},
+			Rectangle{X: 0, Y: 0, Width: 15, Height: 15}},
+		// Adjacent
+		{Rectangle{X: 0, Y: 0, Width: 10, Height: 10}, Rectangle{X: 10, Y: 0, Width: 10, Height: 10},
+			Rectangle{X: 0, Y: 0, Width: 20, Height: 10}},
+		// Disjoint
+		{Rectangle{X: 2, Y: 3, Width: 1, Height: 1}, Rectangle{X: 20, Y: 30, Width: 5, Height: 5},
+			Rectangle{X: 2, Y: 3, Width: 23, Height: 32}},
+		// Empty
+		{Rectangle{X: 2, Y: 3, Width: 4, Height: 5}, Rectangle{X: 100, Y: 100},
+			Rectangle{X: 2, Y: 3, Width: 4, Height: 5}},
+		// Clipped to 16 bits
+		{Rectangle{X: 0, Y: 0, Width: 0xffff, Height: 1}, Rectangle{X: 0xfff0, Y: 0, Width: 0x100, Height: 1},
+			Rectangle{X: 0, Y: 0, Width: 0xffff, Height: 1}},
+	}
+
+	for _, tt := range tests {
+		if result := tt.a.Union(tt.b); result != tt.expected {
+			t.Fatalf("%v.Union(%v) = %v, want %v", tt.a, tt.b, result, tt.expected)
+		}
+
+		if result := tt.b.Union(tt.a); result != tt.expected {
+			t.Fatalf("%v.Union(%v) = %v, want %v", tt.b, tt.a, result, tt.expected)
+		}
+	}
+}
+
+func TestRectangle_Contains(t *testing.T) {
+	r := Rectangle{X: 10, Y: 20, Width: 5, Height: 2}
+
+	tests := []struct {
+		x, y     uint16
+		expected bool
+	}{
+		{10, 20, true},
+		{14, 21, true},
+		{15, 20, false},
+		{10, 22, false},
+		{9, 20, false},
+		{10, 19, false},
+	}
+
+	for _, tt := range tests {
+		if result := r.Contains(tt.x, tt.y); result != tt.expected {
+			t.Fatalf("Contains(%d, %d) = %v, want %v", tt.x, tt.y, result, tt.expected)
+		}
+	}
+
+	edge := Rectangle{X: 0xfff0, Y: 0, Width: 0x100, Height: 1}
+	if !edge.Contains(0xffff, 0) {
+		t.Fatal("pixel at the end of the coordinate space not contained")
+	}
+}
@@ -0,0 +1,125 @@
+package vnc
+
+import (
+	"context"
+	"net"
+)
+
+// updateWaiter is a RequestUpdate call waiting for its update, which is
+// the first one read after the after'th update.
+type updateWaiter struct {
+	after uint64
+	ch    chan *FramebufferUpdateMessage
+}
+
+// RequestUpdate requests an update of the given region, like
+// FramebufferUpdateRequest, and waits for the server to send it, or for
+// ctx to be done. The update is handled as any other: it is applied to
+// the framebuffer kept with ClientConfig.KeepFramebuffer and sent on
+// ServerMessageCh, so RequestUpdate can be used together with them.
+// Updates read before it, such as those sent by continuous updates, are
+// handled as usual too, and none is lost.
+//
+// RFB doesn't tell which request an update answers, so the first update
+// the server starts sending after RequestUpdate has been called is
+// returned. With continuous updates enabled, it may have been sent
+// before the server received the request. The update must not be
+// modified, since it is shared with the rest of the connection.
+func (c *ClientConn) RequestUpdate(ctx context.Context, incremental bool, x, y, width, height uint16) (*FramebufferUpdateMessage, error) {
+	w := c.addUpdateWaiter()
+	defer c.removeUpdateWaiter(w)
+
+	if err := c.FramebufferUpdateRequest(incremental, x, y, width, height); err != nil {
+		return nil, err
+	}
+
+	select {
+	case update, ok := <-w.ch:
+		if !ok {
+			return nil, net.ErrClosed
+		}
+
+		return update, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// addUpdateWaiter registers a waiter for the next update to be read.
+func (c *ClientConn) addUpdateWaiter() *updateWaiter {
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	w := &updateWaiter{after: c.updatesRead, ch: make(chan *FramebufferUpdateMessage, 1)}
+	if c.updatesClosed {
+		close(w.ch)
+		return w
+	}
+
+	c.updateWaiters = append(c.updateWaiters, w)
+	return w
+}
+
+func (c *ClientConn) removeUpdateWaiter(w *updateWaiter) {
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	for i, other := range c.updateWaiters {
+		if other == w {
+			c.updateWaiters = append(c.updateWaiters[:i], c.updateWaiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// updateStarted is called by the main loop when it starts reading an
+// update, and returns its sequence number.
+func (c *ClientConn) updateStarted() uint64 {
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	c.updatesRead++
+	return c.updatesRead
+}
+
+// updateHandled passes an update that has been handled to the waiters
+// that were registered before it started being read. It reports whether
+// there were any, in which case the update must be kept as it is.
+func (c *ClientConn) updateHandled(seq uint64, update *FramebufferUpdateMessage) bool {
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	waiting := c.updateWaiters[:0]
+	delivered := false
+	for _, w := range c.updateWaiters {
+		if w.after >= seq {
+			waiting = append(waiting, w)
+			continue
+		}
+
+		w.ch <- update
+		delivered = true
+	}
+
+	// Clear the waiters that were removed, so they can be collected.
+	for i := len(waiting); i < len(c.updateWaiters); i++ {
+		c.updateWaiters[i] = nil
+	}
+	c.updateWaiters = waiting
+
+	return delivered
+}
+
+// closeUpdateWaiters fails the waiting RequestUpdate calls, once no more
+// updates will be read.
+func (c *ClientConn) closeUpdateWaiters() {
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	for _, w := range c.updateWaiters {
+		close(w.ch)
+	}
+
+	c.updateWaiters = nil
+	c.updatesClosed = true
+}
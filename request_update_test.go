@@ -0,0 +1,114 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestClientConn_RequestUpdate(t *testing.T) {
+	msgCh := make(chan ServerMessage, 2)
+	conn, server := newTestClientConn(&ClientConfig{
+		KeepFramebuffer: true,
+		ServerMessageCh: msgCh,
+	})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 2
+	conn.FrameBufferHeight = 1
+	conn.PixelFormat = testPixelFormat
+	conn.fb = NewFramebuffer(2, 1)
+
+	go conn.mainLoop()
+
+	// The server starts sending an unsolicited update before the request.
+	var unsolicited bytes.Buffer
+	unsolicited.Write([]byte{0, 1})
+	binary.Write(&unsolicited, binary.BigEndian, []uint16{0, 0, 1, 1})
+	binary.Write(&unsolicited, binary.BigEndian, int32(0))
+	unsolicited.Write([]byte{3, 2, 1, 0})
+
+	server.Write([]byte{0, 0})
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn.updateLock.Lock()
+		started := conn.updatesRead
+		conn.updateLock.Unlock()
+		if started == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the update to be read")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	type result struct {
+		update *FramebufferUpdateMessage
+		err    error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		update, err := conn.RequestUpdate(context.Background(), false, 0, 0, 2, 1)
+		resultCh <- result{update, err}
+	}()
+
+	expectUpdateRequest(t, server, false, 0, 0, 2, 1)
+	server.Write(unsolicited.Bytes())
+	writeRawUpdate(t, server, 1, 0, 1, 1, rgb(4, 5, 6))
+
+	var res result
+	select {
+	case res = <-resultCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for RequestUpdate")
+	}
+	if res.err != nil {
+		t.Fatalf("error requesting update: %s", res.err)
+	}
+	if rect := res.update.Rectangles[0]; rect.X != 1 {
+		t.Fatalf("RequestUpdate returned the update at %d,%d, want the one at 1,0", rect.X, rect.Y)
+	}
+
+	// Both updates were passed on and applied.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-msgCh:
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for update %d", i+1)
+		}
+	}
+
+	fb := conn.Framebuffer()
+	if fb.Colors[0] != rgb(1, 2, 3) || fb.Colors[1] != rgb(4, 5, 6) {
+		t.Fatalf("framebuffer is %v", fb.Colors)
+	}
+}
+
+func TestClientConn_RequestUpdateClosed(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	conn.FrameBufferWidth = 2
+	conn.FrameBufferHeight = 1
+
+	go conn.mainLoop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.RequestUpdate(context.Background(), false, 0, 0, 2, 1)
+		errCh <- err
+	}()
+
+	expectUpdateRequest(t, server, false, 0, 0, 2, 1)
+	server.Close()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("expected error once the connection is closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for RequestUpdate")
+	}
+}
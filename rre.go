@@ -0,0 +1,205 @@
+package vnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// RREEncoding sends a rectangle as a background color, and subrectangles
+// of other colors painted over it, in order. CoRREEncoding is the same
+// with smaller subrectangle coordinates.
+//
+// By default, the rectangle is decoded into Colors like any other. With
+// ClientConfig.SparseRRE, Colors is nil, and the rectangle is returned
+// as its Background and Subrects instead, so that a consumer can paint
+// the few pixels that differ from the background itself, without the
+// colors of the whole rectangle being allocated and filled. Both forms are
+// painted by Framebuffer.Apply.
+//
+// See RFC 6143 Section 7.7.3
+type RREEncoding struct {
+	Colors []Color
+
+	Background Color
+	Subrects   []RRESubrect
+}
+
+// RRESubrect is a subrectangle of an RRE or CoRRE rectangle, relative to
+// the top left of the rectangle.
+type RRESubrect struct {
+	Color         Color
+	X, Y          uint16
+	Width, Height uint16
+}
+
+func (*RREEncoding) Type() int32 {
+	return 2
+}
+
+func (*RREEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	colors, background, subrects, err := c.readRRE(rect, r, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RREEncoding{Colors: colors, Background: background, Subrects: subrects}, nil
+}
+
+// CoRREEncoding is the compact variant of RREEncoding, which sends the
+// coordinates of the subrectangles in single bytes, for rectangles of up
+// to 255x255 pixels. Its fields are those of RREEncoding.
+//
+// See RFC 6143 Section 7.7.3
+type CoRREEncoding struct {
+	Colors []Color
+
+	Background Color
+	Subrects   []RRESubrect
+}
+
+func (*CoRREEncoding) Type() int32 {
+	return 4
+}
+
+func (*CoRREEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	colors, background, subrects, err := c.readRRE(rect, r, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CoRREEncoding{Colors: colors, Background: background, Subrects: subrects}, nil
+}
+
+// The most subrectangles read from the server at once by readRRE.
+const rreBatchSize = 1024
+
+// readRRE reads an RRE rectangle, or a CoRRE rectangle if compact is set,
+// returning either its colors or, with ClientConfig.SparseRRE, its
+// background and subrectangles.
+func (c *ClientConn) readRRE(rect *Rectangle, r io.Reader, compact bool) ([]Color, Color, []RRESubrect, error) {
+	sparse := c.config != nil && c.config.SparseRRE
+	if rect.empty() {
+		if sparse {
+			return nil, Color{}, []RRESubrect{}, nil
+		}
+
+		return []Color{}, Color{}, nil, nil
+	}
+
+	if err := c.checkRectangle(rect); err != nil {
+		return nil, Color{}, nil, err
+	}
+
+	format := c.decodeFormat()
+	bytesPerPixel := int(c.PixelFormat.BPP / 8)
+
+	header := c.pixelBuffer(4 + bytesPerPixel)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, Color{}, nil, err
+	}
+
+	count := int(binary.BigEndian.Uint32(header))
+	var background [1]Color
+	if err := format.decode(background[:], header[4:], &c.ColorMap); err != nil {
+		return nil, Color{}, nil, err
+	}
+
+	var colors []Color
+	var subrects []RRESubrect
+	width, height := int(rect.Width), int(rect.Height)
+	if sparse {
+		// The count comes from the server, so the subrectangles are
+		// only allocated as they arrive.
+		subrects = make([]RRESubrect, 0, minInt(count, rreBatchSize))
+	} else {
+		colors = c.colorBuffer(width * height)
+		for i := range colors {
+			colors[i] = background[0]
+		}
+	}
+
+	name, coordSize := "RRE", 8
+	if compact {
+		name, coordSize = "CoRRE", 4
+	}
+	size := bytesPerPixel + coordSize
+
+	for read := 0; read < count; {
+		batch := minInt(count-read, rreBatchSize)
+		data := c.pixelBuffer(batch * size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, Color{}, nil, err
+		}
+
+		for i := 0; i < batch; i++ {
+			p := data[i*size:]
+
+			var subrect RRESubrect
+			var color [1]Color
+			if err := format.decode(color[:], p[:bytesPerPixel], &c.ColorMap); err != nil {
+				return nil, Color{}, nil, err
+			}
+			subrect.Color = color[0]
+
+			p = p[bytesPerPixel:]
+			if compact {
+				subrect.X, subrect.Y = uint16(p[0]), uint16(p[1])
+				subrect.Width, subrect.Height = uint16(p[2]), uint16(p[3])
+			} else {
+				subrect.X, subrect.Y = binary.BigEndian.Uint16(p[0:]), binary.BigEndian.Uint16(p[2:])
+				subrect.Width, subrect.Height = binary.BigEndian.Uint16(p[4:]), binary.BigEndian.Uint16(p[6:])
+			}
+
+			if int(subrect.X)+int(subrect.Width) > width || int(subrect.Y)+int(subrect.Height) > height {
+				return nil, Color{}, nil, fmt.Errorf("%s subrectangle %dx%d at %d,%d is outside of the %dx%d rectangle",
+					name, subrect.Width, subrect.Height, subrect.X, subrect.Y, width, height)
+			}
+
+			if sparse {
+				subrects = append(subrects, subrect)
+				continue
+			}
+
+			for y := int(subrect.Y); y < int(subrect.Y)+int(subrect.Height); y++ {
+				row := colors[y*width+int(subrect.X):][:subrect.Width]
+				for x := range row {
+					row[x] = subrect.Color
+				}
+			}
+		}
+
+		read += batch
+	}
+
+	return colors, background[0], subrects, nil
+}
+
+// paintRRE paints an RRE or CoRRE rectangle with paint, which paints
+// colors into a rectangle of a framebuffer. Sparse rectangles are painted
+// a row at a time, to avoid allocating the colors of the whole rectangle.
+func paintRRE(rect *Rectangle, colors []Color, background Color, subrects []RRESubrect, paint func(*Rectangle, []Color)) {
+	if colors != nil {
+		paint(rect, colors)
+		return
+	}
+	if subrects == nil {
+		return
+	}
+
+	fill := func(x, y, width, height uint16, color Color) {
+		row := make([]Color, width)
+		for i := range row {
+			row[i] = color
+		}
+
+		for i := uint16(0); i < height; i++ {
+			paint(&Rectangle{X: x, Y: y + i, Width: width, Height: 1}, row)
+		}
+	}
+
+	fill(rect.X, rect.Y, rect.Width, rect.Height, background)
+	for _, subrect := range subrects {
+		fill(rect.X+subrect.X, rect.Y+subrect.Y, subrect.Width, subrect.Height, subrect.Color)
+	}
+}
@@ -0,0 +1,148 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// randomRRE returns the RRE, or CoRRE if compact is set, data of a
+// rectangle with overlapping subrectangles of random colors.
+func randomRRE(rng *rand.Rand, width, height, subrects int, compact bool) []byte {
+	randomColor := func() Color {
+		return rgb(uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)))
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(subrects))
+	writeHextilePixel(&buf, randomColor())
+	for i := 0; i < subrects; i++ {
+		writeHextilePixel(&buf, randomColor())
+
+		x, y := rng.Intn(width), rng.Intn(height)
+		w, h := 1+rng.Intn(width-x), 1+rng.Intn(height-y)
+		if compact {
+			buf.Write([]byte{uint8(x), uint8(y), uint8(w), uint8(h)})
+		} else {
+			binary.Write(&buf, binary.BigEndian, []uint16{uint16(x), uint16(y), uint16(w), uint16(h)})
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func TestRREEncoding_Read(t *testing.T) {
+	conn := &ClientConn{
+		config:            &ClientConfig{},
+		FrameBufferWidth:  8,
+		FrameBufferHeight: 4,
+		PixelFormat:       testPixelFormat,
+	}
+
+	red, green, blue := rgb(255, 0, 0), rgb(0, 255, 0), rgb(0, 0, 255)
+
+	// A red rectangle with a green subrectangle of 3x2 at 1,1, partly
+	// covered by a blue one of 2x2 at 3,2.
+	var data bytes.Buffer
+	binary.Write(&data, binary.BigEndian, uint32(2))
+	writeHextilePixel(&data, red)
+	writeHextilePixel(&data, green)
+	binary.Write(&data, binary.BigEndian, []uint16{1, 1, 3, 2})
+	writeHextilePixel(&data, blue)
+	binary.Write(&data, binary.BigEndian, []uint16{3, 2, 2, 2})
+
+	enc, err := new(RREEncoding).Read(conn, &Rectangle{Width: 8, Height: 4}, &data)
+	if err != nil {
+		t.Fatalf("error reading rectangle: %s", err)
+	}
+	if data.Len() != 0 {
+		t.Fatalf("%d bytes left unread", data.Len())
+	}
+
+	colors := enc.(*RREEncoding).Colors
+	for _, tt := range []struct {
+		x, y     int
+		expected Color
+	}{
+		{0, 0, red},
+		{1, 1, green},
+		{3, 1, green},
+		{2, 2, green},
+		{3, 2, blue},
+		{4, 3, blue},
+		{5, 3, red},
+		{7, 3, red},
+	} {
+		if actual := colors[tt.y*8+tt.x]; actual != tt.expected {
+			t.Errorf("pixel %d,%d = %v, want %v", tt.x, tt.y, actual, tt.expected)
+		}
+	}
+
+	// Subrectangles must lie within the rectangle.
+	data.Reset()
+	binary.Write(&data, binary.BigEndian, uint32(1))
+	writeHextilePixel(&data, red)
+	data.Write([]byte{0, 0, 0, 0, 5, 1, 4, 1})
+	_, err = new(CoRREEncoding).Read(conn, &Rectangle{Width: 8, Height: 4}, &data)
+	if err == nil || !strings.Contains(err.Error(), "outside of the 8x4 rectangle") {
+		t.Fatalf("err = %v for a subrectangle outside of the rectangle", err)
+	}
+}
+
+func TestRREEncoding_Sparse(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		var enc Encoding = new(RREEncoding)
+		if compact {
+			enc = new(CoRREEncoding)
+		}
+
+		data := randomRRE(rand.New(rand.NewSource(1)), 100, 60, 50, compact)
+		rect := Rectangle{X: 10, Y: 5, Width: 100, Height: 60}
+
+		var frames []*Framebuffer
+		for _, sparse := range []bool{false, true} {
+			conn := &ClientConn{
+				config:            &ClientConfig{SparseRRE: sparse},
+				FrameBufferWidth:  120,
+				FrameBufferHeight: 70,
+				PixelFormat:       testPixelFormat,
+			}
+
+			r := bytes.NewReader(data)
+			decoded, err := enc.Read(conn, &rect, r)
+			if err != nil {
+				t.Fatalf("compact %v, sparse %v: error reading rectangle: %s", compact, sparse, err)
+			}
+			if r.Len() != 0 {
+				t.Fatalf("compact %v, sparse %v: %d bytes left unread", compact, sparse, r.Len())
+			}
+
+			var colors []Color
+			var subrects []RRESubrect
+			switch decoded := decoded.(type) {
+			case *RREEncoding:
+				colors, subrects = decoded.Colors, decoded.Subrects
+			case *CoRREEncoding:
+				colors, subrects = decoded.Colors, decoded.Subrects
+			}
+			if sparse && (colors != nil || len(subrects) != 50) {
+				t.Fatalf("compact %v: sparse rectangle has %d colors and %d subrectangles", compact, len(colors), len(subrects))
+			}
+
+			rect := rect
+			rect.Enc = decoded
+			fb := NewFramebuffer(120, 70)
+			fb.Apply(&FramebufferUpdateMessage{Rectangles: []Rectangle{rect}})
+			frames = append(frames, fb)
+		}
+
+		for i := range frames[0].Colors {
+			if frames[0].Colors[i] != frames[1].Colors[i] {
+				t.Fatalf("compact %v: pixel %d,%d painted as %v when sparse, %v when materialized",
+					compact, i%120, i/120, frames[1].Colors[i], frames[0].Colors[i])
+			}
+		}
+	}
+}
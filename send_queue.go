@@ -0,0 +1,165 @@
+package vnc
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrWouldBlock is returned by the TrySend methods when the queue of
+// messages waiting to be written to the server is full.
+var ErrWouldBlock = errors.New("send queue full")
+
+// The default ClientConfig.SendQueueSize.
+const defaultSendQueueSize = 64
+
+// sendQueue holds the messages queued by the TrySend methods, which are
+// written to the server by a goroutine of their own, so that a stalled
+// server never blocks the caller.
+type sendQueue struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	msgs []ClientMessage
+
+	// started is set once the goroutine writing the queue has been
+	// started, and writing while it is writing messages. err holds the
+	// error of a failed write, after which nothing more is written.
+	started bool
+	writing bool
+	closed  bool
+	err     error
+}
+
+// TrySendKeyEvent is like KeyEvent, but never blocks. The event is
+// queued, and written to the server in the background. If the queue is
+// full, ErrWouldBlock is returned and the event is not sent. Key events
+// are never dropped once queued, so that key presses and releases stay
+// paired. See ClientConfig.SendQueueSize.
+func (c *ClientConn) TrySendKeyEvent(keysym uint32, down bool) error {
+	return c.trySend(&KeyEventMessage{Down: down, Keysym: keysym})
+}
+
+// TrySendPointerEvent is like PointerEvent, but never blocks, as with
+// TrySendKeyEvent. If the queue is full, and the event only moves the
+// pointer, it replaces the pointer event at the end of the queue when
+// that has the same buttons pressed, since the server only needs the
+// latest position. Otherwise, ErrWouldBlock is returned.
+func (c *ClientConn) TrySendPointerEvent(mask ButtonMask, x, y uint16) error {
+	return c.trySend(&PointerEventMessage{Mask: mask, X: x, Y: y})
+}
+
+// trySend queues a message to be written by the send queue goroutine,
+// which is started with the first message.
+func (c *ClientConn) trySend(msg ClientMessage) error {
+	q := &c.queue
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.err != nil {
+		return q.err
+	}
+	if q.closed {
+		return net.ErrClosed
+	}
+
+	if !q.started {
+		q.started = true
+		q.cond = sync.NewCond(&q.lock)
+		go c.writeQueue()
+	}
+
+	maxSize := c.config.SendQueueSize
+	if maxSize <= 0 {
+		maxSize = defaultSendQueueSize
+	}
+
+	if len(q.msgs) >= maxSize {
+		move, ok := msg.(*PointerEventMessage)
+		if !ok {
+			return ErrWouldBlock
+		}
+
+		last, ok := q.msgs[len(q.msgs)-1].(*PointerEventMessage)
+		if !ok || last.Mask != move.Mask {
+			return ErrWouldBlock
+		}
+
+		q.msgs[len(q.msgs)-1] = move
+		return nil
+	}
+
+	q.msgs = append(q.msgs, msg)
+	q.cond.Broadcast()
+	return nil
+}
+
+// writeQueue writes the queued messages to the server until the
+// connection is closed. All of the messages queued at the time are
+// written at once.
+func (c *ClientConn) writeQueue() {
+	q := &c.queue
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		for len(q.msgs) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			return
+		}
+
+		msgs := q.msgs
+		q.msgs = nil
+		q.writing = true
+		q.lock.Unlock()
+
+		err := c.send(msgs...)
+
+		q.lock.Lock()
+		q.writing = false
+		q.cond.Broadcast()
+
+		if err != nil {
+			q.err = err
+			q.msgs = nil
+			return
+		}
+	}
+}
+
+// waitQueue waits until the messages queued so far have been written,
+// or writing them has failed.
+func (c *ClientConn) waitQueue() error {
+	q := &c.queue
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.cond == nil {
+		return nil
+	}
+
+	for (len(q.msgs) > 0 || q.writing) && q.err == nil && !q.closed {
+		q.cond.Wait()
+	}
+
+	return q.err
+}
+
+// closeQueue stops the send queue goroutine. Messages still queued are
+// discarded.
+func (c *ClientConn) closeQueue() {
+	q := &c.queue
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.msgs = nil
+	if q.cond != nil {
+		q.cond.Broadcast()
+	}
+}
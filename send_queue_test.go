@@ -0,0 +1,92 @@
+package vnc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestClientConn_TrySend(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{SendQueueSize: 2})
+	defer server.Close()
+	defer conn.Close()
+
+	// The server doesn't read yet, so the first event is stuck being
+	// written, and the rest wait in the queue.
+	if err := conn.TrySendKeyEvent('a', true); err != nil {
+		t.Fatalf("error queueing key event: %s", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn.queue.lock.Lock()
+		writing := conn.queue.writing
+		conn.queue.lock.Unlock()
+		if writing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the queue to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	tests := []struct {
+		send     func() error
+		expected error
+	}{
+		{func() error { return conn.TrySendKeyEvent('a', false) }, nil},
+		{func() error { return conn.TrySendPointerEvent(0, 1, 1) }, nil},
+
+		// The queue is full. Moving the pointer replaces the last event,
+		// but anything else is rejected.
+		{func() error { return conn.TrySendKeyEvent('b', true) }, ErrWouldBlock},
+		{func() error { return conn.TrySendPointerEvent(0, 5, 5) }, nil},
+		{func() error { return conn.TrySendPointerEvent(ButtonLeft, 5, 5) }, ErrWouldBlock},
+	}
+
+	for i, tt := range tests {
+		if err := tt.send(); err != tt.expected {
+			t.Fatalf("%d: err = %v, want %v", i, err, tt.expected)
+		}
+	}
+
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- conn.Flush()
+	}()
+
+	data := make([]byte, 22)
+	if _, err := io.ReadFull(server, data); err != nil {
+		t.Fatalf("error reading: %s", err)
+	}
+
+	expected := []byte{
+		4, 1, 0, 0, 0, 0, 0, 'a',
+		4, 0, 0, 0, 0, 0, 0, 'a',
+		5, 0, 0, 5, 0, 5,
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("read %v, want %v", data, expected)
+	}
+
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Fatalf("error flushing: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for Flush")
+	}
+}
+
+func TestClientConn_TrySendClosed(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{})
+	server.Close()
+	conn.Close()
+
+	if err := conn.TrySendKeyEvent('a', true); err == nil {
+		t.Fatal("expected error queueing on a closed connection")
+	}
+}
@@ -1,11 +1,70 @@
 package vnc
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"time"
+	"unicode"
 )
 
+// ErrProtocolDesync is wrapped by the errors reported when the data from
+// the server stops making sense, such as an unknown message type, or a
+// rectangle in an encoding that was never negotiated. This usually means
+// that a message was read using the wrong number of bytes, such as by a
+// decoder with a bug, and that everything that follows is garbage. The
+// connection is closed, since RFB messages can't be resynchronized.
+var ErrProtocolDesync = errors.New("protocol desync")
+
+// ErrPixelFormatMismatch wraps ErrProtocolDesync when the data that makes
+// no sense directly follows the pixels of a Raw rectangle. The size of
+// raw pixel data is implied by the pixel format, so this usually means
+// that the server sends pixels of a different size than the negotiated
+// format, such as a server behind a proxy that changed its format
+// without the client knowing.
+var ErrPixelFormatMismatch = fmt.Errorf("%w: pixel format mismatch", ErrProtocolDesync)
+
+// EncodingError is the error returned when a rectangle fails to decode,
+// if ClientConfig.CaptureDecodeErrors is set. It holds the encoding type
+// and geometry of the rectangle, and the first bytes of its data as
+// received, which can be attached to a bug report to reproduce the
+// problem. Err is the error of the decoder.
+type EncodingError struct {
+	EncodingType int32
+	Rect         Rectangle
+	Data         []byte
+	Err          error
+}
+
+// The most bytes of data captured for an EncodingError.
+const maxEncodingErrorData = 64
+
+func (e *EncodingError) Error() string {
+	return fmt.Sprintf("error decoding %s rectangle %dx%d at %d,%d: %s (data: %s)",
+		EncodingName(e.EncodingType), e.Rect.Width, e.Rect.Height, e.Rect.X, e.Rect.Y, e.Err, hex.EncodeToString(e.Data))
+}
+
+func (e *EncodingError) Unwrap() error {
+	return e.Err
+}
+
+// prefixWriter keeps the first bytes written to it, up to its capacity.
+type prefixWriter struct {
+	data []byte
+}
+
+func (pw *prefixWriter) Write(b []byte) (int, error) {
+	if room := cap(pw.data) - len(pw.data); room > 0 {
+		pw.data = append(pw.data, b[:minInt(room, len(b))]...)
+	}
+
+	return len(b), nil
+}
+
 // A ServerMessage implements a message sent from the server to the client.
 type ServerMessage interface {
 	// The type of the message that is sent down on the wire.
@@ -36,7 +95,52 @@ func (*FramebufferUpdateMessage) Type() uint8 {
 	return 0
 }
 
-func (*FramebufferUpdateMessage) Read(c *ClientConn, r io.Reader) (ServerMessage, error) {
+// NumRectangles returns the number of rectangles in the update,
+// including those of pseudo-encodings.
+func (m *FramebufferUpdateMessage) NumRectangles() int {
+	return len(m.Rectangles)
+}
+
+// Bounds returns the smallest rectangle containing all of the rectangles
+// of the update that carry pixel data. Rectangles of pseudo-encodings,
+// such as the cursor or the desktop size, are left out, since they don't
+// cover an area of the frame buffer. The encoding of the result is nil.
+func (m *FramebufferUpdateMessage) Bounds() Rectangle {
+	var bounds Rectangle
+	for _, rect := range m.Rectangles {
+		if rect.Enc != nil && isPseudoEncoding(rect.Enc.Type()) {
+			continue
+		}
+
+		bounds = bounds.Union(rect)
+	}
+
+	return bounds
+}
+
+// ContainsPseudo reports whether the update has a rectangle of the
+// pseudo-encoding type encType, such as -223 for DesktopSize.
+func (m *FramebufferUpdateMessage) ContainsPseudo(encType int32) bool {
+	for _, rect := range m.Rectangles {
+		if rect.Enc != nil && rect.Enc.Type() == encType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (*FramebufferUpdateMessage) Read(c *ClientConn, r io.Reader) (msg ServerMessage, err error) {
+	ctx := c.decodeContext()
+	if ctx != nil {
+		finish := c.watchDecodeContext(ctx)
+		defer func() {
+			if err = finish(err); err != nil {
+				msg = nil
+			}
+		}()
+	}
+
 	// Read off the padding
 	var padding [1]byte
 	if _, err := io.ReadFull(r, padding[:]); err != nil {
@@ -48,20 +152,33 @@ func (*FramebufferUpdateMessage) Read(c *ClientConn, r io.Reader) (ServerMessage
 		return nil, err
 	}
 
-	// Build the map of encodings supported
-	encMap := make(map[int32]Encoding)
-	for _, enc := range c.Encs {
-		encMap[enc.Type()] = enc
+	maxRects := 0
+	if c.config != nil {
+		maxRects = c.config.MaxRectanglesPerUpdate
 	}
 
-	// We must always support the raw encoding
-	rawEnc := new(RawEncoding)
-	encMap[rawEnc.Type()] = rawEnc
+	encMap := c.encodingMap()
+
+	// With LastRect, servers send the maximum count and end the update
+	// early, so the rectangles are counted as they are read instead.
+	_, lastRect := encMap[new(LastRectPseudoEncoding).Type()]
+	lastRect = lastRect && numRects == 0xFFFF
+	if maxRects > 0 && !lastRect && int(numRects) > maxRects {
+		return nil, fmt.Errorf("update of %d rectangles exceeds the maximum of %d", numRects, maxRects)
+	}
 
-	rects := make([]Rectangle, numRects)
+	// The rectangles are appended as they are read, since servers using
+	// LastRect send the maximum count, and end the update early.
+	rects := make([]Rectangle, 0, minInt(int(numRects), 256))
+	counter := countingReader{r: r}
 	for i := uint16(0); i < numRects; i++ {
+		if ctx != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
 		var encodingType int32
 
+		rects = append(rects, Rectangle{})
 		rect := &rects[i]
 		data := []interface{}{
 			&rect.X,
@@ -77,26 +194,165 @@ func (*FramebufferUpdateMessage) Read(c *ClientConn, r io.Reader) (ServerMessage
 			}
 		}
 
+		// The LastRect rectangle that ends an update doesn't count.
+		if maxRects > 0 && int(i) >= maxRects && encodingType != new(LastRectPseudoEncoding).Type() {
+			return nil, fmt.Errorf("update exceeds the maximum of %d rectangles before its LastRect", maxRects)
+		}
+
+		var prevRaw *Rectangle
+		if i > 0 {
+			prevRaw = rawRectangle(rects[:i])
+		}
+
 		enc, ok := encMap[encodingType]
 		if !ok {
-			return nil, fmt.Errorf("unsupported encoding type: %d", encodingType)
+			problem := fmt.Sprintf("unsupported encoding type %d in rectangle %d of %d", encodingType, i+1, numRects)
+			if prevRaw != nil {
+				return nil, c.pixelFormatMismatch(prevRaw, problem)
+			}
+
+			return nil, fmt.Errorf("%w: %s", ErrProtocolDesync, problem)
+		}
+
+		if prevRaw != nil && !isPseudoEncoding(encodingType) && !c.inFramebuffer(rect) {
+			return nil, c.pixelFormatMismatch(prevRaw, fmt.Sprintf("rectangle %d of %d is outside of the framebuffer", i+1, numRects))
+		}
+
+		start := time.Now()
+
+		counter.n = 0
+		var rectReader io.Reader = &counter
+		var captured *prefixWriter
+		if c.config != nil && c.config.CaptureDecodeErrors {
+			captured = &prefixWriter{data: make([]byte, 0, maxEncodingErrorData)}
+			rectReader = io.TeeReader(&counter, captured)
 		}
 
 		var err error
-		rect.Enc, err = enc.Read(c, rect, r)
+		rect.Enc, err = enc.Read(c, rect, rectReader)
 		if err != nil {
+			if captured != nil {
+				return nil, &EncodingError{EncodingType: encodingType, Rect: *rect, Data: captured.data, Err: err}
+			}
+
 			return nil, err
 		}
+
+		var decoded uint64
+		if !isPseudoEncoding(encodingType) {
+			decoded = uint64(rect.Width) * uint64(rect.Height) * uint64(c.PixelFormat.BPP/8)
+		}
+		c.recordDecode(encodingType, time.Since(start), counter.n, decoded)
+
+		if _, ok := rect.Enc.(*LastRectPseudoEncoding); ok {
+			rects = rects[:i]
+			break
+		}
+
+		if c.config != nil && c.config.OnRectangle != nil {
+			c.config.OnRectangle(*rect)
+		}
 	}
 
 	return &FramebufferUpdateMessage{rects}, nil
 }
 
+// rawRectangle returns the last of rects if it holds Raw pixel data, and
+// nil otherwise.
+func rawRectangle(rects []Rectangle) *Rectangle {
+	if len(rects) == 0 {
+		return nil
+	}
+
+	last := &rects[len(rects)-1]
+	if _, ok := last.Enc.(*RawEncoding); !ok || last.empty() {
+		return nil
+	}
+
+	return last
+}
+
+// pixelFormatMismatch returns an ErrPixelFormatMismatch for a problem
+// found right after the pixel data of the Raw rectangle raw.
+func (c *ClientConn) pixelFormatMismatch(raw *Rectangle, problem string) error {
+	return fmt.Errorf("%w: %s, right after a %dx%d raw rectangle; the server may not be sending %d bits per pixel",
+		ErrPixelFormatMismatch, problem, raw.Width, raw.Height, c.PixelFormat.BPP)
+}
+
+// encodingMap returns the encodings supported by the connection, by type.
+func (c *ClientConn) encodingMap() map[int32]Encoding {
+	encMap := make(map[int32]Encoding)
+	for _, enc := range c.Encs {
+		encMap[enc.Type()] = enc
+	}
+
+	// We must always support the raw encoding, but keep the one passed
+	// to SetEncodings, if any, since it may have options set.
+	rawEnc := new(RawEncoding)
+	if _, ok := encMap[rawEnc.Type()]; !ok {
+		encMap[rawEnc.Type()] = rawEnc
+	}
+
+	// LastRect carries no data, so it is understood even if it wasn't
+	// sent with SetEncodings, since TightVNC servers may end updates
+	// with it regardless, notably with continuous updates. StrictMode
+	// rejects it as an unsupported encoding instead.
+	lastRect := new(LastRectPseudoEncoding)
+	if _, ok := encMap[lastRect.Type()]; !ok && !c.strict() {
+		encMap[lastRect.Type()] = lastRect
+	}
+
+	return encMap
+}
+
+// DecodeRectangle decodes the data of a single rectangle in the given
+// encoding, as it would be decoded as part of a FramebufferUpdate read
+// from the server, without needing a connection to one. The encodings
+// of c are used, along with any state they keep between rectangles,
+// together with its pixel format and color map. This is useful for
+// benchmarking and fuzzing decoders, and for decoding recorded data.
+func DecodeRectangle(c *ClientConn, rect Rectangle, encType int32, data []byte) (Encoding, error) {
+	enc, ok := c.encodingMap()[encType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding type: %d", encType)
+	}
+
+	return enc.Read(c, &rect, bytes.NewReader(data))
+}
+
+// DecodeHex is like DecodeRectangle, but takes the data as a hex string,
+// such as one copied from Wireshark using "Copy as Hex Stream". Spaces,
+// newlines and colons between the bytes are ignored. This makes it easy
+// to turn a capture attached to a bug report into a regression test.
+func DecodeHex(c *ClientConn, encType int32, rect Rectangle, hexData string) (Encoding, error) {
+	hexData = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == ':' {
+			return -1
+		}
+
+		return r
+	}, hexData)
+
+	data, err := hex.DecodeString(hexData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex data: %s", err)
+	}
+
+	return DecodeRectangle(c, rect, encType, data)
+}
+
 // SetColorMapEntriesMessage is sent by the server to set values into
 // the color map. This message will automatically update the color map
 // for the associated connection, but contains the color change data
 // if the consumer wants to read it.
 //
+// The color map is only used by color-mapped pixel formats. A server
+// that sends this message while the pixel format is true color is
+// misbehaving, or is late to notice that the pixel format has changed.
+// The message is then passed on as usual, but the color map of the
+// connection is left alone, and a warning is reported to
+// ClientConfig.Logf.
+//
 // See RFC 6143 Section 7.6.2
 type SetColorMapEntriesMessage struct {
 	FirstColor uint16
@@ -124,6 +380,20 @@ func (*SetColorMapEntriesMessage) Read(c *ClientConn, r io.Reader) (ServerMessag
 		return nil, err
 	}
 
+	trueColor := c.PixelFormat.TrueColor
+	if c.strict() {
+		if trueColor {
+			return nil, fmt.Errorf("%w: SetColorMapEntries in a true color pixel format", ErrSpecViolation)
+		}
+		if end := int(result.FirstColor) + int(numColors); end > len(c.ColorMap) {
+			return nil, fmt.Errorf("%w: SetColorMapEntries for colors %d to %d of a %d color map",
+				ErrSpecViolation, result.FirstColor, end-1, len(c.ColorMap))
+		}
+	}
+	if trueColor {
+		c.logf("ignoring SetColorMapEntries for %d colors in a true color pixel format", numColors)
+	}
+
 	result.Colors = make([]Color, numColors)
 	for i := uint16(0); i < numColors; i++ {
 
@@ -140,8 +410,13 @@ func (*SetColorMapEntriesMessage) Read(c *ClientConn, r io.Reader) (ServerMessag
 			}
 		}
 
-		// Update the connection's color map
-		c.ColorMap[result.FirstColor+i] = *color
+		// Update the connection's color map, keeping the full 16 bits
+		// of each channel. Entries beyond the end of the color map can't
+		// be referred to by any pixel value, and are only kept in the
+		// message.
+		if index := int(result.FirstColor) + int(i); index < len(c.ColorMap) && !trueColor {
+			c.ColorMap[index] = *color
+		}
 	}
 
 	return &result, nil
@@ -173,20 +448,130 @@ func (*ServerCutTextMessage) Type() uint8 {
 
 func (*ServerCutTextMessage) Read(c *ClientConn, r io.Reader) (ServerMessage, error) {
 	// Read off the padding
-	var padding [1]byte
+	var padding [3]byte
 	if _, err := io.ReadFull(r, padding[:]); err != nil {
 		return nil, err
 	}
 
-	var textLength uint32
+	var textLength int32
 	if err := binary.Read(r, binary.BigEndian, &textLength); err != nil {
 		return nil, err
 	}
 
-	textBytes := make([]uint8, textLength)
-	if err := binary.Read(r, binary.BigEndian, &textBytes); err != nil {
+	// A negative length indicates an extended clipboard message.
+	if textLength < 0 {
+		if c.strict() && !c.advertised(new(ExtendedClipboardPseudoEncoding).Type()) {
+			return nil, fmt.Errorf("%w: extended clipboard message without ExtendedClipboard having been sent with SetEncodings", ErrSpecViolation)
+		}
+
+		return readExtendedClipboard(c, r, uint32(-textLength))
+	}
+
+	textBytes, err := readBytes(r, uint32(textLength))
+	if err != nil {
 		return nil, err
 	}
 
 	return &ServerCutTextMessage{string(textBytes)}, nil
 }
+
+// UltraVNCFileTransferMessage is an UltraVNC file transfer message. The
+// file transfer protocol itself is not implemented; the message is only
+// parsed so that it can be skipped without losing sync with the server.
+type UltraVNCFileTransferMessage struct {
+	ContentType  uint8
+	ContentParam uint8
+	Size         uint32
+	Data         []byte
+}
+
+func (*UltraVNCFileTransferMessage) Type() uint8 {
+	return 7
+}
+
+func (*UltraVNCFileTransferMessage) Read(c *ClientConn, r io.Reader) (ServerMessage, error) {
+	var result UltraVNCFileTransferMessage
+	var padding uint8
+	var length uint32
+
+	data := []interface{}{
+		&result.ContentType,
+		&result.ContentParam,
+		&padding,
+		&result.Size,
+		&length,
+	}
+
+	for _, val := range data {
+		if err := binary.Read(r, binary.BigEndian, val); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if result.Data, err = readBytes(r, length); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Special lengths of an UltraVNC text chat message, which carry no text.
+const (
+	TextChatOpen     uint32 = 0xFFFFFFFF
+	TextChatClose    uint32 = 0xFFFFFFFE
+	TextChatFinished uint32 = 0xFFFFFFFD
+)
+
+// UltraVNCTextChatMessage is an UltraVNC text chat message. Control
+// messages that open or close the chat window have an empty Text, and
+// Control set to one of the TextChat constants.
+type UltraVNCTextChatMessage struct {
+	Control uint32
+	Text    string
+}
+
+func (*UltraVNCTextChatMessage) Type() uint8 {
+	return 11
+}
+
+func (*UltraVNCTextChatMessage) Read(c *ClientConn, r io.Reader) (ServerMessage, error) {
+	// Read off the padding
+	var padding [3]byte
+	if _, err := io.ReadFull(r, padding[:]); err != nil {
+		return nil, err
+	}
+
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	switch length {
+	case TextChatOpen, TextChatClose, TextChatFinished:
+		return &UltraVNCTextChatMessage{Control: length}, nil
+	}
+
+	textBytes, err := readBytes(r, length)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UltraVNCTextChatMessage{Text: string(textBytes)}, nil
+}
+
+// readBytes reads length bytes of a message. The buffer grows as the
+// data arrives, instead of being allocated up front, so that a bogus
+// length in a short message can't force a huge allocation.
+func readBytes(r io.Reader, length uint32) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,379 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUltraVNCTextChatMessage_Skipped(t *testing.T) {
+	msgCh := make(chan ServerMessage, 1)
+	chatCh := make(chan ServerMessage, 1)
+	conn, server := newTestClientConn(&ClientConfig{
+		ServerMessageCh: msgCh,
+		UltraVNCMessageHandler: func(msg ServerMessage) {
+			chatCh <- msg
+		},
+	})
+	defer server.Close()
+
+	go conn.mainLoop()
+
+	data := []byte{
+		11, 0, 0, 0, // TextChat, padding
+		0, 0, 0, 5, // Length
+		'h', 'e', 'l', 'l', 'o',
+		2, // Bell
+	}
+	if _, err := server.Write(data); err != nil {
+		t.Fatalf("error writing to client: %s", err)
+	}
+
+	select {
+	case msg := <-chatCh:
+		chat, ok := msg.(*UltraVNCTextChatMessage)
+		if !ok {
+			t.Fatalf("unexpected message: %#v", msg)
+		}
+		if chat.Text != "hello" {
+			t.Fatalf("text = %q, want %q", chat.Text, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for text chat message")
+	}
+
+	select {
+	case msg := <-msgCh:
+		if _, ok := msg.(*BellMessage); !ok {
+			t.Fatalf("unexpected message: %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for bell message")
+	}
+}
+
+func TestServerMessages_HugeLength(t *testing.T) {
+	// Each message claims far more data than it carries, which must fail
+	// without allocating memory for the claimed length.
+	tests := []struct {
+		msg  ServerMessage
+		data []byte
+	}{
+		{new(ServerCutTextMessage), []byte{0, 0, 0, 0x7f, 0xff, 0xff, 0xff, 'a'}},
+		{new(UltraVNCTextChatMessage), []byte{0, 0, 0, 0xf0, 0, 0, 0, 'a'}},
+		{new(QEMUAudioMessage), []byte{1, 0, 2, 0xff, 0xff, 0xff, 0, 1}},
+	}
+
+	for _, tt := range tests {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		_, err := tt.msg.Read(&ClientConn{}, bytes.NewReader(tt.data))
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("%T: err = %v, want %v", tt.msg, err, io.ErrUnexpectedEOF)
+		}
+
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Fatalf("%T: %d bytes allocated", tt.msg, allocated)
+		}
+	}
+}
+
+func TestClientConn_ProtocolDesync(t *testing.T) {
+	logCh := make(chan string, 10)
+	conn, server := newTestClientConn(&ClientConfig{
+		Logf: func(format string, v ...interface{}) {
+			logCh <- fmt.Sprintf(format, v...)
+		},
+	})
+	defer server.Close()
+
+	conn.PixelFormat = testPixelFormat
+	conn.FrameBufferWidth, conn.FrameBufferHeight = 2, 2
+
+	done := make(chan struct{})
+	go func() {
+		conn.mainLoop()
+		close(done)
+	}()
+
+	// The server sends a pixel more than the rectangle holds, so the
+	// rest of the pixel is read as the next message type.
+	data := []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0}
+	data = append(data, 1, 2, 3, 0, 0x7f, 0x7f, 0x7f, 0)
+	go server.Write(data)
+
+	// The rectangle itself decodes.
+	select {
+	case msg := <-logCh:
+		if msg != "vnc: first Raw rectangle decoded" {
+			t.Fatalf("unexpected message logged: %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first rectangle not reported")
+	}
+
+	select {
+	case msg := <-logCh:
+		if !strings.Contains(msg, "protocol desync") || !strings.Contains(msg, "FramebufferUpdateMessage") {
+			t.Fatalf("unexpected message logged: %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no protocol desync reported")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed after protocol desync")
+	}
+}
+
+func TestFramebufferUpdateMessage_UnknownEncoding(t *testing.T) {
+	conn := &ClientConn{PixelFormat: testPixelFormat}
+
+	data := []byte{0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 5}
+	_, err := new(FramebufferUpdateMessage).Read(conn, bytes.NewReader(data))
+	if !errors.Is(err, ErrProtocolDesync) {
+		t.Fatalf("err = %v, want %v", err, ErrProtocolDesync)
+	}
+}
+
+func TestFramebufferUpdateMessage_OnRectangle(t *testing.T) {
+	rectCh := make(chan Rectangle, 2)
+	msgCh := make(chan ServerMessage, 1)
+	conn, server := newTestClientConn(&ClientConfig{
+		ServerMessageCh: msgCh,
+		OnRectangle: func(rect Rectangle) {
+			rectCh <- rect
+		},
+	})
+	defer server.Close()
+
+	conn.PixelFormat = testPixelFormat
+	conn.FrameBufferWidth, conn.FrameBufferHeight = 2, 2
+
+	go conn.mainLoop()
+
+	// The first of two rectangles is sent on its own.
+	first := []byte{0, 0, 0, 2, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 1, 2, 3, 0}
+	if _, err := server.Write(first); err != nil {
+		t.Fatalf("error writing to client: %s", err)
+	}
+
+	select {
+	case rect := <-rectCh:
+		if rect.X != 0 || rect.Y != 0 {
+			t.Fatalf("unexpected rectangle: %#v", rect)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnRectangle not called before the rest of the update")
+	}
+
+	select {
+	case msg := <-msgCh:
+		t.Fatalf("update sent before all of its rectangles were read: %#v", msg)
+	default:
+	}
+
+	second := []byte{0, 1, 0, 1, 0, 1, 0, 1, 0, 0, 0, 0, 4, 5, 6, 0}
+	if _, err := server.Write(second); err != nil {
+		t.Fatalf("error writing to client: %s", err)
+	}
+
+	select {
+	case msg := <-msgCh:
+		update := msg.(*FramebufferUpdateMessage)
+		if len(update.Rectangles) != 2 {
+			t.Fatalf("%d rectangles, want 2", len(update.Rectangles))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for update")
+	}
+
+	if rect := <-rectCh; rect.X != 1 || rect.Y != 1 {
+		t.Fatalf("unexpected rectangle: %#v", rect)
+	}
+}
+
+func TestFramebufferUpdateMessage_LastRect(t *testing.T) {
+	conn := &ClientConn{
+		Encs:              []Encoding{new(LastRectPseudoEncoding)},
+		FrameBufferWidth:  2,
+		FrameBufferHeight: 2,
+		PixelFormat:       testPixelFormat,
+	}
+
+	// The maximum number of rectangles, but only one is sent before
+	// LastRect, followed by a Bell.
+	data := []byte{0, 0xff, 0xff, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 1, 2, 3, 0}
+	data = append(data, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0x20, 2)
+	r := bytes.NewReader(data)
+
+	msg, err := new(FramebufferUpdateMessage).Read(conn, r)
+	if err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+
+	update := msg.(*FramebufferUpdateMessage)
+	if len(update.Rectangles) != 1 {
+		t.Fatalf("%d rectangles, want 1", len(update.Rectangles))
+	}
+	if _, ok := update.Rectangles[0].Enc.(*RawEncoding); !ok {
+		t.Fatalf("unexpected rectangle: %#v", update.Rectangles[0])
+	}
+
+	if r.Len() != 1 {
+		t.Fatalf("%d bytes left after the update, want 1", r.Len())
+	}
+}
+
+func TestFramebufferUpdateMessage_MaxRectanglesPerUpdate(t *testing.T) {
+	conn := &ClientConn{
+		config:            &ClientConfig{MaxRectanglesPerUpdate: 1},
+		Encs:              []Encoding{new(LastRectPseudoEncoding)},
+		FrameBufferWidth:  2,
+		FrameBufferHeight: 2,
+		PixelFormat:       testPixelFormat,
+	}
+
+	// An update declaring 60000 rectangles is rejected before any of
+	// them is read.
+	_, err := new(FramebufferUpdateMessage).Read(conn, bytes.NewReader([]byte{0, 0xea, 0x60}))
+	if err == nil || !strings.Contains(err.Error(), "update of 60000 rectangles exceeds the maximum of 1") {
+		t.Fatalf("err = %v", err)
+	}
+
+	// With LastRect, the count is the maximum, and the rectangles are
+	// counted as they are read, not counting the LastRect itself.
+	rawRect := []byte{0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 1, 2, 3, 0}
+	lastRect := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0x20}
+
+	data := append([]byte{0, 0xff, 0xff}, rawRect...)
+	data = append(data, lastRect...)
+	if _, err := new(FramebufferUpdateMessage).Read(conn, bytes.NewReader(data)); err != nil {
+		t.Fatalf("error reading update ended by LastRect: %s", err)
+	}
+
+	data = append([]byte{0, 0xff, 0xff}, rawRect...)
+	data = append(data, rawRect...)
+	data = append(data, lastRect...)
+	_, err = new(FramebufferUpdateMessage).Read(conn, bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum of 1 rectangles") {
+		t.Fatalf("err = %v for too many rectangles before LastRect", err)
+	}
+}
+
+func TestFramebufferUpdateMessage_Accessors(t *testing.T) {
+	update := &FramebufferUpdateMessage{Rectangles: []Rectangle{
+		{X: 10, Y: 20, Width: 30, Height: 40, Enc: new(RawEncoding)},
+		{X: 100, Y: 5, Width: 10, Height: 10, Enc: new(CopyRectEncoding)},
+		{X: 0, Y: 0, Width: 800, Height: 600, Enc: new(DesktopSizePseudoEncoding)},
+	}}
+
+	if n := update.NumRectangles(); n != 3 {
+		t.Fatalf("NumRectangles() = %d, want 3", n)
+	}
+
+	expected := Rectangle{X: 10, Y: 5, Width: 100, Height: 55}
+	if bounds := update.Bounds(); bounds != expected {
+		t.Fatalf("Bounds() = %+v, want %+v", bounds, expected)
+	}
+
+	if !update.ContainsPseudo(-223) {
+		t.Fatal("expected the update to contain DesktopSize")
+	}
+	if update.ContainsPseudo(-232) {
+		t.Fatal("expected the update not to contain CursorPos")
+	}
+}
+
+func TestFramebufferUpdateMessage_PixelFormatMismatch(t *testing.T) {
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  4,
+		FrameBufferHeight: 4,
+	}
+
+	// Two raw rectangles of two pixels, sent at 16 bits per pixel rather
+	// than the 32 of the pixel format.
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 2})
+	for y := uint16(0); y < 2; y++ {
+		binary.Write(&buf, binary.BigEndian, []uint16{0, y, 2, 1})
+		binary.Write(&buf, binary.BigEndian, int32(0))
+		buf.Write([]byte{0x1f, 0x00, 0xe0, 0x07})
+	}
+
+	_, err := new(FramebufferUpdateMessage).Read(conn, &buf)
+	if !errors.Is(err, ErrPixelFormatMismatch) || !errors.Is(err, ErrProtocolDesync) {
+		t.Fatalf("err = %v, want %v", err, ErrPixelFormatMismatch)
+	}
+	if !strings.Contains(err.Error(), "32 bits per pixel") {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// A desync that doesn't follow raw pixel data isn't blamed on the
+	// pixel format.
+	data := []byte{0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 5}
+	_, err = new(FramebufferUpdateMessage).Read(conn, bytes.NewReader(data))
+	if !errors.Is(err, ErrProtocolDesync) || errors.Is(err, ErrPixelFormatMismatch) {
+		t.Fatalf("err = %v, want only %v", err, ErrProtocolDesync)
+	}
+}
+
+func TestFramebufferUpdateMessage_CaptureDecodeErrors(t *testing.T) {
+	// A 10x10 raw rectangle cut short after 100 of its 400 bytes.
+	pixels := make([]byte, 100)
+	for i := range pixels {
+		pixels[i] = byte(i)
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 1})
+	binary.Write(&buf, binary.BigEndian, []uint16{2, 3, 10, 10})
+	binary.Write(&buf, binary.BigEndian, int32(0))
+	buf.Write(pixels)
+
+	for _, capture := range []bool{false, true} {
+		conn := &ClientConn{
+			config:            &ClientConfig{CaptureDecodeErrors: capture},
+			FrameBufferWidth:  64,
+			FrameBufferHeight: 64,
+			PixelFormat:       testPixelFormat,
+		}
+
+		_, err := new(FramebufferUpdateMessage).Read(conn, bytes.NewReader(buf.Bytes()))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("capture %v: err = %v, want %v", capture, err, io.ErrUnexpectedEOF)
+		}
+
+		var encErr *EncodingError
+		if !capture {
+			if errors.As(err, &encErr) {
+				t.Fatalf("data captured without CaptureDecodeErrors: %s", err)
+			}
+			continue
+		}
+
+		if !errors.As(err, &encErr) {
+			t.Fatalf("err = %#v, want an EncodingError", err)
+		}
+		if encErr.EncodingType != 0 || encErr.Rect.X != 2 || encErr.Rect.Y != 3 || encErr.Rect.Width != 10 || encErr.Rect.Height != 10 {
+			t.Fatalf("captured encoding %d, rectangle %+v", encErr.EncodingType, encErr.Rect)
+		}
+		if !bytes.Equal(encErr.Data, pixels[:64]) {
+			t.Fatalf("captured data %v, want %v", encErr.Data, pixels[:64])
+		}
+		if !strings.Contains(err.Error(), "Raw rectangle 10x10 at 2,3") || !strings.Contains(err.Error(), "000102") {
+			t.Fatalf("error %q doesn't describe the rectangle and its data", err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package vnc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// The version of the format written by Snapshot.
+const snapshotVersion = 1
+
+// snapshotHeader is the state of a connection saved by Snapshot, other
+// than the colors of the framebuffer, which follow it.
+type snapshotHeader struct {
+	Version           int
+	ProtocolVersion   string
+	DesktopName       string
+	FrameBufferWidth  uint16
+	FrameBufferHeight uint16
+	PixelFormat       PixelFormat
+	ColorMap          [256]Color
+	Encodings         map[int32]EncodingStats
+	Framebuffer       bool
+}
+
+// Snapshot saves the state needed to carry on decoding the updates of the
+// connection elsewhere, such as in another process, or to recover the
+// picture of the desktop after a crash: the pixel format and color map,
+// the dimensions and name of the desktop, the statistics of the encodings
+// seen, and the framebuffer, if it is kept with
+// ClientConfig.KeepFramebuffer. The network connection itself isn't
+// saved. See RestoreSnapshot.
+//
+// As with PixelState, this must not be called while the server may be
+// changing the pixel format or the color map.
+func (c *ClientConn) Snapshot() ([]byte, error) {
+	width, height := c.Dimensions()
+	header := snapshotHeader{
+		Version:           snapshotVersion,
+		ProtocolVersion:   c.protocolVersion,
+		DesktopName:       c.DesktopName,
+		FrameBufferWidth:  width,
+		FrameBufferHeight: height,
+		PixelFormat:       c.PixelFormat,
+		ColorMap:          c.ColorMap,
+		Encodings:         c.Stats().Encodings,
+	}
+
+	c.fbLock.Lock()
+	var colors []Color
+	switch {
+	case c.fb != nil:
+		header.FrameBufferWidth, header.FrameBufferHeight = c.fb.Width, c.fb.Height
+		colors = append(colors, c.fb.Colors...)
+	case c.tiledFB != nil:
+		header.FrameBufferWidth, header.FrameBufferHeight = c.tiledFB.Width, c.tiledFB.Height
+		colors = c.tiledFB.colors(Rectangle{Width: c.tiledFB.Width, Height: c.tiledFB.Height})
+	}
+	c.fbLock.Unlock()
+	header.Framebuffer = colors != nil
+
+	headerData, err := json.Marshal(&header)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 4+len(headerData)+6*len(colors))
+	binary.BigEndian.PutUint32(data, uint32(len(headerData)))
+	copy(data[4:], headerData)
+	pixelData := data[4+len(headerData):]
+	for i, col := range colors {
+		p := pixelData[i*6:]
+		binary.BigEndian.PutUint16(p[0:], col.R)
+		binary.BigEndian.PutUint16(p[2:], col.G)
+		binary.BigEndian.PutUint16(p[4:], col.B)
+	}
+
+	return data, nil
+}
+
+// RestoreSnapshot restores the state saved by Snapshot, possibly of
+// another connection to the same server, so that the updates the server
+// sends from then on are decoded the same way. The framebuffer is
+// restored if this connection keeps one. Nothing is sent to the server,
+// so the server must already be sending pixel data in the saved pixel
+// format. As with RestorePixelState, this must not be called while a
+// FramebufferUpdate is being decoded.
+func (c *ClientConn) RestoreSnapshot(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("invalid snapshot: %d bytes", len(data))
+	}
+
+	headerLength := binary.BigEndian.Uint32(data)
+	if uint64(headerLength) > uint64(len(data)-4) {
+		return fmt.Errorf("invalid snapshot: header of %d bytes in %d bytes", headerLength, len(data))
+	}
+
+	var header snapshotHeader
+	if err := json.Unmarshal(data[4:4+headerLength], &header); err != nil {
+		return fmt.Errorf("invalid snapshot: %s", err)
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+	if err := header.PixelFormat.checkBPP(); err != nil {
+		return fmt.Errorf("invalid snapshot: %s", err)
+	}
+
+	width, height := header.FrameBufferWidth, header.FrameBufferHeight
+	if err := c.checkFramebufferSize(width, height); err != nil {
+		return err
+	}
+
+	var colors []Color
+	if header.Framebuffer {
+		pixelData := data[4+headerLength:]
+		if len(pixelData) != 6*int(width)*int(height) {
+			return fmt.Errorf("invalid snapshot: %d bytes of pixels for a %dx%d framebuffer", len(pixelData), width, height)
+		}
+
+		colors = make([]Color, int(width)*int(height))
+		for i := range colors {
+			p := pixelData[i*6:]
+			colors[i] = Color{
+				R: binary.BigEndian.Uint16(p[0:]),
+				G: binary.BigEndian.Uint16(p[2:]),
+				B: binary.BigEndian.Uint16(p[4:]),
+			}
+		}
+	}
+
+	c.protocolVersion = header.ProtocolVersion
+	c.DesktopName = header.DesktopName
+	c.RestorePixelState(PixelState{PixelFormat: header.PixelFormat, ColorMap: header.ColorMap})
+
+	c.statsLock.Lock()
+	c.encodingStats = make(map[int32]*EncodingStats, len(header.Encodings))
+	for encType, s := range header.Encodings {
+		s := s
+		c.encodingStats[encType] = &s
+	}
+	c.statsLock.Unlock()
+
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	c.FrameBufferWidth, c.FrameBufferHeight = width, height
+	switch {
+	case c.fb != nil:
+		c.fb = NewFramebuffer(width, height)
+		copy(c.fb.Colors, colors)
+	case c.tiledFB != nil:
+		c.tiledFB = NewTiledFramebuffer(width, height, c.tiledFB.TileSize)
+		if colors != nil {
+			c.tiledFB.paint(&Rectangle{Width: width, Height: height}, colors)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package vnc
+
+import "testing"
+
+func TestClientConn_Snapshot(t *testing.T) {
+	source, server := newTestClientConn(&ClientConfig{KeepFramebuffer: true})
+	server.Close()
+
+	source.DesktopName = "desktop"
+	source.FrameBufferWidth, source.FrameBufferHeight = 8, 4
+	source.PixelFormat = testPixelFormat
+	source.fb = NewFramebuffer(8, 4)
+	source.recordDecode(0, 0, 48, 48)
+
+	update := &FramebufferUpdateMessage{Rectangles: []Rectangle{
+		{X: 1, Y: 1, Width: 2, Height: 2, Enc: &RawEncoding{
+			Colors: []Color{rgb(1, 2, 3), rgb(4, 5, 6), rgb(7, 8, 9), rgb(10, 11, 12)},
+		}},
+	}}
+	if err := source.handleFramebufferUpdate(update); err != nil {
+		t.Fatalf("error handling update: %s", err)
+	}
+
+	snapshot, err := source.Snapshot()
+	if err != nil {
+		t.Fatalf("error taking snapshot: %s", err)
+	}
+
+	for _, tileSize := range []uint16{0, 4} {
+		restored, server := newTestClientConn(&ClientConfig{KeepFramebuffer: true, FramebufferTileSize: tileSize})
+		server.Close()
+		if tileSize > 0 {
+			restored.tiledFB = NewTiledFramebuffer(1, 1, tileSize)
+		} else {
+			restored.fb = NewFramebuffer(1, 1)
+		}
+
+		if err := restored.RestoreSnapshot(snapshot); err != nil {
+			t.Fatalf("tile size %d: error restoring snapshot: %s", tileSize, err)
+		}
+
+		if restored.PixelFormat != source.PixelFormat || restored.ColorMap != source.ColorMap {
+			t.Fatalf("tile size %d: pixel state not restored", tileSize)
+		}
+		if width, height := restored.Dimensions(); width != 8 || height != 4 {
+			t.Fatalf("tile size %d: dimensions are %dx%d, want 8x4", tileSize, width, height)
+		}
+		if restored.DesktopName != "desktop" {
+			t.Fatalf("tile size %d: DesktopName = %q", tileSize, restored.DesktopName)
+		}
+		if seen := restored.EncodingsSeen(); len(seen) != 1 || seen[0] != 0 {
+			t.Fatalf("tile size %d: EncodingsSeen = %v, want [0]", tileSize, seen)
+		}
+
+		// Both connections render further updates the same way.
+		copyRect := &FramebufferUpdateMessage{Rectangles: []Rectangle{
+			{X: 5, Y: 2, Width: 2, Height: 2, Enc: &CopyRectEncoding{SrcX: 1, SrcY: 1}},
+		}}
+		for _, conn := range []*ClientConn{source, restored} {
+			if err := conn.handleFramebufferUpdate(copyRect); err != nil {
+				t.Fatalf("tile size %d: error handling update: %s", tileSize, err)
+			}
+		}
+
+		var fb *Framebuffer
+		if tileSize > 0 {
+			fb = NewFramebuffer(8, 4)
+			fb.Colors = restored.tiledFB.colors(Rectangle{Width: 8, Height: 4})
+		} else {
+			fb = restored.Framebuffer()
+		}
+		if actual, expected := fb.Checksum(), source.Framebuffer().Checksum(); actual != expected {
+			t.Fatalf("tile size %d: restored checksum %x, want %x", tileSize, actual, expected)
+		}
+	}
+
+	if err := new(ClientConn).RestoreSnapshot(snapshot[:10]); err == nil {
+		t.Fatal("no error restoring a truncated snapshot")
+	}
+}
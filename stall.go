@@ -0,0 +1,74 @@
+package vnc
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrUpdateStalled is passed to ClientConfig.OnDisconnected when the
+// connection was closed because the server didn't answer a
+// FramebufferUpdateRequest in time. See ClientConfig.UpdateStallTimeout.
+var ErrUpdateStalled = errors.New("framebuffer update stalled")
+
+// updateRequested starts the stall timer, unless it is already running
+// for an earlier request.
+func (c *ClientConn) updateRequested() {
+	if c.config == nil || c.config.UpdateStallTimeout <= 0 {
+		return
+	}
+
+	c.stallLock.Lock()
+	defer c.stallLock.Unlock()
+
+	if c.stallTimer == nil {
+		c.stallID++
+		id := c.stallID
+		c.stallTimer = time.AfterFunc(c.config.UpdateStallTimeout, func() {
+			c.updateStalled(id)
+		})
+	}
+}
+
+// updateReceived stops the stall timer, since the server has answered.
+func (c *ClientConn) updateReceived() {
+	c.stallLock.Lock()
+	defer c.stallLock.Unlock()
+
+	if c.stallTimer != nil {
+		c.stallTimer.Stop()
+		c.stallTimer = nil
+	}
+}
+
+// updateStalled is called when the stall timer with the given id fires
+// without an update having been received.
+func (c *ClientConn) updateStalled(id uint64) {
+	c.stallLock.Lock()
+	if c.stallTimer == nil || c.stallID != id {
+		// An update arrived as the timer fired.
+		c.stallLock.Unlock()
+		return
+	}
+	c.stallTimer = nil
+	c.stallLock.Unlock()
+
+	c.logf("no framebuffer update received within %s of a request", c.config.UpdateStallTimeout)
+
+	if c.config.OnStall != nil {
+		c.config.OnStall()
+	}
+
+	if !c.config.CloseOnStall {
+		return
+	}
+
+	c.closeLock.Lock()
+	if c.closed {
+		c.closeLock.Unlock()
+		return
+	}
+	c.stalled = true
+	c.closeLock.Unlock()
+
+	c.c.Close()
+}
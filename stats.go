@@ -0,0 +1,330 @@
+package vnc
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// EncodingStats are statistics about the rectangles received in a single
+// encoding.
+type EncodingStats struct {
+	// Number of rectangles decoded.
+	Rectangles uint64
+
+	// Total and longest wall-clock time spent decoding a rectangle.
+	DecodeTime    time.Duration
+	MaxDecodeTime time.Duration
+
+	// Bytes of rectangle data received, not counting the headers of the
+	// rectangles, and the size of the pixels they decoded to, in the
+	// pixel format of the connection. Pseudo-encodings don't decode to
+	// any pixels.
+	BytesReceived uint64
+	DecodedBytes  uint64
+}
+
+// MeanDecodeTime returns the average time spent decoding a rectangle.
+func (s EncodingStats) MeanDecodeTime() time.Duration {
+	if s.Rectangles == 0 {
+		return 0
+	}
+
+	return s.DecodeTime / time.Duration(s.Rectangles)
+}
+
+// CompressionRatio returns DecodedBytes divided by BytesReceived, which
+// is how many times smaller the data received is than the pixels it
+// decoded to, or 0 if nothing has been received.
+func (s EncodingStats) CompressionRatio() float64 {
+	return compressionRatio(s.DecodedBytes, s.BytesReceived)
+}
+
+func compressionRatio(decoded, received uint64) float64 {
+	if received == 0 {
+		return 0
+	}
+
+	return float64(decoded) / float64(received)
+}
+
+// Stats are statistics about a connection, as returned by
+// ClientConn.Stats.
+type Stats struct {
+	// Statistics for each encoding received, keyed by encoding type.
+	Encodings map[int32]EncodingStats
+
+	// The encoding type with the highest mean decode time, which is
+	// only meaningful if Encodings isn't empty.
+	SlowestEncoding int32
+
+	// The mean time the server has recently taken to answer a
+	// FramebufferUpdateRequest. See ClientConn.ServerResponseTime.
+	ServerResponseTime time.Duration
+}
+
+// Stats returns a snapshot of the statistics gathered for the connection.
+func (c *ClientConn) Stats() Stats {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	result := Stats{
+		Encodings:          make(map[int32]EncodingStats, len(c.encodingStats)),
+		ServerResponseTime: c.serverResponseTime(),
+	}
+
+	var slowest time.Duration
+	for encType, s := range c.encodingStats {
+		result.Encodings[encType] = *s
+
+		if mean := s.MeanDecodeTime(); mean >= slowest {
+			slowest = mean
+			result.SlowestEncoding = encType
+		}
+	}
+
+	return result
+}
+
+// EncodingsSeen returns the types of all of the encodings and
+// pseudo-encodings that have appeared in rectangles received from the
+// server, in ascending order. This tells which of the encodings sent
+// using SetEncodings the server actually uses.
+func (c *ClientConn) EncodingsSeen() []int32 {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	seen := make([]int32, 0, len(c.encodingStats))
+	for encType := range c.encodingStats {
+		seen = append(seen, encType)
+	}
+
+	sort.Slice(seen, func(i, j int) bool { return seen[i] < seen[j] })
+	return seen
+}
+
+// CompressionRatio returns the size of the pixels decoded from all of the
+// rectangles received, divided by the size of their data, across all
+// encodings. This tells how well compression works on the connection.
+// See EncodingStats.CompressionRatio for each encoding.
+func (c *ClientConn) CompressionRatio() float64 {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	var decoded, received uint64
+	for _, s := range c.encodingStats {
+		decoded += s.DecodedBytes
+		received += s.BytesReceived
+	}
+
+	return compressionRatio(decoded, received)
+}
+
+// The number of response times ServerResponseTime averages.
+const responseTimeWindow = 16
+
+// ServerResponseTime returns the mean time the server took to answer the
+// last few FramebufferUpdateRequests, from sending a request until the
+// update answering it starts to arrive, or 0 before any has been
+// answered. Unlike the round trip time measured by Ping, this includes
+// the time the server takes to prepare the update. Requests sent while
+// one is still unanswered are taken to be answered by the same update,
+// and updates sent without a request, such as continuous updates, aren't
+// counted.
+func (c *ClientConn) ServerResponseTime() time.Duration {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	return c.serverResponseTime()
+}
+
+// serverResponseTime is ServerResponseTime, with statsLock held.
+func (c *ClientConn) serverResponseTime() time.Duration {
+	n := minInt(c.responses, responseTimeWindow)
+	if n == 0 {
+		return 0
+	}
+
+	var total time.Duration
+	for _, d := range c.responseTimes[:n] {
+		total += d
+	}
+
+	return total / time.Duration(n)
+}
+
+// recordRequest records the time a FramebufferUpdateRequest is sent, if
+// msgs, which are about to be written, include one.
+func (c *ClientConn) recordRequest(msgs []ClientMessage) {
+	for _, msg := range msgs {
+		if _, ok := msg.(*FramebufferUpdateRequestMessage); !ok {
+			continue
+		}
+
+		c.statsLock.Lock()
+		if c.requestSent.IsZero() {
+			c.requestSent = time.Now()
+		}
+		c.statsLock.Unlock()
+		return
+	}
+}
+
+// TimeToFirstFrame returns the time from the start of connecting to the
+// server, when Dial or Client was called, to when the first
+// FramebufferUpdate had been decoded, which covers the handshake and the
+// time the server took to paint the screen. It is zero until then.
+func (c *ClientConn) TimeToFirstFrame() time.Duration {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	return c.firstFrame
+}
+
+// recordFirstFrame records the time to the first FramebufferUpdate, if
+// it hasn't been recorded yet.
+func (c *ClientConn) recordFirstFrame() {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	if c.firstFrame != 0 || c.connectStarted.IsZero() {
+		return
+	}
+
+	c.firstFrame = time.Since(c.connectStarted)
+}
+
+// recordResponse records that a FramebufferUpdate has started to arrive,
+// answering the requests sent since the last one.
+func (c *ClientConn) recordResponse() {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	if c.requestSent.IsZero() {
+		return
+	}
+
+	c.responseTimes[c.responses%responseTimeWindow] = time.Since(c.requestSent)
+	c.responses++
+	c.requestSent = time.Time{}
+}
+
+// recordDecode records the time spent decoding a single rectangle, and
+// the number of bytes it was received and decoded as.
+func (c *ClientConn) recordDecode(encType int32, d time.Duration, received, decoded uint64) {
+	c.statsLock.Lock()
+	first := c.addDecode(encType, d, received, decoded)
+	c.statsLock.Unlock()
+
+	// Logging the first rectangle of each encoding shows which of the
+	// encodings sent using SetEncodings the server picked, without
+	// logging every rectangle.
+	if first {
+		c.logf("first %s rectangle decoded", EncodingName(encType))
+	}
+}
+
+// addDecode adds a decoded rectangle to the statistics, and reports
+// whether it is the first one of its encoding. statsLock must be held.
+func (c *ClientConn) addDecode(encType int32, d time.Duration, received, decoded uint64) bool {
+	if c.encodingStats == nil {
+		c.encodingStats = make(map[int32]*EncodingStats)
+	}
+
+	s, ok := c.encodingStats[encType]
+	if !ok {
+		s = new(EncodingStats)
+		c.encodingStats[encType] = s
+	}
+
+	s.Rectangles++
+	s.DecodeTime += d
+	if d > s.MaxDecodeTime {
+		s.MaxDecodeTime = d
+	}
+	s.BytesReceived += received
+	s.DecodedBytes += decoded
+
+	return !ok
+}
+
+// The number of updates with pixel data checkEncodingFallback looks at
+// before deciding whether the server falls back from the preferred
+// encoding.
+const fallbackUpdates = 3
+
+// checkEncodingFallback counts the real encodings used by an update, and
+// once enough updates have been counted, calls OnEncodingFallback if
+// none of them used the preferred encoding.
+func (c *ClientConn) checkEncodingFallback(update *FramebufferUpdateMessage) {
+	if c.config.OnEncodingFallback == nil {
+		return
+	}
+
+	copyRectType := new(CopyRectEncoding).Type()
+	preferred, ok := int32(0), false
+	for _, enc := range c.Encs {
+		if encType := enc.Type(); !isPseudoEncoding(encType) && encType != copyRectType {
+			preferred, ok = encType, true
+			break
+		}
+	}
+	if !ok {
+		return
+	}
+
+	c.statsLock.Lock()
+	if c.fallbackChecked {
+		c.statsLock.Unlock()
+		return
+	}
+
+	counted := false
+	for _, rect := range update.Rectangles {
+		encType := rect.Enc.Type()
+		if isPseudoEncoding(encType) || encType == copyRectType {
+			continue
+		}
+
+		if c.fallbackCounts == nil {
+			c.fallbackCounts = make(map[int32]int)
+		}
+		c.fallbackCounts[encType]++
+		counted = true
+	}
+	if counted {
+		c.fallbackUpdates++
+	}
+
+	if c.fallbackUpdates < fallbackUpdates {
+		c.statsLock.Unlock()
+		return
+	}
+	c.fallbackChecked = true
+
+	_, used := c.fallbackCounts[preferred]
+	var actual int32
+	most := 0
+	for encType, n := range c.fallbackCounts {
+		if n > most || n == most && encType < actual {
+			actual, most = encType, n
+		}
+	}
+	c.statsLock.Unlock()
+
+	if !used {
+		c.config.OnEncodingFallback(preferred, actual)
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += uint64(n)
+	return n, err
+}
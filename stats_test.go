@@ -0,0 +1,334 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClientConn_StatsDecodeTime(t *testing.T) {
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+	}
+
+	data := []byte{
+		0,    // Padding
+		0, 1, // Number of rectangles
+		0, 0, 0, 0, 0, 2, 0, 1, // 2x1 at 0,0
+		0, 0, 0, 0, // Raw
+		1, 2, 3, 0,
+		4, 5, 6, 0,
+	}
+
+	if _, err := new(FramebufferUpdateMessage).Read(conn, bytes.NewReader(data)); err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+
+	stats := conn.Stats()
+	raw, ok := stats.Encodings[0]
+	if !ok {
+		t.Fatal("no statistics recorded for the Raw encoding")
+	}
+	if raw.Rectangles != 1 {
+		t.Fatalf("Rectangles = %d, want 1", raw.Rectangles)
+	}
+	if raw.DecodeTime <= 0 || raw.MaxDecodeTime != raw.DecodeTime {
+		t.Fatalf("unexpected decode times: %#v", raw)
+	}
+	if stats.SlowestEncoding != 0 {
+		t.Fatalf("SlowestEncoding = %d, want 0", stats.SlowestEncoding)
+	}
+}
+
+func TestClientConn_EncodingsSeen(t *testing.T) {
+	conn := &ClientConn{
+		Encs:              []Encoding{new(ZlibEncoding)},
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+		PixelFormat:       testPixelFormat,
+	}
+
+	if seen := conn.EncodingsSeen(); len(seen) != 0 {
+		t.Fatalf("EncodingsSeen = %v before any update", seen)
+	}
+
+	chunk := zlibChunks(t, "\x01\x02\x03\x00")[0]
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 1})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 1, 1})
+	binary.Write(&buf, binary.BigEndian, int32(6))
+	binary.Write(&buf, binary.BigEndian, uint32(len(chunk)))
+	buf.Write(chunk)
+
+	if _, err := new(FramebufferUpdateMessage).Read(conn, &buf); err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+
+	if seen := conn.EncodingsSeen(); len(seen) != 1 || seen[0] != 6 {
+		t.Fatalf("EncodingsSeen = %v, want [6]", seen)
+	}
+}
+
+func TestClientConn_CompressionRatio(t *testing.T) {
+	conn := &ClientConn{
+		Encs:              []Encoding{new(TightEncoding)},
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+		PixelFormat:       testPixelFormat,
+	}
+
+	if ratio := conn.CompressionRatio(); ratio != 0 {
+		t.Fatalf("CompressionRatio = %v before any update", ratio)
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 2})
+
+	// 8 bytes of raw pixels, and a 4x4 fill of 64 bytes sent as 4.
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 2, 1})
+	binary.Write(&buf, binary.BigEndian, int32(0))
+	buf.Write([]byte{1, 2, 3, 0, 4, 5, 6, 0})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 1, 4, 4})
+	binary.Write(&buf, binary.BigEndian, int32(7))
+	buf.Write([]byte{0x80, 1, 2, 3})
+
+	if _, err := new(FramebufferUpdateMessage).Read(conn, &buf); err != nil {
+		t.Fatalf("error reading update: %s", err)
+	}
+
+	stats := conn.Stats()
+	tests := []struct {
+		encType  int32
+		received uint64
+		decoded  uint64
+		ratio    float64
+	}{
+		{0, 8, 8, 1},
+		{7, 4, 64, 16},
+	}
+	for _, tt := range tests {
+		s := stats.Encodings[tt.encType]
+		if s.BytesReceived != tt.received || s.DecodedBytes != tt.decoded {
+			t.Fatalf("encoding %d: received %d and decoded %d bytes, want %d and %d",
+				tt.encType, s.BytesReceived, s.DecodedBytes, tt.received, tt.decoded)
+		}
+		if ratio := s.CompressionRatio(); ratio != tt.ratio {
+			t.Fatalf("encoding %d: CompressionRatio = %v, want %v", tt.encType, ratio, tt.ratio)
+		}
+	}
+
+	if ratio := conn.CompressionRatio(); ratio != 6 {
+		t.Fatalf("CompressionRatio = %v, want 6", ratio)
+	}
+}
+
+func TestClientConn_ServerResponseTime(t *testing.T) {
+	msgCh := make(chan ServerMessage, 1)
+	conn, server := newTestClientConn(&ClientConfig{ServerMessageCh: msgCh})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 640
+	conn.FrameBufferHeight = 480
+	conn.PixelFormat = testPixelFormat
+
+	go conn.mainLoop()
+
+	if d := conn.ServerResponseTime(); d != 0 {
+		t.Fatalf("ServerResponseTime = %s before any request", d)
+	}
+
+	const delay = 50 * time.Millisecond
+	receive := func() {
+		select {
+		case <-msgCh:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for update")
+		}
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.FramebufferUpdateRequest(true, 0, 0, 640, 480)
+	}()
+	expectUpdateRequest(t, server, true, 0, 0, 640, 480)
+	if err := <-errCh; err != nil {
+		t.Fatalf("error requesting update: %s", err)
+	}
+
+	time.Sleep(delay)
+	server.Write([]byte{0, 0, 0, 0})
+	receive()
+
+	measured := conn.ServerResponseTime()
+	if measured < delay {
+		t.Fatalf("ServerResponseTime = %s, want at least %s", measured, delay)
+	}
+
+	// An update that wasn't requested isn't a response.
+	server.Write([]byte{0, 0, 0, 0})
+	receive()
+
+	if d := conn.Stats().ServerResponseTime; d != measured {
+		t.Fatalf("Stats().ServerResponseTime = %s, want %s", d, measured)
+	}
+}
+
+func TestClientConn_FirstRectangleLogged(t *testing.T) {
+	var logged []string
+	conn := &ClientConn{
+		config: &ClientConfig{
+			Logf: func(format string, v ...interface{}) {
+				logged = append(logged, fmt.Sprintf(format, v...))
+			},
+		},
+		Encs:              []Encoding{new(CopyRectEncoding)},
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+		PixelFormat:       testPixelFormat,
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < 2; i++ {
+		buf.Write([]byte{0, 0, 4})
+		for j := 0; j < 2; j++ {
+			binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 1, 1})
+			binary.Write(&buf, binary.BigEndian, int32(0))
+			buf.Write([]byte{1, 2, 3, 0})
+
+			binary.Write(&buf, binary.BigEndian, []uint16{1, 1, 1, 1})
+			binary.Write(&buf, binary.BigEndian, int32(1))
+			binary.Write(&buf, binary.BigEndian, []uint16{0, 0})
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := new(FramebufferUpdateMessage).Read(conn, &buf); err != nil {
+			t.Fatalf("error reading update: %s", err)
+		}
+	}
+
+	expected := []string{"vnc: first Raw rectangle decoded", "vnc: first CopyRect rectangle decoded"}
+	if !reflect.DeepEqual(logged, expected) {
+		t.Fatalf("logged %q, want %q", logged, expected)
+	}
+}
+
+func TestClientConn_OnEncodingFallback(t *testing.T) {
+	type fallback struct{ preferred, actual int32 }
+
+	fallbacks := make(chan fallback, 2)
+	msgCh := make(chan ServerMessage, 8)
+	conn, server := newTestClientConn(&ClientConfig{
+		ServerMessageCh: msgCh,
+		OnEncodingFallback: func(preferred, actual int32) {
+			fallbacks <- fallback{preferred, actual}
+		},
+	})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 64
+	conn.FrameBufferHeight = 64
+	conn.PixelFormat = testPixelFormat
+
+	// ZRLE is preferred, after CopyRect, which doesn't count.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.SetEncodings([]Encoding{
+			new(CopyRectEncoding),
+			&UnsupportedEncoding{EncodingType: 16},
+			new(RawEncoding),
+			new(DesktopSizePseudoEncoding),
+		})
+	}()
+	if _, err := ReadClientMessage(server, nil); err != nil {
+		t.Fatalf("error reading SetEncodings: %s", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("error setting encodings: %s", err)
+	}
+
+	go conn.mainLoop()
+
+	// The server ignores ZRLE and sends Raw. Empty updates don't count.
+	for i := 0; i < fallbackUpdates; i++ {
+		select {
+		case f := <-fallbacks:
+			t.Fatalf("fallback %v reported after %d updates", f, i)
+		default:
+		}
+
+		server.Write([]byte{0, 0, 0, 0})
+		writeRawUpdate(t, server, 0, 0, 1, 1, rgb(1, 2, 3))
+		<-msgCh
+		<-msgCh
+	}
+
+	select {
+	case f := <-fallbacks:
+		if expected := (fallback{16, 0}); f != expected {
+			t.Fatalf("fallback = %v, want %v", f, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fallback not reported")
+	}
+
+	// The fallback is only reported once.
+	writeRawUpdate(t, server, 0, 0, 1, 1, rgb(1, 2, 3))
+	<-msgCh
+	select {
+	case f := <-fallbacks:
+		t.Fatalf("fallback %v reported again", f)
+	default:
+	}
+}
+
+func TestClientConn_TimeToFirstFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		// The server takes a while to answer.
+		time.Sleep(20 * time.Millisecond)
+		errCh <- serveTestHandshake(server, []uint8{1}, nil)
+	}()
+
+	msgCh := make(chan ServerMessage, 2)
+	started := time.Now()
+	conn, err := Client(client, &ClientConfig{ServerMessageCh: msgCh})
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer conn.Close()
+	if err := <-errCh; err != nil {
+		t.Fatalf("error in mock server: %s", err)
+	}
+
+	if d := conn.TimeToFirstFrame(); d != 0 {
+		t.Fatalf("TimeToFirstFrame = %s before any update", d)
+	}
+
+	writeRawUpdate(t, server, 0, 0, 1, 1, rgb(1, 2, 3))
+	<-msgCh
+	elapsed := time.Since(started)
+
+	first := conn.TimeToFirstFrame()
+	if first < 20*time.Millisecond || first > elapsed {
+		t.Fatalf("TimeToFirstFrame = %s, want between 20ms and %s", first, elapsed)
+	}
+
+	// Later updates don't change it.
+	time.Sleep(10 * time.Millisecond)
+	writeRawUpdate(t, server, 0, 0, 1, 1, rgb(1, 2, 3))
+	<-msgCh
+	if d := conn.TimeToFirstFrame(); d != first {
+		t.Fatalf("TimeToFirstFrame = %s after the second update, want %s", d, first)
+	}
+}
@@ -0,0 +1,66 @@
+package vnc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSpecViolation is wrapped by the errors returned with
+// ClientConfig.StrictMode for server behavior that is tolerated
+// otherwise.
+var ErrSpecViolation = errors.New("server violates the RFB protocol")
+
+// strict reports whether ClientConfig.StrictMode is set.
+func (c *ClientConn) strict() bool {
+	return c.config != nil && c.config.StrictMode
+}
+
+// advertised reports whether an encoding type was sent with SetEncodings.
+func (c *ClientConn) advertised(encType int32) bool {
+	for _, enc := range c.Encs {
+		if enc.Type() == encType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkNegotiated fails, in StrictMode, for a message of an extension
+// that the client hasn't announced support for with its pseudo-encoding.
+// UltraVNC messages are never negotiated, and TightVNC file transfer
+// messages are only expected during a file transfer. Messages set in
+// ClientConfig.ServerMessages aren't checked.
+func (c *ClientConn) checkNegotiated(msg ServerMessage) error {
+	if !c.strict() {
+		return nil
+	}
+
+	var required Encoding
+	switch msg.(type) {
+	case *UltraVNCFileTransferMessage, *UltraVNCTextChatMessage:
+		return fmt.Errorf("%w: UltraVNC message type %d", ErrSpecViolation, msg.Type())
+	case *FileListDataMessage, *FileDownloadDataMessage, *FileDownloadFailedMessage:
+		if !c.fileTransferActive() {
+			return fmt.Errorf("%w: file transfer message type %d outside of a file transfer", ErrSpecViolation, msg.Type())
+		}
+		return nil
+	case *FenceMessage:
+		required = new(FencePseudoEncoding)
+	case *EndOfContinuousUpdatesMessage:
+		required = new(ContinuousUpdatesPseudoEncoding)
+	case *GIIServerMessage:
+		required = new(GIIPseudoEncoding)
+	case *QEMUAudioMessage:
+		required = new(QEMUAudioPseudoEncoding)
+	default:
+		return nil
+	}
+
+	if !c.advertised(required.Type()) {
+		return fmt.Errorf("%w: message type %d without %s having been sent with SetEncodings",
+			ErrSpecViolation, msg.Type(), EncodingName(required.Type()))
+	}
+
+	return nil
+}
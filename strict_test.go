@@ -0,0 +1,70 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClientConfig_StrictMode(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		conn := &ClientConn{
+			config:            &ClientConfig{StrictMode: strict},
+			FrameBufferWidth:  16,
+			FrameBufferHeight: 16,
+			PixelFormat:       testPixelFormat,
+		}
+
+		// A CopyRect from outside of the framebuffer.
+		_, err := new(CopyRectEncoding).Read(conn, &Rectangle{Width: 4, Height: 4}, bytes.NewReader([]byte{0, 14, 0, 0}))
+		if strict != errors.Is(err, ErrSpecViolation) || !strict && err != nil {
+			t.Fatalf("strict %v: CopyRect err = %v", strict, err)
+		}
+
+		// Colors beyond the end of the color map.
+		conn.PixelFormat = PixelFormat{BPP: 8, Depth: 8}
+		var data bytes.Buffer
+		binary.Write(&data, binary.BigEndian, []uint16{0, 255, 2})
+		binary.Write(&data, binary.BigEndian, make([]uint16, 6))
+		_, err = new(SetColorMapEntriesMessage).Read(conn, bytes.NewReader(data.Bytes()[1:]))
+		if strict != errors.Is(err, ErrSpecViolation) || !strict && err != nil {
+			t.Fatalf("strict %v: SetColorMapEntries err = %v", strict, err)
+		}
+	}
+}
+
+func TestClientConfig_StrictModeMessages(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		msgCh := make(chan ServerMessage, 1)
+		disconnected := make(chan error, 1)
+		conn, server := newTestClientConn(&ClientConfig{
+			StrictMode:      strict,
+			ServerMessageCh: msgCh,
+			OnDisconnected:  func(err error) { disconnected <- err },
+		})
+
+		go conn.mainLoop()
+
+		// A fence, without FencePseudoEncoding having been sent.
+		var fence bytes.Buffer
+		(&FenceMessage{Flags: FenceBlockBefore}).Serialize(&fence)
+		server.Write(fence.Bytes())
+
+		select {
+		case msg := <-msgCh:
+			if strict {
+				t.Fatalf("received %T in strict mode", msg)
+			}
+		case err := <-disconnected:
+			if !strict || !errors.Is(err, ErrSpecViolation) {
+				t.Fatalf("strict %v: disconnected with %v", strict, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("strict %v: fence neither received nor rejected", strict)
+		}
+
+		server.Close()
+	}
+}
@@ -0,0 +1,513 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// TightEncoding is pixel data compressed using the Tight encoding, which
+// combines zlib compression, palettes, gradients and JPEG.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#tight-encoding
+type TightEncoding struct {
+	Colors []Color
+
+	// If ClientConfig.TightYCbCr is set, Image holds the decoded image
+	// of a JPEG rectangle, and Colors is nil. This is nil for the other
+	// kinds of rectangles, and for JPEG images that the decoder doesn't
+	// return as YCbCr, such as grayscale images.
+	//
+	// Both are nil for a JPEG rectangle that couldn't be decoded, which
+	// leaves the rectangle unchanged until the full update requested in
+	// its place arrives.
+	Image *image.YCbCr
+
+	// If ClientConfig.TightRawJPEG is set, JPEG holds the data of a JPEG
+	// rectangle exactly as the server sent it, and both Colors and Image
+	// are nil. The data is a complete JPEG image of the size of the
+	// rectangle, which the client hasn't checked or decoded.
+	JPEG []byte
+}
+
+func (*TightEncoding) Type() int32 {
+	return 7
+}
+
+func (*TightEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	colors, img, jpegData, err := c.readTight(rect, r, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TightEncoding{Colors: colors, Image: img, JPEG: jpegData}, nil
+}
+
+// TightPNGEncoding is the TightPNG variant of the Tight encoding, which
+// uses PNG in place of basic compression for lossless rectangles.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#tightpng-encoding
+type TightPNGEncoding struct {
+	Colors []Color
+
+	// Image holds the decoded image of a JPEG rectangle, as with
+	// TightEncoding.Image, and JPEG its data, as with TightEncoding.JPEG.
+	Image *image.YCbCr
+	JPEG  []byte
+}
+
+func (*TightPNGEncoding) Type() int32 {
+	return -260
+}
+
+func (*TightPNGEncoding) Read(c *ClientConn, rect *Rectangle, r io.Reader) (Encoding, error) {
+	colors, img, jpegData, err := c.readTight(rect, r, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TightPNGEncoding{Colors: colors, Image: img, JPEG: jpegData}, nil
+}
+
+// The compression types of the compression control byte, following the
+// stream reset bits. Types below tightFill are basic compression.
+const (
+	tightFill = 8
+	tightJPEG = 9
+	tightPNG  = 10
+)
+
+// Filters of basic compression.
+const (
+	tightFilterCopy     = 0
+	tightFilterPalette  = 1
+	tightFilterGradient = 2
+)
+
+// tightMinToCompress is the size below which basic compression sends
+// data without zlib.
+const tightMinToCompress = 12
+
+// readTight reads a Tight or, if pngVariant is true, TightPNG rectangle.
+// JPEG rectangles are returned as a YCbCr image if ClientConfig.TightYCbCr
+// is set, or as their undecoded data if ClientConfig.TightRawJPEG is set.
+func (c *ClientConn) readTight(rect *Rectangle, r io.Reader, pngVariant bool) ([]Color, *image.YCbCr, []byte, error) {
+	if err := c.checkRectangle(rect); err != nil {
+		return nil, nil, nil, err
+	}
+
+	var control uint8
+	if err := binary.Read(r, binary.BigEndian, &control); err != nil {
+		return nil, nil, nil, err
+	}
+
+	c.resetTightStreams(control)
+
+	pixels := int(rect.Width) * int(rect.Height)
+	switch compression := control >> 4; {
+	case compression == tightFill:
+		fill := make([]Color, 1)
+		if err := c.readTightPixels(fill, r); err != nil {
+			return nil, nil, nil, err
+		}
+
+		colors := c.colorBuffer(pixels)
+		for i := range colors {
+			colors[i] = fill[0]
+		}
+
+		return colors, nil, nil, nil
+	case compression == tightJPEG && c.config != nil && c.config.TightRawJPEG:
+		jpegData, err := c.readTightJPEGData(r)
+		return nil, nil, jpegData, err
+	case compression == tightJPEG:
+		img, err := c.readTightImage(rect, r, jpeg.Decode)
+		if _, ok := err.(tightDecodeError); ok {
+			// The image data has been read, so the stream is still in
+			// sync. The Go decoder doesn't handle every kind of JPEG,
+			// such as arithmetic coded ones, so ask for the region
+			// again instead of giving up on the connection.
+			c.logf("error decoding tight JPEG rectangle %dx%d at %d,%d, requesting a full update: %s",
+				rect.Width, rect.Height, rect.X, rect.Y, err)
+			c.requestRefresh()
+			return nil, nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if ycbcr, ok := img.(*image.YCbCr); ok && c.config != nil && c.config.TightYCbCr {
+			return nil, ycbcr, nil, nil
+		}
+
+		return c.tightImageColors(img), nil, nil, nil
+	case compression == tightPNG && pngVariant:
+		img, err := c.readTightImage(rect, r, png.Decode)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		return c.tightImageColors(img), nil, nil, nil
+	case compression < tightFill && !pngVariant:
+		colors, err := c.readTightBasic(rect, r, compression)
+		return colors, nil, nil, err
+	default:
+		return nil, nil, nil, fmt.Errorf("invalid tight compression control: %#x", control)
+	}
+}
+
+// readTightBasic reads a rectangle using basic compression.
+func (c *ClientConn) readTightBasic(rect *Rectangle, r io.Reader, compression uint8) ([]Color, error) {
+	stream := &c.tightStreams[compression&0x3]
+
+	filter := uint8(tightFilterCopy)
+	if compression&0x4 != 0 {
+		if err := binary.Read(r, binary.BigEndian, &filter); err != nil {
+			return nil, err
+		}
+	}
+
+	width, height := int(rect.Width), int(rect.Height)
+	pixelSize := c.tightPixelSize()
+
+	var palette []Color
+	var dataLength int
+	switch filter {
+	case tightFilterCopy, tightFilterGradient:
+		dataLength = width * height * pixelSize
+	case tightFilterPalette:
+		var numColors uint8
+		if err := binary.Read(r, binary.BigEndian, &numColors); err != nil {
+			return nil, err
+		}
+
+		palette = make([]Color, int(numColors)+1)
+		if err := c.readTightPixels(palette, r); err != nil {
+			return nil, err
+		}
+
+		if len(palette) == 2 {
+			dataLength = (width + 7) / 8 * height
+		} else {
+			dataLength = width * height
+		}
+	default:
+		return nil, fmt.Errorf("invalid tight filter: %d", filter)
+	}
+
+	data := c.pixelBuffer(dataLength)
+	if dataLength < tightMinToCompress {
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+	} else {
+		length, err := readCompactLength(r)
+		if err != nil {
+			return nil, err
+		}
+
+		zr, err := stream.read(r, length, c.zlibBufferSize())
+		if err != nil {
+			return nil, err
+		}
+
+		lr := c.limitDecompressed(rect, stream, zr)
+		if _, err := io.ReadFull(lr, data); err != nil {
+			return nil, err
+		}
+		if err := lr.finish(); err != nil {
+			return nil, err
+		}
+	}
+
+	colors := c.colorBuffer(width * height)
+	switch filter {
+	case tightFilterCopy:
+		if err := c.decodeTightPixels(colors, data); err != nil {
+			return nil, err
+		}
+	case tightFilterGradient:
+		if err := c.decodeTightGradient(colors, data, width); err != nil {
+			return nil, err
+		}
+	case tightFilterPalette:
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				var index int
+				if len(palette) == 2 {
+					row := data[y*((width+7)/8):]
+					index = int(row[x/8]>>(7-uint(x%8))) & 1
+				} else {
+					index = int(data[y*width+x])
+				}
+
+				if index >= len(palette) {
+					return nil, fmt.Errorf("tight palette index out of range: %d", index)
+				}
+
+				colors[y*width+x] = palette[index]
+			}
+		}
+	}
+
+	return colors, nil
+}
+
+// readTightImage reads a rectangle sent as a JPEG or PNG image.
+func (c *ClientConn) readTightImage(rect *Rectangle, r io.Reader, decode func(io.Reader) (image.Image, error)) (image.Image, error) {
+	if !c.PixelFormat.TrueColor {
+		return nil, fmt.Errorf("tight image data requires a true color pixel format")
+	}
+
+	length, err := readCompactLength(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data := c.pixelBuffer(length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	// The image decoders reject images without pixels.
+	if rect.empty() {
+		return image.NewNRGBA(image.Rectangle{}), nil
+	}
+
+	// Check the size of the image before decoding it, since the decoders
+	// allocate memory for the size claimed in the image header.
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, tightDecodeError{err}
+	}
+
+	if config.Width != int(rect.Width) || config.Height != int(rect.Height) {
+		return nil, fmt.Errorf("tight image is %dx%d, want %dx%d",
+			config.Width, config.Height, rect.Width, rect.Height)
+	}
+
+	img, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, tightDecodeError{err}
+	}
+
+	return img, nil
+}
+
+// readTightJPEGData reads the data of a JPEG rectangle without decoding
+// it, into a slice of its own, since the pixel buffer is reused.
+func (c *ClientConn) readTightJPEGData(r io.Reader) ([]byte, error) {
+	if !c.PixelFormat.TrueColor {
+		return nil, fmt.Errorf("tight image data requires a true color pixel format")
+	}
+
+	length, err := readCompactLength(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// tightColors returns the colors of a Tight rectangle for painting it into
+// a framebuffer, decoding its image or JPEG data if needed. It returns nil
+// for JPEG data that can't be decoded, which leaves the rectangle
+// unpainted.
+func tightColors(colors []Color, img *image.YCbCr, jpegData []byte) []Color {
+	switch {
+	case img != nil:
+		return imageColors(img)
+	case jpegData != nil:
+		decoded, err := jpeg.Decode(bytes.NewReader(jpegData))
+		if err != nil {
+			return nil
+		}
+
+		return imageColors(decoded)
+	}
+
+	return colors
+}
+
+// tightDecodeError is returned by readTightImage if the image data was
+// read, but couldn't be decoded.
+type tightDecodeError struct {
+	err error
+}
+
+func (e tightDecodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e tightDecodeError) Unwrap() error {
+	return e.err
+}
+
+// tightImageColors converts a decoded Tight image into colors.
+func (c *ClientConn) tightImageColors(img image.Image) []Color {
+	bounds := img.Bounds()
+
+	format := c.decodeFormat()
+	colors := c.colorBuffer(bounds.Dx() * bounds.Dy())
+	i := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			red, green, blue, _ := img.At(x, y).RGBA()
+			colors[i] = format.color(
+				red*uint32(format.RedMax)/0xffff,
+				green*uint32(format.GreenMax)/0xffff,
+				blue*uint32(format.BlueMax)/0xffff)
+			i++
+		}
+	}
+
+	return colors
+}
+
+// tightPixelSize returns the size of a TPIXEL, which is packed into
+// three bytes for 24 bit true color in 32 bit pixels.
+func (c *ClientConn) tightPixelSize() int {
+	if c.tightPackedPixels() {
+		return 3
+	}
+
+	return int(c.PixelFormat.BPP / 8)
+}
+
+func (c *ClientConn) tightPackedPixels() bool {
+	f := &c.PixelFormat
+	return f.TrueColor && f.BPP == 32 && f.Depth == 24 &&
+		f.RedMax == 255 && f.GreenMax == 255 && f.BlueMax == 255
+}
+
+// readTightPixels reads len(dst) TPIXELs from r.
+func (c *ClientConn) readTightPixels(dst []Color, r io.Reader) error {
+	data := make([]byte, len(dst)*c.tightPixelSize())
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+
+	return c.decodeTightPixels(dst, data)
+}
+
+// decodeTightPixels decodes TPIXELs into dst.
+func (c *ClientConn) decodeTightPixels(dst []Color, data []byte) error {
+	if !c.tightPackedPixels() {
+		return c.decodeFormat().DecodeInto(dst, data, &c.ColorMap)
+	}
+
+	if len(data) != len(dst)*3 {
+		return fmt.Errorf("tight pixel data length %d doesn't match %d pixels", len(data), len(dst))
+	}
+
+	format := c.decodeFormat()
+	for i := range dst {
+		p := data[i*3:]
+		dst[i] = format.color(uint32(p[0]), uint32(p[1]), uint32(p[2]))
+	}
+
+	return nil
+}
+
+// decodeTightGradient decodes data using the gradient filter, where each
+// channel of a pixel is sent as the difference to the value predicted
+// from the pixels to the left, above, and above left of it.
+func (c *ClientConn) decodeTightGradient(dst []Color, data []byte, width int) error {
+	format := c.decodeFormat()
+	if !format.TrueColor || format.BPP == 8 {
+		return fmt.Errorf("the tight gradient filter requires a 16 or 32 bit true color format")
+	}
+
+	pixelSize := c.tightPixelSize()
+	maxes := [3]int{int(format.RedMax), int(format.GreenMax), int(format.BlueMax)}
+	shifts := [3]uint8{format.RedShift, format.GreenShift, format.BlueShift}
+	byteOrder := format.byteOrder()
+
+	// The channel values of the previous and current rows.
+	prev := make([][3]int, width)
+	row := make([][3]int, width)
+
+	for i := range dst {
+		x := i % width
+		if x == 0 && i > 0 {
+			prev, row = row, prev
+		}
+
+		p := data[i*pixelSize : (i+1)*pixelSize]
+		var diff [3]int
+		switch {
+		case pixelSize == 3:
+			diff = [3]int{int(p[0]), int(p[1]), int(p[2])}
+		default:
+			var raw uint32
+			if pixelSize == 2 {
+				raw = uint32(byteOrder.Uint16(p))
+			} else {
+				raw = byteOrder.Uint32(p)
+			}
+
+			for ch := range diff {
+				diff[ch] = int(raw>>shifts[ch]) & maxes[ch]
+			}
+		}
+
+		for ch := range diff {
+			var left, above, aboveLeft int
+			if x > 0 {
+				left = row[x-1][ch]
+			}
+			if i >= width {
+				above = prev[x][ch]
+				if x > 0 {
+					aboveLeft = prev[x-1][ch]
+				}
+			}
+
+			predicted := left + above - aboveLeft
+			if predicted < 0 {
+				predicted = 0
+			} else if predicted > maxes[ch] {
+				predicted = maxes[ch]
+			}
+
+			row[x][ch] = (predicted + diff[ch]) & maxes[ch]
+		}
+
+		dst[i] = format.color(uint32(row[x][0]), uint32(row[x][1]), uint32(row[x][2]))
+	}
+
+	return nil
+}
+
+// readCompactLength reads a length in the compact representation used
+// by Tight, of one to three bytes holding seven bits each, except for
+// the third byte, which holds eight.
+func readCompactLength(r io.Reader) (int, error) {
+	var length int
+	for i := uint(0); i < 3; i++ {
+		var b uint8
+		if err := binary.Read(r, binary.BigEndian, &b); err != nil {
+			return 0, err
+		}
+
+		if i == 2 {
+			return length | int(b)<<14, nil
+		}
+
+		length |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	return length, nil
+}
@@ -0,0 +1,400 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// compactLength encodes a length in the compact representation of Tight.
+func compactLength(length int) []byte {
+	var data []byte
+	for i := 0; i < 2; i++ {
+		b := uint8(length & 0x7f)
+		length >>= 7
+		if length == 0 {
+			return append(data, b)
+		}
+
+		data = append(data, b|0x80)
+	}
+
+	return append(data, uint8(length))
+}
+
+// readTightRect decodes data as a rectangle of the given encoding, using
+// testPixelFormat.
+func readTightRect(t *testing.T, enc Encoding, width, height uint16, data []byte) []Color {
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+	}
+	rect := &Rectangle{Width: width, Height: height}
+
+	r := bytes.NewReader(data)
+	result, err := enc.Read(conn, rect, r)
+	if err != nil {
+		t.Fatalf("error decoding: %s", err)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("%d bytes left unread", r.Len())
+	}
+
+	switch result := result.(type) {
+	case *TightEncoding:
+		return result.Colors
+	case *TightPNGEncoding:
+		return result.Colors
+	}
+
+	t.Fatalf("unexpected encoding %T", result)
+	return nil
+}
+
+func checkColors(t *testing.T, colors, expected []Color) {
+	if len(colors) != len(expected) {
+		t.Fatalf("got %d colors, want %d", len(colors), len(expected))
+	}
+
+	for i := range colors {
+		if colors[i] != expected[i] {
+			t.Fatalf("color %d = %#v, want %#v", i, colors[i], expected[i])
+		}
+	}
+}
+
+func TestCompactLength(t *testing.T) {
+	for _, length := range []int{0, 127, 128, 16383, 16384, 4194303} {
+		actual, err := readCompactLength(bytes.NewReader(compactLength(length)))
+		if err != nil {
+			t.Fatalf("error reading length %d: %s", length, err)
+		}
+		if actual != length {
+			t.Fatalf("read length %d, want %d", actual, length)
+		}
+	}
+}
+
+func TestTightPNGEncoding_PNG(t *testing.T) {
+	expected := []Color{
+		rgb(255, 0, 0), rgb(0, 255, 0), rgb(0, 0, 255),
+		rgb(1, 2, 3), rgb(128, 128, 128), rgb(255, 255, 255),
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i, c := range expected {
+		img.Set(i%3, i/3, color.NRGBA{R: uint8(c.R >> 8), G: uint8(c.G >> 8), B: uint8(c.B >> 8), A: 255})
+	}
+
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatalf("error encoding png: %s", err)
+	}
+
+	data := append([]byte{0xa0}, compactLength(pngData.Len())...)
+	data = append(data, pngData.Bytes()...)
+
+	checkColors(t, readTightRect(t, new(TightPNGEncoding), 3, 2, data), expected)
+
+	// PNG is only valid in TightPNG.
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+	}
+	if _, err := new(TightEncoding).Read(conn, &Rectangle{Width: 3, Height: 2}, bytes.NewReader(data)); err == nil {
+		t.Fatal("expected error for PNG in Tight")
+	}
+}
+
+func TestTightEncoding_Fill(t *testing.T) {
+	colors := readTightRect(t, new(TightEncoding), 2, 2, []byte{0x80, 10, 20, 30})
+
+	fill := rgb(10, 20, 30)
+	checkColors(t, colors, []Color{fill, fill, fill, fill})
+}
+
+func TestTightEncoding_Palette(t *testing.T) {
+	data := []byte{
+		0x40,    // Basic compression, stream 0, with filter
+		1,       // Palette filter
+		1,       // Two colors
+		0, 0, 0, // Black
+		255, 0, 0, // Red
+		0xa0, 0x50, // Bitmap, with rows padded to a byte
+	}
+
+	black, red := Color{}, rgb(255, 0, 0)
+	checkColors(t, readTightRect(t, new(TightEncoding), 4, 2, data), []Color{
+		red, black, red, black,
+		black, red, black, red,
+	})
+}
+
+func TestTightEncoding_Copy(t *testing.T) {
+	pixels := []byte{
+		1, 2, 3, 4, 5, 6,
+		7, 8, 9, 10, 11, 12,
+	}
+
+	chunk := zlibChunks(t, string(pixels))[0]
+	data := append([]byte{0x10}, compactLength(len(chunk))...)
+	data = append(data, chunk...)
+
+	checkColors(t, readTightRect(t, new(TightEncoding), 2, 2, data), []Color{
+		rgb(1, 2, 3), rgb(4, 5, 6),
+		rgb(7, 8, 9), rgb(10, 11, 12),
+	})
+}
+
+func TestTightEncoding_Gradient(t *testing.T) {
+	diffs := []byte{
+		10, 20, 30, // First pixel, predicted as black
+		5, 5, 5, // Difference to the left pixel
+		1, 1, 1, // Difference to the pixel above
+		0, 0, 0, // Predicted from left, above and above left
+	}
+
+	chunk := zlibChunks(t, string(diffs))[0]
+	data := append([]byte{
+		0x40, // Basic compression, stream 0, with filter
+		2,    // Gradient filter
+	}, compactLength(len(chunk))...)
+	data = append(data, chunk...)
+
+	checkColors(t, readTightRect(t, new(TightEncoding), 2, 2, data), []Color{
+		rgb(10, 20, 30), rgb(15, 25, 35),
+		rgb(11, 21, 31), rgb(16, 26, 36),
+	})
+}
+
+func TestTightEncoding_CopyUncompressed(t *testing.T) {
+	// Less than 12 bytes of pixel data are sent as is, without zlib or
+	// a length, with the filter given either implicitly or explicitly.
+	pixels := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}
+	expected := []Color{rgb(1, 2, 3), rgb(4, 5, 6), rgb(7, 8, 9)}
+
+	checkColors(t, readTightRect(t, new(TightEncoding), 3, 1, append([]byte{0x00}, pixels...)), expected)
+	checkColors(t, readTightRect(t, new(TightEncoding), 3, 1, append([]byte{0x40, 0}, pixels...)), expected)
+}
+
+func TestTightEncoding_UncompressedKeepsStream(t *testing.T) {
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+	}
+
+	// Two chunks of the same zlib stream, with an uncompressed rectangle
+	// using the same stream between them. The uncompressed rectangle must
+	// leave the state of the stream alone.
+	chunks := zlibChunks(t, string([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}), string([]byte{
+		12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1,
+	}))
+
+	var data []byte
+	data = append(data, 0x00)
+	data = append(data, compactLength(len(chunks[0]))...)
+	data = append(data, chunks[0]...)
+	data = append(data, 0x00, 20, 30, 40)
+	data = append(data, 0x00)
+	data = append(data, compactLength(len(chunks[1]))...)
+	data = append(data, chunks[1]...)
+
+	r := bytes.NewReader(data)
+	rects := []Rectangle{{Width: 2, Height: 2}, {Width: 1, Height: 1}, {Width: 2, Height: 2}}
+	expected := [][]Color{
+		{rgb(1, 2, 3), rgb(4, 5, 6), rgb(7, 8, 9), rgb(10, 11, 12)},
+		{rgb(20, 30, 40)},
+		{rgb(12, 11, 10), rgb(9, 8, 7), rgb(6, 5, 4), rgb(3, 2, 1)},
+	}
+
+	for i := range rects {
+		result, err := new(TightEncoding).Read(conn, &rects[i], r)
+		if err != nil {
+			t.Fatalf("rectangle %d: error decoding: %s", i, err)
+		}
+
+		checkColors(t, result.(*TightEncoding).Colors, expected[i])
+	}
+}
+
+func TestTightEncoding_JPEGYCbCr(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, img, nil); err != nil {
+		t.Fatalf("error encoding jpeg: %s", err)
+	}
+
+	data := append([]byte{0x90}, compactLength(jpegData.Len())...)
+	data = append(data, jpegData.Bytes()...)
+
+	for _, keepYCbCr := range []bool{false, true} {
+		conn := &ClientConn{
+			PixelFormat:       testPixelFormat,
+			FrameBufferWidth:  256,
+			FrameBufferHeight: 256,
+			config:            &ClientConfig{TightYCbCr: keepYCbCr},
+		}
+		rect := Rectangle{Width: 16, Height: 8}
+
+		result, err := new(TightEncoding).Read(conn, &rect, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("error decoding: %s", err)
+		}
+
+		enc := result.(*TightEncoding)
+		if keepYCbCr {
+			if enc.Image == nil || enc.Colors != nil {
+				t.Fatalf("expected a YCbCr image, got %d colors", len(enc.Colors))
+			}
+			if enc.Image.Bounds().Dx() != 16 || enc.Image.Bounds().Dy() != 8 {
+				t.Fatalf("image bounds are %v", enc.Image.Bounds())
+			}
+		} else if enc.Image != nil || len(enc.Colors) != 16*8 {
+			t.Fatalf("expected %d colors, got %d and image %v", 16*8, len(enc.Colors), enc.Image != nil)
+		}
+
+		// The framebuffer is painted the same either way.
+		rect.Enc = enc
+		fb := NewFramebuffer(16, 8)
+		fb.Apply(&FramebufferUpdateMessage{Rectangles: []Rectangle{rect}})
+		if c := fb.Colors[0]; colorDiffers(c, rgb(0x80, 0x80, 0x80), 0x200) {
+			t.Fatalf("painted %#v, want about %#v", c, rgb(0x80, 0x80, 0x80))
+		}
+	}
+}
+
+func TestTightEncoding_RawJPEG(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, img, nil); err != nil {
+		t.Fatalf("error encoding jpeg: %s", err)
+	}
+
+	data := append([]byte{0x90}, compactLength(jpegData.Len())...)
+	data = append(data, jpegData.Bytes()...)
+
+	conn := &ClientConn{
+		PixelFormat:       testPixelFormat,
+		FrameBufferWidth:  256,
+		FrameBufferHeight: 256,
+		config:            &ClientConfig{TightRawJPEG: true, TightYCbCr: true},
+	}
+	rect := Rectangle{Width: 16, Height: 8}
+
+	r := bytes.NewReader(data)
+	result, err := new(TightEncoding).Read(conn, &rect, r)
+	if err != nil {
+		t.Fatalf("error decoding: %s", err)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("%d bytes left unread", r.Len())
+	}
+
+	enc := result.(*TightEncoding)
+	if !bytes.Equal(enc.JPEG, jpegData.Bytes()) {
+		t.Fatalf("JPEG data of %d bytes differs from the %d bytes sent", len(enc.JPEG), jpegData.Len())
+	}
+	if enc.Colors != nil || enc.Image != nil {
+		t.Fatalf("JPEG decoded into %d colors and image %v", len(enc.Colors), enc.Image != nil)
+	}
+
+	// The data is kept after the next rectangle is read.
+	sent := append([]byte(nil), enc.JPEG...)
+	if _, err := new(TightEncoding).Read(conn, &rect, bytes.NewReader(data)); err != nil {
+		t.Fatalf("error decoding: %s", err)
+	}
+	if !bytes.Equal(enc.JPEG, sent) {
+		t.Fatal("JPEG data overwritten by the next rectangle")
+	}
+
+	// The framebuffer decodes it itself.
+	rect.Enc = enc
+	fb := NewFramebuffer(16, 8)
+	fb.Apply(&FramebufferUpdateMessage{Rectangles: []Rectangle{rect}})
+	if c := fb.Colors[0]; colorDiffers(c, rgb(0x80, 0x80, 0x80), 0x200) {
+		t.Fatalf("painted %#v, want about %#v", c, rgb(0x80, 0x80, 0x80))
+	}
+}
+
+func TestTightEncoding_UndecodableJPEG(t *testing.T) {
+	var logged []string
+	conn, server := newTestClientConn(&ClientConfig{
+		KeepFramebuffer: true,
+		Logf: func(format string, v ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, v...))
+		},
+	})
+	defer server.Close()
+
+	background := rgb(1, 2, 3)
+	conn.FrameBufferWidth = 64
+	conn.FrameBufferHeight = 32
+	conn.PixelFormat = testPixelFormat
+	conn.Encs = []Encoding{new(TightEncoding)}
+	conn.fb = NewFramebuffer(64, 32)
+	for i := range conn.fb.Colors {
+		conn.fb.Colors[i] = background
+	}
+
+	go conn.mainLoop()
+
+	// A JPEG rectangle with a valid header, but garbage in place of the
+	// image data, followed by a rectangle that does decode.
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, image.NewRGBA(image.Rect(0, 0, 16, 8)), nil); err != nil {
+		t.Fatalf("error encoding jpeg: %s", err)
+	}
+	corrupt := jpegData.Bytes()
+	for i := len(corrupt) / 2; i < len(corrupt)-2; i++ {
+		corrupt[i] = 0xff
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 2})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0, 16, 8})
+	binary.Write(&buf, binary.BigEndian, int32(7))
+	buf.Write([]byte{0x90})
+	buf.Write(compactLength(len(corrupt)))
+	buf.Write(corrupt)
+
+	fill := rgb(0x10, 0x20, 0x30)
+	binary.Write(&buf, binary.BigEndian, []uint16{32, 0, 4, 4})
+	binary.Write(&buf, binary.BigEndian, int32(7))
+	buf.Write([]byte{0x80, 0x10, 0x20, 0x30})
+
+	if _, err := server.Write(buf.Bytes()); err != nil {
+		t.Fatalf("error writing update: %s", err)
+	}
+
+	// The connection survives, and asks for everything to be sent again.
+	expectUpdateRequest(t, server, false, 0, 0, 64, 32)
+
+	if len(logged) != 2 || !strings.Contains(logged[0], "error decoding tight JPEG") || logged[1] != "vnc: first Tight rectangle decoded" {
+		t.Fatalf("logged %q", logged)
+	}
+
+	fb := conn.Framebuffer()
+	if c := fb.Colors[0]; c != background {
+		t.Fatalf("undecodable rectangle painted %#v, want %#v", c, background)
+	}
+	if c := fb.Colors[32]; c != fill {
+		t.Fatalf("following rectangle painted %#v, want %#v", c, fill)
+	}
+}
@@ -0,0 +1,208 @@
+package vnc
+
+import (
+	"image"
+	"image/color"
+)
+
+// TiledFramebuffer is a client-side copy of the pixel data of a remote
+// frame buffer, like Framebuffer, that is kept in square tiles. A tile
+// is only allocated once a rectangle paints any of its pixels, and the
+// pixels of the other tiles are black, so a framebuffer of which only
+// parts are ever updated, such as a viewport, takes much less memory
+// than a Framebuffer of the same size. See ClientConfig.FramebufferTileSize.
+type TiledFramebuffer struct {
+	Width    uint16
+	Height   uint16
+	TileSize uint16
+
+	// The tiles in row-major order, each holding TileSize*TileSize
+	// colors, or nil if it hasn't been painted. The tiles along the
+	// right and bottom edges extend past the framebuffer.
+	tiles   [][]Color
+	columns int
+}
+
+// NewTiledFramebuffer returns a black framebuffer of the given
+// dimensions, which allocates tiles of tileSize by tileSize pixels as
+// they are painted.
+func NewTiledFramebuffer(width, height, tileSize uint16) *TiledFramebuffer {
+	if tileSize == 0 {
+		tileSize = 1
+	}
+
+	columns := (int(width) + int(tileSize) - 1) / int(tileSize)
+	rows := (int(height) + int(tileSize) - 1) / int(tileSize)
+
+	return &TiledFramebuffer{
+		Width:    width,
+		Height:   height,
+		TileSize: tileSize,
+		tiles:    make([][]Color, columns*rows),
+		columns:  columns,
+	}
+}
+
+// AllocatedTiles returns the number of tiles that have been allocated.
+func (fb *TiledFramebuffer) AllocatedTiles() int {
+	n := 0
+	for _, tile := range fb.tiles {
+		if tile != nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+// At returns the color of a pixel, which is black for pixels outside of
+// the framebuffer.
+func (fb *TiledFramebuffer) At(x, y uint16) Color {
+	if x >= fb.Width || y >= fb.Height {
+		return Color{}
+	}
+
+	tile := fb.tiles[fb.tileIndex(int(x), int(y))]
+	if tile == nil {
+		return Color{}
+	}
+
+	size := int(fb.TileSize)
+	return tile[(int(y)%size)*size+int(x)%size]
+}
+
+// SubImage returns a copy of the region of the framebuffer covered by r,
+// clipped to the framebuffer, as Framebuffer.SubImage does.
+func (fb *TiledFramebuffer) SubImage(r Rectangle) image.Image {
+	bounds := image.Rect(int(r.X), int(r.Y), int(r.X)+int(r.Width), int(r.Y)+int(r.Height))
+	bounds = bounds.Intersect(image.Rect(0, 0, int(fb.Width), int(fb.Height)))
+
+	img := image.NewRGBA64(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := fb.At(uint16(x), uint16(y))
+			img.SetRGBA64(x, y, color.RGBA64{R: c.R, G: c.G, B: c.B, A: 0xffff})
+		}
+	}
+
+	return img
+}
+
+// Apply paints the rectangles of a FramebufferUpdate into the
+// framebuffer, the same way as Framebuffer.Apply. Rectangles may span
+// any number of tiles, and CopyRect may copy between them.
+func (fb *TiledFramebuffer) Apply(msg *FramebufferUpdateMessage) {
+	for i := range msg.Rectangles {
+		rect := &msg.Rectangles[i]
+
+		switch enc := rect.Enc.(type) {
+		case *RawEncoding:
+			fb.paint(rect, enc.Colors)
+		case *ZlibEncoding:
+			fb.paint(rect, enc.Colors)
+		case *HextileEncoding:
+			fb.paint(rect, enc.Colors)
+		case *RREEncoding:
+			paintRRE(rect, enc.Colors, enc.Background, enc.Subrects, fb.paint)
+		case *CoRREEncoding:
+			paintRRE(rect, enc.Colors, enc.Background, enc.Subrects, fb.paint)
+		case *TightEncoding:
+			fb.paintTight(rect, enc.Colors, enc.Image, enc.JPEG)
+		case *TightPNGEncoding:
+			fb.paintTight(rect, enc.Colors, enc.Image, enc.JPEG)
+		case *CopyRectEncoding:
+			src := Rectangle{X: enc.SrcX, Y: enc.SrcY, Width: rect.Width, Height: rect.Height}
+			fb.paint(rect, fb.colors(src))
+		case *DesktopSizePseudoEncoding:
+			fb.resize(rect.Width, rect.Height)
+		case *ExtendedDesktopSizePseudoEncoding:
+			if enc.Status == DesktopSizeStatusOK {
+				fb.resize(rect.Width, rect.Height)
+			}
+		}
+	}
+}
+
+// paintTight paints a Tight rectangle, as Framebuffer.paintTight does.
+func (fb *TiledFramebuffer) paintTight(rect *Rectangle, colors []Color, img *image.YCbCr, jpegData []byte) {
+	fb.paint(rect, tightColors(colors, img, jpegData))
+}
+
+// paint copies the colors of a rectangle into the tiles it covers,
+// allocating them as needed.
+func (fb *TiledFramebuffer) paint(rect *Rectangle, colors []Color) {
+	if len(colors) < int(rect.Width)*int(rect.Height) {
+		return
+	}
+
+	right := minInt(int(rect.X)+int(rect.Width), int(fb.Width))
+	bottom := minInt(int(rect.Y)+int(rect.Height), int(fb.Height))
+	size := int(fb.TileSize)
+
+	for y := int(rect.Y); y < bottom; y++ {
+		row := colors[(y-int(rect.Y))*int(rect.Width):]
+
+		// Copy the part of the row that falls in each tile.
+		for x := int(rect.X); x < right; {
+			end := minInt((x/size+1)*size, right)
+
+			index := fb.tileIndex(x, y)
+			if fb.tiles[index] == nil {
+				fb.tiles[index] = make([]Color, size*size)
+			}
+
+			copy(fb.tiles[index][(y%size)*size+x%size:], row[x-int(rect.X):end-int(rect.X)])
+			x = end
+		}
+	}
+}
+
+// colors returns a copy of the colors of a rectangle of the framebuffer,
+// or nil if the rectangle doesn't fit in the framebuffer.
+func (fb *TiledFramebuffer) colors(rect Rectangle) []Color {
+	if int(rect.X)+int(rect.Width) > int(fb.Width) || int(rect.Y)+int(rect.Height) > int(fb.Height) {
+		return nil
+	}
+
+	colors := make([]Color, 0, int(rect.Width)*int(rect.Height))
+	for y := rect.Y; y < rect.Y+rect.Height; y++ {
+		for x := rect.X; x < rect.X+rect.Width; x++ {
+			colors = append(colors, fb.At(x, y))
+		}
+	}
+
+	return colors
+}
+
+// resize changes the dimensions of the framebuffer, keeping the
+// contents of the area common to both sizes. Only the tiles that have
+// been allocated are copied.
+func (fb *TiledFramebuffer) resize(width, height uint16) {
+	if width == fb.Width && height == fb.Height {
+		return
+	}
+
+	resized := NewTiledFramebuffer(width, height, fb.TileSize)
+	size := int(fb.TileSize)
+	for i, tile := range fb.tiles {
+		if tile == nil {
+			continue
+		}
+
+		rect := Rectangle{
+			X:      uint16(i % fb.columns * size),
+			Y:      uint16(i / fb.columns * size),
+			Width:  fb.TileSize,
+			Height: fb.TileSize,
+		}
+		resized.paint(&rect, tile)
+	}
+
+	*fb = *resized
+}
+
+// tileIndex returns the index of the tile holding a pixel.
+func (fb *TiledFramebuffer) tileIndex(x, y int) int {
+	size := int(fb.TileSize)
+	return (y/size)*fb.columns + x/size
+}
@@ -0,0 +1,114 @@
+package vnc
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+// checkTiled checks that a tiled framebuffer holds the same pixels as a
+// plain one.
+func checkTiled(t *testing.T, tiled *TiledFramebuffer, fb *Framebuffer) {
+	if tiled.Width != fb.Width || tiled.Height != fb.Height {
+		t.Fatalf("tiled framebuffer is %dx%d, want %dx%d", tiled.Width, tiled.Height, fb.Width, fb.Height)
+	}
+
+	for y := uint16(0); y < fb.Height; y++ {
+		for x := uint16(0); x < fb.Width; x++ {
+			if c, expected := tiled.At(x, y), fb.Colors[int(y)*int(fb.Width)+int(x)]; c != expected {
+				t.Fatalf("pixel (%d, %d) = %#v, want %#v", x, y, c, expected)
+			}
+		}
+	}
+}
+
+func TestTiledFramebuffer_Apply(t *testing.T) {
+	tiled := NewTiledFramebuffer(60, 50, 16)
+	fb := NewFramebuffer(60, 50)
+
+	// A rectangle spanning four tiles.
+	colors := make([]Color, 16*16)
+	for i := range colors {
+		colors[i] = rgb(uint8(i), uint8(i/16), 0x80)
+	}
+	update := &FramebufferUpdateMessage{Rectangles: []Rectangle{
+		{X: 8, Y: 8, Width: 16, Height: 16, Enc: &RawEncoding{Colors: colors}},
+	}}
+	tiled.Apply(update)
+	fb.Apply(update)
+
+	checkTiled(t, tiled, fb)
+	if n := tiled.AllocatedTiles(); n != 4 {
+		t.Fatalf("%d tiles allocated, want 4", n)
+	}
+
+	// Copy it across tile boundaries again, overlapping the source, and
+	// into the partial tiles along the edges.
+	update = &FramebufferUpdateMessage{Rectangles: []Rectangle{
+		{X: 20, Y: 14, Width: 16, Height: 16, Enc: &CopyRectEncoding{SrcX: 8, SrcY: 8}},
+		{X: 44, Y: 34, Width: 16, Height: 16, Enc: &CopyRectEncoding{SrcX: 20, SrcY: 14}},
+	}}
+	tiled.Apply(update)
+	fb.Apply(update)
+	checkTiled(t, tiled, fb)
+
+	img := tiled.SubImage(Rectangle{X: 10, Y: 10, Width: 100, Height: 5})
+	if img.Bounds() != image.Rect(10, 10, 60, 15) {
+		t.Fatalf("SubImage bounds = %v", img.Bounds())
+	}
+	if r, g, b, _ := img.At(12, 11).RGBA(); (Color{uint16(r), uint16(g), uint16(b)}) != tiled.At(12, 11) {
+		t.Fatalf("SubImage pixel = %v, want %v", img.At(12, 11), tiled.At(12, 11))
+	}
+
+	// Resizing keeps the common area.
+	update = &FramebufferUpdateMessage{Rectangles: []Rectangle{
+		{Width: 40, Height: 70, Enc: &DesktopSizePseudoEncoding{}},
+	}}
+	tiled.Apply(update)
+	fb.Apply(update)
+	checkTiled(t, tiled, fb)
+}
+
+func TestClientConn_FramebufferTileSize(t *testing.T) {
+	msgCh := make(chan ServerMessage, 1)
+	conn, server := newTestClientConn(&ClientConfig{
+		KeepFramebuffer:     true,
+		FramebufferTileSize: 64,
+		ServerMessageCh:     msgCh,
+	})
+	defer server.Close()
+
+	conn.FrameBufferWidth = 1024
+	conn.FrameBufferHeight = 768
+	conn.PixelFormat = testPixelFormat
+	conn.start()
+
+	if fb := conn.Framebuffer(); fb != nil {
+		t.Fatal("Framebuffer returned a copy of a tiled framebuffer")
+	}
+
+	expected := rgb(0x10, 0x20, 0x30)
+	writeRawUpdate(t, server, 60, 60, 8, 8, expected)
+
+	// The update is sent on ServerMessageCh once it has been applied.
+	select {
+	case <-msgCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the update")
+	}
+
+	img := conn.FramebufferImage(Rectangle{X: 59, Y: 59, Width: 10, Height: 10})
+	if r, g, b, _ := img.At(63, 64).RGBA(); (Color{uint16(r), uint16(g), uint16(b)}) != expected {
+		t.Fatalf("pixel = %v, want %v", img.At(63, 64), expected)
+	}
+	if r, _, _, _ := img.At(59, 59).RGBA(); r != 0 {
+		t.Fatalf("pixel outside of the update = %v", img.At(59, 59))
+	}
+
+	conn.fbLock.Lock()
+	allocated := conn.tiledFB.AllocatedTiles()
+	conn.fbLock.Unlock()
+	if allocated != 4 {
+		t.Fatalf("%d tiles allocated, want 4", allocated)
+	}
+}
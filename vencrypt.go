@@ -0,0 +1,202 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// VeNCrypt sub-authentication types.
+const (
+	VeNCryptPlain     uint32 = 256
+	VeNCryptTLSNone   uint32 = 257
+	VeNCryptTLSVnc    uint32 = 258
+	VeNCryptTLSPlain  uint32 = 259
+	VeNCryptX509None  uint32 = 260
+	VeNCryptX509Vnc   uint32 = 261
+	VeNCryptX509Plain uint32 = 262
+)
+
+// A ClientAuthConn is a ClientAuth that replaces the connection during
+// its handshake, such as by wrapping it in TLS. After the handshake, the
+// rest of the protocol is spoken over the connection returned by Conn.
+type ClientAuthConn interface {
+	ClientAuth
+
+	Conn() net.Conn
+}
+
+// VeNCryptAuth is the VeNCrypt security type, which authenticates inside
+// of a TLS tunnel.
+//
+// Only the X509 sub-types are supported, with either no authentication
+// or VNC authentication inside of the tunnel. The TLS sub-types use
+// anonymous Diffie-Hellman key exchange, which crypto/tls doesn't
+// implement, so servers that only offer those can't be connected to.
+type VeNCryptAuth struct {
+	// TLSConfig is the configuration of the TLS tunnel. It must either
+	// set ServerName, or InsecureSkipVerify.
+	TLSConfig *tls.Config
+
+	// PinnedCertSHA256, if set, holds the SHA-256 fingerprints of the
+	// certificates the server may present. The handshake fails unless
+	// the server's leaf certificate matches one of them. This is checked
+	// in addition to the verification of TLSConfig, so to trust a fixed
+	// appliance with a self-signed certificate by its pin alone, set
+	// InsecureSkipVerify as well.
+	PinnedCertSHA256 [][]byte
+
+	// Auth is the authentication used inside of the tunnel, which is
+	// either nil or a *ClientAuthNone for no authentication, or a
+	// *PasswordAuth for VNC authentication.
+	Auth ClientAuth
+
+	conn    net.Conn
+	subType uint32
+}
+
+func (*VeNCryptAuth) SecurityType() uint8 {
+	return 19
+}
+
+func (v *VeNCryptAuth) Conn() net.Conn {
+	return v.conn
+}
+
+func (v *VeNCryptAuth) SecurityInfo() SecurityInfo {
+	return SecurityInfo{
+		Type:    v.SecurityType(),
+		Tunnel:  "VeNCrypt",
+		SubType: v.subType,
+	}
+}
+
+func (v *VeNCryptAuth) Handshake(c net.Conn) error {
+	var subType uint32
+	switch v.Auth.(type) {
+	case nil, *ClientAuthNone:
+		subType = VeNCryptX509None
+	case *PasswordAuth:
+		subType = VeNCryptX509Vnc
+	default:
+		return fmt.Errorf("unsupported VeNCrypt sub-authentication: %T", v.Auth)
+	}
+
+	// Version negotiation. Only version 0.2 is supported.
+	var version [2]uint8
+	if _, err := io.ReadFull(c, version[:]); err != nil {
+		return err
+	}
+	if version[0] == 0 && version[1] < 2 {
+		return fmt.Errorf("unsupported VeNCrypt version: %d.%d", version[0], version[1])
+	}
+
+	if _, err := c.Write([]byte{0, 2}); err != nil {
+		return err
+	}
+
+	var ack uint8
+	if err := binary.Read(c, binary.BigEndian, &ack); err != nil {
+		return err
+	}
+	if ack != 0 {
+		return errors.New("VeNCrypt version 0.2 rejected by server")
+	}
+
+	// Sub-type selection.
+	var numSubTypes uint8
+	if err := binary.Read(c, binary.BigEndian, &numSubTypes); err != nil {
+		return err
+	}
+
+	subTypes := make([]uint32, numSubTypes)
+	if err := binary.Read(c, binary.BigEndian, &subTypes); err != nil {
+		return err
+	}
+
+	found := false
+	anonymous := false
+	for _, t := range subTypes {
+		switch t {
+		case subType:
+			found = true
+		case VeNCryptTLSNone, VeNCryptTLSVnc, VeNCryptTLSPlain:
+			anonymous = true
+		}
+	}
+	if !found {
+		if anonymous {
+			return fmt.Errorf("VeNCrypt sub-type %d not offered, and anonymous TLS is not supported: %v", subType, subTypes)
+		}
+
+		return fmt.Errorf("VeNCrypt sub-type %d not offered: %v", subType, subTypes)
+	}
+
+	if err := binary.Write(c, binary.BigEndian, subType); err != nil {
+		return err
+	}
+
+	if err := binary.Read(c, binary.BigEndian, &ack); err != nil {
+		return err
+	}
+	if ack != 1 {
+		return fmt.Errorf("VeNCrypt sub-type %d rejected by server", subType)
+	}
+
+	tlsConn := tls.Client(c, v.tlsConfig())
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	v.conn = tlsConn
+	v.subType = subType
+
+	if subType == VeNCryptX509Vnc {
+		return v.Auth.Handshake(tlsConn)
+	}
+
+	return nil
+}
+
+// tlsConfig returns the configuration of the TLS tunnel, which checks
+// the pinned certificates, if any.
+func (v *VeNCryptAuth) tlsConfig() *tls.Config {
+	if len(v.PinnedCertSHA256) == 0 {
+		return v.TLSConfig
+	}
+
+	config := new(tls.Config)
+	if v.TLSConfig != nil {
+		config = v.TLSConfig.Clone()
+	}
+
+	verify := config.VerifyPeerCertificate
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if verify != nil {
+			if err := verify(rawCerts, chains); err != nil {
+				return err
+			}
+		}
+
+		if len(rawCerts) == 0 {
+			return errors.New("VeNCrypt server sent no certificate")
+		}
+
+		fingerprint := sha256.Sum256(rawCerts[0])
+		for _, pin := range v.PinnedCertSHA256 {
+			if bytes.Equal(pin, fingerprint[:]) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("VeNCrypt server certificate with SHA-256 fingerprint %x is not pinned", fingerprint)
+	}
+
+	return config
+}
@@ -0,0 +1,260 @@
+package vnc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a self-signed certificate for "vnc.test".
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vnc.test"},
+		DNSNames:     []string{"vnc.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// serveTestVeNCrypt performs the server side of the VeNCrypt handshake
+// offering the given sub-types, and returns the TLS connection that the
+// rest of the protocol is spoken over.
+func serveTestVeNCrypt(server net.Conn, cert tls.Certificate, subTypes []uint32) (net.Conn, error) {
+	server.Write([]byte{0, 2})
+
+	var version [2]byte
+	if _, err := io.ReadFull(server, version[:]); err != nil {
+		return nil, err
+	}
+	server.Write([]byte{0})
+
+	server.Write([]byte{uint8(len(subTypes))})
+	binary.Write(server, binary.BigEndian, subTypes)
+
+	var subType uint32
+	if err := binary.Read(server, binary.BigEndian, &subType); err != nil {
+		return nil, err
+	}
+	server.Write([]byte{1})
+
+	tlsConn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+func TestVeNCryptAuth_Impl(t *testing.T) {
+	var raw interface{}
+	raw = new(VeNCryptAuth)
+	if _, ok := raw.(ClientAuthConn); !ok {
+		t.Fatal("VeNCryptAuth doesn't implement ClientAuthConn")
+	}
+	if _, ok := raw.(ClientAuthTunnel); !ok {
+		t.Fatal("VeNCryptAuth doesn't implement ClientAuthTunnel")
+	}
+}
+
+func TestClient_VeNCrypt(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+
+	tests := []struct {
+		auth     ClientAuth
+		expected uint32
+	}{
+		{nil, VeNCryptX509None},
+		{&PasswordAuth{Password: "secret"}, VeNCryptX509Vnc},
+	}
+
+	for _, tt := range tests {
+		client, server := net.Pipe()
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- func() error {
+				if _, err := server.Write([]byte("RFB 003.008\n")); err != nil {
+					return err
+				}
+				if _, err := io.ReadFull(server, make([]byte, 12)); err != nil {
+					return err
+				}
+
+				server.Write([]byte{1, 19})
+				if _, err := io.ReadFull(server, make([]byte, 1)); err != nil {
+					return err
+				}
+
+				offered := []uint32{VeNCryptTLSNone, VeNCryptX509None, VeNCryptX509Vnc}
+				tlsConn, err := serveTestVeNCrypt(server, cert, offered)
+				if err != nil {
+					return err
+				}
+
+				if tt.auth != nil {
+					tlsConn.Write(make([]byte, 16))
+					if _, err := io.ReadFull(tlsConn, make([]byte, 16)); err != nil {
+						return err
+					}
+				}
+
+				// SecurityResult OK
+				tlsConn.Write([]byte{0, 0, 0, 0})
+
+				if _, err := io.ReadFull(tlsConn, make([]byte, 1)); err != nil {
+					return err
+				}
+
+				return writeTestServerInit(tlsConn, 4, "test")
+			}()
+		}()
+
+		auth := &VeNCryptAuth{
+			TLSConfig: &tls.Config{ServerName: "vnc.test", RootCAs: pool},
+			Auth:      tt.auth,
+		}
+
+		conn, err := Client(client, &ClientConfig{Auth: []ClientAuth{auth}})
+		if err != nil {
+			t.Fatalf("error connecting: %s", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("error in mock server: %s", err)
+		}
+
+		if conn.DesktopName != "test" {
+			t.Errorf("DesktopName = %q, want %q", conn.DesktopName, "test")
+		}
+
+		expected := SecurityInfo{Type: 19, Tunnel: "VeNCrypt", SubType: tt.expected}
+		if conn.Security != expected {
+			t.Errorf("Security = %#v, want %#v", conn.Security, expected)
+		}
+
+		// Close the server end first, so that the TLS close notification
+		// doesn't wait for a reader.
+		server.Close()
+		conn.Close()
+	}
+}
+
+func TestVeNCryptAuth_AnonymousOnly(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		server.Write([]byte{0, 2})
+		io.ReadFull(server, make([]byte, 2))
+		server.Write([]byte{0, 1})
+		binary.Write(server, binary.BigEndian, VeNCryptTLSNone)
+	}()
+
+	auth := &VeNCryptAuth{TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	err := auth.Handshake(client)
+	if err == nil || !strings.Contains(err.Error(), "anonymous TLS is not supported") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestVeNCryptAuth_PinnedCertSHA256(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+
+	tests := []struct {
+		pin      []byte
+		expected bool
+	}{
+		{fingerprint[:], true},
+		{make([]byte, sha256.Size), false},
+	}
+
+	// The connection goes over TCP rather than net.Pipe, since both ends
+	// write at once when the client rejects the certificate: the client
+	// sends its alert while the server is still sending its handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer ln.Close()
+
+	for _, tt := range tests {
+		errCh := make(chan error, 1)
+		go func() {
+			server, err := ln.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer server.Close()
+
+			_, err = serveTestVeNCrypt(server, cert, []uint32{VeNCryptX509None})
+			errCh <- err
+		}()
+
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("error dialing: %s", err)
+		}
+
+		// The certificate is self-signed, so it is only trusted by its pin.
+		auth := &VeNCryptAuth{
+			TLSConfig:        &tls.Config{InsecureSkipVerify: true},
+			PinnedCertSHA256: [][]byte{{1, 2, 3}, tt.pin},
+		}
+
+		err = auth.Handshake(client)
+		client.Close()
+		if tt.expected && err != nil {
+			t.Fatalf("error with a matching pin: %s", err)
+		}
+		if !tt.expected && (err == nil || !strings.Contains(err.Error(), "is not pinned")) {
+			t.Fatalf("unexpected error with a non-matching pin: %v", err)
+		}
+
+		// The server sees its certificate rejected.
+		serverErr := <-errCh
+		if tt.expected && serverErr != nil {
+			t.Fatalf("error in mock server with a matching pin: %s", serverErr)
+		}
+		if !tt.expected && serverErr == nil {
+			t.Fatal("mock server handshake succeeded with a non-matching pin")
+		}
+	}
+}
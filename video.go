@@ -0,0 +1,86 @@
+package vnc
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// StreamRGB24 writes the framebuffer kept with ClientConfig.KeepFramebuffer
+// to w as raw RGB24 video, at fps frames per second, which is what
+// "ffmpeg -f rawvideo -pix_fmt rgb24 -video_size WxH -framerate fps -i -"
+// expects. Each frame is the whole framebuffer, with 8 bits per channel,
+// and the current frame is written again when nothing has changed, to
+// keep the frame rate steady.
+//
+// All frames have the dimensions the framebuffer had when StreamRGB24
+// was called, since raw video can't change size. If the server resizes
+// the desktop, the top left of the new framebuffer is written, cropped
+// or padded with black to those dimensions; start a new stream to change
+// them. StreamRGB24 blocks until writing fails or the connection ends,
+// and returns the error.
+func (c *ClientConn) StreamRGB24(w io.Writer, fps int) error {
+	if fps <= 0 {
+		return fmt.Errorf("invalid frame rate %d", fps)
+	}
+
+	width, height := c.Dimensions()
+	frame := make([]byte, int(width)*int(height)*3)
+	if err := c.rgb24Frame(frame, int(width), int(height)); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(fps))
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+
+		<-ticker.C
+		if err := c.Err(); err != nil {
+			return err
+		}
+
+		if err := c.rgb24Frame(frame, int(width), int(height)); err != nil {
+			return err
+		}
+	}
+}
+
+// rgb24Frame copies the framebuffer into frame, a width by height RGB24
+// image, cropping or padding it with black as needed.
+func (c *ClientConn) rgb24Frame(frame []byte, width, height int) error {
+	c.fbLock.Lock()
+	defer c.fbLock.Unlock()
+
+	var fbWidth, fbHeight int
+	var at func(x, y int) Color
+	switch {
+	case c.fb != nil:
+		fbWidth, fbHeight = int(c.fb.Width), int(c.fb.Height)
+		at = func(x, y int) Color { return c.fb.Colors[y*fbWidth+x] }
+	case c.tiledFB != nil:
+		fbWidth, fbHeight = int(c.tiledFB.Width), int(c.tiledFB.Height)
+		at = func(x, y int) Color { return c.tiledFB.At(uint16(x), uint16(y)) }
+	default:
+		return fmt.Errorf("streaming video requires ClientConfig.KeepFramebuffer")
+	}
+
+	for y := 0; y < height; y++ {
+		row := frame[y*width*3:][:width*3]
+		for x := 0; x < width; x++ {
+			var col Color
+			if x < fbWidth && y < fbHeight {
+				col = at(x, y)
+			}
+
+			row[x*3] = uint8(col.R >> 8)
+			row[x*3+1] = uint8(col.G >> 8)
+			row[x*3+2] = uint8(col.B >> 8)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package vnc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// frameWriter records the frames written to it, calling onFrame after
+// each of them, and fails once it has the given number of frames.
+type frameWriter struct {
+	frames  [][]byte
+	max     int
+	onFrame func(n int)
+}
+
+var errEnoughFrames = errors.New("enough frames")
+
+func (fw *frameWriter) Write(b []byte) (int, error) {
+	fw.frames = append(fw.frames, append([]byte(nil), b...))
+	if fw.onFrame != nil {
+		fw.onFrame(len(fw.frames))
+	}
+	if len(fw.frames) == fw.max {
+		return 0, errEnoughFrames
+	}
+
+	return len(b), nil
+}
+
+func TestClientConn_StreamRGB24(t *testing.T) {
+	conn, server := newTestClientConn(&ClientConfig{KeepFramebuffer: true})
+	defer server.Close()
+
+	conn.FrameBufferWidth, conn.FrameBufferHeight = 3, 2
+	conn.fb = NewFramebuffer(3, 2)
+	conn.fb.Colors[0] = rgb(1, 2, 3)
+
+	// The desktop shrinks after the second frame.
+	w := &frameWriter{max: 3, onFrame: func(n int) {
+		if n == 2 {
+			conn.fbLock.Lock()
+			conn.fb.resize(1, 2)
+			conn.fb.Colors[1] = rgb(4, 5, 6)
+			conn.fbLock.Unlock()
+		}
+	}}
+
+	if err := conn.StreamRGB24(w, 100); err != errEnoughFrames {
+		t.Fatalf("err = %v, want %v", err, errEnoughFrames)
+	}
+
+	first := []byte{1, 2, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	padded := []byte{1, 2, 3, 0, 0, 0, 0, 0, 0, 4, 5, 6, 0, 0, 0, 0, 0, 0}
+	for i, expected := range [][]byte{first, first, padded} {
+		if len(w.frames[i]) != 3*2*3 {
+			t.Fatalf("frame %d is %d bytes, want %d", i, len(w.frames[i]), 3*2*3)
+		}
+		if !bytes.Equal(w.frames[i], expected) {
+			t.Fatalf("frame %d = %v, want %v", i, w.frames[i], expected)
+		}
+	}
+
+	conn, server = newTestClientConn(&ClientConfig{})
+	defer server.Close()
+	if err := conn.StreamRGB24(w, 25); err == nil {
+		t.Fatal("no error without KeepFramebuffer")
+	}
+}
@@ -0,0 +1,159 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// zlibStream is a zlib stream that spans multiple rectangles. Encodings
+// such as Zlib and Tight send the compressed data of each rectangle as a
+// chunk of one continuous stream, so the decompressor and its dictionary
+// must be kept between rectangles.
+type zlibStream struct {
+	input  bytes.Buffer
+	reader io.ReadCloser
+}
+
+// read reads the next length bytes of compressed data from r, and
+// returns a reader for the decompressed data it contains. If bufferSize
+// is set, the buffer of compressed data starts out with that capacity,
+// and is shrunk back to it once a larger chunk has been decompressed.
+func (z *zlibStream) read(r io.Reader, length, bufferSize int) (io.Reader, error) {
+	if bufferSize > 0 && z.input.Cap() != bufferSize && z.input.Len() <= bufferSize {
+		// The decompressor may not have read the end of the previous
+		// chunk yet, so that is kept.
+		buf := make([]byte, z.input.Len(), bufferSize)
+		copy(buf, z.input.Bytes())
+		z.input = *bytes.NewBuffer(buf)
+	}
+	if bufferSize > 0 {
+		// Copying into the buffer grows it unless it has room for
+		// bytes.MinRead more bytes than are read.
+		z.input.Grow(length + bytes.MinRead)
+	}
+
+	// The RFB protocol expects us to read the entire compressed length;
+	// no more (which could happen if we just passed the reader through
+	// zlib.NewReader, due to the input not being a io.ByteReader), and
+	// no less (which could happen if the compressed length was larger
+	// than what's strictly required for the rect's colors), so we read
+	// all of the data up front, appending it to a buffer that the zlib
+	// decoding processes independently.
+	limitedReader := io.LimitedReader{R: r, N: int64(length)}
+	readBytes, err := io.Copy(&z.input, &limitedReader)
+	if err != nil {
+		return nil, err
+	}
+	if readBytes != int64(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// We can only read the zlib header once per stream, so the reader
+	// is created when the first chunk arrives and then re-used.
+	if z.reader == nil {
+		reader, err := zlib.NewReader(&z.input)
+		if err != nil {
+			return nil, err
+		}
+
+		z.reader = reader
+	}
+
+	return z.reader, nil
+}
+
+// zlibBufferSize returns ClientConfig.ZlibBufferSize, or zero to let the
+// buffers of the zlib streams grow as needed.
+func (c *ClientConn) zlibBufferSize() int {
+	if c.config == nil {
+		return 0
+	}
+
+	return c.config.ZlibBufferSize
+}
+
+// limitDecompressed limits the data read from zr, the decompressed data
+// of a rectangle read from the chunk of z, to
+// ClientConfig.MaxDecompressedBytesPerRect. Once the rectangle has been
+// read, finish must be called on the returned reader.
+func (c *ClientConn) limitDecompressed(rect *Rectangle, z *zlibStream, zr io.Reader) *decompressionLimitReader {
+	limit := 2 * int64(rect.Width) * int64(rect.Height) * int64(c.PixelFormat.BPP/8)
+	if c.config != nil && c.config.MaxDecompressedBytesPerRect > 0 {
+		limit = c.config.MaxDecompressedBytesPerRect
+	}
+
+	return &decompressionLimitReader{r: zr, stream: z, rect: rect, limit: limit, remaining: limit}
+}
+
+// decompressionLimitReader fails reads of more than limit bytes from r.
+type decompressionLimitReader struct {
+	r         io.Reader
+	stream    *zlibStream
+	rect      *Rectangle
+	limit     int64
+	remaining int64
+}
+
+func (lr *decompressionLimitReader) Read(b []byte) (int, error) {
+	if lr.remaining <= 0 {
+		return 0, fmt.Errorf("rectangle %dx%d at %d,%d decompresses to more than %d bytes",
+			lr.rect.Width, lr.rect.Height, lr.rect.X, lr.rect.Y, lr.limit)
+	}
+
+	if int64(len(b)) > lr.remaining {
+		b = b[:lr.remaining]
+	}
+
+	n, err := lr.r.Read(b)
+	lr.remaining -= int64(n)
+	return n, err
+}
+
+// The most compressed data that may be left in a chunk once its rectangle
+// has been read, which is the end of the last block and the empty stored
+// block of the flush that ends the chunk.
+const zlibChunkTrailer = 8
+
+// zlibFlushMarker ends the empty stored block of a zlib flush.
+var zlibFlushMarker = []byte{0, 0, 0xff, 0xff}
+
+// finish decompresses and discards what is left of the chunk of the
+// rectangle, so that a chunk holding more data than its rectangle counts
+// towards the limit, and the next rectangle doesn't start with the rest.
+// The decompressor can't be read past the end of a chunk without failing
+// the stream, so the data it has already decompressed, up to its 32KB
+// window, can't be told apart from the flush and is left.
+func (lr *decompressionLimitReader) finish() error {
+	var discard []byte
+	for !lr.stream.chunkEnded() {
+		if discard == nil {
+			discard = make([]byte, 32*1024)
+		}
+
+		if _, err := lr.Read(discard); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// chunkEnded reports whether all that is left of the current chunk of
+// compressed data is the flush that ends it.
+func (z *zlibStream) chunkEnded() bool {
+	left := z.input.Bytes()
+	return len(left) == 0 || (len(left) <= zlibChunkTrailer && bytes.HasSuffix(left, zlibFlushMarker))
+}
+
+// reset discards the state of the stream, so that the next chunk read
+// is the start of a new stream.
+func (z *zlibStream) reset() {
+	if z.reader != nil {
+		z.reader.Close()
+		z.reader = nil
+	}
+
+	z.input.Reset()
+}
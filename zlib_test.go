@@ -0,0 +1,195 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// zlibChunks compresses each of the given strings as consecutive chunks
+// of a single zlib stream, flushing after each of them.
+func zlibChunks(t *testing.T, data ...string) [][]byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+
+	var chunks [][]byte
+	for _, d := range data {
+		if _, err := w.Write([]byte(d)); err != nil {
+			t.Fatalf("error compressing: %s", err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("error flushing: %s", err)
+		}
+
+		chunks = append(chunks, append([]byte(nil), buf.Bytes()...))
+		buf.Reset()
+	}
+
+	return chunks
+}
+
+// readZlibChunk feeds a chunk to a zlib stream and checks that it
+// decompresses to the expected string.
+func readZlibChunk(t *testing.T, z *zlibStream, chunk []byte, expected string) {
+	r, err := z.read(bytes.NewReader(chunk), len(chunk), 0)
+	if err != nil {
+		t.Fatalf("error reading chunk: %s", err)
+	}
+
+	decompressed := make([]byte, len(expected))
+	if _, err := io.ReadFull(r, decompressed); err != nil {
+		t.Fatalf("error decompressing chunk: %s", err)
+	}
+	if string(decompressed) != expected {
+		t.Fatalf("decompressed = %q, want %q", decompressed, expected)
+	}
+}
+
+func TestClientConn_ResetTightStreams(t *testing.T) {
+	conn := &ClientConn{}
+
+	stream0 := zlibChunks(t, "first stream, first chunk", "first stream, second chunk")
+	stream1 := zlibChunks(t, "second stream")
+	newStream1 := zlibChunks(t, "second stream after reset")
+
+	readZlibChunk(t, &conn.tightStreams[0], stream0[0], "first stream, first chunk")
+	readZlibChunk(t, &conn.tightStreams[1], stream1[0], "second stream")
+
+	// Resetting stream 1 allows a new zlib stream to be started on it,
+	// while stream 0 continues where it left off.
+	conn.resetTightStreams(1 << 1)
+
+	readZlibChunk(t, &conn.tightStreams[1], newStream1[0], "second stream after reset")
+	readZlibChunk(t, &conn.tightStreams[0], stream0[1], "first stream, second chunk")
+}
+
+func TestZlibEncoding_MaxDecompressedBytesPerRect(t *testing.T) {
+	// A 256x256 rectangle of black pixels compresses to a few hundred
+	// bytes.
+	chunk := zlibChunks(t, strings.Repeat("\x00", 256*256*4))[0]
+
+	var update bytes.Buffer
+	binary.Write(&update, binary.BigEndian, []uint32{uint32(len(chunk))})
+	update.Write(chunk)
+
+	for _, limit := range []int64{0, 64 << 10} {
+		conn := &ClientConn{
+			config:            &ClientConfig{MaxDecompressedBytesPerRect: limit},
+			FrameBufferWidth:  256,
+			FrameBufferHeight: 256,
+			PixelFormat:       testPixelFormat,
+		}
+		rect := &Rectangle{Width: 256, Height: 256}
+
+		_, err := new(ZlibEncoding).Read(conn, rect, bytes.NewReader(update.Bytes()))
+		if limit == 0 && err != nil {
+			t.Fatalf("error reading rectangle: %s", err)
+		}
+		if limit != 0 && (err == nil || !strings.Contains(err.Error(), "decompresses to more than 65536 bytes")) {
+			t.Fatalf("limit %d: err = %v", limit, err)
+		}
+	}
+}
+
+func TestZlibEncoding_OversizedChunk(t *testing.T) {
+	const pixelBytes = 256 * 256 * 4
+
+	tests := []struct {
+		extra int
+		fails bool
+	}{
+		// Extra data within the default limit, of twice the pixels, is
+		// discarded, and the next rectangle decodes as sent.
+		{pixelBytes / 2, false},
+		{2 * pixelBytes, true},
+	}
+
+	for _, tt := range tests {
+		chunks := zlibChunks(t, strings.Repeat("\x00", pixelBytes+tt.extra), "\x01\x02\x03\x00")
+
+		var update bytes.Buffer
+		for _, chunk := range chunks {
+			binary.Write(&update, binary.BigEndian, uint32(len(chunk)))
+			update.Write(chunk)
+		}
+
+		conn := &ClientConn{
+			config:            &ClientConfig{},
+			FrameBufferWidth:  256,
+			FrameBufferHeight: 256,
+			PixelFormat:       testPixelFormat,
+		}
+		enc := new(ZlibEncoding)
+
+		_, err := enc.Read(conn, &Rectangle{Width: 256, Height: 256}, &update)
+		if tt.fails {
+			if err == nil || !strings.Contains(err.Error(), "decompresses to more than 524288 bytes") {
+				t.Fatalf("%d extra bytes: err = %v", tt.extra, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d extra bytes: error reading rectangle: %s", tt.extra, err)
+		}
+
+		decoded, err := enc.Read(conn, &Rectangle{Width: 1, Height: 1}, &update)
+		if err != nil {
+			t.Fatalf("%d extra bytes: error reading next rectangle: %s", tt.extra, err)
+		}
+		if color := decoded.(*ZlibEncoding).Colors[0]; color != rgb(3, 2, 1) {
+			t.Fatalf("%d extra bytes: next rectangle is %v, want %v", tt.extra, color, rgb(3, 2, 1))
+		}
+	}
+}
+
+func TestZlibEncoding_ZlibBufferSize(t *testing.T) {
+	// Pseudo-random pixels don't compress, so the first rectangle needs
+	// a larger buffer than the others.
+	pixels := make([]byte, 32*32*4)
+	rand.New(rand.NewSource(1)).Read(pixels)
+	small := strings.Repeat("\x01\x02\x03\x00", 8*8)
+	chunks := zlibChunks(t, string(pixels), small, small)
+	if len(chunks[0]) <= 1024 {
+		t.Fatalf("first rectangle compresses to %d bytes", len(chunks[0]))
+	}
+
+	for _, bufferSize := range []int{0, 1024} {
+		conn := &ClientConn{
+			config:            &ClientConfig{ZlibBufferSize: bufferSize},
+			FrameBufferWidth:  32,
+			FrameBufferHeight: 32,
+			PixelFormat:       testPixelFormat,
+		}
+		enc := new(ZlibEncoding)
+
+		for i, chunk := range chunks {
+			var data bytes.Buffer
+			binary.Write(&data, binary.BigEndian, uint32(len(chunk)))
+			data.Write(chunk)
+
+			rect := &Rectangle{Width: 8, Height: 8}
+			expected := rgb(3, 2, 1)
+			if i == 0 {
+				rect = &Rectangle{Width: 32, Height: 32}
+				expected = rgb(pixels[2], pixels[1], pixels[0])
+			}
+
+			decoded, err := enc.Read(conn, rect, &data)
+			if err != nil {
+				t.Fatalf("buffer size %d: error reading rectangle %d: %s", bufferSize, i, err)
+			}
+			if colors := decoded.(*ZlibEncoding).Colors; colors[0] != expected {
+				t.Fatalf("buffer size %d: rectangle %d starts with %v, want %v", bufferSize, i, colors[0], expected)
+			}
+		}
+
+		// The buffer grown by the first rectangle has been shrunk back.
+		if capacity := enc.stream.input.Cap(); bufferSize > 0 && capacity != bufferSize {
+			t.Fatalf("buffer size %d: capacity is %d", bufferSize, capacity)
+		}
+	}
+}